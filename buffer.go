@@ -0,0 +1,25 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// copyBufferSize is the size of the buffers used to copy files, large files
+// (images) benefit from fewer, larger reads and writes.
+const copyBufferSize = 1024 * 1024
+
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// copyBuffer is like io.Copy, but uses a pooled buffer of copyBufferSize.
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	p := copyBufferPool.Get().(*[]byte)
+	n, err := io.CopyBuffer(dst, src, *p)
+	copyBufferPool.Put(p)
+	return n, err
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// writer hides any ReaderFrom implementation of w so that the copy buffer is
+// actually used.
+type writer struct{ w io.Writer }
+
+func (w writer) Write(p []byte) (int, error) { return w.w.Write(p) }
+
+const benchmarkCopySize = 64 * 1024 * 1024
+
+func benchmarkCopy(b *testing.B, copyFn func(io.Writer, io.Reader) (int64, error)) {
+	data := make([]byte, benchmarkCopySize)
+	c := Config{stop: make(chan struct{})}
+	b.SetBytes(benchmarkCopySize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := copyFn(writer{io.Discard}, c.Reader(bytes.NewReader(data))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopy(b *testing.B)       { benchmarkCopy(b, io.Copy) }
+func BenchmarkCopyBuffer(b *testing.B) { benchmarkCopy(b, copyBuffer) }
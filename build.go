@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// BuildStemcellFromOVA writes a stemcell for OVA ova, with version and
+// operating system osName, to w without using the filesystem.
+//
+// A tar header must contain the size of its entry before the entry's content
+// and the manifest must contain the sha1 of the compressed image, but neither
+// is known until the whole OVA has been read.  Since ova cannot be read twice
+// the image and manifest are created in memory, see createImageInMemory, and
+// the stemcell is then written by CreateStemcellTo.  Memory use is therefore
+// roughly the size of the compressed OVA.
+func BuildStemcellFromOVA(ova io.Reader, version, osName string, w io.Writer) error {
+	if err := ValidateVersion(version); err != nil {
+		return err
+	}
+	if err := ValidateOS(osName); err != nil {
+		return err
+	}
+	c := &Config{
+		Version: version,
+		OS:      osName,
+		Logger:  DiscardLogger,
+		stop:    make(chan struct{}),
+	}
+	if err := c.createImageInMemory(ova, 0); err != nil {
+		return err
+	}
+
+	m, err := c.NewManifest()
+	if err != nil {
+		return err
+	}
+	var manifest bytes.Buffer
+	if err := c.writeManifest(&manifest, m); err != nil {
+		return fmt.Errorf("creating manifest: %s", err)
+	}
+	c.manifestData = manifest.Bytes()
+
+	return c.CreateStemcellTo(w)
+}
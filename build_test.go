@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBuildStemcellFromOVA(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+	f, err := os.Open(ova)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var b bytes.Buffer
+	if err := BuildStemcellFromOVA(f, "1.2", "windows2012R2", &b); err != nil {
+		t.Fatal(err)
+	}
+	names, files := readStemcell(t, &b)
+	if len(names) != 2 || names[0] != "image" || names[1] != "stemcell.MF" {
+		t.Fatalf("BuildStemcellFromOVA: unexpected tarball entries: %q", names)
+	}
+	sum := fmt.Sprintf("%x", sha1.Sum(files["image"]))
+	if !strings.Contains(string(files["stemcell.MF"]), sum) {
+		t.Errorf("BuildStemcellFromOVA: manifest does not contain image sha1 (%s):\n%s",
+			sum, files["stemcell.MF"])
+	}
+
+	if err := BuildStemcellFromOVA(f, "1.2", "plan9", &b); err == nil {
+		t.Error("BuildStemcellFromOVA: expected error for unsupported os")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BuildInfoName is the name of the -embed-build-info file in the stemcell.
+const BuildInfoName = "build-info.json"
+
+// BuildInfoSchema is the SchemaVersion of BuildInfo, it is incremented if a
+// field is removed or its meaning changes.
+const BuildInfoSchema = 1
+
+// BuildInfo is the provenance of a stemcell, written as JSON to the
+// BuildInfoName entry of the stemcell by -embed-build-info:
+//
+//	{
+//	  "schema_version": 1,
+//	  "builder_version": "ova2stemcell version 1.0 (commit abc123)",
+//	  "created": "2020-01-02T15:04:05Z",
+//	  "version": "1.2",
+//	  "operating_system": "windows2012R2",
+//	  "input": "vm.ova",
+//	  "input_type": "ova",
+//	  "input_sha256": "...",
+//	  "image_sha1": "...",
+//	  "hostname": "builder-1",
+//	  "build_id": "42"
+//	}
+//
+// The input_sha256 is of the input file, it is omitted for an OVF directory.
+// Empty hostname and build_id are omitted.  BOSH ignores unknown files in a
+// stemcell so the entry is safe to include.
+type BuildInfo struct {
+	SchemaVersion   int       `json:"schema_version"`
+	BuilderVersion  string    `json:"builder_version"`
+	Created         time.Time `json:"created"`
+	Version         string    `json:"version"`
+	OperatingSystem string    `json:"operating_system"`
+	Input           string    `json:"input"` // base name of the input
+	InputType       string    `json:"input_type"`
+	InputSha256     string    `json:"input_sha256,omitempty"`
+	ImageSha1       string    `json:"image_sha1"`
+	Hostname        string    `json:"hostname,omitempty"`
+	BuildID         string    `json:"build_id,omitempty"`
+}
+
+// inputType returns the type of the input of c: ova, ovf, image or stemcell.
+func (c *Config) inputType() string {
+	switch {
+	case c.OVFDir != "":
+		return "ovf"
+	case c.ImageFile != "":
+		return "image"
+	case c.FromStemcell != "":
+		return "stemcell"
+	}
+	return "ova"
+}
+
+// NewBuildInfo returns the BuildInfo of the stemcell of c.Version.  The
+// input is read to compute its sha256, once per Config.
+func (c *Config) NewBuildInfo() (*BuildInfo, error) {
+	if c.inputSha256 == "" && c.OVFDir == "" {
+		h := sha256.New()
+		if err := hashFile(h, c.input()); err != nil {
+			return nil, fmt.Errorf("build info: hashing input: %s", err)
+		}
+		c.inputSha256 = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		c.debugf("build info: omitting hostname: %s", err)
+	}
+	return &BuildInfo{
+		SchemaVersion:   BuildInfoSchema,
+		BuilderVersion:  ToolVersion(),
+		Created:         time.Now().UTC().Truncate(time.Second),
+		Version:         c.Version,
+		OperatingSystem: c.osName(),
+		Input:           filepath.Base(c.input()),
+		InputType:       c.inputType(),
+		InputSha256:     c.inputSha256,
+		ImageSha1:       c.Sha1sum,
+		Hostname:        hostname,
+		BuildID:         c.BuildID,
+	}, nil
+}
+
+// writeBuildInfo writes the BuildInfo of c.Version to the temp directory and
+// adds it to c.ExtraFiles, once, so that it is included in the stemcell.
+func (c *Config) writeBuildInfo() error {
+	info, err := c.NewBuildInfo()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpdir, err := c.TempDir()
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(tmpdir, BuildInfoName)
+	if err := c.replaceFile("build info", name, func(w io.Writer) error {
+		_, err := w.Write(append(b, '\n'))
+		return err
+	}); err != nil {
+		return err
+	}
+	for _, e := range c.ExtraFiles {
+		if e.Path == name {
+			return nil
+		}
+	}
+	c.ExtraFiles = append(c.ExtraFiles, ExtraFile{Path: name, Name: BuildInfoName})
+	return nil
+}
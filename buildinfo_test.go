@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEmbedBuildInfo(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+	b, err := ioutil.ReadFile(ova)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputSum := fmt.Sprintf("%x", sha256.Sum256(b))
+
+	c := &Config{
+		OVAFile:        ova,
+		OutputDir:      dir,
+		EmbedBuildInfo: true,
+		BuildID:        "42",
+		Logger:         DiscardLogger,
+		stop:           make(chan struct{}),
+	}
+	defer c.Cleanup()
+	results, err := realMain(c, []string{"1.2", "1.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		f, err := os.Open(r.StemcellPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, files := readStemcell(t, f)
+		f.Close()
+		if len(names) != 3 || names[2] != BuildInfoName {
+			t.Errorf("%s: entries: got %q want image, stemcell.MF and %s", r.Version, names, BuildInfoName)
+			continue
+		}
+		var info BuildInfo
+		if err := json.Unmarshal(files[BuildInfoName], &info); err != nil {
+			t.Errorf("%s: %s: %s", r.Version, BuildInfoName, err)
+			continue
+		}
+		exp := BuildInfo{
+			SchemaVersion:   BuildInfoSchema,
+			BuilderVersion:  ToolVersion(),
+			Created:         info.Created,
+			Version:         r.Version,
+			OperatingSystem: DefaultOS,
+			Input:           "vm.ova",
+			InputType:       "ova",
+			InputSha256:     inputSum,
+			ImageSha1:       r.ImageSha1,
+			Hostname:        info.Hostname,
+			BuildID:         "42",
+		}
+		if info != exp {
+			t.Errorf("%s: %s: got %+v want %+v", r.Version, BuildInfoName, info, exp)
+		}
+		if info.Created.IsZero() {
+			t.Errorf("%s: %s: missing created time", r.Version, BuildInfoName)
+		}
+	}
+
+	// off by default
+	c = &Config{OVAFile: ova, OutputDir: filepath.Join(dir, "off"), Logger: DiscardLogger, stop: make(chan struct{})}
+	defer c.Cleanup()
+	if err := os.Mkdir(c.OutputDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	results, err = realMain(c, []string{"1.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(results[0].StemcellPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if names, _ := readStemcell(t, f); len(names) != 2 {
+		t.Errorf("entries without EmbedBuildInfo: got %q", names)
+	}
+
+	// an extra file may not be named build-info.json
+	extra := filepath.Join(dir, BuildInfoName)
+	if err := ioutil.WriteFile(extra, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c = &Config{
+		OVAFile:        ova,
+		OutputDir:      dir,
+		EmbedBuildInfo: true,
+		ExtraFiles:     []ExtraFile{{Path: extra, Name: BuildInfoName}},
+		Version:        "1.4",
+	}
+	errs := c.Validate()
+	if len(errs) != 1 || errs[0].(ValidationError).Field != "EmbedBuildInfo" {
+		t.Errorf("Validate: expected an EmbedBuildInfo error got: %v", errs)
+	}
+}
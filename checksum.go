@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// ChecksumAlgorithms are the digest algorithms a checksum sidecar file may be
+// written for, the algorithm name is also the sidecar's file extension.
+var ChecksumAlgorithms = []string{"sha1", "sha256"}
+
+// ParseChecksumAlgorithms parses the comma separated list of checksum
+// algorithms s, duplicates are removed.
+func ParseChecksumAlgorithms(s string) ([]string, error) {
+	var algs []string
+	seen := make(map[string]bool)
+	for _, a := range strings.Split(s, ",") {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if a == "" || seen[a] {
+			continue
+		}
+		ok := false
+		for _, x := range ChecksumAlgorithms {
+			if a == x {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid checksum algorithm (%s): must be one of: %s",
+				a, strings.Join(ChecksumAlgorithms, ", "))
+		}
+		seen[a] = true
+		algs = append(algs, a)
+	}
+	return algs, nil
+}
+
+// WriteChecksumFile writes the digest of filename to the sidecar file
+// "filename.alg" in the "DIGEST  BASENAME" format used by sha1sum and
+// sha256sum, and returns the name of the sidecar file.
+func WriteChecksumFile(filename, alg, digest string) (string, error) {
+	name := filename + "." + alg
+	line := fmt.Sprintf("%s  %s\n", digest, filepath.Base(filename))
+	if err := ioutil.WriteFile(name, []byte(line), 0644); err != nil {
+		return "", fmt.Errorf("writing checksum file (%s): %s", name, err)
+	}
+	return name, nil
+}
+
+// ParseImageChecksums parses the comma separated list of image digest
+// algorithms s, see -checksum.  The manifest requires the sha1, so it must be
+// one of them.
+func ParseImageChecksums(s string) ([]string, error) {
+	algs, err := ParseChecksumAlgorithms(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(algs) == 0 {
+		return nil, errors.New("at least one checksum algorithm is required")
+	}
+	for _, a := range algs {
+		if a == "sha1" {
+			return algs, nil
+		}
+	}
+	return nil, fmt.Errorf("checksum algorithms (%s) must include sha1: it is required by the manifest",
+		strings.Join(algs, ","))
+}
+
+// An imageHash computes the digests of the image requested by
+// Config.ImageChecksums, the sha1 is always computed.  Every way of creating
+// the image hashes the bytes written to the image file, which are the bytes
+// of the image entry of the stemcell, never the tar archive before it is
+// compressed.
+type imageHash struct {
+	sha1   hash.Hash
+	sha256 hash.Hash // nil if not requested
+}
+
+func (c *Config) newImageHash() *imageHash {
+	h := &imageHash{sha1: sha1.New()}
+	if c.wantSha256() {
+		h.sha256 = sha256.New()
+	}
+	return h
+}
+
+func (h *imageHash) Write(p []byte) (int, error) {
+	h.sha1.Write(p)
+	if h.sha256 != nil {
+		h.sha256.Write(p)
+	}
+	return len(p), nil
+}
+
+// Sha1 returns the hex encoded sha1 of the image.
+func (h *imageHash) Sha1() string { return fmt.Sprintf("%x", h.sha1.Sum(nil)) }
+
+// setImageSums sets c.Sha1sum and, if requested, c.Sha256sum to the digests
+// of h.
+func (c *Config) setImageSums(h *imageHash) {
+	c.Sha1sum = h.Sha1()
+	c.Sha256sum = ""
+	if h.sha256 != nil {
+		c.Sha256sum = fmt.Sprintf("%x", h.sha256.Sum(nil))
+		c.debugf("sha256 checksum of image is: %s", c.Sha256sum)
+	}
+}
+
+// wantSha256 returns if the sha256 of the image is requested.
+func (c *Config) wantSha256() bool {
+	for _, a := range c.ImageChecksums {
+		if a == "sha256" {
+			return true
+		}
+	}
+	return false
+}
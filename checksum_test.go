@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseChecksumAlgorithms(t *testing.T) {
+	algs, err := ParseChecksumAlgorithms("SHA256, sha1,sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"sha256", "sha1"}; !reflect.DeepEqual(algs, exp) {
+		t.Errorf("ParseChecksumAlgorithms: got %q want %q", algs, exp)
+	}
+	if algs, err := ParseChecksumAlgorithms(""); err != nil || len(algs) != 0 {
+		t.Errorf("ParseChecksumAlgorithms: empty: got %q, %v", algs, err)
+	}
+	if _, err := ParseChecksumAlgorithms("md5"); err == nil {
+		t.Error("ParseChecksumAlgorithms: expected error for md5")
+	}
+}
+
+func TestWriteChecksumFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "stemcell.tgz")
+	name, err := WriteChecksumFile(filename, "sha256", "abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != filename+".sha256" {
+		t.Errorf("WriteChecksumFile: name: got %q want %q", name, filename+".sha256")
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "abc123  stemcell.tgz\n"; string(b) != exp {
+		t.Errorf("WriteChecksumFile: got %q want %q", b, exp)
+	}
+}
+
+func TestParseImageChecksums(t *testing.T) {
+	algs, err := ParseImageChecksums("sha256,sha1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"sha256", "sha1"}; !reflect.DeepEqual(algs, exp) {
+		t.Errorf("ParseImageChecksums: got %q want %q", algs, exp)
+	}
+	for _, s := range []string{"", ",", "sha256", "md5"} {
+		if _, err := ParseImageChecksums(s); err == nil {
+			t.Errorf("ParseImageChecksums(%q): expected error", s)
+		}
+	}
+}
+
+func TestImageChecksums(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+
+	c := &Config{
+		OVAFile:        ova,
+		OutputDir:      dir,
+		ImageChecksums: []string{"sha256", "sha1"},
+		VerifyOutput:   true,
+		Logger:         DiscardLogger,
+		stop:           make(chan struct{}),
+	}
+	defer c.Cleanup()
+	results, err := realMain(c, []string{"1.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(results[0].StemcellPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, files := readStemcell(t, f)
+
+	sum1 := fmt.Sprintf("%x", sha1.Sum(files["image"]))
+	sum256 := fmt.Sprintf("%x", sha256.Sum256(files["image"]))
+	exp := "sha1: " + yamlString(sum1) + "\nsha256: " + yamlString(sum256) + "\n"
+	if mf := string(files["stemcell.MF"]); !strings.Contains(mf, exp) {
+		t.Errorf("ImageChecksums: manifest does not contain:\n%s\ngot:\n%s", exp, mf)
+	}
+	if c.Sha256sum != sum256 {
+		t.Errorf("ImageChecksums: Sha256sum got %s want %s", c.Sha256sum, sum256)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import "os"
+
+// ANSI escape codes used to colorize terminal output.
+const (
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorReset  = "\x1b[0m"
+)
+
+func colorize(color, s string) string {
+	return color + s + colorReset
+}
+
+// UseColor returns if colored output should be written to file f.  Color is
+// disabled if the NO_COLOR environment variable is set or f is not a terminal.
+func UseColor(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParseConfigFile parses the flag values in config file name.  The file is
+// either a flat YAML ("key: value") or, if name has a ".toml" extension, a
+// flat TOML ("key = value") file.  Blank lines and lines starting with '#'
+// are ignored and values may be quoted.
+func ParseConfigFile(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("config file (%s): %s", name, err)
+	}
+	defer f.Close()
+
+	sep := ":"
+	if filepath.Ext(name) == ".toml" {
+		sep = "="
+	}
+
+	m := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' || line == "---" {
+			continue
+		}
+		i := strings.Index(line, sep)
+		if i == -1 {
+			return nil, fmt.Errorf("config file (%s): line %d: expected 'key%s value'",
+				name, n, sep)
+		}
+		key := strings.TrimSpace(line[:i])
+		val, err := unquote(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("config file (%s): line %d: %s", name, n, err)
+		}
+		if key == "" {
+			return nil, fmt.Errorf("config file (%s): line %d: empty key", name, n)
+		}
+		if _, ok := m[key]; ok {
+			return nil, fmt.Errorf("config file (%s): line %d: duplicate key: %s",
+				name, n, key)
+		}
+		m[key] = val
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("config file (%s): %s", name, err)
+	}
+	return m, nil
+}
+
+// unquote removes the quotes from a double or single quoted string.
+func unquote(s string) (string, error) {
+	if len(s) < 2 {
+		return s, nil
+	}
+	switch {
+	case s[0] == '"' && s[len(s)-1] == '"':
+		return strconv.Unquote(s)
+	case s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	}
+	return s, nil
+}
+
+// ApplyConfigFile sets the flags in fs to the values in config file name.
+// Flags explicitly set on the command line, or via their shorthand, take
+// precedence over values in the file.  Unknown keys are an error.  The
+// sorted keys that were applied, and that were ignored because their flag
+// was already set, are returned so that they can be logged once the logger,
+// which the file may configure, is set up.
+func ApplyConfigFile(fs *flag.FlagSet, name string) (applied, ignored []string, err error) {
+	m, err := ParseConfigFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// flags that share a variable (shorthands) share a Value
+	set := make(map[flag.Value]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Value] = true })
+
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		f := fs.Lookup(key)
+		if f == nil || key == "config" {
+			return nil, nil, fmt.Errorf("config file (%s): unknown key: %s", name, key)
+		}
+		if set[f.Value] {
+			ignored = append(ignored, key)
+			continue
+		}
+		if err := fs.Set(key, m[key]); err != nil {
+			return nil, nil, fmt.Errorf("config file (%s): invalid value for key (%s): %s",
+				name, key, err)
+		}
+		applied = append(applied, key)
+	}
+	return applied, ignored, nil
+}
+
+// EnvPrefix is the prefix of the environment variables that provide default
+// flag values, see EnvName.
+const EnvPrefix = "OVA2STEMCELL_"
+
+// EnvName returns the environment variable of flag name, e.g. the variable of
+// "tmp-dir" is "OVA2STEMCELL_TMP_DIR".
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// EnvAliases are shorter environment variables of flags, by flag name, that
+// are used if the flag's own variable, see EnvName, is not set.
+var EnvAliases = map[string]string{
+	"trust-inputs": EnvPrefix + "TRUST",
+}
+
+// EnvNames returns the environment variables recognized by ApplyEnv, one for
+// each flag in fs other than single letter shorthands, plus any EnvAliases.
+func EnvNames(fs *flag.FlagSet) []string {
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if len(f.Name) > 1 {
+			names = append(names, EnvName(f.Name))
+			if alias := EnvAliases[f.Name]; alias != "" {
+				names = append(names, alias)
+			}
+		}
+	})
+	return names
+}
+
+// ApplyEnv sets the flags in fs that were not set on the command line to the
+// value of their environment variable, see EnvName, as returned by lookup.
+// Empty values are ignored and EnvAliases are used if the variable of a flag
+// is not set.  The names of the variables used are returned.
+//
+// ApplyEnv is called before ApplyConfigFile, so the precedence is: command
+// line, then environment, then config file.
+func ApplyEnv(fs *flag.FlagSet, lookup func(key string) (string, bool)) ([]string, error) {
+	// flags that share a variable (shorthands) share a Value
+	set := make(map[flag.Value]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Value] = true })
+
+	var used []string
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || len(f.Name) == 1 || set[f.Value] {
+			return
+		}
+		key := EnvName(f.Name)
+		val, ok := lookup(key)
+		if alias := EnvAliases[f.Name]; alias != "" && (!ok || val == "") {
+			key = alias
+			val, ok = lookup(key)
+		}
+		if !ok || val == "" {
+			return
+		}
+		if e := fs.Set(f.Name, val); e != nil {
+			err = fmt.Errorf("environment variable (%s): invalid value: %s", key, e)
+			return
+		}
+		used = append(used, key)
+	})
+	return used, err
+}
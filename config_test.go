@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, name, data string) string {
+	dir, err := ioutil.TempDir("", "ova2stemcell-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name = filepath.Join(dir, name)
+	if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	const data = `---
+# comment
+version: "1.2"
+output: '/tmp/out'
+ova: vm.ova
+`
+	for _, ext := range []string{".yml", ".toml"} {
+		s := data
+		if ext == ".toml" {
+			s = "version = \"1.2\"\noutput = '/tmp/out'\nova = vm.ova\n"
+		}
+		name := writeConfigFile(t, "config"+ext, s)
+		defer os.RemoveAll(filepath.Dir(name))
+
+		var version, output, ova string
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.StringVar(&version, "version", "", "")
+		fs.StringVar(&output, "output", "", "")
+		fs.StringVar(&output, "o", "", "")
+		fs.StringVar(&ova, "ova", "", "")
+		if err := fs.Parse([]string{"-o", "/cmd/out"}); err != nil {
+			t.Fatal(err)
+		}
+		applied, ignored, err := ApplyConfigFile(fs, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := []string{"ova", "version"}; !reflect.DeepEqual(applied, exp) {
+			t.Errorf("%s: applied: got %q want %q", ext, applied, exp)
+		}
+		if exp := []string{"output"}; !reflect.DeepEqual(ignored, exp) {
+			t.Errorf("%s: ignored: got %q want %q", ext, ignored, exp)
+		}
+		if version != "1.2" || ova != "vm.ova" {
+			t.Errorf("%s: got version %q ova %q", ext, version, ova)
+		}
+		if output != "/cmd/out" {
+			t.Errorf("%s: command line flag should take precedence got: %q", ext, output)
+		}
+	}
+}
+
+func TestApplyConfigFileUnknownKey(t *testing.T) {
+	name := writeConfigFile(t, "config.yml", "versoin: 1.2\n")
+	defer os.RemoveAll(filepath.Dir(name))
+
+	var version string
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.StringVar(&version, "version", "", "")
+	if _, _, err := ApplyConfigFile(fs, name); err == nil {
+		t.Error("expected error for unknown key")
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	var version, output, ova, tmpDir string
+	var debug, trust bool
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.StringVar(&version, "version", "", "")
+	fs.StringVar(&version, "v", "", "")
+	fs.StringVar(&output, "output", "", "")
+	fs.StringVar(&output, "o", "", "")
+	fs.StringVar(&ova, "ova", "", "")
+	fs.StringVar(&tmpDir, "tmp-dir", "", "")
+	fs.BoolVar(&debug, "debug", false, "")
+	fs.BoolVar(&trust, "trust-inputs", false, "")
+	if err := fs.Parse([]string{"-v", "1.2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"OVA2STEMCELL_VERSION": "9.9",
+		"OVA2STEMCELL_OUTPUT":  "/env/out",
+		"OVA2STEMCELL_OVA":     "",
+		"OVA2STEMCELL_TMP_DIR": "/env/tmp",
+		"OVA2STEMCELL_DEBUG":   "true",
+		"OVA2STEMCELL_O":       "/shorthand",
+		"OVA2STEMCELL_TRUST":   "1", // alias of OVA2STEMCELL_TRUST_INPUTS
+	}
+	lookup := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+	used, err := ApplyEnv(fs, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "1.2" {
+		t.Errorf("ApplyEnv: command line flag should take precedence got: %q", version)
+	}
+	if output != "/env/out" || tmpDir != "/env/tmp" || !debug {
+		t.Errorf("ApplyEnv: got output %q tmp-dir %q debug %t", output, tmpDir, debug)
+	}
+	if ova != "" {
+		t.Errorf("ApplyEnv: empty variable should be ignored got: %q", ova)
+	}
+	if !trust {
+		t.Error("ApplyEnv: alias OVA2STEMCELL_TRUST was not used")
+	}
+	exp := []string{"OVA2STEMCELL_DEBUG", "OVA2STEMCELL_OUTPUT", "OVA2STEMCELL_TMP_DIR",
+		"OVA2STEMCELL_TRUST"}
+	if !reflect.DeepEqual(used, exp) {
+		t.Errorf("ApplyEnv: used: got %q want %q", used, exp)
+	}
+
+	// the environment takes precedence over the config file
+	name := writeConfigFile(t, "config.yml", "output: /config/out\nova: vm.ova\n")
+	defer os.RemoveAll(filepath.Dir(name))
+	if _, _, err := ApplyConfigFile(fs, name); err != nil {
+		t.Fatal(err)
+	}
+	if output != "/env/out" || ova != "vm.ova" {
+		t.Errorf("ApplyConfigFile: got output %q ova %q", output, ova)
+	}
+
+	env = map[string]string{"OVA2STEMCELL_DEBUG": "maybe"}
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.BoolVar(&debug, "debug", false, "")
+	if _, err := ApplyEnv(fs, lookup); err == nil {
+		t.Error("ApplyEnv: expected error for invalid value")
+	}
+}
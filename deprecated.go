@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"sort"
+)
+
+// DeprecatedFlags maps deprecated flags to the flag that replaces them.
+// Deprecated flags are still honored, but a warning naming the replacement
+// is printed when they are used.  To rename a flag register the old name
+// with the same variable as the new one, with the usage "Deprecated: use
+// -NEW", and add it here.
+var DeprecatedFlags = map[string]string{}
+
+// DeprecatedFlagsSet returns the sorted deprecated flags of fs, see
+// DeprecatedFlags, that were set on the command line or by the config file.
+func DeprecatedFlagsSet(fs *flag.FlagSet, deprecated map[string]string) []string {
+	var names []string
+	fs.Visit(func(f *flag.Flag) {
+		if _, ok := deprecated[f.Name]; ok {
+			names = append(names, f.Name)
+		}
+	})
+	sort.Strings(names)
+	return names
+}
+
+// warnDeprecatedFlags logs a warning for each deprecated flag set in fs.
+func warnDeprecatedFlags(fs *flag.FlagSet) {
+	for _, name := range DeprecatedFlagsSet(fs, DeprecatedFlags) {
+		Log.Warnf("flag -%s is deprecated and will be removed, use -%s instead",
+			name, DeprecatedFlags[name])
+	}
+}
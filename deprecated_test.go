@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestDeprecatedFlagsSet(t *testing.T) {
+	deprecated := map[string]string{"v": "version", "x": "gzip"}
+	tests := []struct {
+		args []string
+		exp  []string
+	}{
+		{[]string{"-version", "1.2"}, nil},
+		{[]string{"-v", "1.2"}, []string{"v"}},
+		{[]string{"-x", "-v", "1.2", "-o", "out"}, []string{"v", "x"}},
+	}
+	for _, x := range tests {
+		var version, output string
+		var gzip bool
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.StringVar(&version, "version", "", "")
+		fs.StringVar(&version, "v", "", "")
+		fs.StringVar(&output, "o", "", "")
+		fs.BoolVar(&gzip, "gzip", false, "")
+		fs.BoolVar(&gzip, "x", false, "")
+		if err := fs.Parse(x.args); err != nil {
+			t.Fatal(err)
+		}
+		names := DeprecatedFlagsSet(fs, deprecated)
+		if !reflect.DeepEqual(names, x.exp) {
+			t.Errorf("DeprecatedFlagsSet(%q): got %q want %q", x.args, names, x.exp)
+		}
+		// deprecated flags are still honored
+		if version != "1.2" {
+			t.Errorf("%q: version: got %q want %q", x.args, version, "1.2")
+		}
+	}
+
+	// every deprecated flag must have a registered replacement
+	for old, name := range DeprecatedFlags {
+		if flag.Lookup(old) == nil || flag.Lookup(name) == nil {
+			t.Errorf("DeprecatedFlags: -%s or its replacement -%s is not a flag", old, name)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// stemcellContents are the manifest and the sha1 of each entry of a stemcell
+// tarball, see readStemcellContents.
+type stemcellContents struct {
+	Manifest *Manifest
+	Sums     map[string]string // hex sha1 by entry name
+}
+
+// readStemcellContents reads stemcell tarball name.  Unlike VerifyStemcell
+// any entries are allowed, only the stemcell.MF entry is required.
+func readStemcellContents(name string) (*stemcellContents, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("reading stemcell (%s): %s", name, err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading stemcell (%s): %s", name, err)
+	}
+	defer gr.Close()
+
+	s := &stemcellContents{Sums: make(map[string]string)}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading stemcell (%s): %s", name, err)
+		}
+		if _, ok := s.Sums[hdr.Name]; ok {
+			return nil, fmt.Errorf("reading stemcell (%s): duplicate entry: %s", name, hdr.Name)
+		}
+		h := sha1.New()
+		var mf bytes.Buffer
+		w := io.Writer(h)
+		if hdr.Name == "stemcell.MF" {
+			w = io.MultiWriter(h, &mf)
+		}
+		if _, err := copyBuffer(w, tr); err != nil {
+			return nil, fmt.Errorf("reading stemcell (%s): entry (%s): %s", name, hdr.Name, err)
+		}
+		s.Sums[hdr.Name] = fmt.Sprintf("%x", h.Sum(nil))
+		if hdr.Name == "stemcell.MF" {
+			if s.Manifest, err = ParseManifest(&mf); err != nil {
+				return nil, fmt.Errorf("reading stemcell (%s): %s", name, err)
+			}
+		}
+	}
+	// the gzip trailer checksum is only verified once EOF is read
+	if _, err := copyBuffer(ioutil.Discard, gr); err != nil {
+		return nil, fmt.Errorf("reading stemcell (%s): %s", name, err)
+	}
+	if s.Manifest == nil {
+		return nil, fmt.Errorf("reading stemcell (%s): missing entry: stemcell.MF", name)
+	}
+	return s, nil
+}
+
+// DiffStemcells compares stemcell tarball b to a and returns the differences
+// of their manifests, see DiffManifests, followed by a difference for each
+// entry, other than stemcell.MF, whose sha1 differs or that is missing from
+// either.  The image, whose differences follow from its sha1, is ignored if
+// "sha1" is in ignore, other entries are never ignored.
+func DiffStemcells(a, b string, ignore []string) ([]ManifestDiff, error) {
+	sa, err := readStemcellContents(a)
+	if err != nil {
+		return nil, err
+	}
+	sb, err := readStemcellContents(b)
+	if err != nil {
+		return nil, err
+	}
+	diffs := DiffManifests(sa.Manifest, sb.Manifest, ignore)
+
+	ignoreImage := false
+	for _, f := range ignore {
+		ignoreImage = ignoreImage || f == "sha1"
+	}
+	var names []string
+	for name := range sa.Sums {
+		names = append(names, name)
+	}
+	for name := range sb.Sums {
+		if _, ok := sa.Sums[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "stemcell.MF" || sa.Sums[name] == sb.Sums[name] {
+			continue
+		}
+		diffs = append(diffs, ManifestDiff{
+			Field:    "entry " + name,
+			Expected: sa.Sums[name],
+			Actual:   sb.Sums[name],
+			Ignored:  name == "image" && ignoreImage,
+		})
+	}
+	return diffs, nil
+}
+
+// DiffMode compares stemcell b to a, see DiffStemcells, and writes each
+// difference to w.  An error is returned if any of the differences are not
+// ignored.
+func DiffMode(w io.Writer, a, b string, ignore []string) error {
+	diffs, err := DiffStemcells(a, b, ignore)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, d := range diffs {
+		fmt.Fprintf(w, "stemcell differs: %s\n", d)
+		if !d.Ignored {
+			n++
+		}
+	}
+	if n != 0 {
+		return fmt.Errorf("stemcell (%s) differs from stemcell (%s): %d differences", b, a, n)
+	}
+	if len(diffs) == 0 {
+		fmt.Fprintf(w, "stemcells are identical: %s %s\n", a, b)
+	} else {
+		fmt.Fprintf(w, "stemcells match: %s %s\n", a, b)
+	}
+	return nil
+}
+
+// diffArgs returns the stemcell to compare to -diff, the only argument.
+func diffArgs(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("-diff requires exactly one argument, the stemcell to compare (e.x. -diff A.tgz B.tgz)")
+	}
+	return ExpandPath(args[0])
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffStemcells(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	manifest := func(version, sha1, osName string) string {
+		var b bytes.Buffer
+		if _, err := NewManifest(version, sha1, osName).WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+	stemcell := func(name string, entries ...tarEntry) string {
+		path := filepath.Join(dir, name+".tgz")
+		writeTestStemcell(t, path, entries)
+		return path
+	}
+	a := stemcell("a",
+		tarEntry{Name: "image", Body: "image"},
+		tarEntry{Name: "stemcell.MF", Body: manifest("1.2", "abc", DefaultOS)},
+	)
+	ignore, err := ParseManifestFields(DefaultExpectIgnore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		diffs   []string
+		err     bool
+	}{
+		{
+			"identical",
+			[]tarEntry{
+				{Name: "image", Body: "image"},
+				{Name: "stemcell.MF", Body: manifest("1.2", "abc", DefaultOS)},
+			},
+			nil,
+			false,
+		},
+		{
+			"rebuild",
+			[]tarEntry{
+				{Name: "image", Body: "image 2"},
+				{Name: "stemcell.MF", Body: manifest("1.3", "def", DefaultOS)},
+			},
+			[]string{"version", "sha1", "entry image"},
+			false,
+		},
+		{
+			"os",
+			[]tarEntry{
+				{Name: "image", Body: "image"},
+				{Name: "stemcell.MF", Body: manifest("1.2", "abc", "ubuntu-xenial")},
+			},
+			[]string{"name", "operating_system"},
+			true,
+		},
+		{
+			"extra",
+			[]tarEntry{
+				{Name: "image", Body: "image"},
+				{Name: "stemcell.MF", Body: manifest("1.2", "abc", DefaultOS)},
+				{Name: "extra", Body: "extra"},
+			},
+			[]string{"entry extra"},
+			true,
+		},
+	}
+	for _, x := range tests {
+		b := stemcell(x.name, x.entries...)
+		diffs, err := DiffStemcells(a, b, ignore)
+		if err != nil {
+			t.Errorf("%s: DiffStemcells: %s", x.name, err)
+			continue
+		}
+		var fields []string
+		for _, d := range diffs {
+			fields = append(fields, d.Field)
+		}
+		if strings.Join(fields, ",") != strings.Join(x.diffs, ",") {
+			t.Errorf("%s: DiffStemcells: got %q want %q", x.name, fields, x.diffs)
+		}
+		var w bytes.Buffer
+		if err := DiffMode(&w, a, b, ignore); (err != nil) != x.err {
+			t.Errorf("%s: DiffMode: got error %v want error %t\n%s", x.name, err, x.err, w.String())
+		}
+	}
+
+	if _, err := DiffStemcells(a, stemcell("no-manifest", tarEntry{Name: "image", Body: "image"}), nil); err == nil {
+		t.Error("DiffStemcells: expected error for missing stemcell.MF")
+	}
+	if _, err := diffArgs(nil); err == nil {
+		t.Error("diffArgs: expected error for missing argument")
+	}
+}
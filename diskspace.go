@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// DefaultDiskSpaceFactor is the default multiple of the input size that
+// must be free in the temp directory, room is needed for both the image and
+// the stemcell tarball.
+const DefaultDiskSpaceFactor = 2.0
+
+// errStatfsUnsupported is returned by availableBytes on platforms where the
+// free space of a filesystem cannot be determined.
+var errStatfsUnsupported = errors.New("statfs is not supported on this platform")
+
+// InputSize returns the size in bytes of the OVA file or OVF directory name,
+// plus the size of any extra files.
+func InputSize(name string, extra []ExtraFile) (int64, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	if fi.IsDir() {
+		list, err := ioutil.ReadDir(name)
+		if err != nil {
+			return 0, err
+		}
+		size = 0
+		for _, fi := range list {
+			// symlinks are counted as if followed, see SymlinkFollow
+			if fi.Mode()&os.ModeSymlink != 0 {
+				if target, err := os.Stat(filepath.Join(name, fi.Name())); err == nil {
+					fi = target
+				}
+			}
+			if fi.Mode().IsRegular() {
+				size += fi.Size()
+			}
+		}
+	}
+	for _, e := range extra {
+		fi, err := os.Stat(e.Path)
+		if err != nil {
+			return 0, err
+		}
+		size += fi.Size()
+	}
+	return size, nil
+}
+
+// CheckDiskSpace returns an error if directory dirname, or the default temp
+// directory if empty, does not have at least factor times size bytes free.
+// The check is skipped if factor is not positive or if the free space cannot
+// be determined on this platform.  Debug messages are logged to log.
+func CheckDiskSpace(log Logger, dirname string, size int64, factor float64) error {
+	if factor <= 0 {
+		return nil
+	}
+	if dirname == "" {
+		dirname = os.TempDir()
+	}
+	avail, err := availableBytes(dirname)
+	if err == errStatfsUnsupported {
+		log.Debugf("skipping disk space check: %s", err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("checking disk space (%s): %s", dirname, err)
+	}
+	need := uint64(float64(size) * factor)
+	log.Debugf("disk space (%s): need %s have %s", dirname, formatBytes(need),
+		formatBytes(avail))
+	if avail < need {
+		return fmt.Errorf("insufficient disk space in temp directory (%s): "+
+			"need %s have %s available (see -disk-space-factor)",
+			filepath.Clean(dirname), formatBytes(need), formatBytes(avail))
+	}
+	return nil
+}
+
+// formatBytes formats n using binary units, e.g. "1.5 GiB".
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
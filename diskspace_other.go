@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly
+
+package main
+
+func availableBytes(dirname string) (uint64, error) {
+	return 0, errStatfsUnsupported
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package main
+
+import "syscall"
+
+// availableBytes returns the number of bytes available to unprivileged users
+// on the filesystem containing dirname.
+func availableBytes(dirname string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dirname, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestInputSize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+	})
+	fi, err := os.Stat(ova)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := InputSize(ova, []ExtraFile{{Path: ova, Name: "extra"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 2*fi.Size() {
+		t.Errorf("InputSize: got %d want %d", size, 2*fi.Size())
+	}
+	if size, err = InputSize(dir, nil); err != nil || size != fi.Size() {
+		t.Errorf("InputSize (dir): got %d, %v want %d", size, err, fi.Size())
+	}
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	if err := CheckDiskSpace(DiscardLogger, dir, 1, DefaultDiskSpaceFactor); err != nil {
+		t.Error(err)
+	}
+	if err := CheckDiskSpace(DiscardLogger, dir, 1<<62, 0); err != nil {
+		t.Errorf("CheckDiskSpace: factor 0 should disable the check: %s", err)
+	}
+	if _, err := availableBytes(dir); err == errStatfsUnsupported {
+		t.Skip(err)
+	}
+	if err := CheckDiskSpace(DiscardLogger, dir, 1<<60, 4); err == nil {
+		t.Error("CheckDiskSpace: expected error")
+	}
+}
+
+var formatBytesTests = []struct {
+	n   uint64
+	exp string
+}{
+	{0, "0 B"},
+	{1023, "1023 B"},
+	{1024, "1.0 KiB"},
+	{3 << 29, "1.5 GiB"},
+}
+
+func TestFormatBytes(t *testing.T) {
+	for _, x := range formatBytesTests {
+		if s := formatBytes(x.n); s != x.exp {
+			t.Errorf("formatBytes(%d): got %q want %q", x.n, s, x.exp)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// The types of Events.  A build emits EventStarted, then EventStepStarted
+// and EventStepCompleted for each step, see BuildSteps, with EventProgress
+// while the image is created and EventStemcellCreated for each stemcell.  The
+// last event is always EventFinished or EventFailed.
+const (
+	EventStarted         = "started"
+	EventStepStarted     = "step_started"
+	EventProgress        = "progress"
+	EventStepCompleted   = "step_completed"
+	EventStemcellCreated = "stemcell_created"
+	EventFinished        = "finished"
+	EventFailed          = "failed"
+)
+
+// An Event is one line of the -events stream of newline delimited JSON.
+// Fields that do not apply to the Type are omitted.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Step       string    `json:"step,omitempty"`
+	Version    string    `json:"version,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Sha1       string    `json:"sha1,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`       // input bytes read by the step
+	TotalBytes int64     `json:"total_bytes,omitempty"` // size of the input
+	DurationMS int64     `json:"duration_ms,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// eventProgressInterval is the minimum time between EventProgress events.
+var eventProgressInterval = time.Second
+
+// An EventWriter writes Events to an io.Writer, one JSON object per line.  It
+// is safe for concurrent use.
+type EventWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error // first write error, later events are dropped
+}
+
+// NewEventWriter returns an EventWriter that writes to w.
+func NewEventWriter(w io.Writer) *EventWriter {
+	return &EventWriter{enc: json.NewEncoder(w)}
+}
+
+// Write writes event e, setting its Time if zero.  Once a write fails the
+// error is returned and later events are dropped.
+func (w *EventWriter) Write(e Event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = w.enc.Encode(e)
+	}
+	return w.err
+}
+
+// emit writes event e to c.Events, if set.  Events are informational, a
+// write error is logged but does not fail the build.
+func (c *Config) emit(e Event) {
+	if c.Events == nil {
+		return
+	}
+	if err := c.Events.Write(e); err != nil {
+		c.debugf("writing %s event: %s", e.Type, err)
+	}
+}
+
+// emitStep emits event typ for step timing t.
+func (c *Config) emitStep(typ string, t StepTiming) {
+	e := Event{Type: typ, Step: t.Name, Version: t.Version}
+	if typ == EventStepCompleted {
+		e.DurationMS = milliseconds(t.Duration)
+	}
+	c.emit(e)
+}
+
+// emitProgress emits an EventProgress for the current step, that has read n
+// bytes of its input, at most once per eventProgressInterval.
+func (c *Config) emitProgress(n int64) {
+	if c.Events == nil {
+		return
+	}
+	now := time.Now()
+	if now.Sub(c.progressAt) < eventProgressInterval {
+		return
+	}
+	c.progressAt = now
+	c.mu.Lock()
+	step := c.step
+	c.mu.Unlock()
+	c.emit(Event{Type: EventProgress, Step: step, Bytes: n, TotalBytes: c.inputSize})
+}
+
+// emitFinished emits the last event of a build that started at start and
+// returned err.
+func (c *Config) emitFinished(err error, start time.Time) {
+	var last StepTiming
+	if n := len(c.Timings); n != 0 {
+		last = c.Timings[n-1]
+	}
+	d := milliseconds(time.Since(start))
+	if err != nil {
+		c.emit(Event{Type: EventFailed, Step: last.Name, Version: last.Version,
+			DurationMS: d, Error: err.Error()})
+		return
+	}
+	if last.Name != "" {
+		c.emitStep(EventStepCompleted, last)
+	}
+	c.emit(Event{Type: EventFinished, DurationMS: d})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvents decodes the newline delimited events of b.
+func readEvents(t *testing.T, b *bytes.Buffer) []Event {
+	var events []Event
+	s := bufio.NewScanner(b)
+	for s.Scan() {
+		var e Event
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatalf("invalid event (%s): %s", s.Text(), err)
+		}
+		if e.Time.IsZero() {
+			t.Errorf("event without time: %s", s.Text())
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestBuildEvents(t *testing.T) {
+	defer func(d time.Duration) { eventProgressInterval = d }(eventProgressInterval)
+	eventProgressInterval = 0
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+
+	var b bytes.Buffer
+	c := &Config{
+		OVAFile:   ova,
+		OutputDir: dir,
+		Events:    NewEventWriter(&b),
+		Logger:    DiscardLogger,
+		stop:      make(chan struct{}),
+	}
+	defer c.Cleanup()
+	results, err := realMain(c, []string{"1.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var types []string
+	progress := false
+	for _, e := range readEvents(t, &b) {
+		if e.Type == EventProgress {
+			progress = true
+			if e.Step != "image" || e.Bytes <= 0 || e.TotalBytes <= 0 {
+				t.Errorf("progress event: %+v", e)
+			}
+			continue
+		}
+		s := e.Type
+		if e.Step != "" {
+			s += " " + e.Step
+		}
+		types = append(types, s)
+		if e.Type == EventStemcellCreated && (e.Path != results[0].StemcellPath || e.Sha1 == "") {
+			t.Errorf("stemcell event: %+v", e)
+		}
+	}
+	exp := []string{
+		"started",
+		"step_started validate", "step_completed validate",
+		"step_started image", "step_completed image",
+		"step_started manifest", "step_completed manifest",
+		"step_started stemcell",
+		"stemcell_created",
+		"step_completed stemcell",
+		"finished",
+	}
+	if strings.Join(types, ",") != strings.Join(exp, ",") {
+		t.Errorf("events:\ngot:  %q\nwant: %q", types, exp)
+	}
+	if !progress {
+		t.Error("events: no progress event")
+	}
+
+	// the last event of a failed build is EventFailed
+	b.Reset()
+	c = &Config{
+		OVAFile:   dir, // not an OVA
+		OutputDir: dir,
+		Events:    NewEventWriter(&b),
+		Logger:    DiscardLogger,
+		stop:      make(chan struct{}),
+	}
+	defer c.Cleanup()
+	if _, err := realMain(c, []string{"1.2"}); err == nil {
+		t.Fatal("realMain: expected error for invalid OVA")
+	}
+	events := readEvents(t, &b)
+	if len(events) == 0 {
+		t.Fatal("events: no events for failed build")
+	}
+	last := events[len(events)-1]
+	if last.Type != EventFailed || last.Step != "validate" || last.Error == "" {
+		t.Errorf("events: last event of failed build: %+v", last)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// An ExtraFile is an additional file added to the stemcell tarball after the
+// image and manifest.
+type ExtraFile struct {
+	Path string // path of the file
+	Name string // name of the file in the stemcell tarball
+}
+
+// ParseExtraFile parses an ExtraFile from a string of the form "PATH:NAME",
+// if NAME is omitted the base name of PATH is used.
+func ParseExtraFile(s string) (ExtraFile, error) {
+	path, name := s, ""
+	if i := strings.LastIndexByte(s, ':'); i != -1 && !isVolumeName(s[:i+1]) {
+		path, name = s[:i], s[i+1:]
+	}
+	if path == "" {
+		return ExtraFile{}, fmt.Errorf("invalid include (%s): empty path", s)
+	}
+	if name == "" {
+		name = filepath.Base(path)
+	}
+	return ExtraFile{Path: path, Name: name}, nil
+}
+
+// isVolumeName returns if s is a Windows volume name, e.g. "C:".
+func isVolumeName(s string) bool {
+	return filepath.VolumeName(s) == s && s != ""
+}
+
+func (e ExtraFile) String() string {
+	return e.Path + ":" + e.Name
+}
+
+// ValidateExtraFiles validates that each extra file is a regular file and
+// that the names in the tarball are valid and unique.
+func ValidateExtraFiles(files []ExtraFile) error {
+	seen := map[string]bool{
+		"image":       true,
+		"stemcell.MF": true,
+	}
+	for _, e := range files {
+		if strings.ContainsAny(e.Name, `/\`) || e.Name == "." || e.Name == ".." {
+			return fmt.Errorf("include (%s): invalid name: %s", e, e.Name)
+		}
+		if seen[e.Name] {
+			return fmt.Errorf("include (%s): duplicate name: %s", e, e.Name)
+		}
+		seen[e.Name] = true
+		fi, err := os.Stat(e.Path)
+		if err != nil {
+			return fmt.Errorf("include (%s): %s", e, err)
+		}
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("include (%s): is not a regular file", e)
+		}
+	}
+	return nil
+}
+
+// extraFilesFlag implements flag.Value for the repeatable -include flag.
+type extraFilesFlag []ExtraFile
+
+func (f *extraFilesFlag) String() string {
+	var a []string
+	for _, e := range *f {
+		a = append(a, e.String())
+	}
+	return strings.Join(a, ", ")
+}
+
+func (f *extraFilesFlag) Set(s string) error {
+	e, err := ParseExtraFile(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, e)
+	return nil
+}
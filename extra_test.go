@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var parseExtraFileTests = []struct {
+	in   string
+	file ExtraFile
+}{
+	{"a/b.json", ExtraFile{"a/b.json", "b.json"}},
+	{"a/b.json:c.json", ExtraFile{"a/b.json", "c.json"}},
+	{"a/b.json:", ExtraFile{"a/b.json", "b.json"}},
+}
+
+func TestParseExtraFile(t *testing.T) {
+	for _, x := range parseExtraFileTests {
+		e, err := ParseExtraFile(x.in)
+		if err != nil {
+			t.Errorf("ParseExtraFile(%q): %s", x.in, err)
+			continue
+		}
+		if e != x.file {
+			t.Errorf("ParseExtraFile(%q): got %+v want %+v", x.in, e, x.file)
+		}
+	}
+	if _, err := ParseExtraFile(":name"); err == nil {
+		t.Error("ParseExtraFile: expected error for empty path")
+	}
+}
+
+func TestCreateStemcellExtraFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	extra := filepath.Join(dir, "files.json")
+	if err := ioutil.WriteFile(extra, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files := []ExtraFile{
+		{Path: extra, Name: "dev_tools_file_list.json"},
+		{Path: extra, Name: "a.json"},
+	}
+	if err := ValidateExtraFiles(files); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateExtraFiles([]ExtraFile{{Path: extra, Name: "image"}}); err == nil {
+		t.Error("ValidateExtraFiles: expected error for reserved name")
+	}
+
+	c := newTestConfig(t, dir)
+	defer c.Cleanup()
+	c.ExtraFiles = files
+
+	var b bytes.Buffer
+	if err := c.CreateStemcellTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	names, contents := readStemcell(t, &b)
+	exp := []string{"image", "stemcell.MF", "dev_tools_file_list.json", "a.json"}
+	if len(names) != len(exp) {
+		t.Fatalf("CreateStemcellTo: got entries %q want %q", names, exp)
+	}
+	for i := range exp {
+		if names[i] != exp[i] {
+			t.Errorf("CreateStemcellTo: entry %d: got %q want %q", i, names[i], exp[i])
+		}
+	}
+	if string(contents["a.json"]) != "{}" {
+		t.Errorf("CreateStemcellTo: a.json: got %q", contents["a.json"])
+	}
+}
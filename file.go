@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// MoveFile moves file src to dst.  If overwrite is true an existing dst is
+// atomically replaced, otherwise an error is returned if dst exists.
+//
+// If src and dst are on different devices src is first copied to a temporary
+// file in the directory of dst, which is then renamed to dst, so that dst is
+// never left partially written, which is logged to log.
+func MoveFile(log Logger, src, dst string, overwrite bool) error {
+	if !overwrite {
+		if _, err := os.Stat(dst); !os.IsNotExist(err) {
+			return fmt.Errorf("file (%s) already exists - refusing to overwrite", dst)
+		}
+	}
+	err := os.Rename(src, dst)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+	log.Debugf("cannot rename (%s) to (%s) across devices - copying", src, dst)
+
+	tmp, err := copyToTempFile(src, filepath.Dir(dst))
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
+func isCrossDevice(err error) bool {
+	var e *os.LinkError
+	return errors.As(err, &e) && e.Err == syscall.EXDEV
+}
+
+// copyToTempFile copies file src to a new temporary file in directory dir and
+// returns the name of the temporary file.
+func copyToTempFile(src, dir string) (string, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(src)+"-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := copyBuffer(tmp, f); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// checkWritable checks that files can be created in directory dirname by
+// creating and removing a temp file.
+func checkWritable(dirname string) error {
+	f, err := ioutil.TempFile(dirname, ".ova2stemcell-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// A FilePolicy is how intermediate files that already exist are handled, see
+// Config.createFile.
+type FilePolicy int
+
+const (
+	FileExclusive FilePolicy = iota // fail if the file exists, the default
+	FileOverwrite                   // atomically replace the file
+	FileReuse                       // reuse the file if valid, otherwise replace it
+)
+
+// createFile creates intermediate file name, described by what (e.g. "image
+// file") in errors, and writes it with write.  An existing file is handled
+// according to c.FilePolicy: with FileReuse, reuse is called to validate the
+// existing file, and restore any state write would set, and the file is
+// only written if reuse is nil or fails.
+//
+// If write or closing the file fails the file is removed, so that no partial
+// file is left behind.
+func (c *Config) createFile(what, name string, reuse func() error, write func(w io.Writer) error) error {
+	switch c.FilePolicy {
+	case FileReuse:
+		if _, err := os.Stat(name); err == nil && reuse != nil {
+			err := reuse()
+			if err == nil {
+				c.debugf("reusing existing %s: %s", what, name)
+				return nil
+			}
+			c.debugf("not reusing invalid %s (%s): %s", what, name, err)
+		}
+		fallthrough
+	case FileOverwrite:
+		return c.replaceFile(what, name, write)
+	}
+
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("creating %s (%s): %s", what, name, err)
+	}
+	c.debugf("created temp %s: %s", what, name)
+	if err := writeAndClose(f, what, write); err != nil {
+		if rerr := os.Remove(name); rerr != nil && !os.IsNotExist(rerr) {
+			c.debugf("removing partial %s (%s): %s", what, name, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// replaceFile writes file name with write to a temp file, in the same
+// directory, that is then renamed to name.  An existing file is only
+// replaced if write succeeds.
+func (c *Config) replaceFile(what, name string, write func(w io.Writer) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("creating %s (%s): %s", what, name, err)
+	}
+	c.debugf("created temp %s (%s) for: %s", what, f.Name(), name)
+	if err := writeAndClose(f, what, write); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("creating %s (%s): %s", what, name, err)
+	}
+	return nil
+}
+
+// writeAndClose writes f with write and closes it.  The final write may not
+// fail until the file is closed, so the error of Close is returned.
+func writeAndClose(f *os.File, what string, write func(w io.Writer) error) error {
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("creating %s: closing file (%s): %s", what, f.Name(), err)
+	}
+	return nil
+}
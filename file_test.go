@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMoveFile(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "ova2stemcell-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	src := filepath.Join(tmpdir, "src")
+	dst := filepath.Join(tmpdir, "dst")
+	write := func(name, data string) {
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(src, "new")
+	write(dst, "old")
+	if err := MoveFile(DiscardLogger, src, dst, false); err == nil {
+		t.Error("MoveFile: expected error when overwrite is false and dst exists")
+	}
+	if err := MoveFile(DiscardLogger, src, dst, true); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "new" {
+		t.Errorf("MoveFile: dst contains %q want %q", b, "new")
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("MoveFile: src (%s) was not removed", src)
+	}
+}
+
+func TestCreateFilePolicy(t *testing.T) {
+	tmpdir := tempDir(t)
+	name := filepath.Join(tmpdir, "file")
+	write := func(data string) func(io.Writer) error {
+		return func(w io.Writer) error {
+			_, err := io.WriteString(w, data)
+			return err
+		}
+	}
+	fail := func(io.Writer) error { return errors.New("write failed") }
+	read := func() string {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	c := &Config{}
+	if err := c.createFile("file", name, nil, write("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.createFile("file", name, nil, write("2")); err == nil {
+		t.Error("createFile (exclusive): expected error for existing file")
+	}
+	if s := read(); s != "1" {
+		t.Errorf("createFile (exclusive): got %q want %q", s, "1")
+	}
+
+	c.FilePolicy = FileOverwrite
+	if err := c.createFile("file", name, nil, fail); err == nil {
+		t.Error("createFile (overwrite): expected write error")
+	}
+	if s := read(); s != "1" {
+		t.Errorf("createFile (overwrite): failed write replaced file: got %q", s)
+	}
+	if err := c.createFile("file", name, nil, write("2")); err != nil {
+		t.Fatal(err)
+	}
+	if s := read(); s != "2" {
+		t.Errorf("createFile (overwrite): got %q want %q", s, "2")
+	}
+
+	c.FilePolicy = FileReuse
+	valid := func() error { return nil }
+	invalid := func() error { return errors.New("invalid") }
+	if err := c.createFile("file", name, valid, fail); err != nil {
+		t.Errorf("createFile (reuse): valid file not reused: %s", err)
+	}
+	if err := c.createFile("file", name, invalid, write("3")); err != nil {
+		t.Fatal(err)
+	}
+	if s := read(); s != "3" {
+		t.Errorf("createFile (reuse): invalid file not replaced: got %q", s)
+	}
+
+	fis, err := ioutil.ReadDir(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 {
+		t.Errorf("createFile: temp files left behind: %d files", len(fis))
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ValidateStemcellFile validates stemcell tarball name, see -from-stemcell.
+// Its contents are verified by CreateImageFromStemcell.
+func ValidateStemcellFile(name string) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fmt.Errorf("opening stemcell (%s): %s", name, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("stemcell (%s): is not a regular file", name)
+	}
+	if fi.Size() == 0 {
+		return fmt.Errorf("stemcell (%s): file is empty", name)
+	}
+	return nil
+}
+
+// CreateImageFromStemcell extracts the image of existing stemcell tarball
+// name to a temp file, so that a stemcell for another version may be created
+// without rebuilding the image.  The image is used as is.  The stemcell's
+// manifest must be valid, be for the operating system of c and its sha1 must
+// match the image, otherwise an error is returned.  Other entries of the
+// stemcell are ignored.
+func (c *Config) CreateImageFromStemcell(name string) error {
+	c.debugf("creating image from stemcell: %s", name)
+
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("opening stemcell (%s): %s", name, err)
+	}
+	defer f.Close()
+
+	tmpdir, err := c.TempDir()
+	if err != nil {
+		return err
+	}
+	imagePath := filepath.Join(tmpdir, "image")
+
+	// remove the image if the stemcell is invalid
+	if err := c.extractStemcellImage(f, imagePath); err != nil {
+		os.Remove(imagePath)
+		return fmt.Errorf("stemcell (%s): %s", name, err)
+	}
+	c.Image = imagePath
+	c.debugf("sha1 checksum of image is: %s", c.Sha1sum)
+	return nil
+}
+
+// extractStemcellImage writes the image of stemcell tarball r to file name
+// and sets c.Sha1sum, see CreateImageFromStemcell.
+func (c *Config) extractStemcellImage(r io.Reader, name string) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	var m *Manifest
+	var h *imageHash
+	seen := make(map[string]bool)
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if seen[hdr.Name] {
+			return fmt.Errorf("duplicate entry: %s", hdr.Name)
+		}
+		seen[hdr.Name] = true
+
+		switch hdr.Name {
+		case "image":
+			if h, err = c.writeStemcellImage(tr, name); err != nil {
+				return err
+			}
+		case "stemcell.MF":
+			if m, err = ParseManifest(tr); err != nil {
+				return err
+			}
+			if err := m.Validate(); err != nil {
+				return err
+			}
+		default:
+			c.debugf("ignoring stemcell entry: %s", hdr.Name)
+		}
+	}
+	// the gzip trailer checksum is only verified once EOF is read
+	if _, err := copyBuffer(ioutil.Discard, gr); err != nil {
+		return err
+	}
+	if h == nil {
+		return errors.New("missing entry: image")
+	}
+	if m == nil {
+		return errors.New("missing entry: stemcell.MF")
+	}
+	if sum := h.Sha1(); sum != m.Sha1 {
+		if !c.TrustInputs {
+			return fmt.Errorf("image sha1 (%s) does not match manifest sha1 (%s)", sum, m.Sha1)
+		}
+		c.debugf("trusted inputs: ignoring image sha1 (%s) that does not match manifest sha1 (%s)",
+			sum, m.Sha1)
+	}
+	if m.OperatingSystem != c.osName() {
+		return fmt.Errorf("stemcell operating system (%s) does not match -os (%s)",
+			m.OperatingSystem, c.osName())
+	}
+	c.debugf("using image of stemcell version: %s", m.Version)
+	c.setImageSums(h)
+	return nil
+}
+
+// writeStemcellImage copies image r to new file name and returns its
+// digests.
+func (c *Config) writeStemcellImage(r io.Reader, name string) (*imageHash, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t := time.Now()
+	h := c.newImageHash()
+	if _, err := copyBuffer(io.MultiWriter(c.limitImage(f), h), c.Reader(r)); err != nil {
+		return nil, fmt.Errorf("extracting image: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("extracting image: %s", err)
+	}
+	c.debugf("extracted image in: %s", time.Since(t))
+	return h, nil
+}
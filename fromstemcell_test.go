@@ -0,0 +1,147 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestStemcell writes a stemcell tarball with the given entries to
+// file name.
+func writeTestStemcell(t *testing.T, name string, entries []tarEntry) {
+	var b bytes.Buffer
+	gw := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.Name, Mode: 0644, Size: int64(len(e.Body))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.Body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFromStemcell(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+
+	c := &Config{OVAFile: ova, OutputDir: dir, Logger: DiscardLogger, stop: make(chan struct{})}
+	defer c.Cleanup()
+	results, err := realMain(c, []string{"1.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := results[0]
+
+	c = &Config{
+		FromStemcell: source.StemcellPath,
+		OutputDir:    dir,
+		VerifyOutput: true,
+		Logger:       DiscardLogger,
+		stop:         make(chan struct{}),
+	}
+	defer c.Cleanup()
+	if err := c.ValidateInput(); err != nil {
+		t.Fatal(err)
+	}
+	results, err = realMain(c, []string{"1.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[0]; r.ImageSha1 != source.ImageSha1 || r.Version != "1.3" {
+		t.Errorf("realMain: got image sha1 %s version %s want %s %s",
+			r.ImageSha1, r.Version, source.ImageSha1, "1.3")
+	}
+
+	read := func(name string) map[string][]byte {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		_, files := readStemcell(t, f)
+		return files
+	}
+	old, cur := read(source.StemcellPath), read(results[0].StemcellPath)
+	if !bytes.Equal(old["image"], cur["image"]) {
+		t.Error("realMain: the image of the new stemcell differs from the source stemcell")
+	}
+	if !strings.Contains(string(cur["stemcell.MF"]), "version: \"1.3\"") {
+		t.Errorf("realMain: unexpected manifest:\n%s", cur["stemcell.MF"])
+	}
+
+	manifest := func(sha1, osName string) string {
+		var b bytes.Buffer
+		if _, err := NewManifest("1.2", sha1, osName).WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+	tests := map[string]struct {
+		entries []tarEntry
+		exp     string
+	}{
+		"sha1": {
+			[]tarEntry{
+				{Name: "image", Body: "image"},
+				{Name: "stemcell.MF", Body: manifest("0123456789abcdef", DefaultOS)},
+			},
+			"does not match manifest sha1",
+		},
+		"os": {
+			[]tarEntry{
+				{Name: "image", Body: "image"},
+				{Name: "stemcell.MF", Body: manifest("0e76292794888d4f1fa75fb3aff4ca27c58f56a6", "ubuntu-xenial")},
+			},
+			"does not match -os",
+		},
+		"manifest": {
+			[]tarEntry{{Name: "image", Body: "image"}},
+			"missing entry: stemcell.MF",
+		},
+	}
+	for name, x := range tests {
+		stemcell := filepath.Join(dir, name+".tgz")
+		writeTestStemcell(t, stemcell, x.entries)
+		c := &Config{Logger: DiscardLogger, stop: make(chan struct{})}
+		err := c.CreateImageFromStemcell(stemcell)
+		c.Cleanup()
+		if err == nil || !strings.Contains(err.Error(), x.exp) {
+			t.Errorf("%s: CreateImageFromStemcell: got error %v want: %q", name, err, x.exp)
+		}
+		if c.Image != "" {
+			t.Errorf("%s: CreateImageFromStemcell: image set on error: %s", name, c.Image)
+		}
+	}
+	// with -trust-inputs the sha1 of the manifest is not checked, but the
+	// sha1 of the image is still computed
+	stemcell := filepath.Join(dir, "sha1.tgz")
+	c = &Config{TrustInputs: true, Logger: DiscardLogger, stop: make(chan struct{})}
+	defer c.Cleanup()
+	if err := c.CreateImageFromStemcell(stemcell); err != nil {
+		t.Fatalf("CreateImageFromStemcell (trusted): %s", err)
+	}
+	if exp := "0e76292794888d4f1fa75fb3aff4ca27c58f56a6"; c.Sha1sum != exp {
+		t.Errorf("CreateImageFromStemcell (trusted): sha1 got %s want %s", c.Sha1sum, exp)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import "fmt"
+
+// A BuildHook is called by realMain after a build phase with the path of the
+// file the phase created.  Returning an error aborts the build, as if the
+// phase itself failed: realMain returns the error and the caller removes the
+// temp files with Config.Cleanup.
+//
+// The hooks of a Config are called in this order, the manifest and stemcell
+// hooks once per version:
+//
+//	OnImageCreated     the image, empty if it was created in memory or is
+//	                   streamed, see Config.StreamImage
+//	OnManifestWritten  the stemcell.MF in the temp directory
+//	OnStemcellCreated  the stemcell in the output directory, it is removed
+//	                   if the hook fails
+type BuildHook func(path string) error
+
+// runHook calls hook, if not nil, with path.  The name of the hook is added
+// to its error.
+func (c *Config) runHook(name string, hook BuildHook, path string) error {
+	if hook == nil {
+		return nil
+	}
+	c.debugf("running %s hook: %s", name, path)
+	if err := hook(path); err != nil {
+		return fmt.Errorf("%s hook (%s): %s", name, path, err)
+	}
+	return nil
+}
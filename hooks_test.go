@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildHooks(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+
+	var calls []string
+	hook := func(name string) BuildHook {
+		return func(path string) error {
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("%s hook: %s", name, err)
+			}
+			calls = append(calls, name+":"+filepath.Base(path))
+			return nil
+		}
+	}
+	c := &Config{
+		OVAFile:           ova,
+		OutputDir:         dir,
+		Logger:            DiscardLogger,
+		OnImageCreated:    hook("image"),
+		OnManifestWritten: hook("manifest"),
+		OnStemcellCreated: hook("stemcell"),
+		stop:              make(chan struct{}),
+	}
+	defer c.Cleanup()
+	if _, err := realMain(c, []string{"1.2", "1.3"}); err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{
+		"image:image",
+		"manifest:stemcell.MF",
+		"stemcell:" + StemcellFilename("1.2", DefaultOS),
+		"manifest:stemcell.MF",
+		"stemcell:" + StemcellFilename("1.3", DefaultOS),
+	}
+	if strings.Join(calls, " ") != strings.Join(exp, " ") {
+		t.Errorf("hooks: got %q want %q", calls, exp)
+	}
+
+	// a failing hook aborts the build and its stemcell is removed
+	out := filepath.Join(dir, "out")
+	if err := os.Mkdir(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	c = &Config{
+		OVAFile:           ova,
+		OutputDir:         out,
+		Logger:            DiscardLogger,
+		OnStemcellCreated: func(string) error { return errors.New("malware found") },
+		stop:              make(chan struct{}),
+	}
+	defer c.Cleanup()
+	_, err := realMain(c, []string{"1.2"})
+	if err == nil || !strings.Contains(err.Error(), "malware found") {
+		t.Fatalf("realMain: expected hook error got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, StemcellFilename("1.2", DefaultOS))); !os.IsNotExist(err) {
+		t.Errorf("realMain: stemcell not removed after hook error: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DefaultIaaS is the IaaS of stemcell manifests if none is specified.
+const DefaultIaaS = "vsphere"
+
+// An IaaSDescriptor describes the manifest of stemcells for an IaaS.
+type IaaSDescriptor struct {
+	// Name is the value of -iaas, e.g. "vsphere".
+	Name string
+
+	// Infrastructure is the infrastructure segment of the manifest name,
+	// e.g. "vsphere-esxi".
+	Infrastructure string
+
+	// CloudProperties are the cloud_properties of the manifest.
+	CloudProperties map[string]string
+
+	// StemcellFormat is the stemcell_formats entry of the v2 manifest
+	// layout, e.g. "vsphere-ova".
+	StemcellFormat string
+}
+
+// IaaSes are the supported IaaS manifest presets.
+var IaaSes = map[string]*IaaSDescriptor{
+	"vsphere": {
+		Name:           "vsphere",
+		Infrastructure: "vsphere-esxi",
+		CloudProperties: map[string]string{
+			"infrastructure": "vsphere",
+			"hypervisor":     "esxi",
+		},
+		StemcellFormat: "vsphere-ova",
+	},
+	"aws": {
+		Name:           "aws",
+		Infrastructure: "aws-xen-hvm",
+		CloudProperties: map[string]string{
+			"infrastructure":      "aws",
+			"architecture":        "x86_64",
+			"root_device_name":    "/dev/sda1",
+			"virtualization_type": "hvm",
+		},
+		StemcellFormat: "aws-raw",
+	},
+	"azure": {
+		Name:           "azure",
+		Infrastructure: "azure-hyperv",
+		CloudProperties: map[string]string{
+			"infrastructure": "azure",
+			"hypervisor":     "hyperv",
+		},
+		StemcellFormat: "azure-vhd",
+	},
+}
+
+// IaaSNames returns the sorted names of the supported IaaSes.
+func IaaSNames() []string {
+	var names []string
+	for name := range IaaSes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupIaaS returns the IaaSDescriptor for IaaS name.
+func LookupIaaS(name string) (*IaaSDescriptor, error) {
+	if d, ok := IaaSes[name]; ok {
+		return d, nil
+	}
+	return nil, fmt.Errorf("unsupported iaas (%s) expected one of: %s",
+		name, strings.Join(IaaSNames(), ", "))
+}
+
+func ValidateIaaS(name string) error {
+	_, err := LookupIaaS(name)
+	return err
+}
+
+// SetIaaS sets the cloud_properties and, if set by the layout, the
+// stemcell_formats of m to those of d.  The infrastructure segment of the
+// name is set by OSDescriptor.ManifestNameIaaS.
+func (m *Manifest) SetIaaS(d *IaaSDescriptor) {
+	m.CloudProperties = make(map[string]string, len(d.CloudProperties))
+	for k, v := range d.CloudProperties {
+		m.CloudProperties[k] = v
+	}
+	if m.StemcellFormats != nil {
+		m.StemcellFormats = []string{d.StemcellFormat}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+var iaasManifestTests = []struct {
+	iaas, layout, exp string
+}{
+	{"vsphere", ManifestV1, `---
+name: bosh-vsphere-esxi-ubuntu-xenial-go_agent
+version: "1.2"
+sha1: abc
+operating_system: ubuntu-xenial
+cloud_properties:
+  hypervisor: esxi
+  infrastructure: vsphere
+`},
+	{"aws", ManifestV1, `---
+name: bosh-aws-xen-hvm-ubuntu-xenial-go_agent
+version: "1.2"
+sha1: abc
+operating_system: ubuntu-xenial
+cloud_properties:
+  architecture: x86_64
+  infrastructure: aws
+  root_device_name: /dev/sda1
+  virtualization_type: hvm
+`},
+	{"azure", ManifestV1, `---
+name: bosh-azure-hyperv-ubuntu-xenial-go_agent
+version: "1.2"
+sha1: abc
+operating_system: ubuntu-xenial
+cloud_properties:
+  hypervisor: hyperv
+  infrastructure: azure
+`},
+	{"aws", ManifestV2, `---
+name: bosh-aws-xen-hvm-ubuntu-xenial-go_agent
+version: "1.2"
+bosh_protocol: "1"
+sha1: abc
+operating_system: ubuntu-xenial
+stemcell_formats:
+- aws-raw
+cloud_properties:
+  architecture: x86_64
+  infrastructure: aws
+  root_device_name: /dev/sda1
+  virtualization_type: hvm
+`},
+}
+
+func TestIaaSManifest(t *testing.T) {
+	for _, x := range iaasManifestTests {
+		c := &Config{
+			Version:        "1.2",
+			Sha1sum:        "abc",
+			OS:             "ubuntu-xenial",
+			ManifestLayout: x.layout,
+			IaaS:           x.iaas,
+		}
+		m, err := c.NewManifest()
+		if err != nil {
+			t.Errorf("%s (%s): %s", x.iaas, x.layout, err)
+			continue
+		}
+		var b bytes.Buffer
+		if _, err := m.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		if s := b.String(); s != x.exp {
+			t.Errorf("%s (%s): got:\n%s\nwant:\n%s", x.iaas, x.layout, s, x.exp)
+		}
+	}
+	for _, name := range IaaSNames() {
+		if IaaSes[name].Name != name {
+			t.Errorf("IaaSes: %s: got Name %s", name, IaaSes[name].Name)
+		}
+	}
+
+	c := &Config{Version: "1.2", Sha1sum: "abc", IaaS: "gcp"}
+	if _, err := c.NewManifest(); err == nil {
+		t.Error("NewManifest: expected error for unsupported iaas")
+	}
+}
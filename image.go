@@ -0,0 +1,190 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// ValidateImageFile validates raw image file name, see -image.
+func ValidateImageFile(name string) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fmt.Errorf("opening image file (%s): %s", name, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("image file (%s): is not a regular file", name)
+	}
+	if fi.Size() == 0 {
+		return fmt.Errorf("image file (%s): file is empty", name)
+	}
+	return nil
+}
+
+// CreateImageFromFile uses file name as the image, without assuming that it
+// is an OVA.  If name is already gzip compressed, or NoImageGzip is set, the
+// file is used as is and only its sha1 is computed, otherwise it is
+// compressed to a temp file like CreateImageFromOVA.  Either way the sha1 is
+// of the exact bytes added to the stemcell.
+func (c *Config) CreateImageFromFile(name string) error {
+	c.debugf("creating image from file: %s", name)
+
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("opening image file (%s): %s", name, err)
+	}
+	defer f.Close()
+
+	if !c.NoImageGzip && !isGzipFile(name) {
+		return c.compressImage(f, name)
+	}
+
+	c.debugf("using image file as is: %s", name)
+	if c.MaxImageSize > 0 {
+		fi, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("reading image file (%s): %s", name, err)
+		}
+		if fi.Size() > c.MaxImageSize {
+			return fmt.Errorf("image file (%s): %s", name, c.imageTooLarge())
+		}
+	}
+	h := c.newImageHash()
+	t := time.Now()
+	if _, err := copyBuffer(h, c.Reader(f)); err != nil {
+		return fmt.Errorf("reading image file (%s): %s", name, err)
+	}
+	c.debugf("computed image sha1 in: %s", time.Since(t))
+
+	c.Image = name
+	c.setImageSums(h)
+	c.debugf("sha1 checksum of image file is: %s", c.Sha1sum)
+
+	return nil
+}
+
+// maxDeflateRatio is the largest compression ratio of deflate, about 1032:1,
+// rounded up.
+const maxDeflateRatio = 1100
+
+// CheckImageSize returns an error if an image entry of size bytes, created
+// by compressing inputSize bytes, is implausible: it is empty, or is smaller
+// or larger than compressing inputSize bytes can produce.  An inputSize of
+// zero is an image that was used as is, only its size is checked.
+func CheckImageSize(size, inputSize int64) error {
+	if size <= 0 {
+		return fmt.Errorf("image is empty (%d bytes)", size)
+	}
+	if inputSize <= 0 {
+		return nil
+	}
+	if size < inputSize/maxDeflateRatio {
+		return fmt.Errorf("image (%d bytes) is too small to be %d bytes compressed",
+			size, inputSize)
+	}
+	// stored deflate blocks and gzip members add a few bytes per block
+	if size > inputSize+inputSize/100+64*1024 {
+		return fmt.Errorf("image (%d bytes) is too large to be %d bytes compressed",
+			size, inputSize)
+	}
+	return nil
+}
+
+// imageSize returns the size of the image, in memory, on disk or streamed.
+func (c *Config) imageSize() (int64, error) {
+	if c.imageData != nil {
+		return int64(len(c.imageData)), nil
+	}
+	if c.imageStream != "" {
+		return c.streamSize, nil
+	}
+	fi, err := os.Stat(c.Image)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// An imageInputWriter counts the uncompressed bytes written to an image
+// writer, see Config.imageWriter, and reports them to progress, if not nil.
+type imageInputWriter struct {
+	io.WriteCloser
+	n        *int64
+	progress func(n int64)
+}
+
+func (w imageInputWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	*w.n += int64(n)
+	if w.progress != nil {
+		w.progress(*w.n)
+	}
+	return n, err
+}
+
+// reuseImage returns a func that validates existing image file name, see
+// Config.createFile, and sets c.Sha1sum, and c.Sha256sum, to its digests.
+// Unless NoImageGzip is set the image must be a complete gzip stream.
+func (c *Config) reuseImage(name string) func() error {
+	return func() error {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := c.newImageHash()
+		var r io.Reader = io.TeeReader(f, h)
+		if !c.NoImageGzip {
+			gr, err := gzip.NewReader(r)
+			if err != nil {
+				return err
+			}
+			r = gr
+		}
+		if _, err := copyBuffer(ioutil.Discard, c.Reader(r)); err != nil {
+			return err
+		}
+		// read any trailing bytes not consumed by the gzip reader
+		if _, err := copyBuffer(h, f); err != nil {
+			return err
+		}
+		c.setImageSums(h)
+		c.imageInputSize = 0 // the input is not known
+		return nil
+	}
+}
+
+// An imageLimitWriter fails writes that would exceed its remaining bytes, see
+// Config.limitImage.
+type imageLimitWriter struct {
+	w io.Writer
+	n int64 // remaining bytes
+	c *Config
+}
+
+func (l *imageLimitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, l.c.imageTooLarge()
+	}
+	n, err := l.w.Write(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// limitImage returns w limited to c.MaxImageSize bytes, w is returned if
+// there is no limit.  The image, as written to disk or memory, is written
+// to w.
+func (c *Config) limitImage(w io.Writer) io.Writer {
+	if c.MaxImageSize <= 0 {
+		return w
+	}
+	return &imageLimitWriter{w: w, n: c.MaxImageSize, c: c}
+}
+
+func (c *Config) imageTooLarge() error {
+	return fmt.Errorf("image is larger than the maximum image size (%d bytes), see -max-image-size",
+		c.MaxImageSize)
+}
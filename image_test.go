@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCreateImageFromFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	raw := filepath.Join(dir, "disk.img")
+	if err := ioutil.WriteFile(raw, []byte(strings.Repeat("disk", 1024)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gz := gzipFile(t, raw, filepath.Join(dir, "disk.img.gz"))
+
+	tests := []struct {
+		name    string
+		noGzip  bool
+		inPlace bool // image is used as is
+	}{
+		{raw, false, false},
+		{raw, true, true},
+		{gz, false, true},
+	}
+	for _, x := range tests {
+		if err := ValidateImageFile(x.name); err != nil {
+			t.Fatal(err)
+		}
+		c := &Config{
+			ImageFile:   x.name,
+			OutputDir:   dir,
+			OutputName:  "stemcell-{version}.tgz",
+			Force:       true,
+			NoImageGzip: x.noGzip,
+			Logger:      DiscardLogger,
+			stop:        make(chan struct{}),
+		}
+		results, err := realMain(c, []string{"1.2"})
+		if err != nil {
+			t.Fatalf("%s (no gzip %t): %s", x.name, x.noGzip, err)
+		}
+		c.Cleanup()
+		if (c.Image == x.name) != x.inPlace {
+			t.Errorf("%s (no gzip %t): image used in place: got %t want %t",
+				x.name, x.noGzip, c.Image == x.name, x.inPlace)
+		}
+
+		f, err := os.Open(results[0].StemcellPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, files := readStemcell(t, f)
+		f.Close()
+		m, err := ParseManifest(bytes.NewReader(files["stemcell.MF"]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		image := files["image"]
+		if sum := fmt.Sprintf("%x", sha1.Sum(image)); m.Sha1 != sum {
+			t.Errorf("%s (no gzip %t): manifest sha1 %s is not the sha1 of the image %s",
+				x.name, x.noGzip, m.Sha1, sum)
+		}
+		if compressed := bytes.HasPrefix(image, gzipMagic); compressed == x.noGzip {
+			t.Errorf("%s (no gzip %t): image gzip compressed: %t", x.name, x.noGzip, compressed)
+		}
+		if !x.noGzip {
+			r, err := gzip.NewReader(bytes.NewReader(image))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil || len(b) != 4096 {
+				t.Errorf("%s: decompressing image: %d bytes %v", x.name, len(b), err)
+			}
+		}
+	}
+
+	if err := ValidateImageFile(dir); err == nil {
+		t.Error("ValidateImageFile: expected error for directory")
+	}
+	empty := filepath.Join(dir, "empty.img")
+	if err := ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateImageFile(empty); err == nil {
+		t.Error("ValidateImageFile: expected error for empty file")
+	}
+}
+
+func TestCheckImageSize(t *testing.T) {
+	tests := []struct {
+		size, input int64
+		ok          bool
+	}{
+		{0, 0, false},
+		{0, 1 << 20, false},
+		{100, 0, true}, // used as is
+		{1 << 10, 1 << 20, true},
+		{1 << 20, 1 << 20, true}, // incompressible
+		{1 << 20, 1 << 30, true}, // 1024:1, deflate of zeros
+		{1 << 10, 1 << 30, false},
+		{2 << 20, 1 << 20, false},
+	}
+	for _, x := range tests {
+		if err := CheckImageSize(x.size, x.input); (err == nil) != x.ok {
+			t.Errorf("CheckImageSize(%d, %d): got error %v want ok %t", x.size, x.input, err, x.ok)
+		}
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c := newTestConfig(t, dir)
+	defer c.Cleanup()
+	if err := c.CreateStemcellTo(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	size, err := c.imageSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ImageSize != size || c.imageInputSize == 0 {
+		t.Errorf("CreateStemcellTo: ImageSize %d (want %d) input %d", c.ImageSize, size,
+			c.imageInputSize)
+	}
+
+	// an image truncated to zero bytes fails the build
+	if err := os.Truncate(c.Image, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateStemcellTo(ioutil.Discard); err == nil {
+		t.Error("CreateStemcellTo: expected error for an empty image")
+	}
+}
+
+func TestMaxImageSize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// random data does not compress, so the image is larger than the limit
+	disk := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(disk)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: string(disk)},
+	})
+	gz := gzipFile(t, ova, filepath.Join(dir, "image.gz"))
+
+	tests := []struct {
+		name     string
+		ova      string
+		image    string
+		memory   int64
+		maxSize  int64
+		tooLarge bool
+	}{
+		{"file", ova, "", 0, 16 * 1024, true},
+		{"memory", ova, "", 1 << 20, 16 * 1024, true},
+		{"image", "", gz, 0, 16 * 1024, true},
+		{"limit", ova, "", 0, 1 << 20, false},
+	}
+	for _, x := range tests {
+		c := &Config{
+			OVAFile:          x.ova,
+			ImageFile:        x.image,
+			MemoryImageLimit: x.memory,
+			MaxImageSize:     x.maxSize,
+			OutputDir:        filepath.Join(dir, x.name),
+			Logger:           DiscardLogger,
+			stop:             make(chan struct{}),
+		}
+		if err := os.Mkdir(c.OutputDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		_, err := realMain(c, []string{"1.2"})
+		c.Cleanup()
+		if x.tooLarge {
+			if err == nil || !strings.Contains(err.Error(), "-max-image-size") {
+				t.Errorf("%s: realMain: expected max image size error got: %v", x.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: realMain: %s", x.name, err)
+		}
+	}
+}
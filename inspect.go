@@ -0,0 +1,49 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"text/tabwriter"
+)
+
+// InspectOVA writes a table of the entries in OVA file name to w, followed by
+// the result of validating the OVA and whether ovftool is available.  Nothing
+// is extracted.  An error is returned if the OVA is not valid.
+func InspectOVA(w io.Writer, name string) error {
+	Log.Debugf("inspecting ova file: %s", name)
+	if _, err := os.Stat(name); err != nil {
+		return fmt.Errorf("opening ova file (%s): %s", name, err)
+	}
+
+	var names []string
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSIZE\tMODE")
+	err := walkOVA(name, nil, func(h *tar.Header, _ io.Reader) error {
+		names = append(names, h.Name)
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", h.Name, h.Size, h.FileInfo().Mode())
+		return nil
+	})
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("invalid ova file (%s): %s", name, err)
+	}
+	fmt.Fprintln(w)
+
+	if path, err := exec.LookPath("ovftool"); err == nil {
+		fmt.Fprintf(w, "ovftool: %s\n", path)
+	} else {
+		fmt.Fprintln(w, "ovftool: not found")
+	}
+
+	if err := ValidateOVFNames(names); err != nil {
+		fmt.Fprintf(w, "valid: no (%s)\n", err)
+		return fmt.Errorf("ova (%s): %s", name, err)
+	}
+	fmt.Fprintln(w, "valid: yes")
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type tarEntry struct {
+	Name     string
+	Body     string
+	Typeflag byte
+}
+
+// createTar creates tar file name in directory dir containing entries.
+func createTar(t testing.TB, dir, name string, entries []tarEntry) string {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, e := range entries {
+		h := &tar.Header{
+			Name:     e.Name,
+			Mode:     0644,
+			Size:     int64(len(e.Body)),
+			Typeflag: e.Typeflag,
+		}
+		if h.Typeflag == 0 {
+			h.Typeflag = tar.TypeReg
+		}
+		if h.Typeflag != tar.TypeReg {
+			h.Size = 0
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.Body)[:h.Size]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	name = filepath.Join(dir, name)
+	if err := ioutil.WriteFile(name, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func tempDir(t testing.TB) string {
+	dir, err := ioutil.TempDir("", "ova2stemcell-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestInspectOVA(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm.mf", Body: "SHA1(vm.ovf)= 00"},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+	var b bytes.Buffer
+	if err := InspectOVA(&b, ova); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, s := range []string{"vm.ovf", "vm.mf", "vm-disk1.vmdk", "valid: yes"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("InspectOVA: output does not contain %q:\n%s", s, out)
+		}
+	}
+
+	invalid := createTar(t, dir, "invalid.ova", []tarEntry{
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+	b.Reset()
+	if err := InspectOVA(&b, invalid); err == nil {
+		t.Error("InspectOVA: expected error for ova without an ovf file")
+	}
+	if !strings.Contains(b.String(), "valid: no") {
+		t.Errorf("InspectOVA: expected invalid report:\n%s", b.String())
+	}
+}
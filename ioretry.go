@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// transientErrors are the errors, e.g. of a networked volume, that may not
+// occur again if the read or write is retried, see Config.IORetries.
+var transientErrors = []error{syscall.EIO, syscall.EAGAIN}
+
+// isTransientIOError returns if err is one of transientErrors.
+func isTransientIOError(err error) bool {
+	for _, e := range transientErrors {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// noteIOError records err, a read or write error of c.Reader or c.Writer, if
+// it is transient.  Errors are often formatted, losing err, before they are
+// returned so retryIO cannot check the error it is returned.
+func (c *Config) noteIOError(err error) {
+	if !isTransientIOError(err) {
+		return
+	}
+	c.mu.Lock()
+	c.ioErr = err
+	c.mu.Unlock()
+}
+
+// retryIO calls fn, that creates step's file, and if it fails with a
+// transient read or write error calls it again, up to c.IORetries times.
+// fn must start from scratch each call, reopening its input, and remove
+// the file it creates if it fails, see createFile.
+func (c *Config) retryIO(step string, fn func() error) error {
+	for i := 0; ; i++ {
+		c.mu.Lock()
+		c.ioErr = nil
+		c.mu.Unlock()
+
+		err := fn()
+		if err == nil || i >= c.IORetries {
+			return err
+		}
+		c.mu.Lock()
+		ioErr := c.ioErr
+		c.mu.Unlock()
+		if ioErr == nil && !isTransientIOError(err) {
+			return err
+		}
+		c.logger().Warnf("%s: transient i/o error, retrying (%d of %d): %s", step, i+1, c.IORetries, err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// flakyReader fails its first fails reads with err.
+type flakyReader struct {
+	r     io.Reader
+	fails int
+	err   error
+}
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	if r.fails > 0 {
+		r.fails--
+		return 0, r.err
+	}
+	return r.r.Read(p)
+}
+
+func TestRetryIO(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		retries int
+		fails   int
+		err     error
+		ok      bool
+		calls   int
+	}{
+		{0, 0, nil, true, 1},
+		{0, 1, syscall.EIO, false, 1},
+		{1, 1, syscall.EIO, true, 2},
+		{2, 1, syscall.EAGAIN, true, 2},
+		{1, 2, syscall.EIO, false, 2},
+		{2, 1, syscall.EACCES, false, 1}, // not transient
+	}
+	for i, x := range tests {
+		c := &Config{IORetries: x.retries, Logger: DiscardLogger, stop: make(chan struct{})}
+		name := filepath.Join(dir, fmt.Sprintf("file-%d", i))
+		r := &flakyReader{fails: x.fails, err: x.err}
+		calls := 0
+		err := c.retryIO("test", func() error {
+			calls++
+			// each attempt starts from scratch
+			r.r = strings.NewReader("contents")
+			return c.createFile("test file", name, nil, func(w io.Writer) error {
+				if _, err := copyBuffer(w, c.Reader(r)); err != nil {
+					return fmt.Errorf("copying: %s", err)
+				}
+				return nil
+			})
+		})
+		if (err == nil) != x.ok || calls != x.calls {
+			t.Errorf("%d: retryIO: got error %v after %d calls want success %t after %d calls",
+				i, err, calls, x.ok, x.calls)
+			continue
+		}
+		b, rerr := ioutil.ReadFile(name)
+		if x.ok && (rerr != nil || string(b) != "contents") {
+			t.Errorf("%d: file: got %q, %v want %q", i, b, rerr, "contents")
+		}
+		if !x.ok && !os.IsNotExist(rerr) {
+			t.Errorf("%d: partial file not removed: %v", i, rerr)
+		}
+	}
+}
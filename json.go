@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+type jsonStemcell struct {
+	Path            string `json:"path"`
+	Version         string `json:"version"`
+	OperatingSystem string `json:"operating_system"`
+	ImageSha1       string `json:"image_sha1"`
+	ImageSize       int64  `json:"image_size,omitempty"`
+	Sha1            string `json:"sha1,omitempty"`
+	Sha256          string `json:"sha256,omitempty"`
+	Unpacked        bool   `json:"unpacked"`
+	DurationMS      int64  `json:"duration_ms"`
+}
+
+type jsonStep struct {
+	Name       string `json:"name"`
+	Version    string `json:"version,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+type jsonResult struct {
+	Stemcells  []jsonStemcell `json:"stemcells"`
+	Steps      []jsonStep     `json:"steps"`
+	DurationMS int64          `json:"duration_ms"`
+}
+
+func milliseconds(d time.Duration) int64 { return int64(d / time.Millisecond) }
+
+// WriteJSON writes results, the duration of each step and the total duration
+// of the build to w as a JSON object.  Durations are in milliseconds.
+func WriteJSON(w io.Writer, results []*BuildResult, timings []StepTiming, total time.Duration) error {
+	v := jsonResult{
+		Stemcells:  []jsonStemcell{},
+		Steps:      []jsonStep{},
+		DurationMS: milliseconds(total),
+	}
+	for _, r := range results {
+		v.Stemcells = append(v.Stemcells, jsonStemcell{
+			Path:            r.StemcellPath,
+			Version:         r.Version,
+			OperatingSystem: r.OperatingSystem,
+			ImageSha1:       r.ImageSha1,
+			ImageSize:       r.ImageSize,
+			Sha1:            r.TarballSha1,
+			Sha256:          r.TarballSha256,
+			Unpacked:        r.Unpacked,
+			DurationMS:      milliseconds(r.Duration),
+		})
+	}
+	for _, t := range timings {
+		v.Steps = append(v.Steps, jsonStep{
+			Name:       t.Name,
+			Version:    t.Version,
+			DurationMS: milliseconds(t.Duration),
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestWriteJSON(t *testing.T) {
+	results := []*BuildResult{{
+		StemcellPath:    "/out/bosh-stemcell-1.2-vsphere-esxi-windows2012R2-go_agent.tgz",
+		Version:         "1.2",
+		OperatingSystem: DefaultOS,
+		ImageSha1:       "image",
+		ImageSize:       1024,
+		TarballSha1:     "tarball",
+		Duration:        3 * time.Second,
+	}}
+	timings := []StepTiming{
+		{Name: "validate", Duration: 5 * time.Millisecond},
+		{Name: "image", Duration: 2 * time.Second},
+		{Name: "manifest", Version: "1.2", Duration: time.Millisecond},
+		{Name: "stemcell", Version: "1.2", Duration: 994 * time.Millisecond},
+	}
+	var b bytes.Buffer
+	if err := WriteJSON(&b, results, timings, 3*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	var v struct {
+		Stemcells []map[string]interface{} `json:"stemcells"`
+		Steps     []struct {
+			Name       string `json:"name"`
+			Version    string `json:"version"`
+			DurationMS int64  `json:"duration_ms"`
+		} `json:"steps"`
+		DurationMS int64 `json:"duration_ms"`
+	}
+	if err := json.Unmarshal(b.Bytes(), &v); err != nil {
+		t.Fatalf("%s:\n%s", err, b.String())
+	}
+	if len(v.Stemcells) != 1 || v.Stemcells[0]["sha1"] != "tarball" ||
+		v.Stemcells[0]["version"] != "1.2" {
+		t.Errorf("WriteJSON: stemcells: got %v", v.Stemcells)
+	}
+	if v.Stemcells[0]["image_size"] != float64(1024) {
+		t.Errorf("WriteJSON: image_size: got %v want %d", v.Stemcells[0]["image_size"], 1024)
+	}
+	if _, ok := v.Stemcells[0]["sha256"]; ok {
+		t.Error("WriteJSON: empty sha256 should be omitted")
+	}
+	if len(v.Steps) != len(timings) {
+		t.Fatalf("WriteJSON: expected %d steps got: %d", len(timings), len(v.Steps))
+	}
+	var sum int64
+	for i, s := range v.Steps {
+		if s.Name != timings[i].Name || s.Version != timings[i].Version {
+			t.Errorf("WriteJSON: step %d: got %+v want %+v", i, s, timings[i])
+		}
+		sum += s.DurationMS
+	}
+	if sum != 3000 || v.DurationMS != 3000 {
+		t.Errorf("WriteJSON: got step sum %d total %d want 3000", sum, v.DurationMS)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// The sections of the specifications that lint checks refer to.
+const (
+	lintSpecTarball  = "BOSH stemcell spec: tarball structure"
+	lintSpecManifest = "BOSH stemcell spec: stemcell.MF"
+	lintSpecImage    = "BOSH vSphere stemcell: image is a gzip compressed OVA"
+	lintSpecOVF      = "DMTF DSP0243: OVF package"
+)
+
+// A LintResult is the result of one check of LintStemcell.
+type LintResult struct {
+	Check string // what was checked
+	Spec  string // the specification the check is from
+	Err   error  // nil if the check passed
+}
+
+func (r LintResult) String() string {
+	status := "PASS"
+	if r.Err != nil {
+		status = "FAIL"
+	}
+	s := fmt.Sprintf("%s  %s (%s)", status, r.Check, r.Spec)
+	if r.Err != nil {
+		s += ": " + r.Err.Error()
+	}
+	return s
+}
+
+// lintImage is the result of reading the image entry, see readLintImage.
+type lintImage struct {
+	sha1, sha256 string
+	gzipErr      error    // the image is not gzip compressed
+	tarErr       error    // the decompressed image is not a tar archive
+	names        []string // names of the image's tar entries
+}
+
+// readLintImage reads image r, that should be a gzip compressed OVA, and
+// returns its digests and the names of its entries.  Whether or not the
+// image is valid it is read in full so that its digests are computed.
+func readLintImage(r io.Reader) (*lintImage, error) {
+	h1 := sha1.New()
+	h256 := sha256.New()
+	tee := io.TeeReader(r, io.MultiWriter(h1, h256))
+	img := &lintImage{}
+
+	gr, err := gzip.NewReader(tee)
+	if err != nil {
+		img.gzipErr = err
+	} else {
+		tr := tar.NewReader(gr)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				img.tarErr = err
+				break
+			}
+			if name := cleanTarName(hdr.Name); name != "" {
+				img.names = append(img.names, name)
+			}
+		}
+		// read the tar padding and the gzip trailer
+		if _, err := copyBuffer(ioutil.Discard, gr); err != nil {
+			img.gzipErr = err
+		}
+	}
+	if _, err := copyBuffer(ioutil.Discard, tee); err != nil {
+		return nil, err
+	}
+	img.sha1 = fmt.Sprintf("%x", h1.Sum(nil))
+	img.sha256 = fmt.Sprintf("%x", h256.Sum(nil))
+	return img, nil
+}
+
+// readLintEntries reads the entries of the decompressed stemcell tarball r
+// and returns the contents of stemcell.MF, the image, see readLintImage, and
+// the number of times each entry was seen.
+func readLintEntries(r io.Reader) (mf []byte, img *lintImage, seen map[string]int, err error) {
+	seen = make(map[string]int)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		seen[hdr.Name]++
+		switch hdr.Name {
+		case "image":
+			img, err = readLintImage(tr)
+		case "stemcell.MF":
+			mf, err = ioutil.ReadAll(tr)
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	// the gzip trailer checksum is only verified once EOF is read
+	if _, err := copyBuffer(ioutil.Discard, r); err != nil {
+		return nil, nil, nil, err
+	}
+	return mf, img, seen, nil
+}
+
+// LintStemcell checks stemcell tarball r against the layered requirements of
+// a vSphere stemcell: the tarball is a gzip compressed tar, containing an
+// image and a valid stemcell.MF whose digests are those of the image, and the
+// image is itself a gzip compressed tar of an OVF package.  The results of
+// the checks are returned in order, checks that depend on a failed check
+// are not run.  Entries other than image and stemcell.MF are allowed.
+func LintStemcell(r io.Reader) []LintResult {
+	var results []LintResult
+	check := func(spec, what string, err error) bool {
+		results = append(results, LintResult{Check: what, Spec: spec, Err: err})
+		return err == nil
+	}
+
+	gr, err := gzip.NewReader(r)
+	if !check(lintSpecTarball, "stemcell is gzip compressed", err) {
+		return results
+	}
+	defer gr.Close()
+
+	mf, img, seen, err := readLintEntries(gr)
+	if !check(lintSpecTarball, "stemcell is a tar archive", err) {
+		return results
+	}
+
+	err = nil
+	for _, name := range []string{"image", "stemcell.MF"} {
+		if n := seen[name]; n == 0 {
+			err = fmt.Errorf("missing entry: %s", name)
+			break
+		} else if n > 1 {
+			err = fmt.Errorf("duplicate entry: %s", name)
+			break
+		}
+	}
+	if !check(lintSpecTarball, "stemcell contains one image and one stemcell.MF", err) {
+		return results
+	}
+
+	m, err := ParseManifest(bytes.NewReader(mf))
+	if check(lintSpecManifest, "stemcell.MF is valid YAML", err) &&
+		check(lintSpecManifest, "stemcell.MF has the required keys", m.Validate()) {
+
+		err = nil
+		if img.sha1 != m.Sha1 {
+			err = fmt.Errorf("image sha1 (%s) does not match manifest sha1 (%s)", img.sha1, m.Sha1)
+		}
+		check(lintSpecManifest, "stemcell.MF sha1 is the sha1 of the image", err)
+		if m.Sha256 != "" {
+			err = nil
+			if img.sha256 != m.Sha256 {
+				err = fmt.Errorf("image sha256 (%s) does not match manifest sha256 (%s)",
+					img.sha256, m.Sha256)
+			}
+			check(lintSpecManifest, "stemcell.MF sha256 is the sha256 of the image", err)
+		}
+	}
+
+	if check(lintSpecImage, "image is gzip compressed", img.gzipErr) &&
+		check(lintSpecImage, "image is a tar archive", img.tarErr) {
+		check(lintSpecOVF, "image is an OVF package with one .ovf descriptor", ValidateOVFNames(img.names))
+	}
+	return results
+}
+
+// LintMode checks stemcell file name, see LintStemcell, and writes the result
+// of each check to w.  An error is returned if any check failed.
+func LintMode(w io.Writer, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("linting stemcell (%s): %s", name, err)
+	}
+	defer f.Close()
+
+	failed := 0
+	for _, r := range LintStemcell(f) {
+		fmt.Fprintln(w, r)
+		if r.Err != nil {
+			failed++
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("linting stemcell (%s): %d checks failed", name, failed)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLintStemcell(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ova := string(writeStemcell(t, []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	}))
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte("not a tar"))
+	gw.Close()
+	notTar := gz.String()
+	noOVF := string(writeStemcell(t, []tarEntry{{Name: "vm-disk1.vmdk", Body: "disk"}}))
+
+	manifest := func(image string) string {
+		var b bytes.Buffer
+		m := NewManifest("1.2", fmt.Sprintf("%x", sha1.Sum([]byte(image))), DefaultOS)
+		if _, err := m.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		fail    string // the failed check, if any
+	}{
+		{"valid", []tarEntry{
+			{Name: "image", Body: ova},
+			{Name: "stemcell.MF", Body: manifest(ova)},
+			{Name: "packages.txt", Body: "extra entries are allowed"},
+		}, ""},
+		{"missing", []tarEntry{
+			{Name: "image", Body: ova},
+		}, "stemcell contains one image and one stemcell.MF"},
+		{"keys", []tarEntry{
+			{Name: "image", Body: ova},
+			{Name: "stemcell.MF", Body: "name: n\nversion: \"1.2\"\n"},
+		}, "stemcell.MF has the required keys"},
+		{"sha1", []tarEntry{
+			{Name: "image", Body: ova},
+			{Name: "stemcell.MF", Body: manifest("other")},
+		}, "stemcell.MF sha1 is the sha1 of the image"},
+		{"gzip", []tarEntry{
+			{Name: "image", Body: "raw image"},
+			{Name: "stemcell.MF", Body: manifest("raw image")},
+		}, "image is gzip compressed"},
+		{"tar", []tarEntry{
+			{Name: "image", Body: notTar},
+			{Name: "stemcell.MF", Body: manifest(notTar)},
+		}, "image is a tar archive"},
+		{"ovf", []tarEntry{
+			{Name: "image", Body: noOVF},
+			{Name: "stemcell.MF", Body: manifest(noOVF)},
+		}, "image is an OVF package with one .ovf descriptor"},
+	}
+	for _, x := range tests {
+		name := filepath.Join(dir, x.name+".tgz")
+		writeTestStemcell(t, name, x.entries)
+		var failed []string
+		var w bytes.Buffer
+		err := LintMode(&w, name)
+		for _, line := range strings.Split(w.String(), "\n") {
+			if strings.HasPrefix(line, "FAIL") {
+				failed = append(failed, line)
+			}
+		}
+		if x.fail == "" {
+			if err != nil || len(failed) != 0 {
+				t.Errorf("%s: LintMode: unexpected failure: %v\n%s", x.name, err, w.String())
+			}
+			continue
+		}
+		if err == nil || len(failed) != 1 || !strings.Contains(failed[0], x.fail) {
+			t.Errorf("%s: LintMode: expected only %q to fail got: %v\n%s", x.name, x.fail, err, w.String())
+		}
+	}
+
+	if r := LintStemcell(strings.NewReader("not gzip")); len(r) != 1 || r[0].Err == nil {
+		t.Errorf("LintStemcell: expected only the gzip check to fail got: %v", r)
+	}
+}
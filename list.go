@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ListOS writes a line for each supported operating system to w containing
+// the -os value, the stemcell filename and the manifest name, separated by
+// tabs.  VERSION is used in place of the stemcell version.
+func ListOS(w io.Writer) error {
+	for _, name := range OperatingSystemNames() {
+		d := OperatingSystems[name]
+		_, err := fmt.Fprintf(w, "%s\t%s\t%s\n", name, d.StemcellFilename("VERSION"),
+			d.ManifestName())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListFormats writes a line for each manifest layout to w containing the
+// -manifest-version value and a comma separated list of the top-level keys
+// it writes, separated by a tab.
+func ListFormats(w io.Writer) error {
+	for _, name := range ManifestLayoutNames() {
+		_, err := fmt.Fprintf(w, "%s\t%s\n", name, strings.Join(ManifestLayoutKeys[name], ","))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestListOS(t *testing.T) {
+	var b bytes.Buffer
+	if err := ListOS(&b); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != len(OperatingSystems) {
+		t.Fatalf("ListOS: expected %d lines got:\n%s", len(OperatingSystems), b.String())
+	}
+	exp := "windows2012R2\tbosh-stemcell-VERSION-vsphere-esxi-windows2012R2-go_agent.tgz\t" +
+		"bosh-vsphere-esxi-windows-2012R2-go_agent"
+	found := false
+	for _, line := range lines {
+		if len(strings.Split(line, "\t")) != 3 {
+			t.Errorf("ListOS: expected 3 fields: %q", line)
+		}
+		found = found || line == exp
+	}
+	if !found {
+		t.Errorf("ListOS: missing line %q in:\n%s", exp, b.String())
+	}
+}
+
+func TestListFormats(t *testing.T) {
+	var b bytes.Buffer
+	if err := ListFormats(&b); err != nil {
+		t.Fatal(err)
+	}
+	exp := "v1\tname,version,sha1,operating_system,cloud_properties\n" +
+		"v2\tname,version,bosh_protocol,sha1,operating_system,stemcell_formats,cloud_properties\n"
+	if s := b.String(); s != exp {
+		t.Errorf("ListFormats: got:\n%s\nwant:\n%s", s, exp)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LockPath returns the name of the -lock file of stemcell path stemcellPath,
+// a hidden file next to it.
+func LockPath(stemcellPath string) string {
+	dir, name := filepath.Split(stemcellPath)
+	return filepath.Join(dir, "."+name+".lock")
+}
+
+// A lockFile is a lock file held by this process, see createLockFile.
+type lockFile struct {
+	name string
+	f    *os.File // holds the lock, nil if the lock is the file existing
+}
+
+// readLockFile returns the process ID recorded in lock file name.
+func readLockFile(name string) (int, bool) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	return pid, err == nil && pid > 0
+}
+
+// lockHeldError returns the error of lock file name being held by another
+// build.
+func lockHeldError(name string) error {
+	if pid, ok := readLockFile(name); ok {
+		return fmt.Errorf("another build is in progress (pid %d): lock file (%s) is held", pid, name)
+	}
+	return fmt.Errorf("another build is in progress: lock file (%s) is held", name)
+}
+
+// lock creates the lock file of the stemcell of each of versions, see
+// LockPath, so that a concurrent build of the same stemcell fails rather than
+// racing.  On error no lock is held.  The locks are released by unlock, or
+// Cleanup.
+func (c *Config) lock(versions []string) error {
+	for _, ver := range versions {
+		name := LockPath(StemcellPath(c.OutputDir, c.OutputName, ver, c.osName(), c.Unpacked))
+		c.debugf("creating lock file: %s", name)
+		l, err := createLockFile(c.logger(), name)
+		if err != nil {
+			c.unlock()
+			return fmt.Errorf("locking stemcell (version %s): %s", ver, err)
+		}
+		c.mu.Lock()
+		c.locks = append(c.locks, l)
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// unlock removes the lock files created by lock.
+func (c *Config) unlock() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unlockLocked()
+}
+
+// unlockLocked is unlock, c.mu must be held.
+func (c *Config) unlockLocked() {
+	for _, l := range c.locks {
+		c.debugf("removing lock file: %s", l.name)
+		l.release()
+	}
+	c.locks = nil
+}
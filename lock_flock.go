@@ -0,0 +1,67 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// createLockFile takes an exclusive flock(2) of lock file name, creating it
+// if needed, and records the process ID in it.  If another build holds the
+// lock an error is returned.  The kernel releases the lock when the process
+// exits, so the lock file of a build that did not exit cleanly is not held
+// and is reused, which is logged to log.
+func createLockFile(log Logger, name string) (*lockFile, error) {
+	for {
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			f.Close()
+			if err == syscall.EWOULDBLOCK {
+				return nil, lockHeldError(name)
+			}
+			return nil, fmt.Errorf("lock file (%s): %s", name, err)
+		}
+		// the build that held the lock may have removed the file, see
+		// release, after it was opened: the lock is then of a file that
+		// other builds cannot see
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if cur, err := os.Stat(name); err != nil || !os.SameFile(fi, cur) {
+			f.Close()
+			continue
+		}
+		if pid, ok := readLockFile(name); ok {
+			log.Debugf("reusing lock file (%s): build (pid %d) is not running", name, pid)
+		}
+		if err := writeLockPID(f); err != nil {
+			os.Remove(name)
+			f.Close()
+			return nil, fmt.Errorf("lock file (%s): %s", name, err)
+		}
+		return &lockFile{name: name, f: f}, nil
+	}
+}
+
+// writeLockPID replaces the contents of lock file f with the process ID.
+func writeLockPID(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+	return err
+}
+
+// release removes the lock file and then releases the lock, in that order so
+// that the file cannot be locked by another build as it is removed.
+func (l *lockFile) release() {
+	os.Remove(l.name)
+	l.f.Close()
+}
@@ -0,0 +1,79 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// staleLockAge is the age after which a lock file is assumed to have been
+// left by a build that did not exit cleanly.  Whether the build that created
+// a lock file is running cannot be determined on this platform, see
+// processRunning, so until then it is assumed to be.
+const staleLockAge = 24 * time.Hour
+
+// createLockFile creates lock file name, recording the process ID in it.  If
+// the file exists, and is newer than staleLockAge, an error is returned.  An
+// older lock file is replaced, which is logged to log.
+func createLockFile(log Logger, name string) (*lockFile, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err == nil {
+		_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(name)
+			return nil, err
+		}
+		return &lockFile{name: name}, nil
+	}
+	if !os.IsExist(err) {
+		return nil, err
+	}
+	// a lock file without a process ID may still be being written, so is
+	// held like any other
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, fmt.Errorf("lock file (%s): %s", name, err)
+	}
+	age := time.Since(fi.ModTime())
+	if age < staleLockAge {
+		return nil, fmt.Errorf("%s: remove it if it is not", lockHeldError(name))
+	}
+	log.Debugf("replacing stale lock file (%s): modified %s ago", name, age.Round(time.Second))
+
+	// the lock file is replaced by a complete one, so that it is never
+	// missing or partially written, and is then checked in case another
+	// build replaced it at the same time
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp-")
+	if err != nil {
+		return nil, fmt.Errorf("lock file (%s): %s", name, err)
+	}
+	_, err = fmt.Fprintf(tmp, "%d\n", os.Getpid())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("lock file (%s): %s", name, err)
+	}
+	if pid, ok := readLockFile(name); !ok || pid != os.Getpid() {
+		return nil, lockHeldError(name)
+	}
+	return &lockFile{name: name}, nil
+}
+
+// release removes the lock file, unless another build replaced it.
+func (l *lockFile) release() {
+	if pid, ok := readLockFile(l.name); ok && pid == os.Getpid() {
+		os.Remove(l.name)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockPath(t *testing.T) {
+	name := filepath.Join("out", "bosh-stemcell-1.2-azure-hyperv-windows2016-go_agent.tgz")
+	exp := filepath.Join("out", ".bosh-stemcell-1.2-azure-hyperv-windows2016-go_agent.tgz.lock")
+	if s := LockPath(name); s != exp {
+		t.Errorf("LockPath(%q) = %q; want: %q", name, s, exp)
+	}
+}
+
+func TestConfigLock(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	newConfig := func() *Config {
+		return &Config{OutputDir: dir, Logger: DiscardLogger, stop: make(chan struct{})}
+	}
+	versions := []string{"1.2", "1.3"}
+	locks := func() []string {
+		a, err := filepath.Glob(filepath.Join(dir, ".*.lock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+
+	c1 := newConfig()
+	if err := c1.lock(versions); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(locks()); n != 2 {
+		t.Fatalf("expected 2 lock files got: %d", n)
+	}
+
+	// a second build of one of the same stemcells fails and holds no lock
+	c2 := newConfig()
+	err := c2.lock([]string{"1.1", "1.3"})
+	if err == nil || !strings.Contains(err.Error(), "another build is in progress") {
+		t.Fatalf("expected lock error got: %v", err)
+	}
+	if n := len(locks()); n != 2 {
+		t.Errorf("expected failed lock to remove its lock files: %q", locks())
+	}
+
+	// the lock is released by Cleanup
+	c1.Cleanup()
+	if a := locks(); len(a) != 0 {
+		t.Fatalf("expected Cleanup to remove the lock files: %q", a)
+	}
+	if err := c2.lock(versions); err != nil {
+		t.Fatal(err)
+	}
+	c2.unlock()
+
+	// a lock left by a build that did not exit cleanly is taken over
+	name := LockPath(StemcellPath(dir, "", "1.2", DefaultOS, false))
+	if err := ioutil.WriteFile(name, []byte("1073741824\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(name, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	c3 := newConfig()
+	if err := c3.lock(versions); err != nil {
+		t.Fatalf("stale lock: %s", err)
+	}
+	if pid, ok := readLockFile(name); !ok || pid != os.Getpid() {
+		t.Errorf("stale lock: got pid %d want %d", pid, os.Getpid())
+	}
+	if err := newConfig().lock(versions); err == nil {
+		t.Error("expected error for a lock taken over from a stale lock")
+	}
+	c3.unlock()
+	if a := locks(); len(a) != 0 {
+		t.Errorf("expected unlock to remove the lock files: %q", a)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A Logger records build progress at debug, info and warning levels.
+type Logger interface {
+	Debugf(format string, a ...interface{})
+	Infof(format string, a ...interface{})
+	Warnf(format string, a ...interface{})
+}
+
+// Log is the Logger used by package level functions and by any Config
+// without a Logger of its own.  By default only warnings and info messages
+// are written to stderr, see ParseFlags.
+var Log Logger = NewLogger(nil, false)
+
+// DiscardLogger is a Logger that discards all messages.
+var DiscardLogger Logger = discardLogger{}
+
+type discardLogger struct{}
+
+func (discardLogger) Debugf(string, ...interface{}) {}
+func (discardLogger) Infof(string, ...interface{})  {}
+func (discardLogger) Warnf(string, ...interface{})  {}
+
+// StdLogger is a Logger that writes messages to an io.Writer, debug messages
+// are only written if debugging is enabled.
+type StdLogger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	debug bool
+	color bool
+}
+
+// NewLogger returns a StdLogger that writes to w, if w is nil os.Stderr is
+// used.
+func NewLogger(w io.Writer, debug bool) *StdLogger {
+	return &StdLogger{w: w, debug: debug}
+}
+
+// SetColor sets if the level prefix of debug messages and the text of
+// warnings are colorized.
+func (l *StdLogger) SetColor(on bool) {
+	l.mu.Lock()
+	l.color = on
+	l.mu.Unlock()
+}
+
+func (l *StdLogger) output(prefix, format string, a ...interface{}) {
+	msg := strings.TrimSuffix(fmt.Sprintf(format, a...), "\n")
+	l.mu.Lock()
+	if l.color {
+		switch prefix {
+		case "debug: ":
+			prefix = colorize(colorGreen, prefix)
+		case "warning: ":
+			msg = colorize(colorYellow, prefix+msg)
+			prefix = ""
+		}
+	}
+	defer l.mu.Unlock()
+	w := l.w
+	if w == nil {
+		w = os.Stderr
+	}
+	fmt.Fprintln(w, prefix+msg)
+}
+
+func (l *StdLogger) Debugf(format string, a ...interface{}) {
+	if l.debug {
+		l.output("debug: ", format, a...)
+	}
+}
+
+func (l *StdLogger) Infof(format string, a ...interface{}) {
+	l.output("", format, a...)
+}
+
+func (l *StdLogger) Warnf(format string, a ...interface{}) {
+	l.output("warning: ", format, a...)
+}
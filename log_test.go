@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, false)
+	l.Debugf("debug %d", 1)
+	l.Infof("info %d", 2)
+	l.Warnf("warn %d\n", 3)
+	exp := "info 2\nwarning: warn 3\n"
+	if s := buf.String(); s != exp {
+		t.Errorf("StdLogger: got %q want %q", s, exp)
+	}
+
+	buf.Reset()
+	l = NewLogger(&buf, true)
+	l.Debugf("debug %d", 1)
+	if s := buf.String(); s != "debug: debug 1\n" {
+		t.Errorf("StdLogger: got %q want %q", s, "debug: debug 1\n")
+	}
+
+	buf.Reset()
+	l.SetColor(true)
+	l.Debugf("debug")
+	l.Warnf("warn")
+	exp = colorGreen + "debug: " + colorReset + "debug\n" +
+		colorYellow + "warning: warn" + colorReset + "\n"
+	if s := buf.String(); s != exp {
+		t.Errorf("StdLogger (color): got %q want %q", s, exp)
+	}
+}
+
+type recordLogger struct {
+	msgs []string
+}
+
+func (r *recordLogger) Debugf(format string, a ...interface{}) {
+	r.msgs = append(r.msgs, fmt.Sprintf(format, a...))
+}
+
+func (r *recordLogger) Infof(format string, a ...interface{}) { r.Debugf(format, a...) }
+func (r *recordLogger) Warnf(format string, a ...interface{}) { r.Debugf(format, a...) }
+
+func TestConfigLogger(t *testing.T) {
+	r := new(recordLogger)
+	c := Config{Logger: r}
+	c.debugf("hello %s", "world")
+	if len(r.msgs) != 1 || r.msgs[0] != "hello world" {
+		t.Errorf("Config: expected injected Logger to be used got: %q", r.msgs)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// A LogFile is an io.Writer that appends to a file that may be reopened, so
+// that it can be rotated by tools like logrotate, see -log-file.
+type LogFile struct {
+	mu   sync.Mutex
+	name string
+	f    *os.File
+}
+
+// OpenLogFile opens file name for appending, creating it if necessary.
+func OpenLogFile(name string) (*LogFile, error) {
+	l := &LogFile{name: name}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(p)
+}
+
+// Reopen closes and reopens the log file.  If the file cannot be opened the
+// current file is kept.
+func (l *LogFile) Reopen() error {
+	f, err := os.OpenFile(l.name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening log file (%s): %s", l.name, err)
+	}
+	l.mu.Lock()
+	old := l.f
+	l.f = f
+	l.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Close closes the log file.
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestLogFileReopen(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "ova2stemcell.log")
+	f, err := OpenLogFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	l := NewLogger(f, true)
+	l.Debugf("one")
+
+	// rotate the log, like logrotate, then reopen it
+	rotated := name + ".1"
+	if err := os.Rename(name, rotated); err != nil {
+		t.Fatal(err)
+	}
+	l.Debugf("two")
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	l.Infof("three")
+
+	for file, exp := range map[string]string{
+		rotated: "debug: one\ndebug: two\n",
+		name:    "three\n",
+	} {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != exp {
+			t.Errorf("%s: got %q want %q", filepath.Base(file), b, exp)
+		}
+	}
+
+	if _, err := OpenLogFile(filepath.Join(dir, "missing", "log")); err == nil {
+		t.Error("OpenLogFile: expected error for missing directory")
+	}
+}
+
+func TestWithoutSignal(t *testing.T) {
+	sigs := withoutSignal(InterruptSignals(), LogReopenSignal)
+	if len(sigs) != len(InterruptSignals())-1 {
+		t.Fatalf("withoutSignal: got %v", sigs)
+	}
+	for _, s := range sigs {
+		if s == syscall.SIGHUP {
+			t.Errorf("withoutSignal: %s was not removed", s)
+		}
+	}
+}
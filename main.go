@@ -2,46 +2,175 @@ package main
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"crypto/ed25519"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 )
 
+// Build information of the tool, set with:
+//
+//	go build -ldflags "-X main.BuildVersion=1.0 -X main.BuildCommit=$(git rev-parse HEAD)"
 var (
-	Version     string
-	OutputDir   string
-	EnableDebug bool
-	OvaFile     string
-	OvfDir      string
+	BuildVersion = "devel"
+	BuildCommit  = "unknown"
 )
 
-var Debugf = func(format string, a ...interface{}) {}
+// DefaultDrainSize is the default Config.DrainSize, files such as the
+// manifest are always much smaller.
+const DefaultDrainSize = 1 << 20
+
+// DefaultMemoryImageLimit is the default -memory-image-limit, large enough
+// for test fixtures and small enough to not risk running out of memory.
+const DefaultMemoryImageLimit = 32 << 20
+
+// ToolVersion returns the version string of the tool itself.
+func ToolVersion() string {
+	return fmt.Sprintf("ova2stemcell version %s (commit %s)", BuildVersion, BuildCommit)
+}
+
+var (
+	StemcellVersion string
+	OperatingSystem string
+	OutputDir       string
+	OutputName      string
+	Force           bool
+	ConfigFile      string
+	InspectFile     string
+	IncludeFiles    extraFilesFlag
+	TmpRoot         string
+	Unpacked        bool
+	MinVersion      string
+	NoImageGzip     bool
+	EmitChecksum    string
+	ImageChecksum   string
+	Agent           string
+	DiskSpaceFactor float64
+	SummaryFile     string
+	MetricsFile     string
+	VerifyOutput    bool
+	TrustInputs     bool
+	MemoryLimit     int64
+	MaxImageSize    int64
+	ManifestLayout  string
+	ManifestTmpl    string
+	EnableDebug     bool
+	EnableColor     bool
+	ShowVersion     bool
+	SelfTestMode    bool
+	CleanOrphans    time.Duration
+	BuildID         string
+	ListOSMode      bool
+	ListFormatsMode bool
+	StrictOrder     bool
+	StrictNames     bool
+	AllowDevices    string
+	OVFSymlinks     string
+	OVFNames        string
+	PrintManifest   bool
+	ValidateMode    bool
+	JSONOutput      bool
+	EventsOutput    bool
+	Timeout         time.Duration
+	StepTimeouts    string
+	OvaFile         string
+	OvfDir          string
+	ImageFile       string
+	FromStemcell    string
+	LogFilePath     string
+	VerifyFile      string
+	DiffFile        string
+	LintFile        string
+	MatchFile       string
+	VerifyOVAFile   string
+	ExpectManifest  string
+	VerifySigKey    string
+	SignKey         string
+	ExpectIgnore    string
+	APIVersion      int
+	IaaS            string
+	GzipThreads     int
+	IORetries       int
+	EmbedBuildInfo  bool
+	LockOutput      bool
+	StreamImage     bool
+	WorkDir         string
+)
+
+// TrustedChecks are the integrity checks skipped by -trust-inputs.  The sha1
+// of the image is always computed, it is required by the manifest.
+const TrustedChecks = "-verify-output, the image size check and the -from-stemcell image sha1 check"
+
+// logFile is the -log-file, if any, that Log writes to.
+var logFile *LogFile
 
 const UsageMessage = `
-Usage %[1]s: [OPTIONS...] [-VERSION version] [-OVA FILENAME] [-OVF DIRNAME]
+Usage %[1]s: [OPTIONS...] [-VERSION version] [-OS os] [-OVA FILENAME] [-OVF DIRNAME] [-IMAGE FILENAME] [-FROM-STEMCELL FILENAME]
 
 Creates a BOSH stemcell from a OVA file or a directory containing an OVF
 package.
 
 Usage:
-  Either the [ova] or [ovf] flag must be specified, the [version] flag
-  is required.  If the [output] flag is not specified the stemcell fill
-  will be created in the current working directory.
+  One of the [ova], [ovf], [image] or [from-stemcell] flags must be
+  specified, the [version] flag is required.  If the [output] flag is not
+  specified the stemcell fill will be created in the current working
+  directory.
+
+  With [from-stemcell] the image of an existing stemcell, whose sha1 is
+  verified against its manifest, is reused and only the manifest changes.
+
+  If the [version] or [os] flags are not specified they are read from the
+  ProductSection and OperatingSystemSection of the .ovf file, if present.
+
+  The OVA file may be gzip compressed (e.g. vm.ova.gz).
+
+Environment:
+  Every flag may also be set with an environment variable named after it,
+  e.g. OVA2STEMCELL_VERSION or OVA2STEMCELL_TMP_DIR.  Flags on the command
+  line take precedence over the environment, which takes precedence over
+  the [config] file.  Use [debug] to print the recognized variables.
+
+Output:
+  One line is printed to stdout for each stemcell created:
+
+    created stemcell: PATH (version VERSION, sha1 SHA1)
+    created unpacked stemcell: PATH (version VERSION)
+
+  where SHA1 is the checksum of the stemcell tarball.  Earlier versions
+  printed "created stemell: PATH" followed by "stemcell sha1: SHA1".
+
+  With [json] a single JSON object is printed instead, containing the
+  stemcells created and the duration_ms of each build step.
+
+  With [events] a JSON object is printed on its own line for each build
+  event (started, step_started, progress, step_completed, stemcell_created)
+  as the build progresses.  The last event is "finished" or "failed".
+
+  With "-output -" the stemcell tarball itself is written to stdout and
+  nothing else is, logs are written to stderr.  Only one version may be
+  built.
 
 Examples:
-  %[1]s -v 1.2 -ova vm.ova
-  %[1]s -v 1.2 -ovf ~/dirname/ -o ~/stemcells/
+  %[1]s -version 1.2 -ova vm.ova
+  %[1]s -version 1.2 -ovf ~/dirname/ -o ~/stemcells/
+  %[1]s -version 1.2 -image disk.img
+  %[1]s -version 1.3 -from-stemcell bosh-stemcell-1.2-vsphere-esxi-windows2012R2-go_agent.tgz
 
 Flags:
 `
@@ -52,17 +181,195 @@ func init() {
 		flag.PrintDefaults()
 	}
 
-	flag.StringVar(&OvaFile, "ova", "", "Path to OVA file")
+	flag.StringVar(&OvaFile, "ova", "", "Path to OVA file, may be gzip compressed")
 	flag.StringVar(&OvfDir, "ovf", "", "Directory containing OVF package")
-
-	flag.StringVar(&Version, "version", "", "Stemcell version in the form of [DIGITS].[DIGITS] (e.x. 123.01)")
-	flag.StringVar(&Version, "v", "", "Stemcell version (shorthand)")
+	flag.StringVar(&ImageFile, "image", "",
+		"Raw image file to use as the stemcell image, compressed with gzip unless it already is")
+	flag.StringVar(&FromStemcell, "from-stemcell", "",
+		"Existing stemcell whose image is reused, after verifying its sha1, for the new version")
+
+	flag.StringVar(&StemcellVersion, "version", "",
+		"Stemcell version in the form of [DIGITS].[DIGITS] (e.x. 123.01), a comma separated list creates one stemcell per version")
+	flag.StringVar(&StemcellVersion, "v", "", "Stemcell version (shorthand)")
+
+	flag.BoolVar(&StrictOrder, "strict-order", false,
+		"Require the .ovf file to be the first entry of the OVA, followed by the .mf file if any")
+	flag.BoolVar(&StrictNames, "strict-names", false,
+		"Require the .mf and .cert files to have the base name of the .ovf file (e.x. vm.ovf and vm.mf)")
+	flag.StringVar(&OVFSymlinks, "ovf-symlinks", SymlinkError,
+		"How symlinks in the -ovf directory are handled: error (fail), follow (add the file linked to) or skip")
+	flag.StringVar(&OVFNames, "ovf-name-policy", "default",
+		"Files the OVA or OVF package must, and may, contain: default (one .ovf, at most one .mf and .cert), "+
+			"strict (also requires a .mf) or lenient (one .ovf, anything else)")
+	flag.StringVar(&AllowDevices, "ovf-allow-devices", "",
+		"Fail if the .ovf has a VirtualHardwareSection device not in this comma separated list of names or "+
+			"ResourceType numbers (processor and memory are always allowed): "+strings.Join(OVFDeviceNames(), ", "))
+
+	flag.StringVar(&MinVersion, "min-version", "",
+		"Require the stemcell version to be greater than this version")
+
+	flag.StringVar(&OperatingSystem, "os", DefaultOS,
+		"Stemcell operating system: "+strings.Join(OperatingSystemNames(), ", "))
+
+	flag.StringVar(&Agent, "agent", DefaultAgent,
+		"Agent suffix of the stemcell manifest name (e.x. go_agent-hardened)")
+
+	flag.StringVar(&IaaS, "iaas", DefaultIaaS,
+		fmt.Sprintf("IaaS of the stemcell manifest (%s)", strings.Join(IaaSNames(), ", ")))
+
+	flag.IntVar(&APIVersion, "api-version", 0,
+		"Agent API version written to the manifest as api_version, 0 omits it")
+
+	flag.StringVar(&ManifestLayout, "manifest-version", ManifestV1,
+		"Manifest layout: v1 (all directors) or v2 (adds bosh_protocol and stemcell_formats, bosh v262+)")
+	flag.StringVar(&ManifestTmpl, "manifest-template", "",
+		"Write the manifest with this Go text/template file, executed with the manifest fields "+
+			"(e.x. {{ .Version }} and {{ .Sha1 }}), instead of the built-in manifest")
 
 	flag.StringVar(&OutputDir, "output", "",
-		"Output directory, default is the current working directory.")
+		"Output directory, default is the current working directory.  '-' writes the stemcell tarball to stdout.")
 	flag.StringVar(&OutputDir, "o", "", "Output directory (shorthand)")
 
+	flag.StringVar(&OutputName, "output-name", "",
+		"Stemcell filename, '%s' or '{version}' are replaced with the stemcell version.")
+
+	flag.StringVar(&TmpRoot, "tmp-dir", "",
+		"Directory to create temporary files in, default is $TMPDIR")
+
+	flag.Float64Var(&DiskSpaceFactor, "disk-space-factor", DefaultDiskSpaceFactor,
+		"Require this multiple of the input size to be free in the temp directory, 0 disables the check")
+
+	flag.Var(&IncludeFiles, "include",
+		"Add file to the stemcell as PATH[:NAME], may be repeated")
+
+	flag.Int64Var(&MemoryLimit, "memory-image-limit", DefaultMemoryImageLimit,
+		"Create the image in memory, instead of a temp file, if the OVA is no larger than this many bytes, 0 disables")
+
+	flag.BoolVar(&StreamImage, "stream-image", false,
+		"Compress the OVA twice, to size the image and then directly into the stemcell, instead of writing the "+
+			"image to a temp file: halves the disk writes of large OVAs")
+
+	flag.StringVar(&WorkDir, "work-dir", "",
+		"Checkpoint the image to this directory and, if a build of the same input is restarted, resume from "+
+			"it instead of compressing the input again")
+
+	flag.Int64Var(&MaxImageSize, "max-image-size", 0,
+		"Fail the build if the image, as added to the stemcell, would be larger than this many bytes, 0 disables")
+
+	flag.IntVar(&GzipThreads, "gzip-threads", 1,
+		"Number of threads that gzip compress the image and stemcell, 0 is one per CPU.  "+
+			"More than one writes the output as concatenated gzip blocks.")
+
+	flag.BoolVar(&EmbedBuildInfo, "embed-build-info", false,
+		"Add "+BuildInfoName+", the builder version, time, input sha256 and host of the build, to the stemcell")
+
+	flag.BoolVar(&LockOutput, "lock", false,
+		"Fail if another build of the same stemcell is in progress, using a lock file next to the stemcell")
+
+	flag.IntVar(&IORetries, "io-retries", 0,
+		"Retry creating the image or stemcell from scratch up to this many times if a read or write "+
+			"fails with a transient error (EIO or EAGAIN), e.x. on a networked volume")
+
+	flag.BoolVar(&NoImageGzip, "no-image-gzip", false,
+		"Experimental: do not gzip compress the image (BOSH expects a compressed image)")
+
+	flag.BoolVar(&Unpacked, "unpacked", false,
+		"Write the image and stemcell.MF as loose files to a directory named after the stemcell, instead of a tarball")
+
+	flag.StringVar(&EmitChecksum, "emit-checksum", "",
+		"Write a checksum file next to the stemcell for each comma separated algorithm: "+
+			strings.Join(ChecksumAlgorithms, ", "))
+
+	flag.StringVar(&ImageChecksum, "checksum", "sha1",
+		"Comma separated digests of the image to write to the manifest (sha1 is always included), each must be one of: "+
+			strings.Join(ChecksumAlgorithms, ", "))
+
+	flag.BoolVar(&VerifyOutput, "verify-output", true,
+		"Re-read each stemcell after it is created and verify its entries and image sha1")
+
+	flag.BoolVar(&TrustInputs, "trust-inputs", false,
+		"Skip redundant integrity checks ("+TrustedChecks+") for trusted rebuilds, also set by "+
+			EnvAliases["trust-inputs"]+"=1")
+
+	flag.DurationVar(&Timeout, "timeout", 0,
+		"Stop the build, and remove its temp files, if it takes longer than this (e.x. 1h30m), 0 is no timeout")
+
+	flag.StringVar(&StepTimeouts, "step-timeout", "",
+		"Comma separated STEP=DURATION timeouts of individual build steps: "+strings.Join(BuildSteps, ", "))
+
+	flag.BoolVar(&JSONOutput, "json", false,
+		"Print the stemcells created, and the duration of each build step, as JSON instead of one line per stemcell")
+
+	flag.BoolVar(&EventsOutput, "events", false,
+		"Print newline delimited JSON events as the build progresses, instead of one line per stemcell")
+
+	flag.StringVar(&SummaryFile, "summary", "",
+		"Write the size, sha1 and duration of each build step to this file, '-' logs it to stderr")
+
+	flag.StringVar(&MetricsFile, "metrics-file", "",
+		"Atomically write the outcome, step durations, sizes and checksums of the build as JSON to this file, "+
+			"even if the build fails")
+
+	flag.BoolVar(&Force, "force", false, "Overwrite an existing stemcell")
+	flag.BoolVar(&Force, "f", false, "Overwrite an existing stemcell (shorthand)")
+
+	flag.StringVar(&InspectFile, "inspect", "",
+		"Print the contents of OVA file and whether it is valid, then exit")
+
+	flag.StringVar(&VerifyFile, "verify", "",
+		"Verify the entries, manifest and image sha1 of this stemcell tarball, then exit")
+	flag.StringVar(&ExpectManifest, "expect-manifest", "",
+		"With -verify, compare the stemcell's manifest field by field to this manifest and fail if any differ")
+	flag.StringVar(&VerifySigKey, "verify-sig", "",
+		"With -verify, verify the stemcell's detached "+SignatureExt+" signature with this PEM ed25519 public key")
+	flag.StringVar(&SignKey, "sign-key", "",
+		"Write a detached Ed25519ph (SHA-512) signature of each stemcell to STEMCELL"+SignatureExt+
+			" with this PEM PKCS #8 ed25519 private key (e.x. openssl genpkey -algorithm ed25519)")
+	flag.StringVar(&ExpectIgnore, "expect-ignore", DefaultExpectIgnore,
+		"Comma separated manifest fields whose -expect-manifest or -diff differences are reported but ignored: "+
+			strings.Join(ManifestFields, ", "))
+	flag.StringVar(&LintFile, "lint", "",
+		"Check this stemcell tarball, including its nested image, against the stemcell spec, "+
+			"print each check, then exit")
+	flag.StringVar(&DiffFile, "diff", "",
+		"Compare this stemcell tarball to the stemcell given as the only argument (e.x. -diff A.tgz B.tgz), "+
+			"fail if any manifest field or entry differs, then exit")
+	flag.StringVar(&VerifyOVAFile, "verify-ova", "",
+		"Check the digest of each file of this OVA against its .mf manifest, print each check, then exit")
+	flag.StringVar(&MatchFile, "match-stemcell", "",
+		"Report the gzip level and header that reproduce the image of this stemcell tarball "+
+			"from its decompressed content, then exit")
+
+	flag.BoolVar(&ListOSMode, "list-os", false,
+		"Print the supported operating systems, and the stemcell filename and manifest name of each, then exit")
+	flag.BoolVar(&ListFormatsMode, "list-formats", false,
+		"Print the manifest versions, and the keys each writes, then exit")
+
+	flag.BoolVar(&ValidateMode, "validate", false,
+		"Run every flag and input check, print the result of each and PASS or FAIL, then exit without building")
+
+	flag.BoolVar(&PrintManifest, "print-manifest", false,
+		"Validate the flags and input, print the stemcell.MF of each version, with a pending sha1, then exit")
+
+	flag.DurationVar(&CleanOrphans, "clean-orphans", 0,
+		"Remove the temp directories of killed builds not modified for this long (e.x. 24h) from -tmp-dir, then exit")
+	flag.StringVar(&BuildID, "build-id", "",
+		"ID of the build included in the name of its temp directory, to trace orphaned temp directories")
+
+	flag.BoolVar(&SelfTestMode, "selftest", false,
+		"Check that the environment can build stemcells, print a PASS/FAIL report and exit")
+
+	flag.StringVar(&ConfigFile, "config", "",
+		"YAML (key: value) or TOML (key = value) file of flag values, command line flags take precedence")
+
+	flag.BoolVar(&ShowVersion, "tool-version", false, "Print the version of this tool and exit")
+	flag.BoolVar(&ShowVersion, "V", false, "Print the version of this tool and exit (shorthand)")
+
 	flag.BoolVar(&EnableDebug, "debug", false, "Print lots of debugging information")
+	flag.StringVar(&LogFilePath, "log-file", "",
+		"Append log messages to this file instead of stderr, SIGHUP reopens the file (e.x. after logrotate)")
+	flag.BoolVar(&EnableColor, "color", false,
+		"Colorize debug output, warnings and errors (disabled if NO_COLOR is set or stderr is not a terminal)")
 }
 
 func Usage() {
@@ -70,41 +377,63 @@ func Usage() {
 	os.Exit(1)
 }
 
-func ValidateInputFlags(ova, ovf string) error {
-	Debugf("validating [ova] (%s) and [ovf] (%s) flags", ova, ovf)
-	ova = strings.TrimSpace(ova)
-	ovf = strings.TrimSpace(ovf)
-	switch {
-	case ova == "" && ovf == "":
-		return errors.New("must specify either the [ova] or [ovf] flag")
-	case ova != "" && ovf != "":
-		return errors.New("both [ova] and [ovf] flags provided - only one may be defined")
-	}
+// colorErrors is set by ParseFlags if errors should be printed in color.
+var colorErrors bool
 
-	// check for extra flags
-	Debugf("validating that no extra flags or arguments were provided")
-	if n := len(flag.Args()); n != 0 {
-		return fmt.Errorf("extra arguments: %s\n", strings.Join(flag.Args(), ", "))
+// PrintError prints err to stderr, in red if the -color flag was provided.
+func PrintError(err error) {
+	msg := strings.TrimSuffix(err.Error(), "\n")
+	if colorErrors {
+		msg = colorize(colorRed, msg)
 	}
-	return nil
+	fmt.Fprintln(os.Stderr, msg)
 }
 
 // Validates that version s if of
 func ValidateVersion(version string) error {
-	Debugf("validating version string: %s", version)
 	s := strings.TrimSpace(version)
 	if s == "" {
 		return errors.New("missing required argument 'version'")
 	}
 	if !regexp.MustCompile(`^\d{1,}.\d{1,}$`).MatchString(s) {
-		Debugf("expected version string to match regex: '%s'", `^\d*.*\d$`)
 		return fmt.Errorf("invalid version (%s) expected format [NUMBER].[NUMBER]", s)
 	}
 	return nil
 }
 
+// SplitVersions splits a comma separated list of stemcell versions.
+func SplitVersions(s string) []string {
+	var versions []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			versions = append(versions, v)
+		}
+	}
+	return versions
+}
+
+// ValidateVersions validates each version and that the stemcell filenames,
+// as generated from name, of versions do not collide.
+func ValidateVersions(versions []string, name, osName string) error {
+	if len(versions) == 0 {
+		return errors.New("missing required argument 'version'")
+	}
+	seen := make(map[string]string)
+	for _, v := range versions {
+		if err := ValidateVersion(v); err != nil {
+			return err
+		}
+		filename := OutputFilename(name, v, osName)
+		if prev, ok := seen[filename]; ok {
+			return fmt.Errorf("versions (%s) and (%s) have the same stemcell filename: %s",
+				prev, v, filename)
+		}
+		seen[filename] = v
+	}
+	return nil
+}
+
 func ValidateOutputDir(dirname string) error {
-	Debugf("validating output directory: %s", dirname)
 	if dirname == "" {
 		return nil
 	}
@@ -115,64 +444,117 @@ func ValidateOutputDir(dirname string) error {
 	if !fi.IsDir() {
 		return fmt.Errorf("output argument (%s): is not a directory\n", dirname)
 	}
+	// fail now, not when the stemcell is moved to the directory
+	if err := checkWritable(dirname); err != nil {
+		return fmt.Errorf("output directory (%s): is not writable: %s", dirname, err)
+	}
+	return nil
+}
+
+// ValidateTmpRoot validates that temp files can be created in directory
+// dirname, if dirname is empty the default temp directory is validated.
+func ValidateTmpRoot(dirname string) error {
+	if dirname == "" {
+		dirname = os.TempDir()
+	}
+	fi, err := os.Stat(dirname)
+	if err != nil {
+		return fmt.Errorf("temp directory (%s): %s", dirname, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("temp directory (%s): is not a directory", dirname)
+	}
+	if err := checkWritable(dirname); err != nil {
+		return fmt.Errorf("temp directory (%s): is not writable: %s", dirname, err)
+	}
 	return nil
 }
 
-func ValidateStemcellFilename(dirname, version string) error {
-	name := filepath.Join(dirname, StemcellFilename(version))
-	Debugf("validating that stemcell filename (%s) does not exist", name)
+func ValidateOutputName(name string) error {
+	if name == "" {
+		return nil
+	}
+	if strings.ContainsRune(name, '/') || strings.ContainsRune(name, filepath.Separator) {
+		return fmt.Errorf("output name (%s): must not contain a path separator", name)
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("output name (%s): is not a valid filename", name)
+	}
+	return nil
+}
+
+// StemcellPath returns the path of the stemcell with version and operating
+// system osName created in directory dirname, name is the -output-name (see
+// OutputFilename).  If unpacked is true the directory of an unpacked stemcell
+// is returned.
+func StemcellPath(dirname, name, version, osName string, unpacked bool) string {
+	path := filepath.Join(dirname, OutputFilename(name, version, osName))
+	if unpacked {
+		path = UnpackedDirname(path)
+	}
+	return path
+}
+
+// ValidateStemcellFilename validates that stemcell name does not exist,
+// unless force is true.
+func ValidateStemcellFilename(name string, force bool) error {
+	if force {
+		return nil
+	}
 	if _, err := os.Stat(name); !os.IsNotExist(err) {
 		return fmt.Errorf("file (%s) already exists - refusing to overwrite", name)
 	}
 	return nil
 }
 
-// Validate that names consitute and ovf file
+// ValidateOVFNames validates that names constitute an OVF package, see
+// DefaultOVFNamePolicy.
 func ValidateOVFNames(names []string) error {
-	Debugf("validating ovf package files: %s", strings.Join(names, ", "))
+	return DefaultOVFNamePolicy.Validate(names)
+}
 
-	// file extensions - for validation
-	exts := make(map[string]int)
+// ValidateOVFBasenames returns an error if the .mf or .cert file of OVF
+// package files names does not have the same base name as the .ovf file,
+// e.g. "vm.ovf", "vm.mf" and "vm.cert".  Some tools require this.  The names
+// must have already been validated by ValidateOVFNames.
+func ValidateOVFBasenames(names []string) error {
+	var base string
 	for _, s := range names {
-		exts[filepath.Ext(s)]++
+		if filepath.Ext(s) == ".ovf" {
+			base = strings.TrimSuffix(s, ".ovf")
+		}
 	}
-
-	// list files by ext - for error messages
-	byExt := func(ext string) string {
-		var a []string
-		for _, s := range names {
-			if filepath.Ext(s) == ext {
-				a = append(a, s)
-			}
+	for _, s := range names {
+		ext := filepath.Ext(s)
+		if (ext == ".mf" || ext == ".cert") && strings.TrimSuffix(s, ext) != base {
+			return fmt.Errorf("%s file (%s) does not have the base name of the .ovf file: %s",
+				ext, s, base+ext)
 		}
-		return strings.Join(a, ", ")
 	}
+	return nil
+}
 
-	// minimal check for required files
-	// source: http://www.dmtf.org/sites/default/files/standards/documents/DSP0243_2.1.1.pdf
-	//
-	if n := exts[".ovf"]; n != 1 {
-		if n == 0 {
-			return errors.New("missing .ovf file (one is required)")
-		}
-		if n > 1 {
-			return fmt.Errorf("multiple .ovf files (expected one): %s", byExt(".ovf"))
+// validateOVFBasenames validates the base names of OVF package files names,
+// see ValidateOVFBasenames.  If strict is false a warning is logged to log
+// instead of returning an error.  The error is prefixed with prefix.
+func validateOVFBasenames(log Logger, prefix string, names []string, strict bool) error {
+	if err := ValidateOVFBasenames(names); err != nil {
+		if strict {
+			return fmt.Errorf("%s: %s", prefix, err)
 		}
+		log.Warnf("%s: %s (see -strict-names)", prefix, err)
 	}
-	if n := exts[".mf"]; n > 1 {
-		return fmt.Errorf("multiple .mf files (expected one or zero): %s", byExt(".mf"))
-	}
-	if n := exts[".cert"]; n > 1 {
-		return fmt.Errorf("multiple .cert files (expected one or zero): %s", byExt(".cert"))
-	}
-
 	return nil
 }
 
-func ValidateOVFDirectory(dirname string) error {
-	Debugf("validating ovf directory: %s", dirname)
+// ValidateOVFDirectory validates OVF directory dirname.  The files must
+// satisfy policy, if nil DefaultOVFNamePolicy.  If strictNames is true the
+// .mf and .cert files must have the base name of the .ovf file (see
+// ValidateOVFDirectory), otherwise a warning is logged to log if they do not.
+func ValidateOVFDirectory(log Logger, dirname string, strictNames bool, symlinks string, policy *OVFNamePolicy) error {
+	log.Debugf("validating ovf directory: %s", dirname)
 
-	fis, err := ioutil.ReadDir(dirname)
+	fis, err := readOVFDirectory(log, dirname, symlinks)
 	if err != nil {
 		return fmt.Errorf("ovf directory (%s): %s", dirname, err)
 	}
@@ -192,54 +574,197 @@ func ValidateOVFDirectory(dirname string) error {
 		}
 		names = append(names, fi.Name())
 	}
-	Debugf("ovf directory (%s) contains the following files: %s",
+	log.Debugf("ovf directory (%s) contains the following files: %s",
 		dirname, strings.Join(names, ", "))
 
-	if err := ValidateOVFNames(names); err != nil {
+	if policy == nil {
+		policy = DefaultOVFNamePolicy
+	}
+	if err := policy.Validate(names); err != nil {
 		return fmt.Errorf("ovf directory (%s): %s", dirname, err)
 	}
-	return nil
+	return validateOVFBasenames(log, fmt.Sprintf("ovf directory (%s)", dirname), names, strictNames)
 }
 
-func ValidateOVAFile(name string) error {
-	Debugf("validating ova file: %s", name)
-	f, err := os.Open(name)
+// walkOVA calls fn for each header in OVA file name, which may be gzip
+// compressed.  PAX global headers and the archive root ("./") are skipped and
+// the leading "./" of names is removed.  GNU and PAX long names are handled
+// by archive/tar.
+//
+// If hashes is not nil it is called with the header of each regular file,
+// the contents of the file are written to the hashes it returns, as the
+// archive is read, before fn is called.  Either way the OVA is read once.
+// The contents of the entry not read by the hashes are read from r, e.g.
+// all of them if hashes returns none.
+func walkOVA(name string, hashes func(h *tar.Header) []hash.Hash, fn func(h *tar.Header, r io.Reader) error) error {
+	f, err := openOVA(name)
 	if err != nil {
-		return fmt.Errorf("opening ova file (%s): %s", name, err)
+		return err
 	}
 	defer f.Close()
 
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		hdr.Name = cleanTarName(hdr.Name)
+		if hdr.Name == "" {
+			continue
+		}
+		if hashes != nil && hdr.Typeflag == tar.TypeReg {
+			if hs := hashes(hdr); len(hs) != 0 {
+				w := make([]io.Writer, len(hs))
+				for i, h := range hs {
+					w[i] = h
+				}
+				if _, err := copyBuffer(io.MultiWriter(w...), tr); err != nil {
+					return err
+				}
+			}
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// cleanTarName strips any leading "./" from tar entry name, the archive root
+// is returned as an empty string.
+func cleanTarName(name string) string {
+	for strings.HasPrefix(name, "./") {
+		name = name[len("./"):]
+	}
+	if name == "." {
+		return ""
+	}
+	return name
+}
+
+// tarBlockSize is the size of a tar header block.
+const tarBlockSize = 512
+
+// ValidateOVAFile validates OVA file name.  If strict is true the entries
+// must be in the order required by the OVF specification (see
+// ValidateOVFOrder), otherwise a warning is logged to log if they are not.
+// Likewise, if strictNames is true the .mf and .cert entries must have the
+// base name of the .ovf entry (see ValidateOVFBasenames).  The entries must
+// satisfy policy, if nil DefaultOVFNamePolicy.
+func ValidateOVAFile(log Logger, name string, strict, strictNames bool, policy *OVFNamePolicy) error {
+	log.Debugf("validating ova file: %s", name)
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fmt.Errorf("opening ova file (%s): %s", name, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("ova file (%s): is not a regular file", name)
+	}
+	if fi.Size() == 0 {
+		return fmt.Errorf("ova file (%s): file is empty", name)
+	}
+	// a tar archive consists of one or more 512 byte blocks, a compressed
+	// archive may be smaller
+	if fi.Size() < tarBlockSize && !isGzipFile(name) {
+		return fmt.Errorf("ova file (%s): file is truncated (%d bytes)", name, fi.Size())
+	}
+
 	// record file names - this will be used to validate the ova
 	var names []string
 
-	// TODO: make sure the ova does not contain directories
-	tr := tar.NewReader(f)
-	for err == nil {
-		var h *tar.Header
-		h, err = tr.Next()
-		if h != nil {
-			names = append(names, h.Name)
-			Debugf("    %s", h.Name)
+	err = walkOVA(name, nil, func(h *tar.Header, _ io.Reader) error {
+		log.Debugf("    %s", h.Name)
+		if err := validateOVAEntry(h); err != nil {
+			return err
 		}
-	}
-	if err != io.EOF {
+		names = append(names, h.Name)
+		return nil
+	})
+	if err != nil {
 		return fmt.Errorf("invalid ova file (%s): %s", name, err)
 	}
-	if err := ValidateOVFNames(names); err != nil {
+	if policy == nil {
+		policy = DefaultOVFNamePolicy
+	}
+	if err := policy.Validate(names); err != nil {
 		return fmt.Errorf("ova (%s): %s", name, err)
 	}
+	if err := validateOVFBasenames(log, fmt.Sprintf("ova (%s)", name), names, strictNames); err != nil {
+		return err
+	}
+	if err := ValidateOVFOrder(names); err != nil {
+		if strict {
+			return fmt.Errorf("ova (%s): %s", name, err)
+		}
+		log.Warnf("ova (%s): %s (see -strict-order)", name, err)
+	}
+	return nil
+}
+
+// validateOVAEntry returns an error if OVA entry h is not a regular file.
+// The files of an OVF package are stored at the root of the OVA, so it must
+// not contain directories, links or special files.
+func validateOVAEntry(h *tar.Header) error {
+	switch h.Typeflag {
+	case tar.TypeReg:
+		return nil
+	case tar.TypeDir:
+		return fmt.Errorf("contains a directory (%s): an ova may only contain files", h.Name)
+	case tar.TypeSymlink, tar.TypeLink:
+		return fmt.Errorf("contains a link (%s -> %s): an ova may only contain files",
+			h.Name, h.Linkname)
+	default:
+		return fmt.Errorf("contains an unsupported entry (%s) of type: %q", h.Name, h.Typeflag)
+	}
+}
+
+// ValidateOVFOrder validates that the OVA entries names are in the order
+// required by the OVF specification: the .ovf descriptor first followed by
+// the .mf manifest, if any.
+func ValidateOVFOrder(names []string) error {
+	if len(names) == 0 {
+		return errors.New("empty ova")
+	}
+	if filepath.Ext(names[0]) != ".ovf" {
+		return fmt.Errorf("first entry must be the .ovf file, found order: %s",
+			strings.Join(names, ", "))
+	}
+	for i, s := range names {
+		if filepath.Ext(s) == ".mf" && i != 1 {
+			return fmt.Errorf(".mf file must follow the .ovf file, found order: %s",
+				strings.Join(names, ", "))
+		}
+	}
 	return nil
 }
 
-func StemcellFilename(version string) string {
-	return fmt.Sprintf("bosh-stemcell-%s-vsphere-esxi-windows2012R2-go_agent.tgz", version)
+func StemcellFilename(version, osName string) string {
+	return lookupOS(osName).StemcellFilename(version)
+}
+
+// OutputFilename returns the filename the stemcell for version is saved as.
+// If name is empty StemcellFilename is used, otherwise any "%s" or "{version}"
+// in name is replaced with version.
+func OutputFilename(name, version, osName string) string {
+	if name == "" {
+		return StemcellFilename(version, osName)
+	}
+	name = strings.Replace(name, "%s", version, -1)
+	return strings.Replace(name, "{version}", version, -1)
 }
 
 var ErrInterupt = errors.New("interupt")
 
 type CancelWriter struct {
-	w    io.Writer
-	stop chan struct{}
+	w     io.Writer
+	stop  chan struct{}
+	onErr func(error) // if not nil, called with write errors
 }
 
 func (w *CancelWriter) Write(p []byte) (int, error) {
@@ -247,13 +772,18 @@ func (w *CancelWriter) Write(p []byte) (int, error) {
 	case <-w.stop:
 		return 0, ErrInterupt
 	default:
-		return w.w.Write(p)
+		n, err := w.w.Write(p)
+		if err != nil && w.onErr != nil {
+			w.onErr(err)
+		}
+		return n, err
 	}
 }
 
 type CancelReader struct {
-	r    io.Reader
-	stop chan struct{}
+	r     io.Reader
+	stop  chan struct{}
+	onErr func(error) // if not nil, called with read errors other than io.EOF
 }
 
 func (r *CancelReader) Read(p []byte) (int, error) {
@@ -261,7 +791,11 @@ func (r *CancelReader) Read(p []byte) (int, error) {
 	case <-r.stop:
 		return 0, ErrInterupt
 	default:
-		return r.r.Read(p)
+		n, err := r.r.Read(p)
+		if err != nil && err != io.EOF && r.onErr != nil {
+			r.onErr(err)
+		}
+		return n, err
 	}
 }
 
@@ -270,36 +804,274 @@ type Config struct {
 	Stemcell string
 	Manifest string
 	Sha1sum  string
+	Version  string // stemcell version
+	OS       string // stemcell operating system, if empty DefaultOS is used
+	Logger   Logger // if nil Log is used
+
+	// Agent is the agent suffix of the manifest name, if empty
+	// DefaultAgent is used.
+	Agent string
+
+	// APIVersion is the api_version of the manifest, it is omitted if
+	// zero.
+	APIVersion int
+
+	// IaaS selects the manifest preset of IaaSes, if empty DefaultIaaS is
+	// used.
+	IaaS string
+
+	// ManifestLayout is the layout of the manifest, ManifestV1 or
+	// ManifestV2, if empty ManifestV1 is used.
+	ManifestLayout string
+
+	// ManifestTemplate, if not nil, is executed to write the manifest
+	// instead of Manifest.WriteTo, see ExecuteManifestTemplate.
+	ManifestTemplate *template.Template
+
+	// NoImageGzip stores the image uncompressed, this is experimental as
+	// BOSH expects a gzip compressed image.
+	NoImageGzip bool
+
+	// MaxImageSize is the largest image, in bytes, that may be created,
+	// zero is no limit.
+	MaxImageSize int64
+
+	// GzipThreads is the number of goroutines that compress the image and
+	// stemcell, see parallelGzipWriter.  If less than two compress/gzip is
+	// used.
+	GzipThreads int
+
+	// EmbedBuildInfo adds the BuildInfo of each stemcell to it as
+	// BuildInfoName, see writeBuildInfo.
+	EmbedBuildInfo bool
+	inputSha256    string // sha256 of the input, see NewBuildInfo
+
+	// Lock creates a lock file next to each stemcell while it is built, see
+	// lock, so that concurrent builds of the same stemcell fail.
+	Lock  bool
+	locks []*lockFile // lock files held, protected by mu
+
+	// DrainSize is the size of the largest file whose copy is completed,
+	// rather than cancelled part way, when c is stopped, see drainReader.
+	// Stopping c is checked between steps, see startStep.
+	DrainSize int64
+
+	// IORetries is the number of times the image or stemcell is created
+	// again, from scratch, if a read or write fails with a transient
+	// error, see retryIO.
+	IORetries int
+	ioErr     error // last transient i/o error, see noteIOError
+
+	// TmpRoot is the directory the temp directory is created in, if empty
+	// the default temp directory ($TMPDIR) is used.
+	TmpRoot string
+
+	// WorkDir, if set, is the persistent directory the image is
+	// checkpointed to, instead of the temp directory, so that a build that
+	// is restarted with the same input resumes after the image, see
+	// createImage.
+	WorkDir string
+
+	// ExtraFiles are added to the stemcell, in order, after the image
+	// and manifest.
+	ExtraFiles []ExtraFile
+
+	// ImageChecksums are the digests of the image written to the manifest,
+	// see ParseImageChecksums.  The sha1 is always written.  Sha256sum is
+	// the sha256 of the image, if requested.
+	ImageChecksums []string
+	Sha256sum      string
+
+	StemcellSha1sum   string // sha1 of the stemcell tarball
+	StemcellSha256sum string // sha256 of the stemcell tarball
+	stemcellSha512    []byte // sha512 of the stemcell tarball, only if SignKey is set
+
+	// The following are only used by realMain.
+	OVAFile         string   // input OVA file, if the other inputs are empty
+	OVFDir          string   // input OVF directory
+	ImageFile       string   // input raw image, see CreateImageFromFile
+	FromStemcell    string   // input stemcell, see CreateImageFromStemcell
+	OutputDir       string   // directory stemcells are created in
+	OutputName      string   // stemcell filename, see OutputFilename
+	Unpacked        bool     // see WriteUnpacked
+	Force           bool     // overwrite existing stemcells
+	StrictOrder     bool     // see ValidateOVAFile
+	StrictNames     bool     // see ValidateOVAFile and ValidateOVFDirectory
+	AllowDevices    []string // if not nil, see CheckOVFDevices
+	Symlinks        string   // symlink policy of OVFDir, see SymlinkPolicies
+	NamePolicy      string   // OVFNamePolicies preset, empty is the default
+	DiskSpaceFactor float64  // see CheckDiskSpace
+	Checksums       []string // checksum files to write, see WriteChecksumFile
+	SignKey         string   // private key that signs each stemcell, see WriteSignatureFile
+	VerifyOutput    bool     // verify each stemcell after it is created
+	TrustInputs     bool     // skip redundant integrity checks, see TrustedChecks
+
+	// Output, if not nil, is written the stemcell tarball instead of a file
+	// in OutputDir.  Only one version may be built and Unpacked, Checksums
+	// and OnStemcellCreated are ignored.
+	Output io.Writer
+
+	// Timeout is the time realMain may take before it is stopped, zero is
+	// no timeout.  StepTimeouts are the timeouts of individual steps, see
+	// BuildSteps.
+	Timeout      time.Duration
+	StepTimeouts map[string]time.Duration
+
+	// OnImageCreated, OnManifestWritten and OnStemcellCreated are called
+	// by realMain after each phase of the build, see BuildHook.
+	OnImageCreated    BuildHook
+	OnManifestWritten BuildHook
+	OnStemcellCreated BuildHook
+
+	// MemoryImageLimit is the size of the largest OVA whose image is
+	// created in memory, instead of a temp file, by CreateImageFromOVA.
+	// Zero disables in memory images, as does WorkDir.
+	MemoryImageLimit int64
+	imageData        []byte // in memory image, Image is empty if set
+	manifestData     []byte // in memory manifest, Manifest is empty if set
+	imageInputSize   int64  // bytes compressed to create the image, 0 if used as is
+
+	// StreamImage compresses the OVA twice, first to compute the size and
+	// sha1 of the image and then directly into the stemcell, instead of
+	// writing the image to a temp file that is then copied into the
+	// stemcell, see measureImage.  This halves the bytes written to disk at
+	// the cost of compressing the OVA twice.  Only OVA files are streamed.
+	StreamImage bool
+	imageStream string // OVA file of a streamed image, Image is empty if set
+	streamSize  int64  // size of the streamed image
+
+	// ImageSize is the size of the image entry of the stemcell, set by
+	// CreateStemcellTo.
+	ImageSize int64
+
+	// MetricsFile, if set, is written by realMain at the end of the build,
+	// successful or not, see writeMetricsFile.
+	MetricsFile string
+
+	// Steps records the artifacts created by realMain, see WriteSummary.
+	Steps []BuildStep
+
+	// Timings records the duration of each step of realMain.  Steps are
+	// timed back to back, so the sum of the durations is the duration of
+	// the build.
+	Timings []StepTiming
+
+	// FilePolicy is how intermediate files that already exist are handled,
+	// the default is to fail.
+	FilePolicy FilePolicy
+
+	// BuildID is included in the name of the temp directory, see
+	// CleanOrphanTempDirs.
+	BuildID string
+
+	// Events, if not nil, is written an Event as each step of realMain
+	// starts and completes.
+	Events     *EventWriter
+	progressAt time.Time // time of the last EventProgress
+	inputSize  int64     // size of the input, see InputSize
+
 	tmpdir   string
+	tmpLabel string // versions included in the temp directory name
 	stop     chan struct{}
+	stopOnce sync.Once
+	mu       sync.Mutex // protects tmpdir, cleaned, locks, ioErr and the timeout fields
+	cleaned  bool
+
+	step        string        // step of realMain that is running
+	stepStart   time.Time     // when step started
+	stepVersion string        // c.Version when step started
+	deadline    *time.Timer   // see Timeout
+	deadlineAt  time.Time     // when deadline expires
+	stepTimer   *time.Timer   // see StepTimeouts
+	stepAt      time.Time     // when stepTimer expires
+	timeout     *TimeoutError // first timeout that expired
+}
+
+func (c *Config) osName() string {
+	if c.OS != "" {
+		return c.OS
+	}
+	return DefaultOS
+}
+
+func (c *Config) logger() Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return Log
+}
+
+func (c *Config) debugf(format string, a ...interface{}) {
+	c.logger().Debugf(format, a...)
 }
 
 // returns a io.Writer that returns an error when Config c is stopped
 func (c *Config) Writer(w io.Writer) *CancelWriter {
-	return &CancelWriter{w: w, stop: c.stop}
+	return &CancelWriter{w: w, stop: c.stop, onErr: c.noteIOError}
 }
 
 // returns a io.Reader that returns an error when Config c is stopped
 func (c *Config) Reader(r io.Reader) *CancelReader {
-	return &CancelReader{r: r, stop: c.stop}
+	return &CancelReader{r: r, stop: c.stop, onErr: c.noteIOError}
 }
 
+// drainReader returns a reader of r, a file of size bytes, that like Reader
+// can be cancelled by stopping c, unless size is at most c.DrainSize.  A
+// small copy is not cancelled part way, so that the file is never left half
+// written, stopping c is noticed by the next long copy or step instead.
+func (c *Config) drainReader(r io.Reader, size int64) *CancelReader {
+	if size <= c.DrainSize {
+		return &CancelReader{r: r, onErr: c.noteIOError} // a nil stop is never closed
+	}
+	return c.Reader(r)
+}
+
+// stopped returns if c has been stopped.
+func (c *Config) stopped() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop cancels any reads or writes in progress and removes the temp directory.
+// It is safe to call Stop multiple times and concurrently with Cleanup.
 func (c *Config) Stop() {
-	Debugf("stopping config")
-	defer c.Cleanup() // make sure this runs!
-	close(c.stop)
+	c.stopOnce.Do(func() {
+		c.debugf("stopping config")
+		defer c.Cleanup() // make sure this runs!
+		if c.stop != nil {
+			close(c.stop)
+		}
+	})
 }
 
+// Cleanup removes the temp directory, after which no new temp directory will
+// be created, and any lock files.  It is safe to call Cleanup multiple times.
 func (c *Config) Cleanup() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unlockLocked()
+	if c.cleaned {
+		return
+	}
+	c.cleaned = true
 	if c.tmpdir != "" {
-		Debugf("deleting temp directory: %s", c.tmpdir)
+		c.debugf("deleting temp directory: %s", c.tmpdir)
 		os.RemoveAll(c.tmpdir)
 	}
 }
 
-func (c *Config) AddTarFile(tr *tar.Writer, name string) error {
-	Debugf("adding file (%s) to tar archive", name)
-	f, err := os.Open(name)
+// AddTarFile adds file filename to tar archive tr as name, the name of the
+// file on disk is never used.  The copy can be cancelled by stopping c.
+func (c *Config) AddTarFile(tr *tar.Writer, filename, name string) error {
+	if name == "" {
+		panic("AddTarFile: empty archive name")
+	}
+	c.debugf("adding file (%s) to tar archive as: %s", filename, name)
+	f, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
@@ -308,244 +1080,555 @@ func (c *Config) AddTarFile(tr *tar.Writer, name string) error {
 	if err != nil {
 		return err
 	}
-	hdr, err := tar.FileInfoHeader(fi, "")
+	hdr, err := tarFileHeader(fi, name)
 	if err != nil {
 		return err
 	}
 	if err := tr.WriteHeader(hdr); err != nil {
 		return err
 	}
-	if _, err := io.Copy(tr, c.Reader(f)); err != nil {
+	if _, err := copyBuffer(tr, c.Reader(f)); err != nil {
 		return err
 	}
 	return nil
 }
 
+// tarHeader returns the header of every regular file added to an image or
+// stemcell, whether it is read from a file or memory, so that the entries of
+// a stemcell do not depend on how it was built.  The header is PAX format:
+// the USTAR format cannot encode files larger than 8GB or sub-second
+// modification times.  The owner is root and the names of the builder's user
+// and group are not recorded.
+func tarHeader(name string, size int64, modTime time.Time) *tar.Header {
+	return &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatPAX,
+	}
+}
+
+// tarFileHeader returns the tar header, see tarHeader, of regular file fi
+// named name.  Executable files keep their executable bits.
+func tarFileHeader(fi os.FileInfo, name string) (*tar.Header, error) {
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("file (%s): is not a regular file", fi.Name())
+	}
+	hdr := tarHeader(name, fi.Size(), fi.ModTime())
+	if fi.Mode()&0111 != 0 {
+		hdr.Mode = 0755
+	}
+	return hdr, nil
+}
+
+// addTarBytes adds data to tar archive tr as a regular file named name.
+func (c *Config) addTarBytes(tr *tar.Writer, name string, data []byte) error {
+	if err := tr.WriteHeader(tarHeader(name, int64(len(data)), time.Now())); err != nil {
+		return err
+	}
+	_, err := copyBuffer(tr, c.Reader(bytes.NewReader(data)))
+	return err
+}
+
+// hasImage returns if the image has been created, either as a file or in
+// memory, or measured to be streamed.
+func (c *Config) hasImage() bool {
+	return c.Image != "" || c.imageData != nil || c.imageStream != ""
+}
+
 func (c *Config) TempDir() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cleaned {
+		return "", errors.New("creating temp directory: config was stopped")
+	}
 	if c.tmpdir != "" {
 		if _, err := os.Stat(c.tmpdir); err != nil {
-			Debugf("unable to stat temp dir (%s) was it deleted?", c.tmpdir)
+			c.debugf("unable to stat temp dir (%s) was it deleted?", c.tmpdir)
 			return "", fmt.Errorf("opening temp directory: %s", c.tmpdir)
 		}
 		return c.tmpdir, nil
 	}
-	name, err := ioutil.TempDir("", "ova2stemcell-")
+	name, err := ioutil.TempDir(c.TmpRoot, c.tempDirPrefix())
 	if err != nil {
 		return "", fmt.Errorf("creating temp directory: %s", err)
 	}
+	if err := writePIDFile(name); err != nil {
+		os.RemoveAll(name)
+		return "", fmt.Errorf("creating temp directory: %s", err)
+	}
 	c.tmpdir = name
-	Debugf("created temp directory: %s", name)
+	c.debugf("created temp directory: %s", name)
 	return c.tmpdir, nil
 }
 
 func (c *Config) CreateStemcell() error {
-	Debugf("creating stemcell")
-
-	// programming errors - panic!
-	if c.Manifest == "" {
-		panic("CreateStemcell: empty manifest")
-	}
-	if c.Image == "" {
-		panic("CreateStemcell: empty image")
-	}
+	c.debugf("creating stemcell")
 
 	tmpdir, err := c.TempDir()
 	if err != nil {
 		return err
 	}
 
-	c.Stemcell = filepath.Join(tmpdir, StemcellFilename(Version))
-	stemcell, err := os.OpenFile(c.Stemcell, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
-	if err != nil {
+	name := filepath.Join(tmpdir, StemcellFilename(c.Version, c.osName()))
+	if err := c.createFile("stemcell", name, nil, c.CreateStemcellTo); err != nil {
 		return err
 	}
-	defer stemcell.Close()
-	Debugf("created temp stemcell: %s", c.Stemcell)
+	c.Stemcell = name
+	return nil
+}
 
-	errorf := func(format string, a ...interface{}) error {
-		stemcell.Close()
-		os.Remove(c.Stemcell)
-		return fmt.Errorf(format, a...)
+// CreateStemcellTo writes the stemcell tarball, containing the image and
+// manifest, to w and sets StemcellSha1sum and StemcellSha256sum to the
+// checksums of the bytes written.
+// The image and manifest must already have been created.
+func (c *Config) CreateStemcellTo(w io.Writer) error {
+	// programming errors - panic!
+	if c.Version == "" {
+		panic("CreateStemcell: empty version")
+	}
+	if c.Manifest == "" && c.manifestData == nil {
+		panic("CreateStemcell: empty manifest")
+	}
+	if !c.hasImage() {
+		panic("CreateStemcell: empty image")
 	}
 
 	t := time.Now()
-	w := gzip.NewWriter(c.Writer(stemcell))
-	tr := tar.NewWriter(w)
+	h := sha1.New()
+	h256 := sha256.New()
+	hashes := []io.Writer{h, h256, w}
+	var h512 hash.Hash // signed, see WriteSignatureFile
+	if c.SignKey != "" {
+		h512 = sha512.New()
+		hashes = append(hashes, h512)
+	}
+	gw := c.gzipWriter(c.Writer(io.MultiWriter(hashes...)))
+	tr := tar.NewWriter(gw)
+
+	// the entry names are explicit, never those of the temp files
+	var entries []string
+	if c.imageData != nil {
+		c.debugf("adding in memory image to stemcell tarball")
+		if err := c.addTarBytes(tr, "image", c.imageData); err != nil {
+			return fmt.Errorf("creating stemcell: %s", err)
+		}
+	} else if c.imageStream != "" {
+		c.debugf("streaming image of ova (%s) to stemcell tarball", c.imageStream)
+		if err := c.addStreamedImage(tr); err != nil {
+			return fmt.Errorf("creating stemcell: %s", err)
+		}
+	} else {
+		c.debugf("adding image file to stemcell tarball: %s", c.Image)
+		if err := c.AddTarFile(tr, c.Image, "image"); err != nil {
+			return fmt.Errorf("creating stemcell: %s", err)
+		}
+	}
+	entries = append(entries, "image")
 
-	Debugf("adding image file to stemcell tarball: %s", c.Image)
-	if err := c.AddTarFile(tr, c.Image); err != nil {
-		return errorf("creating stemcell: %s", err)
+	if c.manifestData != nil {
+		c.debugf("adding in memory manifest to stemcell tarball")
+		if err := c.addTarBytes(tr, "stemcell.MF", c.manifestData); err != nil {
+			return fmt.Errorf("creating stemcell: %s", err)
+		}
+	} else {
+		c.debugf("adding manifest file to stemcell tarball: %s", c.Manifest)
+		if err := c.AddTarFile(tr, c.Manifest, "stemcell.MF"); err != nil {
+			return fmt.Errorf("creating stemcell: %s", err)
+		}
+	}
+	entries = append(entries, "stemcell.MF")
+	if err := checkStemcellEntries(entries); err != nil {
+		panic("CreateStemcell: " + err.Error())
 	}
 
-	Debugf("adding manifest file to stemcell tarball: %s", c.Manifest)
-	if err := c.AddTarFile(tr, c.Manifest); err != nil {
-		return errorf("creating stemcell: %s", err)
+	for _, e := range c.ExtraFiles {
+		c.debugf("adding extra file to stemcell tarball: %s", e)
+		if err := c.AddTarFile(tr, e.Path, e.Name); err != nil {
+			return fmt.Errorf("creating stemcell: %s", err)
+		}
 	}
 
 	if err := tr.Close(); err != nil {
-		return errorf("creating stemcell: %s", err)
+		return fmt.Errorf("creating stemcell: %s", err)
 	}
 
-	if err := w.Close(); err != nil {
-		return errorf("creating stemcell: %s", err)
+	if err := gw.Close(); err != nil {
+		return fmt.Errorf("creating stemcell: %s", err)
 	}
 
-	Debugf("created stemcell in: %s", time.Since(t))
+	// cheap check, unlike VerifyOutput, that the image entry is plausible
+	size, err := c.imageSize()
+	if err != nil {
+		return fmt.Errorf("creating stemcell: %s", err)
+	}
+	if c.TrustInputs {
+		c.debugf("trusted inputs: not checking image size: %d", size)
+	} else if err := CheckImageSize(size, c.imageInputSize); err != nil {
+		return fmt.Errorf("creating stemcell: %s", err)
+	}
+	c.ImageSize = size
+
+	c.debugf("created stemcell in: %s", time.Since(t))
+
+	c.StemcellSha1sum = fmt.Sprintf("%x", h.Sum(nil))
+	c.debugf("sha1 checksum of stemcell is: %s", c.StemcellSha1sum)
+	c.StemcellSha256sum = fmt.Sprintf("%x", h256.Sum(nil))
+	c.debugf("sha256 checksum of stemcell is: %s", c.StemcellSha256sum)
+	if h512 != nil {
+		c.stemcellSha512 = h512.Sum(nil)
+	}
 
 	return nil
 }
 
+// stemcellEntries are the names, in order, of the entries every stemcell
+// tarball starts with, whatever the names of the files they are read from.
+var stemcellEntries = []string{"image", "stemcell.MF"}
+
+// checkStemcellEntries returns an error if names, the entries added to a
+// stemcell before any extra files, are not exactly stemcellEntries.
+func checkStemcellEntries(names []string) error {
+	if strings.Join(names, ",") != strings.Join(stemcellEntries, ",") {
+		return fmt.Errorf("stemcell entries (%s) must be: %s",
+			strings.Join(names, ", "), strings.Join(stemcellEntries, ", "))
+	}
+	return nil
+}
+
+// gzipOSUnknown is the gzip header OS byte for an unknown operating system,
+// see RFC 1952.
+const gzipOSUnknown = 255
+
+// newGzipWriter returns a gzip.Writer that writes to w with a header that
+// does not depend on when or where it was written: no name, comment or
+// modification time and an unknown OS.  This makes the compressed output
+// deterministic given identical input.
+func newGzipWriter(w io.Writer) *gzip.Writer {
+	gw := gzip.NewWriter(w)
+	gw.Header = gzip.Header{OS: gzipOSUnknown}
+	return gw
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// gzipWriter returns a gzip.Writer that writes to w, or if c.GzipThreads is
+// greater than one a parallelGzipWriter.
+func (c *Config) gzipWriter(w io.Writer) io.WriteCloser {
+	if c.GzipThreads > 1 {
+		return newParallelGzipWriter(w, c.GzipThreads)
+	}
+	return newGzipWriter(w)
+}
+
+// imageWriter returns a gzip writer, see gzipWriter, that writes to w, or if
+// NoImageGzip is set a WriteCloser that writes to w directly.  The bytes
+// written are counted in c.imageInputSize, see CheckImageSize.
+func (c *Config) imageWriter(w io.Writer) io.WriteCloser {
+	c.imageInputSize = 0
+	if c.NoImageGzip {
+		return imageInputWriter{nopWriteCloser{w}, &c.imageInputSize, c.emitProgress}
+	}
+	return imageInputWriter{c.gzipWriter(w), &c.imageInputSize, c.emitProgress}
+}
+
 func (c *Config) CreateImageFromOVF(dirname string) error {
-	Debugf("creating ova file from directory: %s", dirname)
+	c.debugf("creating ova file from directory: %s", dirname)
 
-	fis, err := ioutil.ReadDir(dirname)
+	fis, err := readOVFDirectory(c.logger(), dirname, c.Symlinks)
 	if err != nil {
 		return fmt.Errorf("ovf directory (%s): %s", dirname, err)
 	}
-
-	tmpdir, err := c.TempDir()
+	// strict consumers, such as ovftool, require the disks in the order
+	// they are referenced by the descriptor
+	refs, err := readOVFReferences(dirname, fis)
 	if err != nil {
-		return err
+		return fmt.Errorf("ovf directory (%s): %s", dirname, err)
 	}
+	ovfFileOrder(fis, refs)
 
-	c.Image = filepath.Join(tmpdir, "image")
-	image, err := os.OpenFile(c.Image, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	image, err := c.imagePath()
 	if err != nil {
-		return fmt.Errorf("creating image file (%s): %s", c.Image, err)
-	}
-	defer image.Close()
-
-	errorf := func(format string, a ...interface{}) error {
-		image.Close()
-		os.Remove(c.Image)
-		return fmt.Errorf(format, a...)
+		return err
 	}
 
-	Debugf("created temp image file: %s", c.Image)
-
-	// Wrap file f with c.Writer so that writes can be cancelled
-	w := gzip.NewWriter(c.Writer(image))
-	t := time.Now()
-	h := sha1.New()
-	tr := tar.NewWriter(io.MultiWriter(h, w))
+	err = c.createImage(image, func(f io.Writer) error {
+		// Wrap file f with c.Writer so that writes can be cancelled, the
+		// sha1 is of the image as written (like CreateImageFromOVA) not
+		// the tar.
+		t := time.Now()
+		h := c.newImageHash()
+		w := c.imageWriter(c.Writer(io.MultiWriter(h, c.limitImage(f))))
+		tr := tar.NewWriter(w)
+
+		for _, fi := range fis {
+			path := filepath.Join(dirname, fi.Name())
+			if err := c.AddTarFile(tr, path, fi.Name()); err != nil {
+				return fmt.Errorf("adding file (%s) to image (%s) archive: %s",
+					dirname, path, err)
+			}
+		}
 
-	for _, fi := range fis {
-		path := filepath.Join(dirname, fi.Name())
-		if err := c.AddTarFile(tr, path); err != nil {
-			return errorf("adding file (%s) to image (%s) archive: %s",
-				dirname, path, err)
+		if err := tr.Close(); err != nil {
+			return fmt.Errorf("creating ova from directory (%s): %s", dirname, err)
 		}
-	}
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("creating ova from directory (%s): %s", dirname, err)
+		}
+		c.debugf("created image file in: %s", time.Since(t))
 
-	if err := tr.Close(); err != nil {
-		return errorf("creating ova from directory (%s): %s", dirname, err)
-	}
-	if err := w.Close(); err != nil {
-		return errorf("creating ova from directory (%s): %s", dirname, err)
+		c.setImageSums(h)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	Debugf("created image file in: %s", time.Since(t))
-
-	c.Sha1sum = fmt.Sprintf("%x", h.Sum(nil))
-	Debugf("sha1 checksum of image file is: %s", c.Sha1sum)
+	c.Image = image
+	c.debugf("sha1 checksum of image file is: %s", c.Sha1sum)
 
 	return nil
 }
 
 func (c *Config) CreateImageFromOVA(name string) error {
-	Debugf("creating image fime from ova: %s", name)
+	c.debugf("creating image fime from ova: %s", name)
 
-	ova, err := os.Open(name)
+	// a gzip compressed OVA is decompressed and then compressed again, like
+	// an uncompressed OVA, so that the image is always a gzip compressed tar
+	// archive and its sha1 does not depend on how the OVA was compressed.
+	ova, err := openOVA(name)
 	if err != nil {
 		return fmt.Errorf("opening ova file (%s): %s", name, err)
 	}
 	defer ova.Close()
 
-	tmpdir, err := c.TempDir()
+	// the decompressed size of a compressed OVA is not known, and an in
+	// memory image cannot be checkpointed to the WorkDir
+	if fi, err := ova.Stat(); err == nil && !ova.Compressed() && fi.Size() <= c.MemoryImageLimit &&
+		c.WorkDir == "" {
+		return c.createImageInMemory(ova, fi.Size())
+	}
+	if c.StreamImage {
+		return c.measureImage(ova, name)
+	}
+
+	return c.compressImage(ova, name)
+}
+
+// compressImage creates the image by compressing r, read from file name, to
+// a temp file.
+func (c *Config) compressImage(r io.Reader, name string) error {
+	image, err := c.imagePath()
 	if err != nil {
 		return err
 	}
 
-	c.Image = filepath.Join(tmpdir, "image")
-	image, err := os.OpenFile(c.Image, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	err = c.createImage(image, func(f io.Writer) error {
+		c.debugf("compressing (%s) with gzip to image file: %s", name, image)
+
+		h := c.newImageHash()
+		t := time.Now()
+		w := c.imageWriter(c.Writer(io.MultiWriter(h, c.limitImage(f))))
+		if _, err := copyBuffer(w, c.Reader(r)); err != nil {
+			return fmt.Errorf("writing image (%s): %s", image, err)
+		}
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("writing image (%s): %s", image, err)
+		}
+		c.debugf("created image file in: %s", time.Since(t))
+
+		c.setImageSums(h)
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("creating image file (%s): %s", c.Image, err)
+		return err
 	}
-	defer image.Close()
-	Debugf("created temp image file: %s", c.Image)
+	c.Image = image
+	c.debugf("sha1 checksum of image file is: %s", c.Sha1sum)
 
-	Debugf("compressing ova (%s) with gzip to image file: %s", name, c.Image)
+	return nil
+}
 
-	h := sha1.New()
+// createImageInMemory compresses ova, which is size bytes, to c.imageData
+// instead of a temp file.
+func (c *Config) createImageInMemory(ova io.Reader, size int64) error {
+	c.debugf("compressing ova (%d bytes) with gzip to memory", size)
+
+	var image bytes.Buffer
+	image.Grow(int(size / 2))
+	h := c.newImageHash()
 	t := time.Now()
-	w := gzip.NewWriter(c.Writer(io.MultiWriter(h, image)))
-	if _, err := io.Copy(w, ova); err != nil {
-		os.Remove(c.Image)
-		return fmt.Errorf("writing image (%s): %s", c.Image, err)
+	w := c.imageWriter(c.Writer(io.MultiWriter(h, c.limitImage(&image))))
+	if _, err := copyBuffer(w, c.Reader(ova)); err != nil {
+		return fmt.Errorf("writing image: %s", err)
 	}
 	if err := w.Close(); err != nil {
-		os.Remove(c.Image)
-		return fmt.Errorf("writing image (%s): %s", c.Image, err)
+		return fmt.Errorf("writing image: %s", err)
 	}
-	Debugf("created image file in: %s", time.Since(t))
+	c.debugf("created in memory image in: %s", time.Since(t))
 
-	c.Sha1sum = fmt.Sprintf("%x", h.Sum(nil))
-	Debugf("sha1 checksum of image file is: %s", c.Sha1sum)
+	c.imageData = image.Bytes()
+	c.setImageSums(h)
+	c.debugf("sha1 checksum of image is: %s", c.Sha1sum)
 
 	return nil
 }
 
-func (c *Config) WriteManifest() error {
-	const format = `---
-name: bosh-vsphere-esxi-windows-2012R2-go_agent
-version: %s
-sha1: %s
-operating_system: windows2012R2
-cloud_properties:
-  infrastructure: vsphere
-  hypervisor: esxi
-`
+// NewManifest returns the validated manifest of the stemcell for c.Version
+// with the image sha1 c.Sha1sum and, if set, sha256 c.Sha256sum.
+func (c *Config) NewManifest() (*Manifest, error) {
+	m := NewManifest(c.Version, c.Sha1sum, c.osName())
+	m.Sha256 = c.Sha256sum
+	iaas := IaaSes[DefaultIaaS]
+	if c.IaaS != "" {
+		var err error
+		if iaas, err = LookupIaaS(c.IaaS); err != nil {
+			return nil, err
+		}
+	}
+	agent := c.Agent
+	if agent == "" {
+		agent = DefaultAgent
+	}
+	m.Name = lookupOS(c.osName()).ManifestNameIaaS(iaas, agent)
+	m.APIVersion = c.APIVersion
+	if c.NoImageGzip {
+		m.Comment = "experimental: image is not gzip compressed"
+	}
+	layout := c.ManifestLayout
+	if layout == "" {
+		layout = ManifestV1
+	}
+	m.SetLayout(layout)
+	m.SetIaaS(iaas)
+	if err := m.ValidateLayout(layout); err != nil {
+		return nil, err
+	}
+	if m.Version != c.Version {
+		return nil, fmt.Errorf("invalid manifest: version (%s) does not match -version (%s)",
+			m.Version, c.Version)
+	}
 
+	return m, nil
+}
+
+func (c *Config) WriteManifest() error {
 	// programming error - this should never happen...
 	if c.Manifest != "" {
 		panic("already created manifest: " + c.Manifest)
 	}
 
-	tmpdir, err := c.TempDir()
+	if c.Version == "" {
+		panic("WriteManifest: empty version")
+	}
+
+	m, err := c.NewManifest()
 	if err != nil {
 		return err
 	}
 
-	c.Manifest = filepath.Join(tmpdir, "stemcell.MF")
-	f, err := os.OpenFile(c.Manifest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	tmpdir, err := c.TempDir()
 	if err != nil {
-		return fmt.Errorf("creating stemcell.MF (%s): %s", c.Manifest, err)
+		return err
 	}
-	defer f.Close()
-	Debugf("created temp stemcell.MF file: %s", c.Manifest)
 
-	if _, err := fmt.Fprintf(f, format, Version, c.Sha1sum); err != nil {
-		os.Remove(c.Manifest)
-		return fmt.Errorf("writing stemcell.MF (%s): %s", c.Manifest, err)
+	name := filepath.Join(tmpdir, "stemcell.MF")
+	err = c.createFile("stemcell.MF", name, nil, func(w io.Writer) error {
+		if err := c.writeManifest(w, m); err != nil {
+			return fmt.Errorf("writing stemcell.MF (%s): %s", name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	Debugf("wrote stemcell.MF with sha1: %s and version: %s", c.Sha1sum, Version)
+	c.Manifest = name
+	c.debugf("wrote stemcell.MF with sha1: %s and version: %s", c.Sha1sum, c.Version)
 
 	return nil
 }
 
 func ParseFlags() error {
 	flag.Parse()
-	Version = strings.TrimSpace(Version)
-	OvaFile = strings.TrimSpace(OvaFile)
-	OvaFile = strings.TrimSpace(OvaFile)
-	OutputDir = strings.TrimSpace(OutputDir)
+	envVars, err := ApplyEnv(flag.CommandLine, os.LookupEnv)
+	if err != nil {
+		return err
+	}
+	var configSet, configIgnored []string
+	if ConfigFile != "" {
+		name, err := ExpandPath(strings.TrimSpace(ConfigFile))
+		if err != nil {
+			return err
+		}
+		ConfigFile = name
+		configSet, configIgnored, err = ApplyConfigFile(flag.CommandLine, ConfigFile)
+		if err != nil {
+			return err
+		}
+	}
+	StemcellVersion = strings.TrimSpace(StemcellVersion)
+	MinVersion = strings.TrimSpace(MinVersion)
+	OperatingSystem = strings.TrimSpace(OperatingSystem)
+	Agent = strings.TrimSpace(Agent)
+	ManifestLayout = strings.TrimSpace(ManifestLayout)
+	IaaS = strings.TrimSpace(IaaS)
+	OutputName = strings.TrimSpace(OutputName)
+
+	// resolve paths now so that errors and comparisons are consistent
+	for _, p := range []*string{&OvaFile, &OvfDir, &ImageFile, &FromStemcell, &OutputDir, &TmpRoot, &InspectFile,
+		&ManifestTmpl, &LogFilePath, &VerifyFile, &DiffFile, &LintFile, &MatchFile,
+		&VerifyOVAFile, &ExpectManifest, &MetricsFile, &VerifySigKey, &SignKey, &WorkDir} {
+		if p == &OutputDir && strings.TrimSpace(OutputDir) == StdoutOutput {
+			OutputDir = StdoutOutput
+			continue
+		}
+		name, err := ExpandPath(strings.TrimSpace(*p))
+		if err != nil {
+			return err
+		}
+		*p = name
+	}
 
-	if EnableDebug {
-		Debugf = log.New(os.Stderr, "debug: ", 0).Printf
-		Debugf("enabled")
+	colorErrors = EnableColor && UseColor(os.Stderr)
+	var l *StdLogger
+	if LogFilePath != "" {
+		f, err := OpenLogFile(LogFilePath)
+		if err != nil {
+			return err
+		}
+		logFile = f
+		l = NewLogger(f, EnableDebug)
+	} else {
+		l = NewLogger(os.Stderr, EnableDebug)
+		l.SetColor(colorErrors)
+	}
+	Log = l
+	Log.Debugf("enabled")
+	Log.Debugf("recognized environment variables: %s", strings.Join(EnvNames(flag.CommandLine), ", "))
+	for _, key := range envVars {
+		Log.Debugf("set flag from environment variable: %s", key)
+	}
+	if ConfigFile != "" {
+		Log.Debugf("applied config file: %s", ConfigFile)
+	}
+	for _, key := range configIgnored {
+		Log.Debugf("config file: ignoring key (%s) set on the command line", key)
+	}
+	for _, key := range configSet {
+		Log.Debugf("config file: set %s = %s", key, flag.Lookup(key).Value)
 	}
+	warnDeprecatedFlags(flag.CommandLine)
 
-	if err := ValidateInputFlags(OvaFile, OvfDir); err != nil {
-		return err
+	// modes that do not create a stemcell
+	if ShowVersion || InspectFile != "" || VerifyFile != "" || DiffFile != "" || LintFile != "" ||
+		MatchFile != "" || VerifyOVAFile != "" || SelfTestMode || CleanOrphans != 0 ||
+		ListOSMode || ListFormatsMode {
+		return nil
 	}
 
 	if OutputDir == "" || OutputDir == "." {
@@ -553,39 +1636,289 @@ func ParseFlags() error {
 		if err != nil {
 			return fmt.Errorf("getting working directory: %s", err)
 		}
-		Debugf("set output dir (%s) to working directory: %s", OutputDir, wd)
+		Log.Debugf("set output dir (%s) to working directory: %s", OutputDir, wd)
 		OutputDir = wd
 	}
 
+	applyOVFMetadata()
 	return nil
 }
 
+// applyOVFMetadata sets the -version and -os flags, if they were not
+// provided, from the ProductSection and OperatingSystemSection of the input
+// OVF descriptor.  Values that are missing or invalid are ignored and left
+// to flag validation.
+func applyOVFMetadata() {
+	osSet := false
+	flag.Visit(func(f *flag.Flag) { osSet = osSet || f.Name == "os" })
+	if StemcellVersion != "" && osSet {
+		return
+	}
+	input := OvaFile
+	if OvfDir != "" {
+		input = OvfDir
+	}
+	if input == "" {
+		return
+	}
+	m, err := ReadOVFMetadata(input)
+	if err != nil {
+		Log.Debugf("reading ovf metadata: %s", err)
+		return
+	}
+	if StemcellVersion == "" && m.Version != "" {
+		if err := ValidateVersion(m.Version); err != nil {
+			Log.Warnf("ignoring ovf ProductSection version: %s", err)
+		} else {
+			Log.Infof("using version from ovf ProductSection: %s", m.Version)
+			StemcellVersion = m.Version
+		}
+	}
+	if !osSet {
+		name, err := m.OS()
+		if err != nil {
+			Log.Debugf("%s, using -os default: %s", err, OperatingSystem)
+		} else {
+			Log.Infof("using operating system from ovf OperatingSystemSection: %s", name)
+			OperatingSystem = name
+		}
+	}
+}
+
+// flagConfig returns the Config set by the flags.  Flags that fail to parse
+// are left unset, see ValidateFlags.
+func flagConfig() *Config {
+	checksums, _ := ParseChecksumAlgorithms(EmitChecksum)
+	imageChecksums, _ := ParseImageChecksums(ImageChecksum)
+	var manifestTemplate *template.Template
+	if ManifestTmpl != "" {
+		manifestTemplate, _ = LoadManifestTemplate(ManifestTmpl)
+	}
+	stepTimeouts, _ := ParseStepTimeouts(StepTimeouts)
+	allowDevices, _ := ParseOVFDevices(AllowDevices)
+
+	c := &Config{
+		OS:               OperatingSystem,
+		Agent:            Agent,
+		APIVersion:       APIVersion,
+		IaaS:             IaaS,
+		ManifestLayout:   ManifestLayout,
+		ManifestTemplate: manifestTemplate,
+		MemoryImageLimit: MemoryLimit,
+		StreamImage:      StreamImage,
+		MaxImageSize:     MaxImageSize,
+		TmpRoot:          TmpRoot,
+		WorkDir:          WorkDir,
+		NoImageGzip:      NoImageGzip,
+		GzipThreads:      gzipThreads(GzipThreads),
+		IORetries:        IORetries,
+		Lock:             LockOutput,
+		MetricsFile:      MetricsFile,
+		SignKey:          SignKey,
+		DrainSize:        DefaultDrainSize,
+		EmbedBuildInfo:   EmbedBuildInfo,
+		BuildID:          BuildID,
+		ExtraFiles:       IncludeFiles,
+		OVAFile:          OvaFile,
+		OVFDir:           OvfDir,
+		ImageFile:        ImageFile,
+		FromStemcell:     FromStemcell,
+		OutputDir:        OutputDir,
+		OutputName:       OutputName,
+		Unpacked:         Unpacked,
+		Force:            Force,
+		StrictOrder:      StrictOrder,
+		StrictNames:      StrictNames,
+		AllowDevices:     allowDevices,
+		Symlinks:         OVFSymlinks,
+		NamePolicy:       OVFNames,
+		DiskSpaceFactor:  DiskSpaceFactor,
+		Checksums:        checksums,
+		ImageChecksums:   imageChecksums,
+		VerifyOutput:     VerifyOutput,
+		TrustInputs:      TrustInputs,
+		Timeout:          Timeout,
+		StepTimeouts:     stepTimeouts,
+		stop:             make(chan struct{}),
+	}
+	if OutputDir == StdoutOutput {
+		c.OutputDir = ""
+		c.Output = os.Stdout
+	}
+	return c
+}
+
 func main() {
 	if err := ParseFlags(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		PrintError(err)
 		Usage()
 	}
 
-	if err := ValidateVersion(Version); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		Usage()
+	if ShowVersion {
+		fmt.Println(ToolVersion())
+		return
 	}
-	if err := ValidateOutputDir(OutputDir); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		Usage()
+
+	if InspectFile != "" {
+		if err := InspectOVA(os.Stdout, InspectFile); err != nil {
+			PrintError(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if LintFile != "" {
+		if err := LintMode(os.Stdout, LintFile); err != nil {
+			PrintError(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if VerifyOVAFile != "" {
+		if err := VerifyOVAMode(os.Stdout, VerifyOVAFile); err != nil {
+			PrintError(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if MatchFile != "" {
+		if err := MatchStemcellImage(os.Stdout, MatchFile, TmpRoot); err != nil {
+			PrintError(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if DiffFile != "" {
+		ignore, err := ParseManifestFields(ExpectIgnore)
+		if err != nil {
+			PrintError(err)
+			Usage()
+		}
+		other, err := diffArgs(flag.Args())
+		if err != nil {
+			PrintError(err)
+			Usage()
+		}
+		if err := DiffMode(os.Stdout, DiffFile, other, ignore); err != nil {
+			PrintError(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if VerifyFile != "" {
+		ignore, err := ParseManifestFields(ExpectIgnore)
+		if err != nil {
+			PrintError(err)
+			Usage()
+		}
+		var extra []string
+		for _, e := range IncludeFiles {
+			extra = append(extra, e.Name)
+		}
+		if err := VerifyMode(os.Stdout, VerifyFile, ExpectManifest, VerifySigKey, ignore, extra); err != nil {
+			PrintError(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if ListOSMode || ListFormatsMode {
+		if ListOSMode {
+			if err := ListOS(os.Stdout); err != nil {
+				PrintError(err)
+				os.Exit(1)
+			}
+		}
+		if ListFormatsMode {
+			if err := ListFormats(os.Stdout); err != nil {
+				PrintError(err)
+				os.Exit(1)
+			}
+		}
+		return
+	}
+
+	if SelfTestMode {
+		if err := SelfTest(os.Stdout, TmpRoot); err != nil {
+			PrintError(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if CleanOrphans != 0 {
+		if CleanOrphans < 0 {
+			PrintError(fmt.Errorf("invalid clean orphans age (%s): must be positive", CleanOrphans))
+			Usage()
+		}
+		if err := CleanOrphanTempDirs(os.Stdout, TmpRoot, CleanOrphans); err != nil {
+			PrintError(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	errs := ValidateFlags()
+	if ValidateMode {
+		if err := ValidateReport(os.Stdout, flagConfig(), errs); err != nil {
+			PrintError(err)
+			os.Exit(1)
+		}
+		return
 	}
-	if err := ValidateStemcellFilename(OutputDir, Version); err != nil {
-		fmt.Fprintln(os.Stderr, err)
+	for _, e := range errs {
+		if e.Fatal() {
+			PrintError(e)
+		} else {
+			Log.Warnf("%s", e.Message)
+		}
+	}
+	if HasFatal(errs) {
 		Usage()
 	}
+	versions := SplitVersions(StemcellVersion)
+	c := flagConfig()
+	if EventsOutput {
+		c.Events = NewEventWriter(os.Stdout)
+	}
 
-	start := time.Now()
-	c := Config{stop: make(chan struct{})}
+	if PrintManifest {
+		if err := c.ValidateInput(); err != nil {
+			PrintError(err)
+			os.Exit(1)
+		}
+		if err := c.PrintManifests(os.Stdout, versions); err != nil {
+			PrintError(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// reopen the log file, instead of stopping, when it is rotated
+	interrupts := InterruptSignals()
+	if logFile != nil {
+		interrupts = withoutSignal(interrupts, LogReopenSignal)
+		go func() {
+			ch := make(chan os.Signal, 1)
+			signal.Notify(ch, LogReopenSignal)
+			for sig := range ch {
+				if err := logFile.Reopen(); err != nil {
+					PrintError(err)
+					continue
+				}
+				Log.Debugf("received (%s) signal reopened log file: %s", sig, LogFilePath)
+			}
+		}()
+	}
 
 	// cleanup if interupted
 	go func() {
 		ch := make(chan os.Signal, 64)
-		signal.Notify(ch)
+		signal.Notify(ch, interrupts...)
 		stopping := false
 		for sig := range ch {
 			if stopping {
@@ -600,42 +1933,330 @@ func main() {
 
 	// cleanup on error
 	exit := func(err error) {
-		fmt.Fprintln(os.Stderr, err)
+		PrintError(err)
 		c.Cleanup()
 		os.Exit(1)
 	}
 
-	if OvfDir != "" {
-		if err := ValidateOVFDirectory(OvfDir); err != nil {
-			exit(err)
-		}
-		if err := c.CreateImageFromOVF(OvfDir); err != nil {
+	start := time.Now()
+	results, err := realMain(c, versions)
+	if err != nil {
+		exit(err)
+	}
+	if JSONOutput {
+		if err := WriteJSON(os.Stdout, results, c.Timings, time.Since(start)); err != nil {
 			exit(err)
 		}
-	} else {
-		if err := ValidateOVAFile(OvaFile); err != nil {
-			exit(err)
+	} else if c.Output == nil && c.Events == nil {
+		for _, r := range results {
+			// the format of these lines is documented in UsageMessage
+			if r.Unpacked {
+				fmt.Printf("created unpacked stemcell: %s (version %s)\n", r.StemcellPath,
+					r.Version)
+			} else {
+				fmt.Printf("created stemcell: %s (version %s, sha1 %s)\n", r.StemcellPath,
+					r.Version, r.TarballSha1)
+			}
 		}
-		if err := c.CreateImageFromOVA(OvaFile); err != nil {
+	}
+	if SummaryFile != "" {
+		if err := WriteSummaryFile(SummaryFile, c.Steps); err != nil {
 			exit(err)
 		}
 	}
 
-	if err := c.WriteManifest(); err != nil {
-		exit(err)
+	c.Cleanup()
+}
+
+// A BuildResult describes a stemcell created by realMain.
+type BuildResult struct {
+	StemcellPath    string // tarball, or directory if Unpacked
+	Version         string
+	OperatingSystem string
+	ImageSha1       string // sha1 of the image, as written to the manifest
+	ImageSize       int64  // size of the image entry of the stemcell
+	TarballSha1     string // sha1 of the stemcell tarball, empty if Unpacked
+	TarballSha256   string // sha256 of the stemcell tarball, empty if Unpacked
+	Unpacked        bool
+	Duration        time.Duration // time since the build started
+}
+
+// realMain creates a stemcell for each of versions from the input OVA or OVF
+// directory of c, and returns a BuildResult for each stemcell.  The options of
+// c must have already been validated, see ValidateFlags.  Only c is modified,
+// so different Configs may be built concurrently.  Temp files are not removed, the caller
+// is responsible for calling c.Cleanup.  On error the returned results are
+// nil.
+//
+// If c.Timeout, or the timeout of a step, expires c is stopped and a
+// *TimeoutError naming the step that was running is returned.
+//
+// If c.MetricsFile is set the Metrics of the build are written to it when it
+// ends, even if it fails.
+//
+// If c.Lock is set the lock file of each stemcell is held while it is built,
+// if another build holds one an error is returned and nothing is built.
+//
+// If c.WorkDir is set the image is checkpointed to it, and reused by a
+// restarted build of the same input, the checkpoint is removed once the
+// build succeeds, see Config.createImage.
+//
+// If c.Events is set the progress of the build is written to it, the last
+// event is EventFinished or EventFailed.
+func realMain(c *Config, versions []string) (results []*BuildResult, err error) {
+	start := time.Now()
+	if c.MetricsFile != "" {
+		defer func() { c.writeMetricsFile(versions, results, err, start) }()
 	}
-	if err := c.CreateStemcell(); err != nil {
-		exit(err)
+	c.emit(Event{Type: EventStarted, Path: c.input(), Version: strings.Join(versions, ",")})
+	c.startTimers()
+	if c.Lock {
+		err = c.lock(versions)
+	}
+	if err == nil {
+		results, err = buildStemcells(c, versions)
+		c.unlock()
+	}
+	c.stopTimers()
+	err = c.timeoutError(err)
+	c.emitFinished(err, start)
+	if err != nil {
+		return nil, err
 	}
+	return results, nil
+}
 
-	stemcellPath := filepath.Join(OutputDir, filepath.Base(c.Stemcell))
-	Debugf("moving stemcell (%s) to: %s", c.Stemcell, stemcellPath)
+// ValidateInput validates the input OVA file, OVF directory, image file or
+// stemcell of c.  If AllowDevices is set the devices of the OVF are checked,
+// see CheckOVFDevices.
+func (c *Config) ValidateInput() error {
+	var err error
+	switch {
+	case c.OVFDir != "":
+		err = ValidateOVFDirectory(c.logger(), c.OVFDir, c.StrictNames, c.Symlinks, c.namePolicy())
+	case c.ImageFile != "":
+		c.debugf("validating image file: %s", c.ImageFile)
+		return ValidateImageFile(c.ImageFile)
+	case c.FromStemcell != "":
+		c.debugf("validating stemcell file: %s", c.FromStemcell)
+		return ValidateStemcellFile(c.FromStemcell)
+	default:
+		err = ValidateOVAFile(c.logger(), c.OVAFile, c.StrictOrder, c.StrictNames, c.namePolicy())
+	}
+	if err != nil || c.AllowDevices == nil {
+		return err
+	}
+	m, err := ReadOVFMetadata(c.input())
+	if err != nil {
+		return err
+	}
+	if err := CheckOVFDevices(m, c.AllowDevices); err != nil {
+		return fmt.Errorf("ovf (%s): %s", c.input(), err)
+	}
+	return nil
+}
 
-	if err := os.Rename(c.Stemcell, stemcellPath); err != nil {
-		exit(err)
+// namePolicy returns the OVFNamePolicy of c, the default if c.NamePolicy is
+// invalid.
+func (c *Config) namePolicy() *OVFNamePolicy {
+	if p, err := LookupOVFNamePolicy(c.NamePolicy); err == nil {
+		return p
+	}
+	return DefaultOVFNamePolicy
+}
+
+// input returns the input OVA file, OVF directory, image file or stemcell of
+// c.
+func (c *Config) input() string {
+	switch {
+	case c.OVFDir != "":
+		return c.OVFDir
+	case c.ImageFile != "":
+		return c.ImageFile
+	case c.FromStemcell != "":
+		return c.FromStemcell
+	}
+	return c.OVAFile
+}
+
+func buildStemcells(c *Config, versions []string) ([]*BuildResult, error) {
+	start := time.Now()
+	c.tmpLabel = strings.Join(versions, "_")
+
+	if err := c.startStep("validate"); err != nil {
+		return nil, err
+	}
+	if err := c.ValidateInput(); err != nil {
+		return nil, err
 	}
+	// the key signs every version, load it once
+	var signKey ed25519.PrivateKey
+	if c.SignKey != "" {
+		var err error
+		if signKey, err = LoadSigningKey(c.SignKey); err != nil {
+			return nil, err
+		}
+	}
+	// fail now rather than after spending minutes compressing the image
+	size, err := InputSize(c.input(), c.ExtraFiles)
+	if err != nil {
+		return nil, err
+	}
+	c.inputSize = size
+	if err := CheckDiskSpace(c.logger(), c.TmpRoot, size, c.DiskSpaceFactor); err != nil {
+		return nil, err
+	}
+
+	if err := c.startStep("image"); err != nil {
+		return nil, err
+	}
+	err = c.retryIO("image", func() error {
+		switch {
+		case c.OVFDir != "":
+			return c.CreateImageFromOVF(c.OVFDir)
+		case c.ImageFile != "":
+			return c.CreateImageFromFile(c.ImageFile)
+		case c.FromStemcell != "":
+			return c.CreateImageFromStemcell(c.FromStemcell)
+		}
+		return c.CreateImageFromOVA(c.OVAFile)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.recordStep("image", c.Image, c.Sha1sum, start); err != nil {
+		return nil, err
+	}
+	if err := c.runHook("image", c.OnImageCreated, c.Image); err != nil {
+		return nil, err
+	}
+
+	// the image is shared, only the manifest and stemcell differ per version
+	var results []*BuildResult
+	for _, version := range versions {
+		c.Version = version
+		t := time.Now()
+		if err := c.startStep("manifest"); err != nil {
+			return nil, err
+		}
+		if err := c.WriteManifest(); err != nil {
+			return nil, err
+		}
+		if c.EmbedBuildInfo {
+			if err := c.writeBuildInfo(); err != nil {
+				return nil, err
+			}
+		}
+		if err := c.recordStep("manifest", c.Manifest, "", t); err != nil {
+			return nil, err
+		}
+		if err := c.runHook("manifest", c.OnManifestWritten, c.Manifest); err != nil {
+			return nil, err
+		}
 
-	Debugf("created stemcell (%s) in: %s", stemcellPath, time.Since(start))
+		stemcellPath := StdoutOutput
+		if c.Output == nil {
+			stemcellPath = StemcellPath(c.OutputDir, c.OutputName, version, c.osName(), c.Unpacked)
+			if err := ValidateFilenameVersion(filepath.Base(stemcellPath), version); err != nil {
+				return nil, err
+			}
+		}
+		t = time.Now()
+		if err := c.startStep("stemcell"); err != nil {
+			return nil, err
+		}
+		if c.Output != nil {
+			if err := c.writeStemcellOutput(t); err != nil {
+				return nil, err
+			}
+			c.debugf("wrote stemcell to stdout in: %s", time.Since(start))
+		} else if c.Unpacked {
+			if err := c.WriteUnpacked(stemcellPath, c.Force); err != nil {
+				return nil, err
+			}
+			c.debugf("created unpacked stemcell (%s) in: %s", stemcellPath, time.Since(start))
+			if err := c.recordStep("stemcell", stemcellPath, "", t); err != nil {
+				return nil, err
+			}
+			if err := c.runHook("stemcell", c.OnStemcellCreated, stemcellPath); err != nil {
+				os.RemoveAll(stemcellPath)
+				return nil, err
+			}
+		} else {
+			if err := c.retryIO("stemcell", c.CreateStemcell); err != nil {
+				return nil, err
+			}
+			c.debugf("moving stemcell (%s) to: %s", c.Stemcell, stemcellPath)
+
+			if err := MoveFile(c.logger(), c.Stemcell, stemcellPath, c.Force); err != nil {
+				return nil, err
+			}
 
-	fmt.Println("created stemell:", stemcellPath)
+			if c.VerifyOutput && c.TrustInputs {
+				c.debugf("trusted inputs: not verifying stemcell: %s", stemcellPath)
+			}
+			if c.VerifyOutput && !c.TrustInputs {
+				c.debugf("verifying stemcell: %s", stemcellPath)
+				var extra []string
+				for _, e := range c.ExtraFiles {
+					extra = append(extra, e.Name)
+				}
+				if _, err := VerifyStemcellFile(stemcellPath, version, extra); err != nil {
+					os.Remove(stemcellPath)
+					return nil, err
+				}
+			}
+
+			c.debugf("created stemcell (%s) in: %s", stemcellPath, time.Since(start))
+			if err := c.recordStep("stemcell", stemcellPath, c.StemcellSha1sum, t); err != nil {
+				return nil, err
+			}
+			if err := c.runHook("stemcell", c.OnStemcellCreated, stemcellPath); err != nil {
+				os.Remove(stemcellPath)
+				return nil, err
+			}
+
+			for _, alg := range c.Checksums {
+				digest := c.StemcellSha1sum
+				if alg == "sha256" {
+					digest = c.StemcellSha256sum
+				}
+				name, err := WriteChecksumFile(stemcellPath, alg, digest)
+				if err != nil {
+					return nil, err
+				}
+				c.debugf("wrote %s checksum file: %s", alg, name)
+			}
+			if signKey != nil {
+				name, err := WriteSignatureFile(stemcellPath, signKey, c.stemcellSha512)
+				if err != nil {
+					return nil, err
+				}
+				c.debugf("wrote signature file: %s", name)
+			}
+		}
+
+		if err := os.Remove(c.Manifest); err != nil {
+			return nil, err
+		}
+		c.Manifest = ""
+
+		r := &BuildResult{
+			StemcellPath:    stemcellPath,
+			Version:         version,
+			OperatingSystem: c.osName(),
+			ImageSha1:       c.Sha1sum,
+			ImageSize:       c.ImageSize,
+			Unpacked:        c.Unpacked && c.Output == nil,
+			Duration:        time.Since(start),
+		}
+		if !r.Unpacked {
+			r.TarballSha1 = c.StemcellSha1sum
+			r.TarballSha256 = c.StemcellSha256sum
+		}
+		results = append(results, r)
+		c.emit(Event{Type: EventStemcellCreated, Version: version, Path: stemcellPath, Sha1: r.TarballSha1})
+	}
+	c.removeCheckpoint()
+	return results, nil
 }
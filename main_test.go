@@ -1,9 +1,23 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var versionTests = []struct {
@@ -48,3 +62,1010 @@ func TestValidateOutputDir(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestValidateReadOnlyDir(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("directory permissions do not apply to root")
+	}
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0755)
+
+	if err := ValidateOutputDir(dir); err == nil || !strings.Contains(err.Error(), "not writable") {
+		t.Errorf("ValidateOutputDir: expected not writable error got: %v", err)
+	}
+	if err := ValidateTmpRoot(dir); err == nil || !strings.Contains(err.Error(), "not writable") {
+		t.Errorf("ValidateTmpRoot: expected not writable error got: %v", err)
+	}
+}
+
+var outputFilenameTests = []struct {
+	name, version, exp string
+}{
+	{"", "1.2", StemcellFilename("1.2", DefaultOS)},
+	{"stemcell.tgz", "1.2", "stemcell.tgz"},
+	{"stemcell-%s.tgz", "1.2", "stemcell-1.2.tgz"},
+	{"stemcell-{version}.tgz", "1.2", "stemcell-1.2.tgz"},
+}
+
+func TestOutputFilename(t *testing.T) {
+	for _, x := range outputFilenameTests {
+		if s := OutputFilename(x.name, x.version, DefaultOS); s != x.exp {
+			t.Errorf("OutputFilename(%q, %q): got %q want %q", x.name, x.version, s, x.exp)
+		}
+	}
+	for _, s := range []string{"a/b.tgz", ".", ".."} {
+		if err := ValidateOutputName(s); err == nil {
+			t.Errorf("ValidateOutputName(%q): expected error", s)
+		}
+	}
+}
+
+func TestParseStemcellFilename(t *testing.T) {
+	tests := []struct {
+		name, version, os string
+		ok                bool
+	}{
+		{StemcellFilename("1.2", DefaultOS), "1.2", DefaultOS, true},
+		{StemcellFilename("1200.15", "ubuntu-xenial"), "1200.15", "ubuntu-xenial", true},
+		{UnpackedDirname(StemcellFilename("1.2", DefaultOS)), "1.2", DefaultOS, true},
+		{"bosh-stemcell-1.2-vsphere-esxi--go_agent.tgz", "", "", false},
+		{"bosh-stemcell-latest-vsphere-esxi-windows2012R2-go_agent.tgz", "", "", false},
+		{"bosh-stemcell-1.2-aws-xen-windows2012R2-go_agent.tgz", "", "", false},
+		{"stemcell-1.2.tgz", "", "", false},
+	}
+	for _, x := range tests {
+		version, osName, ok := ParseStemcellFilename(x.name)
+		if version != x.version || osName != x.os || ok != x.ok {
+			t.Errorf("ParseStemcellFilename(%q): got %q, %q, %t want %q, %q, %t",
+				x.name, version, osName, ok, x.version, x.os, x.ok)
+		}
+	}
+
+	if err := ValidateFilenameVersion(StemcellFilename("1.2", DefaultOS), "1.2"); err != nil {
+		t.Error(err)
+	}
+	if err := ValidateFilenameVersion(StemcellFilename("1.2", DefaultOS), "1.3"); err == nil {
+		t.Error("ValidateFilenameVersion: expected error for mismatched version")
+	}
+	if err := ValidateFilenameVersion("stemcell.tgz", "1.3"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateOVAFileTarFormats(t *testing.T) {
+	names, err := filepath.Glob("testdata/tar/*.ova")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) == 0 {
+		t.Fatal("no test ova files found in: testdata/tar")
+	}
+	for _, name := range names {
+		if err := ValidateOVAFile(DiscardLogger, name, false, false, nil); err != nil {
+			t.Errorf("ValidateOVAFile (%s): %s", name, err)
+		}
+	}
+}
+
+func TestValidateOVAFileEntryTypes(t *testing.T) {
+	for name, exp := range map[string]string{
+		"testdata/invalid/dir-entry.ova":     "contains a directory (disks/)",
+		"testdata/invalid/symlink-entry.ova": "contains a link (vm-disk1.vmdk -> disks/vm-disk1.vmdk)",
+	} {
+		err := ValidateOVAFile(DiscardLogger, name, false, false, nil)
+		if err == nil {
+			t.Errorf("ValidateOVAFile (%s): expected error", name)
+			continue
+		}
+		if !strings.Contains(err.Error(), exp) {
+			t.Errorf("ValidateOVAFile (%s): error %q does not contain: %q", name, err, exp)
+		}
+	}
+}
+
+func TestValidateOVFNames(t *testing.T) {
+	// a custom policy that requires a manifest
+	mf := &OVFNamePolicy{
+		Required: []string{".ovf", ".mf"},
+		Max:      map[string]int{".ovf": 1, ".mf": 1, ".vmdk": 2},
+	}
+	tests := []struct {
+		policy *OVFNamePolicy
+		names  []string
+		err    string
+	}{
+		{DefaultOVFNamePolicy, []string{"vm.ovf", "vm-disk1.vmdk"}, ""},
+		{DefaultOVFNamePolicy, []string{"vm.ovf", "vm.mf", "vm.cert", "vm.nvram", "a.vmdk", "b.vmdk"}, ""},
+		{DefaultOVFNamePolicy, []string{"vm-disk1.vmdk"}, "missing .ovf file (one is required)"},
+		{DefaultOVFNamePolicy, []string{"a.ovf", "b.ovf"}, "multiple .ovf files (expected one): a.ovf, b.ovf"},
+		{DefaultOVFNamePolicy, []string{"vm.ovf", "a.mf", "b.mf"}, "multiple .mf files (expected one or zero)"},
+		{DefaultOVFNamePolicy, []string{"vm.ovf", "a.cert", "b.cert"}, "multiple .cert files (expected one or zero)"},
+		{OVFNamePolicies["strict"], []string{"vm.ovf", "vm-disk1.vmdk"}, "missing .mf file (one is required)"},
+		{OVFNamePolicies["strict"], []string{"vm.ovf", "vm.mf", "vm-disk1.vmdk"}, ""},
+		{OVFNamePolicies["lenient"], []string{"vm.ovf", "a.mf", "b.mf", "a.cert", "b.cert"}, ""},
+		{OVFNamePolicies["lenient"], []string{"a.ovf", "b.ovf"}, "multiple .ovf files"},
+		{mf, []string{"vm.ovf", "a.vmdk", "b.vmdk"}, "missing .mf file (one is required)"},
+		{mf, []string{"vm.ovf", "vm.mf", "a.vmdk", "b.vmdk"}, ""},
+		{mf, []string{"vm.ovf", "vm.mf", "a.vmdk", "b.vmdk", "c.vmdk"},
+			"too many .vmdk files (expected at most 2): a.vmdk, b.vmdk, c.vmdk"},
+	}
+	for i, x := range tests {
+		err := x.policy.Validate(x.names)
+		if x.err == "" {
+			if err != nil {
+				t.Errorf("%d: Validate(%q): %s", i, x.names, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), x.err) {
+			t.Errorf("%d: Validate(%q): got error %v want: %q", i, x.names, err, x.err)
+		}
+	}
+
+	// the test OVAs have a manifest
+	ova := "testdata/tar/gnu-longname.ova"
+	if err := ValidateOVAFile(DiscardLogger, ova, false, false, mf); err != nil {
+		t.Errorf("ValidateOVAFile (%s): %s", ova, err)
+	}
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova = createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+	if err := ValidateOVAFile(DiscardLogger, ova, false, false, nil); err != nil {
+		t.Errorf("ValidateOVAFile (%s): %s", ova, err)
+	}
+	if err := ValidateOVAFile(DiscardLogger, ova, false, false, OVFNamePolicies["strict"]); err == nil {
+		t.Errorf("ValidateOVAFile (%s): expected error for missing .mf file", ova)
+	}
+	if _, err := LookupOVFNamePolicy("loose"); err == nil {
+		t.Error("LookupOVFNamePolicy: expected error for unknown policy")
+	}
+}
+
+func TestValidateOVFBasenames(t *testing.T) {
+	tests := []struct {
+		names []string
+		ok    bool
+	}{
+		{[]string{"vm.ovf", "vm-disk1.vmdk"}, true},
+		{[]string{"vm.ovf", "vm.mf", "vm.cert", "vm-disk1.vmdk"}, true},
+		{[]string{"vm.ovf", "other.mf", "vm-disk1.vmdk"}, false},
+		{[]string{"vm.ovf", "vm.mf", "signed.cert", "vm-disk1.vmdk"}, false},
+		{[]string{"vm.ovf", "vm.ovf.mf", "vm-disk1.vmdk"}, false},
+	}
+	for _, x := range tests {
+		if err := ValidateOVFBasenames(x.names); (err == nil) != x.ok {
+			t.Errorf("ValidateOVFBasenames(%q): got error %v want ok %t", x.names, err, x.ok)
+		}
+	}
+
+	for name, exp := range map[string]string{
+		"testdata/invalid/mf-basename.ova":   ".mf file (other.mf) does not have the base name of the .ovf file: vm.mf",
+		"testdata/invalid/cert-basename.ova": ".cert file (signed.cert) does not have the base name of the .ovf file: vm.cert",
+	} {
+		if err := ValidateOVAFile(DiscardLogger, name, false, false, nil); err != nil {
+			t.Errorf("ValidateOVAFile (%s): mismatched names should only warn: %s", name, err)
+		}
+		err := ValidateOVAFile(DiscardLogger, name, false, true, nil)
+		if err == nil || !strings.Contains(err.Error(), exp) {
+			t.Errorf("ValidateOVAFile (%s): got error %v want: %q", name, err, exp)
+		}
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"vm.ovf", "other.mf", "vm-disk1.vmdk"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ValidateOVFDirectory(DiscardLogger, dir, false, "", nil); err != nil {
+		t.Errorf("ValidateOVFDirectory: mismatched names should only warn: %s", err)
+	}
+	if err := ValidateOVFDirectory(DiscardLogger, dir, true, "", nil); err == nil {
+		t.Error("ValidateOVFDirectory: expected error for mismatched names")
+	}
+}
+
+func TestCleanTarName(t *testing.T) {
+	for in, exp := range map[string]string{
+		"vm.ovf":     "vm.ovf",
+		"./vm.ovf":   "vm.ovf",
+		"././vm.ovf": "vm.ovf",
+		"./":         "",
+		".":          "",
+	} {
+		if s := cleanTarName(in); s != exp {
+			t.Errorf("cleanTarName(%q): got %q want %q", in, s, exp)
+		}
+	}
+}
+
+func TestValidateVersions(t *testing.T) {
+	if v := SplitVersions(" 1.2, 1.3,,"); len(v) != 2 || v[0] != "1.2" || v[1] != "1.3" {
+		t.Errorf("SplitVersions: got %q", v)
+	}
+	if err := ValidateVersions([]string{"1.2", "1.3"}, "", DefaultOS); err != nil {
+		t.Error(err)
+	}
+	if err := ValidateVersions([]string{"1.2", "1.2"}, "", DefaultOS); err == nil {
+		t.Error("ValidateVersions: expected error for duplicate versions")
+	}
+	if err := ValidateVersions([]string{"1.2", "1.3"}, "stemcell.tgz", DefaultOS); err == nil {
+		t.Error("ValidateVersions: expected error for colliding output names")
+	}
+	if err := ValidateVersions(nil, "", DefaultOS); err == nil {
+		t.Error("ValidateVersions: expected error for no versions")
+	}
+}
+
+// newTestConfig returns a Config with an image created from a small OVA
+// and a manifest for version 1.2.
+func newTestConfig(t testing.TB, dir string) *Config {
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+	c := &Config{Version: "1.2", Logger: DiscardLogger, stop: make(chan struct{})}
+	if err := c.CreateImageFromOVA(ova); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteManifest(); err != nil {
+		c.Cleanup()
+		t.Fatal(err)
+	}
+	return c
+}
+
+// readStemcell returns the contents of the files in stemcell tarball r.
+func readStemcell(t testing.TB, r io.Reader) (names []string, files map[string][]byte) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = make(map[string][]byte)
+	tr := tar.NewReader(gr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Name)
+		files[h.Name] = b
+	}
+	return names, files
+}
+
+func TestCreateStemcellTo(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c := newTestConfig(t, dir)
+	defer c.Cleanup()
+
+	var b bytes.Buffer
+	if err := c.CreateStemcellTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if sum := fmt.Sprintf("%x", sha1.Sum(b.Bytes())); sum != c.StemcellSha1sum {
+		t.Errorf("StemcellSha1sum: got %s want %s", c.StemcellSha1sum, sum)
+	}
+	names, _ := readStemcell(t, &b)
+	if len(names) != 2 || names[0] != "image" || names[1] != "stemcell.MF" {
+		t.Errorf("CreateStemcellTo: unexpected tarball entries: %q", names)
+	}
+}
+
+// flushErrorWriter is a Writer that fails all but the first n writes.
+type flushErrorWriter struct {
+	w io.Writer
+	n int
+}
+
+func (w *flushErrorWriter) Write(p []byte) (int, error) {
+	if w.n <= 0 {
+		return 0, errors.New("flush error")
+	}
+	w.n--
+	return w.w.Write(p)
+}
+
+func TestCreateFileCloseError(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c := newTestConfig(t, dir)
+	defer c.Cleanup()
+
+	tests := map[string]func(w io.Writer) error{
+		// the gzip header is written immediately, the small tarball is
+		// buffered until the gzip writer is closed
+		"flush": func(w io.Writer) error {
+			return c.CreateStemcellTo(&flushErrorWriter{w: w, n: 1})
+		},
+		// the file is closed before createFile closes it
+		"close": func(w io.Writer) error {
+			if err := c.CreateStemcellTo(w); err != nil {
+				return err
+			}
+			return w.(*os.File).Close()
+		},
+	}
+	for name, write := range tests {
+		stemcell := filepath.Join(dir, name+".tgz")
+		if err := c.createFile("stemcell", stemcell, nil, write); err == nil {
+			t.Errorf("%s: createFile: expected error", name)
+		}
+		if _, err := os.Stat(stemcell); !os.IsNotExist(err) {
+			t.Errorf("%s: createFile: partial stemcell not removed: %v", name, err)
+		}
+	}
+}
+
+func TestTarFileHeaderLarge(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// sparse file, larger than the 8GB USTAR limit
+	const size = 9 << 30
+	name := filepath.Join(dir, "image")
+	if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(name, size); err != nil {
+		t.Skipf("creating sparse file: %s", err)
+	}
+	mtime := time.Unix(1500000000, 123456789)
+	if err := os.Chtimes(name, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, err := tarFileHeader(fi, "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := tar.NewWriter(&b).WriteHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	h, err := tar.NewReader(&b).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Name != "image" || h.Size != size {
+		t.Errorf("tarFileHeader: got name %q size %d want %q %d", h.Name, h.Size, "image", size)
+	}
+	if !h.ModTime.Equal(mtime) {
+		t.Errorf("tarFileHeader: got mtime %s want %s", h.ModTime, mtime)
+	}
+	if !h.AccessTime.IsZero() || !h.ChangeTime.IsZero() {
+		t.Errorf("tarFileHeader: access (%s) and change (%s) times should not be recorded",
+			h.AccessTime, h.ChangeTime)
+	}
+}
+
+func TestTarHeaderTemplate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	data := []byte("image data")
+	name := filepath.Join(dir, "image")
+	if err := ioutil.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{stop: make(chan struct{})}
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	if err := c.AddTarFile(tw, name, "image"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.addTarBytes(tw, "image", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the entry does not depend on whether the image is a file or in memory
+	var hdrs []*tar.Header
+	tr := tar.NewReader(&b)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.ModTime, h.PAXRecords = time.Time{}, nil
+		hdrs = append(hdrs, h)
+	}
+	if len(hdrs) != 2 {
+		t.Fatalf("expected 2 entries got: %d", len(hdrs))
+	}
+	if !reflect.DeepEqual(hdrs[0], hdrs[1]) {
+		t.Errorf("headers differ:\nfile:   %+v\nmemory: %+v", hdrs[0], hdrs[1])
+	}
+	if h := hdrs[0]; h.Mode != 0644 || h.Uid != 0 || h.Gid != 0 || h.Uname != "" || h.Gname != "" {
+		t.Errorf("header: got mode %o uid %d gid %d uname %q gname %q", h.Mode, h.Uid, h.Gid,
+			h.Uname, h.Gname)
+	}
+}
+
+func TestValidateOVAFileSize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, size := range []int{0, 1} {
+		name := filepath.Join(dir, fmt.Sprintf("%d.ova", size))
+		if err := ioutil.WriteFile(name, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ValidateOVAFile(DiscardLogger, name, false, false, nil); err == nil {
+			t.Errorf("ValidateOVAFile: expected error for %d byte file", size)
+		}
+	}
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+	})
+	if err := ValidateOVAFile(DiscardLogger, ova, false, false, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfigStop(t *testing.T) {
+	c := &Config{Logger: DiscardLogger, stop: make(chan struct{})}
+	tmpdir, err := c.TempDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() { defer wg.Done(); c.Stop() }()
+		go func() { defer wg.Done(); c.Cleanup() }()
+	}
+	wg.Wait()
+
+	if _, err := os.Stat(tmpdir); !os.IsNotExist(err) {
+		t.Errorf("Stop: temp directory (%s) was not removed", tmpdir)
+	}
+	if _, err := c.Writer(ioutil.Discard).Write([]byte("a")); err != ErrInterupt {
+		t.Errorf("Stop: expected write to fail with: %v got: %v", ErrInterupt, err)
+	}
+	if _, err := c.TempDir(); err == nil {
+		t.Error("TempDir: expected error after Stop")
+	}
+}
+
+func TestTmpRoot(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	if err := ValidateTmpRoot(dir); err != nil {
+		t.Error(err)
+	}
+	if err := ValidateTmpRoot(filepath.Join(dir, "missing")); err == nil {
+		t.Error("ValidateTmpRoot: expected error for missing directory")
+	}
+
+	c := &Config{TmpRoot: dir, Logger: DiscardLogger}
+	defer c.Cleanup()
+	tmpdir, err := c.TempDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(tmpdir) != dir {
+		t.Errorf("TempDir: expected (%s) to be created in: %s", tmpdir, dir)
+	}
+}
+
+func TestGzipDeterministic(t *testing.T) {
+	data := bytes.Repeat([]byte("stemcell"), 4096)
+	compress := func() []byte {
+		var b bytes.Buffer
+		w := newGzipWriter(&b)
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+	b1 := compress()
+	b2 := compress()
+	if !bytes.Equal(b1, b2) {
+		t.Error("newGzipWriter: output of identical data differs")
+	}
+	r, err := gzip.NewReader(bytes.NewReader(b1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := r.Header; !h.ModTime.IsZero() || h.Name != "" || h.Comment != "" || h.OS != gzipOSUnknown {
+		t.Errorf("newGzipWriter: unexpected header: %+v", h)
+	}
+}
+
+func TestNoImageGzip(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+	c := &Config{
+		Version:     "1.2",
+		NoImageGzip: true,
+		Logger:      DiscardLogger,
+		stop:        make(chan struct{}),
+	}
+	defer c.Cleanup()
+	if err := c.CreateImageFromOVA(ova); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := ioutil.ReadFile(ova)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := ioutil.ReadFile(c.Image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(image, want) {
+		t.Error("NoImageGzip: image should be a copy of the OVA")
+	}
+	if sum := fmt.Sprintf("%x", sha1.Sum(image)); sum != c.Sha1sum {
+		t.Errorf("NoImageGzip: Sha1sum got %s want %s", c.Sha1sum, sum)
+	}
+
+	if err := c.WriteManifest(); err != nil {
+		t.Fatal(err)
+	}
+	mf, err := ioutil.ReadFile(c.Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(mf, []byte("# experimental: image is not gzip compressed\n")) {
+		t.Errorf("NoImageGzip: manifest does not note the image is uncompressed:\n%s", mf)
+	}
+}
+
+func TestRealMain(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+
+	c := &Config{
+		OVAFile:   ova,
+		OutputDir: dir,
+		Checksums: []string{"sha256"},
+		Logger:    DiscardLogger,
+		stop:      make(chan struct{}),
+	}
+	defer c.Cleanup()
+	start := time.Now()
+	results, err := realMain(c, []string{"1.2", "1.3"})
+	total := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("realMain: expected 2 results got: %d", len(results))
+	}
+	for i, r := range results {
+		if r.Version != []string{"1.2", "1.3"}[i] {
+			t.Errorf("realMain: result %d: version: got %q", i, r.Version)
+		}
+		b, err := ioutil.ReadFile(r.StemcellPath)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if sum := fmt.Sprintf("%x", sha1.Sum(b)); sum != r.TarballSha1 {
+			t.Errorf("realMain: result %d: TarballSha1: got %s want %s", i, r.TarballSha1, sum)
+		}
+		if r.ImageSha1 == "" || r.TarballSha256 == "" || r.OperatingSystem != DefaultOS {
+			t.Errorf("realMain: result %d: missing fields: %+v", i, r)
+		}
+		if _, err := os.Stat(r.StemcellPath + ".sha256"); err != nil {
+			t.Errorf("realMain: result %d: %s", i, err)
+		}
+	}
+
+	var steps []string
+	for _, s := range c.Steps {
+		steps = append(steps, s.Name+"@"+s.Version)
+		if s.Size == 0 || s.Sha1 == "" {
+			t.Errorf("realMain: step %s: missing size or sha1: %+v", s.Name, s)
+		}
+	}
+	exp := []string{"image@", "manifest@1.2", "stemcell@1.2", "manifest@1.3", "stemcell@1.3"}
+	if strings.Join(steps, " ") != strings.Join(exp, " ") {
+		t.Errorf("realMain: steps: got %q want %q", steps, exp)
+	}
+
+	steps = nil
+	var sum time.Duration
+	for _, s := range c.Timings {
+		steps = append(steps, s.Name+"@"+s.Version)
+		sum += s.Duration
+	}
+	exp = append([]string{"validate@"}, exp...)
+	if strings.Join(steps, " ") != strings.Join(exp, " ") {
+		t.Errorf("realMain: timings: got %q want %q", steps, exp)
+	}
+	// steps are timed back to back
+	if sum > total {
+		t.Errorf("realMain: timings: sum %s is greater than the total %s", sum, total)
+	}
+}
+
+func TestMemoryImage(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: strings.Repeat("disk", 1024)},
+	})
+
+	build := func(limit int64) (*Config, map[string][]byte) {
+		c := &Config{
+			Version:          "1.2",
+			MemoryImageLimit: limit,
+			Logger:           DiscardLogger,
+			stop:             make(chan struct{}),
+		}
+		if err := c.CreateImageFromOVA(ova); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.WriteManifest(); err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if err := c.CreateStemcellTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		_, files := readStemcell(t, &b)
+		return c, files
+	}
+
+	disk, diskFiles := build(0)
+	defer disk.Cleanup()
+	mem, memFiles := build(1 << 20)
+	defer mem.Cleanup()
+
+	if disk.imageData != nil || disk.Image == "" {
+		t.Error("MemoryImageLimit: expected image file with a limit of 0")
+	}
+	if mem.imageData == nil || mem.Image != "" {
+		t.Error("MemoryImageLimit: expected in memory image")
+	}
+	if mem.Sha1sum != disk.Sha1sum {
+		t.Errorf("MemoryImageLimit: sha1: got %s want %s", mem.Sha1sum, disk.Sha1sum)
+	}
+	for _, name := range []string{"image", "stemcell.MF"} {
+		if !bytes.Equal(memFiles[name], diskFiles[name]) {
+			t.Errorf("MemoryImageLimit: %s differs from the disk image", name)
+		}
+	}
+
+	unpacked := filepath.Join(dir, "unpacked")
+	if err := mem.WriteUnpacked(unpacked, false); err != nil {
+		t.Fatal(err)
+	}
+	image, err := ioutil.ReadFile(filepath.Join(unpacked, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(image, diskFiles["image"]) {
+		t.Error("MemoryImageLimit: unpacked image differs from the disk image")
+	}
+}
+
+func TestValidateOVFOrder(t *testing.T) {
+	tests := []struct {
+		names []string
+		ok    bool
+	}{
+		{[]string{"vm.ovf", "vm.mf", "vm-disk1.vmdk"}, true},
+		{[]string{"vm.ovf", "vm-disk1.vmdk"}, true},
+		{[]string{"vm-disk1.vmdk", "vm.ovf"}, false},
+		{[]string{"vm.ovf", "vm-disk1.vmdk", "vm.mf"}, false},
+		{nil, false},
+	}
+	for _, x := range tests {
+		if err := ValidateOVFOrder(x.names); (err == nil) != x.ok {
+			t.Errorf("ValidateOVFOrder(%q): got error %v want ok %t", x.names, err, x.ok)
+		}
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+	})
+	if err := ValidateOVAFile(DiscardLogger, ova, false, false, nil); err != nil {
+		t.Errorf("ValidateOVAFile: lenient order check: %s", err)
+	}
+	if err := ValidateOVAFile(DiscardLogger, ova, true, false, nil); err == nil {
+		t.Error("ValidateOVAFile: expected error with strict order")
+	}
+}
+
+func TestRealMainConcurrent(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	const n = 8
+	configs := make([]*Config, n)
+	for i := range configs {
+		sub := filepath.Join(dir, fmt.Sprint(i))
+		if err := os.Mkdir(sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+		ova := createTar(t, sub, "vm.ova", []tarEntry{
+			{Name: "vm.ovf", Body: "<Envelope/>"},
+			{Name: "vm-disk1.vmdk", Body: strings.Repeat(fmt.Sprint(i), 4096)},
+		})
+		configs[i] = &Config{
+			OVAFile:          ova,
+			OutputDir:        sub,
+			MemoryImageLimit: int64(i%2) << 20, // mix of disk and memory images
+			Logger:           DiscardLogger,
+			stop:             make(chan struct{}),
+		}
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]*BuildResult, n)
+	errs := make([]error, n)
+	for i, c := range configs {
+		wg.Add(1)
+		go func(i int, c *Config) {
+			defer wg.Done()
+			results[i], errs[i] = realMain(c, []string{fmt.Sprintf("%d.0", i+1)})
+		}(i, c)
+	}
+	wg.Wait()
+
+	tmpdirs := make(map[string]bool)
+	for i, c := range configs {
+		defer c.Cleanup()
+		if errs[i] != nil {
+			t.Errorf("%d: realMain: %s", i, errs[i])
+			continue
+		}
+		if tmpdirs[c.tmpdir] && c.tmpdir != "" {
+			t.Errorf("%d: realMain: temp dir shared with another build: %s", i, c.tmpdir)
+		}
+		tmpdirs[c.tmpdir] = true
+
+		r := results[i][0]
+		if exp := fmt.Sprintf("%d.0", i+1); r.Version != exp {
+			t.Errorf("%d: realMain: version: got %s want %s", i, r.Version, exp)
+		}
+		if filepath.Dir(r.StemcellPath) != c.OutputDir {
+			t.Errorf("%d: realMain: stemcell (%s) not in output dir: %s", i, r.StemcellPath, c.OutputDir)
+		}
+		f, err := os.Open(r.StemcellPath)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		_, files := readStemcell(t, f)
+		f.Close()
+		if sum := fmt.Sprintf("%x", sha1.Sum(files["image"])); sum != r.ImageSha1 {
+			t.Errorf("%d: realMain: image sha1: got %s want %s", i, r.ImageSha1, sum)
+		}
+		m, err := ParseManifest(bytes.NewReader(files["stemcell.MF"]))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if m.Version != r.Version || m.Sha1 != r.ImageSha1 {
+			t.Errorf("%d: realMain: manifest (version %s, sha1 %s) does not match result (%s, %s)",
+				i, m.Version, m.Sha1, r.Version, r.ImageSha1)
+		}
+	}
+}
+
+// The manifest sha1 is always the sha1 of the image entry of the stemcell,
+// the compressed bytes, however the image was created.
+func TestManifestImageSha1(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	entries := []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: strings.Repeat("disk", 1024)},
+	}
+	ova := createTar(t, dir, "vm.ova", entries)
+	gz := gzipFile(t, ova, filepath.Join(dir, "vm.ova.gz"))
+	ovf := filepath.Join(dir, "ovf")
+	if err := os.Mkdir(ovf, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if err := ioutil.WriteFile(filepath.Join(ovf, e.Name), []byte(e.Body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		set  func(c *Config)
+	}{
+		{"ova", func(c *Config) { c.OVAFile = ova }},
+		{"ova-memory", func(c *Config) { c.OVAFile, c.MemoryImageLimit = ova, DefaultMemoryImageLimit }},
+		{"ova-gzip", func(c *Config) { c.OVAFile = gz }},
+		{"ova-threads", func(c *Config) { c.OVAFile, c.GzipThreads = ova, 4 }},
+		{"ovf", func(c *Config) { c.OVFDir = ovf }},
+		{"ovf-threads", func(c *Config) { c.OVFDir, c.GzipThreads = ovf, 4 }},
+	}
+	for _, x := range tests {
+		c := &Config{
+			OutputDir:  dir,
+			OutputName: x.name + "-{version}.tgz",
+			Logger:     DiscardLogger,
+			stop:       make(chan struct{}),
+		}
+		x.set(c)
+		results, err := realMain(c, []string{"1.2"})
+		c.Cleanup()
+		if err != nil {
+			t.Errorf("%s: realMain: %s", x.name, err)
+			continue
+		}
+		f, err := os.Open(results[0].StemcellPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, files := readStemcell(t, f)
+		f.Close()
+		m, err := ParseManifest(bytes.NewReader(files["stemcell.MF"]))
+		if err != nil {
+			t.Fatalf("%s: %s", x.name, err)
+		}
+		if !bytes.HasPrefix(files["image"], gzipMagic) {
+			t.Errorf("%s: image is not gzip compressed", x.name)
+		}
+		if sum := fmt.Sprintf("%x", sha1.Sum(files["image"])); m.Sha1 != sum {
+			t.Errorf("%s: manifest sha1 %s is not the sha1 of the image entry %s", x.name, m.Sha1, sum)
+		}
+	}
+}
+
+func TestCreateStemcellEntryNames(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c := newTestConfig(t, dir)
+	defer c.Cleanup()
+
+	// the names of the temp files must not leak into the stemcell
+	for _, p := range []*string{&c.Image, &c.Manifest} {
+		renamed := *p + ".renamed"
+		if err := os.Rename(*p, renamed); err != nil {
+			t.Fatal(err)
+		}
+		*p = renamed
+	}
+	var b bytes.Buffer
+	if err := c.CreateStemcellTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	names, _ := readStemcell(t, &b)
+	if err := checkStemcellEntries(names); err != nil {
+		t.Errorf("CreateStemcellTo: unexpected tarball entries: %s", err)
+	}
+
+	for _, names := range [][]string{
+		{"image.renamed", "stemcell.MF.renamed"},
+		{"stemcell.MF", "image"},
+		{"image"},
+		{"image", "stemcell.MF", "extra"},
+	} {
+		if err := checkStemcellEntries(names); err == nil {
+			t.Errorf("checkStemcellEntries(%q): expected error", names)
+		}
+	}
+}
+
+func TestWalkOVAHash(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "./", Typeflag: tar.TypeDir},
+		{Name: "./vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+
+	hashes := make(map[string]hash.Hash)
+	sha256Hash := func(h *tar.Header) []hash.Hash {
+		hashes[h.Name] = sha256.New()
+		return []hash.Hash{hashes[h.Name]}
+	}
+	sums := make(map[string]string)
+	err := walkOVA(ova, sha256Hash, func(h *tar.Header, _ io.Reader) error {
+		sums[h.Name] = fmt.Sprintf("%x", hashes[h.Name].Sum(nil))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range map[string]string{"vm.ovf": "<Envelope/>", "vm-disk1.vmdk": "disk"} {
+		if exp := fmt.Sprintf("%x", sha256.Sum256([]byte(body))); sums[name] != exp {
+			t.Errorf("walkOVA: %s: got sum %q want %q", name, sums[name], exp)
+		}
+	}
+	if len(sums) != 2 {
+		t.Errorf("walkOVA: expected 2 entries got: %v", sums)
+	}
+
+	// the contents of an entry that is not hashed are read by fn
+	bodies := make(map[string]string)
+	ovfOnly := func(h *tar.Header) []hash.Hash {
+		if h.Name == "vm.ovf" {
+			return []hash.Hash{sha256.New()}
+		}
+		return nil
+	}
+	err = walkOVA(ova, ovfOnly, func(h *tar.Header, r io.Reader) error {
+		b, err := ioutil.ReadAll(r)
+		bodies[h.Name] = string(b)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodies["vm.ovf"] != "" || bodies["vm-disk1.vmdk"] != "disk" {
+		t.Errorf("walkOVA: unexpected unhashed contents: %q", bodies)
+	}
+}
+
+func benchmarkWalkOVA(b *testing.B, newHash func() hash.Hash) {
+	dir := tempDir(b)
+	defer os.RemoveAll(dir)
+
+	const size = 64 << 20
+	ova := createTar(b, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: strings.Repeat("d", size)},
+	})
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var hashes func(*tar.Header) []hash.Hash
+		if newHash != nil {
+			hashes = func(*tar.Header) []hash.Hash { return []hash.Hash{newHash()} }
+		}
+		err := walkOVA(ova, hashes, func(*tar.Header, io.Reader) error { return nil })
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWalkOVA(b *testing.B)       { benchmarkWalkOVA(b, nil) }
+func BenchmarkWalkOVASHA1(b *testing.B)   { benchmarkWalkOVA(b, sha1.New) }
+func BenchmarkWalkOVASHA256(b *testing.B) { benchmarkWalkOVA(b, sha256.New) }
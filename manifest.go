@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Manifest is a BOSH stemcell manifest (stemcell.MF).
+type Manifest struct {
+	Name            string
+	Version         string
+	Sha1            string
+	Sha256          string // optional
+	OperatingSystem string
+	CloudProperties map[string]string
+
+	// BoshProtocol and StemcellFormats are only written by the v2 layout.
+	BoshProtocol    string
+	StemcellFormats []string
+
+	// APIVersion is the agent API version of the stemcell, it is omitted
+	// if zero.
+	APIVersion int
+
+	// Comment, if not empty, is written as a YAML comment at the start of
+	// the manifest.
+	Comment string
+}
+
+// Manifest layouts, see ValidateManifestLayout.
+const (
+	// ManifestV1 is the original layout: name, version, sha1,
+	// operating_system and cloud_properties.  It is accepted by all
+	// directors.
+	ManifestV1 = "v1"
+
+	// ManifestV2 adds the bosh_protocol and stemcell_formats keys, which
+	// directors that select a CPI by the stemcell's format (bosh v262 and
+	// later) use.
+	ManifestV2 = "v2"
+)
+
+// ManifestLayoutKeys are the top-level keys written by each manifest layout.
+var ManifestLayoutKeys = map[string][]string{
+	ManifestV1: {"name", "version", "sha1", "operating_system", "cloud_properties"},
+	ManifestV2: {"name", "version", "bosh_protocol", "sha1", "operating_system",
+		"stemcell_formats", "cloud_properties"},
+}
+
+// ManifestLayoutNames returns the sorted names of the manifest layouts.
+func ManifestLayoutNames() []string {
+	var names []string
+	for name := range ManifestLayoutKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateManifestLayout returns an error if layout is not a known manifest
+// layout.
+func ValidateManifestLayout(layout string) error {
+	if _, ok := ManifestLayoutKeys[layout]; ok {
+		return nil
+	}
+	return fmt.Errorf("invalid manifest version (%s): must be one of: %s",
+		layout, strings.Join(ManifestLayoutNames(), ", "))
+}
+
+// SetLayout sets the keys specific to layout, keys not used by layout are
+// cleared.
+func (m *Manifest) SetLayout(layout string) {
+	switch layout {
+	case ManifestV2:
+		m.BoshProtocol = "1"
+		m.StemcellFormats = []string{IaaSes[DefaultIaaS].StemcellFormat}
+	default:
+		m.BoshProtocol = ""
+		m.StemcellFormats = nil
+	}
+}
+
+// NewManifest returns the manifest of a stemcell with version, operating
+// system osName and an image with sha1 checksum sha1.
+func NewManifest(version, sha1, osName string) *Manifest {
+	d := lookupOS(osName)
+	m := &Manifest{
+		Name:            d.ManifestName(),
+		Version:         version,
+		Sha1:            sha1,
+		OperatingSystem: d.OS,
+	}
+	m.SetIaaS(IaaSes[DefaultIaaS])
+	return m
+}
+
+// Validate checks that all of the keys required by BOSH are present.
+func (m *Manifest) Validate() error {
+	var missing []string
+	if m.Name == "" {
+		missing = append(missing, "name")
+	}
+	if m.Version == "" {
+		missing = append(missing, "version")
+	}
+	if m.Sha1 == "" {
+		missing = append(missing, "sha1")
+	}
+	if m.OperatingSystem == "" {
+		missing = append(missing, "operating_system")
+	}
+	if len(m.CloudProperties) == 0 {
+		missing = append(missing, "cloud_properties")
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("invalid manifest: missing required keys: %q", missing)
+	}
+	for k := range m.CloudProperties {
+		if k == "" {
+			return errors.New("invalid manifest: empty cloud_properties key")
+		}
+	}
+	if m.APIVersion < 0 {
+		return fmt.Errorf("invalid manifest: api_version (%d) must be a positive integer",
+			m.APIVersion)
+	}
+	return nil
+}
+
+// ValidateLayout checks that all of the keys required by layout are present.
+func (m *Manifest) ValidateLayout(layout string) error {
+	if err := ValidateManifestLayout(layout); err != nil {
+		return err
+	}
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	if layout == ManifestV2 {
+		var missing []string
+		if m.BoshProtocol == "" {
+			missing = append(missing, "bosh_protocol")
+		}
+		if len(m.StemcellFormats) == 0 {
+			missing = append(missing, "stemcell_formats")
+		}
+		if len(missing) != 0 {
+			return fmt.Errorf("invalid %s manifest: missing required keys: %q",
+				layout, missing)
+		}
+	}
+	return nil
+}
+
+// WriteTo writes the manifest as YAML to w.  Keys are always written in the
+// same order and values are quoted as required.
+func (m *Manifest) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+	b.WriteString("---\n")
+	if m.Comment != "" {
+		for _, line := range strings.Split(m.Comment, "\n") {
+			fmt.Fprintf(&b, "# %s\n", line)
+		}
+	}
+	fmt.Fprintf(&b, "name: %s\n", yamlString(m.Name))
+	fmt.Fprintf(&b, "version: %s\n", yamlString(m.Version))
+	if m.BoshProtocol != "" {
+		fmt.Fprintf(&b, "bosh_protocol: %s\n", yamlString(m.BoshProtocol))
+	}
+	if m.APIVersion != 0 {
+		fmt.Fprintf(&b, "api_version: %d\n", m.APIVersion)
+	}
+	fmt.Fprintf(&b, "sha1: %s\n", yamlString(m.Sha1))
+	if m.Sha256 != "" {
+		fmt.Fprintf(&b, "sha256: %s\n", yamlString(m.Sha256))
+	}
+	fmt.Fprintf(&b, "operating_system: %s\n", yamlString(m.OperatingSystem))
+	if len(m.StemcellFormats) != 0 {
+		b.WriteString("stemcell_formats:\n")
+		for _, f := range m.StemcellFormats {
+			fmt.Fprintf(&b, "- %s\n", yamlString(f))
+		}
+	}
+	b.WriteString("cloud_properties:\n")
+	keys := make([]string, 0, len(m.CloudProperties))
+	for k := range m.CloudProperties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "  %s: %s\n", yamlString(k), yamlString(m.CloudProperties[k]))
+	}
+	return b.WriteTo(w)
+}
+
+// ParseManifest parses the stemcell manifest read from r.  Only the subset of
+// YAML written by WriteTo, plus comments and nested blocks, is supported.
+// Unknown keys, and any values nested under them, are ignored so that
+// manifests created by other tools can be read.  Nested values in
+// cloud_properties are also ignored since they cannot be represented by
+// Manifest.CloudProperties.
+func ParseManifest(r io.Reader) (*Manifest, error) {
+	m := &Manifest{CloudProperties: make(map[string]string)}
+	seen := make(map[string]bool)
+
+	var block string // top-level key of the current block
+	childIndent := 0 // indentation of cloud_properties entries
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		text := strings.TrimRight(sc.Text(), " \t\r")
+		line := strings.TrimLeft(text, " ")
+		if line == "" || line[0] == '#' || line == "---" {
+			continue
+		}
+		if strings.HasPrefix(line, "\t") {
+			return nil, fmt.Errorf("manifest: line %d: tabs are not allowed for indentation", n)
+		}
+		indent := len(text) - len(line)
+		if block != "" && (line == "-" || strings.HasPrefix(line, "- ")) {
+			if block != "stemcell_formats" {
+				continue // sequence entry of an unknown key
+			}
+			v, err := yamlScalar(strings.TrimPrefix(line, "-"))
+			if err != nil {
+				return nil, fmt.Errorf("manifest: line %d: %s", n, err)
+			}
+			m.StemcellFormats = append(m.StemcellFormats, v)
+			continue
+		}
+
+		if indent != 0 {
+			if block != "cloud_properties" {
+				continue // value of an unknown key
+			}
+			if childIndent == 0 {
+				childIndent = indent
+			}
+			if indent > childIndent {
+				continue // nested cloud_properties value
+			}
+			if indent < childIndent {
+				return nil, fmt.Errorf("manifest: line %d: invalid indentation", n)
+			}
+			key, val, err := yamlKeyValue(line)
+			if err != nil {
+				return nil, fmt.Errorf("manifest: line %d: %s", n, err)
+			}
+			if strings.TrimSpace(val) == "" {
+				continue // start of a nested block
+			}
+			if m.CloudProperties[key], err = yamlScalar(val); err != nil {
+				return nil, fmt.Errorf("manifest: line %d: %s", n, err)
+			}
+			continue
+		}
+
+		key, val, err := yamlKeyValue(line)
+		if err != nil {
+			return nil, fmt.Errorf("manifest: line %d: %s", n, err)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("manifest: line %d: duplicate key: %s", n, key)
+		}
+		seen[key] = true
+		block = key
+		childIndent = 0
+
+		var p *string
+		switch key {
+		case "name":
+			p = &m.Name
+		case "version":
+			p = &m.Version
+		case "sha1":
+			p = &m.Sha1
+		case "sha256":
+			p = &m.Sha256
+		case "operating_system":
+			p = &m.OperatingSystem
+		case "bosh_protocol":
+			p = &m.BoshProtocol
+		case "api_version":
+			v, err := yamlScalar(val)
+			if err != nil {
+				return nil, fmt.Errorf("manifest: line %d: %s", n, err)
+			}
+			if m.APIVersion, err = strconv.Atoi(v); err != nil || m.APIVersion <= 0 {
+				return nil, fmt.Errorf("manifest: line %d: api_version (%s) must be a positive integer", n, v)
+			}
+			continue
+		case "stemcell_formats":
+			v := strings.TrimSpace(val)
+			if strings.HasPrefix(v, "[") && strings.HasSuffix(v, "]") {
+				for _, f := range strings.Split(v[1:len(v)-1], ",") {
+					if f = strings.TrimSpace(f); f != "" {
+						if f, err = yamlScalar(f); err != nil {
+							return nil, fmt.Errorf("manifest: line %d: %s", n, err)
+						}
+						m.StemcellFormats = append(m.StemcellFormats, f)
+					}
+				}
+			} else if v != "" && v[0] != '#' {
+				return nil, fmt.Errorf("manifest: line %d: stemcell_formats must be a sequence", n)
+			}
+			continue
+		case "cloud_properties":
+			v, err := yamlScalar(val)
+			if err != nil {
+				return nil, fmt.Errorf("manifest: line %d: %s", n, err)
+			}
+			if v != "" && v != "{}" {
+				return nil, fmt.Errorf("manifest: line %d: cloud_properties must be a mapping", n)
+			}
+			continue
+		default:
+			continue // unknown key
+		}
+		if *p, err = yamlScalar(val); err != nil {
+			return nil, fmt.Errorf("manifest: line %d: %s", n, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("manifest: %s", err)
+	}
+	return m, nil
+}
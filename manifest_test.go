@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestManifestWriteTo(t *testing.T) {
+	const exp = `---
+name: bosh-vsphere-esxi-windows-2012R2-go_agent
+version: "1.2"
+sha1: "0123456789abcdef"
+operating_system: windows2012R2
+cloud_properties:
+  hypervisor: esxi
+  infrastructure: vsphere
+`
+	var b bytes.Buffer
+	if _, err := NewManifest("1.2", "0123456789abcdef", DefaultOS).WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if s := b.String(); s != exp {
+		t.Errorf("Manifest.WriteTo: got:\n%s\nwant:\n%s", s, exp)
+	}
+}
+
+func TestManifestValidate(t *testing.T) {
+	m := NewManifest("1.2", "abc", DefaultOS)
+	if err := m.Validate(); err != nil {
+		t.Error(err)
+	}
+	m.Sha1 = ""
+	if err := m.Validate(); err == nil {
+		t.Error("Manifest.Validate: expected error for missing sha1")
+	}
+}
+
+func TestManifestAPIVersion(t *testing.T) {
+	m := NewManifest("1.2", "abc", DefaultOS)
+	var b bytes.Buffer
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(b.String(), "api_version") {
+		t.Errorf("Manifest.WriteTo: api_version written when unset:\n%s", b.String())
+	}
+
+	m.APIVersion = 3
+	b.Reset()
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "version: \"1.2\"\napi_version: 3\nsha1: ") {
+		t.Errorf("Manifest.WriteTo: api_version missing or misplaced:\n%s", b.String())
+	}
+	p, err := ParseManifest(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.APIVersion != 3 {
+		t.Errorf("ParseManifest: APIVersion got %d want %d", p.APIVersion, 3)
+	}
+
+	for _, v := range []string{"0", "-1", "abc"} {
+		s := "name: n\nversion: \"1\"\napi_version: " + v + "\n"
+		if _, err := ParseManifest(strings.NewReader(s)); err == nil {
+			t.Errorf("ParseManifest: expected error for api_version: %s", v)
+		}
+	}
+	m.APIVersion = -1
+	if err := m.Validate(); err == nil {
+		t.Error("Manifest.Validate: expected error for negative api_version")
+	}
+}
+
+var yamlStringTests = []struct {
+	in, exp string
+}{
+	{"vsphere", "vsphere"},
+	{"1.2", `"1.2"`},
+	{"true", `"true"`},
+	{"", `""`},
+	{"a: b", `"a: b"`},
+	{"a\nb", `"a\nb"`},
+	{"-foo", `"-foo"`},
+}
+
+func TestYAMLString(t *testing.T) {
+	for _, x := range yamlStringTests {
+		if s := yamlString(x.in); s != x.exp {
+			t.Errorf("yamlString(%q): got %s want %s", x.in, s, x.exp)
+		}
+	}
+}
+
+func TestNewManifestOS(t *testing.T) {
+	m := NewManifest("1.2", "abc", "ubuntu-xenial")
+	if m.Name != "bosh-vsphere-esxi-ubuntu-xenial-go_agent" {
+		t.Errorf("NewManifest: name: got %q", m.Name)
+	}
+	if m.OperatingSystem != "ubuntu-xenial" {
+		t.Errorf("NewManifest: operating_system: got %q", m.OperatingSystem)
+	}
+	exp := "bosh-stemcell-1.2-vsphere-esxi-ubuntu-xenial-go_agent.tgz"
+	if s := StemcellFilename("1.2", "ubuntu-xenial"); s != exp {
+		t.Errorf("StemcellFilename: got %q want %q", s, exp)
+	}
+	if err := ValidateOS("plan9"); err == nil {
+		t.Error("ValidateOS: expected error for unsupported os")
+	}
+}
+
+func TestParseManifestRoundTrip(t *testing.T) {
+	manifests := []*Manifest{
+		NewManifest("1.2", "0123456789abcdef", DefaultOS),
+		NewManifest("1200.3", "abc", "ubuntu-bionic"),
+		{
+			Name:            "a: b",
+			Version:         "true",
+			Sha1:            "abc",
+			Sha256:          "def",
+			OperatingSystem: "it's #1",
+			CloudProperties: map[string]string{
+				"key: 1": "'quoted'",
+				"empty":  "",
+			},
+			Comment: "line 1\nline 2",
+		},
+	}
+	v2 := NewManifest("1.2", "abc", DefaultOS)
+	v2.SetLayout(ManifestV2)
+	manifests = append(manifests, v2)
+
+	for _, m := range manifests {
+		var b bytes.Buffer
+		if _, err := m.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		p, err := ParseManifest(&b)
+		if err != nil {
+			t.Errorf("ParseManifest: %s", err)
+			continue
+		}
+		exp := *m
+		exp.Comment = ""
+		if !reflect.DeepEqual(p, &exp) {
+			t.Errorf("ParseManifest: got %+v want %+v", p, &exp)
+		}
+	}
+}
+
+func TestParseManifestUnknownKeys(t *testing.T) {
+	const s = `---
+# third-party manifest
+name: bosh-vsphere-esxi-ubuntu-xenial-go_agent
+version: '1.2' # comment
+api_version: 2
+sha1: abc
+tags:
+- a
+- b
+stemcell_formats: [vsphere-ova, 'vsphere-ovf']
+operating_system: ubuntu-xenial
+cloud_properties:
+    infrastructure: vsphere
+    nested:
+        a: b
+    hypervisor: "esxi"
+extra:
+  key: value
+`
+	m, err := ParseManifest(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &Manifest{
+		Name:            "bosh-vsphere-esxi-ubuntu-xenial-go_agent",
+		Version:         "1.2",
+		Sha1:            "abc",
+		OperatingSystem: "ubuntu-xenial",
+		CloudProperties: map[string]string{
+			"infrastructure": "vsphere",
+			"hypervisor":     "esxi",
+		},
+		StemcellFormats: []string{"vsphere-ova", "vsphere-ovf"},
+		APIVersion:      2,
+	}
+	if !reflect.DeepEqual(m, exp) {
+		t.Errorf("ParseManifest: got %+v want %+v", m, exp)
+	}
+}
+
+func TestParseManifestErrors(t *testing.T) {
+	tests := []string{
+		"name: a\nname: b\n",
+		"name\n",
+		"version: \"1.2\n",
+		"version: '1.2\n",
+		"version: \"1.2\" x\n",
+		"cloud_properties: vsphere\n",
+		"cloud_properties:\n    a: b\n  c: d\n",
+	}
+	for _, s := range tests {
+		if _, err := ParseManifest(strings.NewReader(s)); err == nil {
+			t.Errorf("ParseManifest(%q): expected error", s)
+		}
+	}
+}
+
+func TestManifestNameAgent(t *testing.T) {
+	d := lookupOS("ubuntu-xenial")
+	if s := d.ManifestName(); s != "bosh-vsphere-esxi-ubuntu-xenial-go_agent" {
+		t.Errorf("ManifestName: got %q", s)
+	}
+	exp := "bosh-vsphere-esxi-ubuntu-xenial-go_agent-hardened"
+	if s := d.ManifestNameAgent("go_agent-hardened"); s != exp {
+		t.Errorf("ManifestNameAgent: got %q want %q", s, exp)
+	}
+	for _, s := range []string{"go_agent", "go_agent-hardened", "agent.v2"} {
+		if err := ValidateAgent(s); err != nil {
+			t.Errorf("ValidateAgent(%q): %s", s, err)
+		}
+	}
+	for _, s := range []string{"", "-agent", "go agent", "a/b", "a: b", "agent#1"} {
+		if err := ValidateAgent(s); err == nil {
+			t.Errorf("ValidateAgent(%q): expected error", s)
+		}
+	}
+}
+
+func TestManifestLayout(t *testing.T) {
+	const exp = `---
+name: bosh-vsphere-esxi-windows-2012R2-go_agent
+version: "1.2"
+bosh_protocol: "1"
+sha1: abc
+operating_system: windows2012R2
+stemcell_formats:
+- vsphere-ova
+cloud_properties:
+  hypervisor: esxi
+  infrastructure: vsphere
+`
+	m := NewManifest("1.2", "abc", DefaultOS)
+	if err := m.ValidateLayout(ManifestV2); err == nil {
+		t.Error("Manifest.ValidateLayout: expected error for missing v2 keys")
+	}
+	m.SetLayout(ManifestV2)
+	if err := m.ValidateLayout(ManifestV2); err != nil {
+		t.Error(err)
+	}
+	var b bytes.Buffer
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if s := b.String(); s != exp {
+		t.Errorf("Manifest.WriteTo (v2): got:\n%s\nwant:\n%s", s, exp)
+	}
+
+	m.SetLayout(ManifestV1)
+	if m.BoshProtocol != "" || m.StemcellFormats != nil {
+		t.Errorf("Manifest.SetLayout (v1): v2 keys not cleared: %+v", m)
+	}
+	if err := ValidateManifestLayout("v3"); err == nil {
+		t.Error("ValidateManifestLayout: expected error for v3")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// errImageMismatch is returned by a compareWriter when the bytes written
+// differ from those it compares them to.
+var errImageMismatch = errors.New("image bytes differ")
+
+// A compareWriter compares the bytes written to it to those read from r.
+type compareWriter struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func (w *compareWriter) Write(p []byte) (int, error) {
+	if cap(w.buf) < len(p) {
+		w.buf = make([]byte, len(p))
+	}
+	b := w.buf[:len(p)]
+	if _, err := io.ReadFull(w.r, b); err != nil || !bytes.Equal(b, p) {
+		return 0, errImageMismatch
+	}
+	return len(p), nil
+}
+
+// A gzipCandidate is a way the image of a stemcell may have been compressed,
+// see MatchStemcellImage.
+type gzipCandidate struct {
+	Name      string
+	NewWriter func(w io.Writer, hdr gzip.Header) io.WriteCloser
+}
+
+// gzipCandidates are the compressions tried by MatchStemcellImage, in order.
+// Single stream candidates are given the header of the image, the parallel
+// candidate writes its own.  Level 6 is omitted, it is the default level.
+var gzipCandidates = func() []gzipCandidate {
+	level := func(name string, level int) gzipCandidate {
+		return gzipCandidate{name, func(w io.Writer, hdr gzip.Header) io.WriteCloser {
+			gw, _ := gzip.NewWriterLevel(w, level)
+			gw.Header = hdr
+			return gw
+		}}
+	}
+	c := []gzipCandidate{level("gzip level -1 (default, as ova2stemcell writes it)", gzip.DefaultCompression)}
+	for _, n := range []int{1, 2, 3, 4, 5, 7, 8, 9} {
+		c = append(c, level(fmt.Sprintf("gzip level %d", n), n))
+	}
+	c = append(c,
+		level("gzip level 0 (no compression)", gzip.NoCompression),
+		level("gzip level -2 (huffman only)", gzip.HuffmanOnly),
+		gzipCandidate{"1 MiB gzip members (as -gzip-threads greater than one writes it)",
+			func(w io.Writer, _ gzip.Header) io.WriteCloser {
+				return newParallelGzipWriter(w, 1)
+			}},
+	)
+	return c
+}()
+
+// matchCandidate returns if compressing the decompressed image file name
+// with candidate c reproduces the image byte for byte.
+func matchCandidate(name string, c gzipCandidate, hdr gzip.Header) (bool, error) {
+	src, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	gr, err := gzip.NewReader(bufio.NewReader(src))
+	if err != nil {
+		return false, err
+	}
+	dst, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer dst.Close()
+
+	cw := &compareWriter{r: bufio.NewReader(dst)}
+	w := c.NewWriter(cw, hdr)
+	if _, err := copyBuffer(w, gr); err != nil {
+		if err == errImageMismatch {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := w.Close(); err != nil {
+		if err == errImageMismatch {
+			return false, nil
+		}
+		return false, err
+	}
+	// the image must not be longer than the candidate
+	if _, err := cw.r.ReadByte(); err != io.EOF {
+		return false, nil
+	}
+	return true, nil
+}
+
+// extractImage writes the image entry of stemcell tarball name to a new temp
+// file in tmpRoot and returns the name of the file.
+func extractImage(name, tmpRoot string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return "", errors.New("missing entry: image")
+		}
+		if err != nil {
+			return "", err
+		}
+		if hdr.Name != "image" {
+			continue
+		}
+		tmp, err := ioutil.TempFile(tmpRoot, "ova2stemcell-match-")
+		if err != nil {
+			return "", err
+		}
+		if _, err := copyBuffer(tmp, tr); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return "", err
+		}
+		if err := tmp.Close(); err != nil {
+			os.Remove(tmp.Name())
+			return "", err
+		}
+		return tmp.Name(), nil
+	}
+}
+
+// MatchStemcellImage reports to w which of the gzipCandidates, if any,
+// reproduces the image of stemcell tarball name from its decompressed
+// content.  The gzip header of the image is reported and used by the
+// candidates.  The image is extracted to a temp file in tmpRoot.  An error
+// is returned if no candidate matches, meaning that the image was
+// compressed by another gzip implementation or its content differs.
+func MatchStemcellImage(w io.Writer, name, tmpRoot string) error {
+	image, err := extractImage(name, tmpRoot)
+	if err != nil {
+		return fmt.Errorf("matching stemcell (%s): %s", name, err)
+	}
+	defer os.Remove(image)
+
+	f, err := os.Open(image)
+	if err != nil {
+		return fmt.Errorf("matching stemcell (%s): %s", name, err)
+	}
+	gr, err := gzip.NewReader(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("matching stemcell (%s): image is not gzip compressed: %s", name, err)
+	}
+	hdr := gr.Header
+	mtime := "none"
+	if !hdr.ModTime.IsZero() {
+		mtime = hdr.ModTime.UTC().Format("2006-01-02T15:04:05Z")
+	}
+	fmt.Fprintf(w, "image gzip header: os %d, mtime %s, name %q, comment %q\n",
+		hdr.OS, mtime, hdr.Name, hdr.Comment)
+	if hdr.OS != gzipOSUnknown || !hdr.ModTime.IsZero() || hdr.Name != "" || hdr.Comment != "" {
+		fmt.Fprintf(w, "image gzip header differs from the header ova2stemcell writes (os %d, no mtime or name)\n",
+			gzipOSUnknown)
+	}
+
+	for _, c := range gzipCandidates {
+		ok, err := matchCandidate(image, c, hdr)
+		if err != nil {
+			return fmt.Errorf("matching stemcell (%s): %s", name, err)
+		}
+		if ok {
+			fmt.Fprintf(w, "match: %s reproduces the image\n", c.Name)
+			return nil
+		}
+		fmt.Fprintf(w, "no match: %s\n", c.Name)
+	}
+	return fmt.Errorf("matching stemcell (%s): no candidate reproduces the image: it was compressed "+
+		"by another gzip implementation or its content differs", name)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchStemcellImage(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// larger than one parallel gzip block
+	var content bytes.Buffer
+	for i := 0; content.Len() < 5*parallelGzipBlockSize/2; i++ {
+		fmt.Fprintf(&content, "line %d of the image\n", i)
+	}
+	compress := func(newWriter func(w io.Writer) io.WriteCloser) string {
+		var b bytes.Buffer
+		w := newWriter(&b)
+		if _, err := w.Write(content.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+	level := func(level int, hdr gzip.Header) func(w io.Writer) io.WriteCloser {
+		return func(w io.Writer) io.WriteCloser {
+			gw, err := gzip.NewWriterLevel(w, level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gw.Header = hdr
+			return gw
+		}
+	}
+
+	tests := []struct {
+		name  string
+		image string
+		match string // expected output, empty if no candidate matches
+	}{
+		{
+			"default",
+			compress(func(w io.Writer) io.WriteCloser { return newGzipWriter(w) }),
+			"match: gzip level -1 (default",
+		},
+		{
+			"parallel",
+			compress(func(w io.Writer) io.WriteCloser { return newParallelGzipWriter(w, 4) }),
+			"match: 1 MiB gzip members",
+		},
+		{
+			"best-speed",
+			compress(level(gzip.BestSpeed, gzip.Header{Name: "image", ModTime: time.Unix(1500000000, 0), OS: 3})),
+			"match: gzip level 1 reproduces",
+		},
+		{
+			"flushed",
+			compress(func(w io.Writer) io.WriteCloser {
+				gw := gzip.NewWriter(w)
+				return &flushWriter{gw}
+			}),
+			"",
+		},
+	}
+	for _, x := range tests {
+		name := filepath.Join(dir, x.name+".tgz")
+		writeTestStemcell(t, name, []tarEntry{
+			{Name: "image", Body: x.image},
+			{Name: "stemcell.MF", Body: "name: test\n"},
+		})
+		var w bytes.Buffer
+		err := MatchStemcellImage(&w, name, dir)
+		if x.match == "" {
+			if err == nil || !strings.Contains(err.Error(), "no candidate reproduces") {
+				t.Errorf("%s: expected no candidate error got: %v\n%s", x.name, err, w.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s\n%s", x.name, err, w.String())
+			continue
+		}
+		if !strings.Contains(w.String(), x.match) {
+			t.Errorf("%s: expected output to contain %q got:\n%s", x.name, x.match, w.String())
+		}
+	}
+
+	name := filepath.Join(dir, "missing.tgz")
+	writeTestStemcell(t, name, []tarEntry{{Name: "stemcell.MF", Body: "name: test\n"}})
+	if err := MatchStemcellImage(ioutil.Discard, name, dir); err == nil {
+		t.Error("expected error for stemcell without an image")
+	}
+
+	// the extracted images are removed
+	tmp, err := filepath.Glob(filepath.Join(dir, "ova2stemcell-match-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmp) != 0 {
+		t.Errorf("temp files not removed: %q", tmp)
+	}
+}
+
+// flushWriter flushes its gzip.Writer after each write, which no candidate
+// of MatchStemcellImage does.
+type flushWriter struct {
+	*gzip.Writer
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err == nil {
+		err = w.Writer.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// MetricsSchema is the schema_version of the -metrics-file, incremented when
+// a field is removed or its meaning changes.
+const MetricsSchema = 1
+
+// The outcomes of a build recorded in the -metrics-file.
+const (
+	OutcomeSuccess     = "success"
+	OutcomeFailure     = "failure"
+	OutcomeInterrupted = "interrupted"
+	OutcomeTimeout     = "timeout"
+)
+
+// Metrics is the JSON document written to the -metrics-file at the end of
+// every build, successful or not.  Durations are in milliseconds.
+type Metrics struct {
+	SchemaVersion int               `json:"schema_version"`
+	ToolVersion   string            `json:"tool_version"`
+	Outcome       string            `json:"outcome"`
+	Error         string            `json:"error,omitempty"`
+	Started       time.Time         `json:"started"`
+	DurationMS    int64             `json:"duration_ms"`
+	Input         string            `json:"input"`
+	InputSize     int64             `json:"input_size"`
+	Versions      []string          `json:"versions"`
+	Steps         []jsonStep        `json:"steps"`     // duration of each step run
+	Artifacts     []metricsArtifact `json:"artifacts"` // files created, see BuildStep
+	Stemcells     []jsonStemcell    `json:"stemcells"` // empty unless the build succeeded
+}
+
+type metricsArtifact struct {
+	Step       string `json:"step"`
+	Version    string `json:"version,omitempty"`
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	Sha1       string `json:"sha1,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// buildOutcome returns the outcome of a build that returned err, stopped is
+// if its Config was stopped.  The error of an interrupted build may wrap
+// ErrInterupt, so stopped is used.
+func buildOutcome(err error, stopped bool) string {
+	switch err.(type) {
+	case nil:
+		return OutcomeSuccess
+	case *TimeoutError:
+		return OutcomeTimeout
+	}
+	if err == ErrInterupt || stopped {
+		return OutcomeInterrupted
+	}
+	return OutcomeFailure
+}
+
+// NewMetrics returns the Metrics of the build of versions by c that started
+// at start, returned results and err.
+func (c *Config) NewMetrics(versions []string, results []*BuildResult, err error, start time.Time) *Metrics {
+	m := &Metrics{
+		SchemaVersion: MetricsSchema,
+		ToolVersion:   ToolVersion(),
+		Outcome:       buildOutcome(err, c.stopped()),
+		Started:       start.UTC(),
+		DurationMS:    milliseconds(time.Since(start)),
+		Input:         c.input(),
+		InputSize:     c.inputSize,
+		Versions:      versions,
+		Steps:         []jsonStep{},
+		Artifacts:     []metricsArtifact{},
+		Stemcells:     []jsonStemcell{},
+	}
+	if err != nil {
+		m.Error = err.Error()
+	}
+	for _, t := range c.Timings {
+		m.Steps = append(m.Steps, jsonStep{
+			Name:       t.Name,
+			Version:    t.Version,
+			DurationMS: milliseconds(t.Duration),
+		})
+	}
+	c.mu.Lock()
+	for _, s := range c.Steps {
+		m.Artifacts = append(m.Artifacts, metricsArtifact{
+			Step:       s.Name,
+			Version:    s.Version,
+			Path:       s.Path,
+			Size:       s.Size,
+			Sha1:       s.Sha1,
+			DurationMS: milliseconds(s.Duration),
+		})
+	}
+	c.mu.Unlock()
+	for _, r := range results {
+		m.Stemcells = append(m.Stemcells, jsonStemcell{
+			Path:            r.StemcellPath,
+			Version:         r.Version,
+			OperatingSystem: r.OperatingSystem,
+			ImageSha1:       r.ImageSha1,
+			ImageSize:       r.ImageSize,
+			Sha1:            r.TarballSha1,
+			Sha256:          r.TarballSha256,
+			Unpacked:        r.Unpacked,
+			DurationMS:      milliseconds(r.Duration),
+		})
+	}
+	return m
+}
+
+// writeMetricsFile writes the Metrics of the build, see NewMetrics, to
+// c.MetricsFile.  The file is replaced atomically, so a reader never sees a
+// partial file.  Metrics are informational, a write error is logged but does
+// not fail the build.
+func (c *Config) writeMetricsFile(versions []string, results []*BuildResult, err error, start time.Time) {
+	m := c.NewMetrics(versions, results, err, start)
+	werr := c.replaceFile("metrics file", c.MetricsFile, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(m)
+	})
+	if werr != nil {
+		c.logger().Warnf("writing metrics file: %s", werr)
+		return
+	}
+	c.debugf("wrote metrics file: %s", c.MetricsFile)
+}
+
+// ValidateMetricsFile validates that -metrics-file name can be created.
+func ValidateMetricsFile(name string) error {
+	dir := filepath.Dir(name)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("metrics file (%s): %s", name, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("metrics file (%s): %s is not a directory", name, dir)
+	}
+	if err := checkWritable(dir); err != nil {
+		return fmt.Errorf("metrics file (%s): directory is not writable: %s", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRealMainMetricsFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+	name := filepath.Join(dir, "metrics.json")
+
+	tests := []struct {
+		input   string
+		outcome string
+		err     string
+	}{
+		{ova, OutcomeSuccess, ""},
+		{filepath.Join(dir, "missing.ova"), OutcomeFailure, "missing.ova"},
+	}
+	for _, x := range tests {
+		c := &Config{
+			OVAFile:     x.input,
+			OutputDir:   dir,
+			Force:       true,
+			MetricsFile: name,
+			Logger:      DiscardLogger,
+			stop:        make(chan struct{}),
+		}
+		results, err := realMain(c, []string{"1.2"})
+		c.Cleanup()
+		if (err == nil) != (x.err == "") {
+			t.Fatalf("%s: unexpected error: %v", x.outcome, err)
+		}
+
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("%s: %s", x.outcome, err)
+		}
+		var m Metrics
+		if err := json.Unmarshal(b, &m); err != nil {
+			t.Fatalf("%s: %s", x.outcome, err)
+		}
+		if m.Outcome != x.outcome || m.SchemaVersion != MetricsSchema || m.Input != x.input {
+			t.Errorf("%s: unexpected metrics: %+v", x.outcome, m)
+		}
+		if len(m.Steps) == 0 || m.Steps[0].Name != "validate" {
+			t.Errorf("%s: expected the validate step to be timed: %+v", x.outcome, m.Steps)
+		}
+		if x.err != "" {
+			if !strings.Contains(m.Error, x.err) || len(m.Stemcells) != 0 {
+				t.Errorf("%s: expected error %q and no stemcells got: %+v", x.outcome, x.err, m)
+			}
+			continue
+		}
+		if m.Error != "" || len(m.Stemcells) != 1 || m.Stemcells[0].Sha1 != results[0].TarballSha1 {
+			t.Errorf("%s: expected stemcell %+v got: %+v", x.outcome, results[0], m)
+		}
+		if m.InputSize == 0 || len(m.Artifacts) != 3 {
+			t.Errorf("%s: expected input size and 3 artifacts got: %+v", x.outcome, m)
+		}
+	}
+
+	// the file is replaced atomically, no temp file is left
+	list, err := filepath.Glob(filepath.Join(dir, ".metrics.json.tmp-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 {
+		t.Errorf("temp files not removed: %q", list)
+	}
+}
+
+func TestBuildOutcome(t *testing.T) {
+	tests := []struct {
+		err     error
+		stopped bool
+		exp     string
+	}{
+		{nil, false, OutcomeSuccess},
+		{errors.New("bad"), false, OutcomeFailure},
+		{ErrInterupt, false, OutcomeInterrupted},
+		{errors.New("adding file: interrupted"), true, OutcomeInterrupted},
+		{&TimeoutError{Step: "image"}, true, OutcomeTimeout},
+	}
+	for _, x := range tests {
+		if s := buildOutcome(x.err, x.stopped); s != x.exp {
+			t.Errorf("buildOutcome(%v, %t) = %q; want: %q", x.err, x.stopped, s, x.exp)
+		}
+	}
+}
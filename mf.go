@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// An MFEntry is a line of an OVF package manifest (.mf) file, for example:
+//
+//	SHA256(vm.ovf)= 0123...
+type MFEntry struct {
+	Algorithm string // SHA1, SHA256 or SHA512
+	Filename  string
+	Digest    string
+}
+
+var mfLineRe = regexp.MustCompile(`^(SHA1|SHA256|SHA512)\((.+)\)\s*=\s*([[:xdigit:]]+)$`)
+
+func parseMFLine(line string) (MFEntry, bool) {
+	m := mfLineRe.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return MFEntry{}, false
+	}
+	return MFEntry{Algorithm: m[1], Filename: m[2], Digest: strings.ToLower(m[3])}, true
+}
+
+// ParseMF parses the entries of an OVF package manifest.
+func ParseMF(r io.Reader) ([]MFEntry, error) {
+	var entries []MFEntry
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		e, ok := parseMFLine(line)
+		if !ok {
+			return nil, fmt.Errorf("mf: invalid line %d: %q", n, line)
+		}
+		entries = append(entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// newMFHash returns a new hash.Hash for manifest algorithm alg.
+func newMFHash(alg string) (hash.Hash, error) {
+	switch alg {
+	case "SHA1":
+		return sha1.New(), nil
+	case "SHA256":
+		return sha256.New(), nil
+	case "SHA512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("mf: unsupported digest algorithm: %s", alg)
+}
+
+func hashFile(h hash.Hash, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = copyBuffer(h, f)
+	return err
+}
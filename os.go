@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultOS is the operating system of stemcells if none is specified.
+const DefaultOS = "windows2012R2"
+
+// An OSDescriptor describes how stemcells for an operating system are named.
+type OSDescriptor struct {
+	// OS is the operating_system of the manifest and the OS segment of the
+	// stemcell filename, e.g. "windows2012R2".
+	OS string
+
+	// ManifestOS is the OS segment of the manifest name, e.g. "windows-2012R2".
+	ManifestOS string
+
+	// OVFNames are case-insensitive substrings of the vmw:osType or
+	// Description of an OVF's OperatingSystemSection that identify the
+	// operating system, see OVFMetadata.OS.
+	OVFNames []string
+}
+
+// OperatingSystems are the supported stemcell operating systems.
+var OperatingSystems = map[string]*OSDescriptor{
+	"windows2012R2": {
+		OS:         "windows2012R2",
+		ManifestOS: "windows-2012R2",
+		OVFNames:   []string{"windows8Server64Guest", "Windows Server 2012"},
+	},
+	"ubuntu-xenial": {
+		OS:         "ubuntu-xenial",
+		ManifestOS: "ubuntu-xenial",
+		OVFNames:   []string{"Ubuntu 16.04", "xenial"},
+	},
+	"ubuntu-bionic": {
+		OS:         "ubuntu-bionic",
+		ManifestOS: "ubuntu-bionic",
+		OVFNames:   []string{"Ubuntu 18.04", "bionic"},
+	},
+}
+
+// OperatingSystemNames returns the sorted names of the supported operating
+// systems.
+func OperatingSystemNames() []string {
+	var names []string
+	for name := range OperatingSystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupOS returns the OSDescriptor for operating system name.
+func LookupOS(name string) (*OSDescriptor, error) {
+	if d, ok := OperatingSystems[name]; ok {
+		return d, nil
+	}
+	return nil, fmt.Errorf("unsupported operating system (%s) expected one of: %s",
+		name, strings.Join(OperatingSystemNames(), ", "))
+}
+
+// lookupOS is like LookupOS, but returns a descriptor using name for all
+// segments if the operating system is not supported.  It is used where the
+// operating system has already been validated.
+func lookupOS(name string) *OSDescriptor {
+	if d, err := LookupOS(name); err == nil {
+		return d
+	}
+	return &OSDescriptor{OS: name, ManifestOS: name}
+}
+
+func ValidateOS(name string) error {
+	_, err := LookupOS(name)
+	return err
+}
+
+// StemcellFilename returns the name of the stemcell tarball.
+func (d *OSDescriptor) StemcellFilename(version string) string {
+	return fmt.Sprintf("bosh-stemcell-%s-vsphere-esxi-%s-go_agent.tgz", version, d.OS)
+}
+
+// ParseStemcellFilename returns the version and operating system of stemcell
+// filename name, which must match the pattern of StemcellFilename
+// ("bosh-stemcell-VERSION-vsphere-esxi-OS-go_agent.tgz").  The ".tgz"
+// extension is optional so that the directories of unpacked stemcells may be
+// parsed.  If name does not match the pattern ok is false.
+func ParseStemcellFilename(name string) (version, osName string, ok bool) {
+	s := strings.TrimSuffix(name, ".tgz")
+	if !strings.HasPrefix(s, "bosh-stemcell-") || !strings.HasSuffix(s, "-go_agent") {
+		return "", "", false
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "bosh-stemcell-"), "-go_agent")
+	i := strings.Index(s, "-vsphere-esxi-")
+	if i <= 0 {
+		return "", "", false
+	}
+	version, osName = s[:i], s[i+len("-vsphere-esxi-"):]
+	if osName == "" || ValidateVersion(version) != nil {
+		return "", "", false
+	}
+	return version, osName, true
+}
+
+// ValidateFilenameVersion returns an error if stemcell filename name, with
+// the pattern of StemcellFilename, contains a version other than version.
+// Names with another pattern are not checked.
+func ValidateFilenameVersion(name, version string) error {
+	v, _, ok := ParseStemcellFilename(name)
+	if ok && v != version {
+		return fmt.Errorf("stemcell filename (%s) has version (%s) but the stemcell "+
+			"version is (%s)", name, v, version)
+	}
+	return nil
+}
+
+// ManifestName returns the name field of the stemcell manifest.
+func (d *OSDescriptor) ManifestName() string {
+	return d.ManifestNameAgent(DefaultAgent)
+}
+
+// ManifestNameAgent returns the name field of the stemcell manifest with
+// agent as the agent suffix, e.g. "go_agent-hardened".
+func (d *OSDescriptor) ManifestNameAgent(agent string) string {
+	return d.ManifestNameIaaS(IaaSes[DefaultIaaS], agent)
+}
+
+// ManifestNameIaaS returns the name field of the stemcell manifest for iaas
+// with agent as the agent suffix, e.g. "bosh-aws-xen-hvm-ubuntu-xenial-go_agent".
+func (d *OSDescriptor) ManifestNameIaaS(iaas *IaaSDescriptor, agent string) string {
+	return fmt.Sprintf("bosh-%s-%s-%s", iaas.Infrastructure, d.ManifestOS, agent)
+}
+
+// DefaultAgent is the agent suffix of the manifest name.
+const DefaultAgent = "go_agent"
+
+var agentRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// ValidateAgent validates the manifest agent suffix, only letters, digits,
+// '_', '.' and '-' are allowed so that it is safe in YAML and filenames.
+func ValidateAgent(agent string) error {
+	if len(agent) > 64 || !agentRe.MatchString(agent) {
+		return fmt.Errorf("invalid agent suffix (%s): must start with a letter or "+
+			"digit and contain only letters, digits, '_', '.' and '-'", agent)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+)
+
+// gzipMagic are the first bytes of a gzip stream, see RFC 1952.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// An ovaFile is an open OVA file.  If the OVA is gzip compressed, e.g.
+// "vm.ova.gz", reads return the decompressed tar archive.  Concatenated gzip
+// members are read as one stream (gzip.Reader's multistream mode).
+type ovaFile struct {
+	io.Reader
+	f  *os.File
+	gz *gzip.Reader
+}
+
+// openOVA opens OVA file name, gzip compression is detected by the magic
+// bytes at the start of the file not the extension.
+func openOVA(name string) (*ovaFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, len(gzipMagic))
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if n != len(gzipMagic) || !bytes.Equal(magic, gzipMagic) {
+		return &ovaFile{Reader: f, f: f}, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &ovaFile{Reader: gz, f: f, gz: gz}, nil
+}
+
+// Compressed returns if the OVA file is gzip compressed.
+func (o *ovaFile) Compressed() bool { return o.gz != nil }
+
+// Stat returns the FileInfo of the underlying, possibly compressed, file.
+func (o *ovaFile) Stat() (os.FileInfo, error) { return o.f.Stat() }
+
+// Close closes the OVA file.
+func (o *ovaFile) Close() error {
+	var err error
+	if o.gz != nil {
+		err = o.gz.Close()
+	}
+	if cerr := o.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// isGzipFile returns if file name starts with the gzip magic bytes.
+func isGzipFile(name string) bool {
+	f, err := openOVA(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return f.Compressed()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// gzipFile writes a gzip compressed copy of file src to dst.
+func gzipFile(t testing.TB, src, dst string) string {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := gzip.NewWriter(f)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return dst
+}
+
+func TestGzipOVA(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: testOVF},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+	gz := gzipFile(t, ova, filepath.Join(dir, "vm.ova.gz"))
+
+	if isGzipFile(ova) || !isGzipFile(gz) {
+		t.Fatalf("isGzipFile: got %t, %t want false, true", isGzipFile(ova), isGzipFile(gz))
+	}
+	if err := ValidateOVAFile(DiscardLogger, gz, true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadOVFMetadata(gz); err != nil {
+		t.Fatal(err)
+	}
+
+	sha1sum := func(name string, limit int64) string {
+		c := &Config{
+			Version:          "1.2",
+			MemoryImageLimit: limit,
+			Logger:           DiscardLogger,
+			stop:             make(chan struct{}),
+		}
+		defer c.Cleanup()
+		if err := c.CreateImageFromOVA(name); err != nil {
+			t.Fatal(err)
+		}
+		return c.Sha1sum
+	}
+	// the image of a compressed ova must be the same as an uncompressed ova
+	want := sha1sum(ova, 0)
+	for _, limit := range []int64{0, 1 << 20} {
+		if got := sha1sum(gz, limit); got != want {
+			t.Errorf("CreateImageFromOVA (limit %d): sha1: got %s want %s", limit, got, want)
+		}
+	}
+
+	// truncated gzip stream
+	data, err := ioutil.ReadFile(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := filepath.Join(dir, "bad.ova.gz")
+	if err := ioutil.WriteFile(bad, data[:len(data)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateOVAFile(DiscardLogger, bad, false, false, nil); err == nil {
+		t.Error("ValidateOVAFile: expected error for truncated gzip ova")
+	}
+}
+
+func TestGzipOVAMultistream(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: testOVF},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+	data, err := ioutil.ReadFile(ova)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// compress the two halves of the ova as separate gzip members
+	var b bytes.Buffer
+	for _, p := range [][]byte{data[:len(data)/2], data[len(data)/2:]} {
+		w := gzip.NewWriter(&b)
+		if _, err := w.Write(p); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gz := filepath.Join(dir, "vm.ova.gz")
+	if err := ioutil.WriteFile(gz, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ValidateOVAFile(DiscardLogger, gz, true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	f, err := openOVA(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("openOVA: read %d bytes of concatenated gzip members want %d", len(got), len(data))
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxOVFSize is the largest .ovf descriptor that will be parsed.
+const maxOVFSize = 16 << 20
+
+// OVFMetadata is the stemcell metadata found in an OVF descriptor.
+type OVFMetadata struct {
+	Version       string // ProductSection/Version
+	OSType        string // OperatingSystemSection vmw:osType attribute
+	OSDescription string // OperatingSystemSection/Description
+	Devices       []OVFDevice
+	Files         []string // References/File href attributes, in order
+}
+
+// An OVFDevice is an Item of the VirtualHardwareSection of an OVF.
+type OVFDevice struct {
+	ElementName  string
+	ResourceType int // CIM_ResourceAllocationSettingData ResourceType, 0 if invalid
+}
+
+// ovfDeviceTypes maps the ResourceType of an OVFDevice to its name, as used by
+// -ovf-allow-devices, and a description.  Several types may share a name.
+var ovfDeviceTypes = map[int]struct{ Name, Desc string }{
+	1:  {"other", "other device"},
+	3:  {"processor", "processor"},
+	4:  {"memory", "memory"},
+	5:  {"controller", "IDE controller"},
+	6:  {"controller", "SCSI controller"},
+	7:  {"controller", "Fibre Channel controller"},
+	8:  {"controller", "iSCSI controller"},
+	10: {"ethernet", "ethernet adapter"},
+	11: {"network", "other network adapter"},
+	14: {"floppy", "floppy drive"},
+	15: {"cdrom", "CD drive"},
+	16: {"cdrom", "DVD drive"},
+	17: {"disk", "disk drive"},
+	20: {"controller", "other storage controller"},
+	21: {"serial", "serial port"},
+	22: {"parallel", "parallel port"},
+	23: {"usb", "USB controller"},
+	24: {"video", "graphics controller"},
+	35: {"sound", "sound card"},
+}
+
+// Name returns the -ovf-allow-devices name of d, the ResourceType of devices
+// without a name.
+func (d OVFDevice) Name() string {
+	if t, ok := ovfDeviceTypes[d.ResourceType]; ok {
+		return t.Name
+	}
+	return strconv.Itoa(d.ResourceType)
+}
+
+func (d OVFDevice) String() string {
+	desc := "unknown device"
+	if t, ok := ovfDeviceTypes[d.ResourceType]; ok {
+		desc = t.Desc
+	}
+	return fmt.Sprintf("%s %q (ResourceType %d)", desc, d.ElementName, d.ResourceType)
+}
+
+// OVFDeviceNames returns the sorted names accepted by ParseOVFDevices.
+func OVFDeviceNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, t := range ovfDeviceTypes {
+		if !seen[t.Name] {
+			seen[t.Name] = true
+			names = append(names, t.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseOVFDevices parses the comma separated device names, or ResourceType
+// numbers, of -ovf-allow-devices.  An empty string returns nil, no device
+// check.
+func ParseOVFDevices(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	known := make(map[string]bool)
+	for _, t := range ovfDeviceTypes {
+		known[t.Name] = true
+	}
+	names := []string{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, err := strconv.Atoi(name); err != nil && !known[name] {
+			return nil, fmt.Errorf("invalid ovf device (%s): must be a ResourceType number or one of: %s",
+				name, strings.Join(OVFDeviceNames(), ", "))
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// CheckOVFDevices returns an error listing the devices of m whose name is not
+// in allow, see ParseOVFDevices.  The processor and memory are not devices
+// and are always allowed.
+func CheckOVFDevices(m *OVFMetadata, allow []string) error {
+	allowed := map[string]bool{"processor": true, "memory": true}
+	for _, name := range allow {
+		allowed[name] = true
+	}
+	var bad []string
+	for _, d := range m.Devices {
+		if !allowed[d.Name()] && !allowed[strconv.Itoa(d.ResourceType)] {
+			bad = append(bad, d.String())
+		}
+	}
+	if len(bad) != 0 {
+		return fmt.Errorf("devices not allowed by -ovf-allow-devices (%s): %s",
+			strings.Join(allow, ","), strings.Join(bad, ", "))
+	}
+	return nil
+}
+
+type ovfEnvelope struct {
+	References struct {
+		Files []struct {
+			Href string `xml:"href,attr"`
+		} `xml:"File"`
+	} `xml:"References"`
+	VirtualSystem struct {
+		ProductSection struct {
+			Version string `xml:"Version"`
+		} `xml:"ProductSection"`
+		OperatingSystemSection struct {
+			OSType      string `xml:"osType,attr"`
+			Description string `xml:"Description"`
+		} `xml:"OperatingSystemSection"`
+		VirtualHardwareSection struct {
+			Items []struct {
+				ElementName  string `xml:"ElementName"`
+				ResourceType string `xml:"ResourceType"`
+			} `xml:"Item"`
+		} `xml:"VirtualHardwareSection"`
+	} `xml:"VirtualSystem"`
+}
+
+// ParseOVFMetadata parses the metadata of the OVF descriptor read from r.
+func ParseOVFMetadata(r io.Reader) (*OVFMetadata, error) {
+	var env ovfEnvelope
+	if err := xml.NewDecoder(io.LimitReader(r, maxOVFSize)).Decode(&env); err != nil {
+		return nil, fmt.Errorf("parsing ovf: %s", err)
+	}
+	vs := env.VirtualSystem
+	m := &OVFMetadata{
+		Version:       strings.TrimSpace(vs.ProductSection.Version),
+		OSType:        strings.TrimSpace(vs.OperatingSystemSection.OSType),
+		OSDescription: strings.TrimSpace(vs.OperatingSystemSection.Description),
+	}
+	for _, item := range vs.VirtualHardwareSection.Items {
+		n, _ := strconv.Atoi(strings.TrimSpace(item.ResourceType))
+		m.Devices = append(m.Devices, OVFDevice{
+			ElementName:  strings.TrimSpace(item.ElementName),
+			ResourceType: n,
+		})
+	}
+	for _, f := range env.References.Files {
+		m.Files = append(m.Files, strings.TrimSpace(f.Href))
+	}
+	return m, nil
+}
+
+// ReadOVFMetadata returns the metadata of the .ovf descriptor in OVA file or
+// OVF directory name.
+func ReadOVFMetadata(name string) (*OVFMetadata, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		matches, err := filepath.Glob(filepath.Join(name, "*.ovf"))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) != 1 {
+			return nil, fmt.Errorf("ovf directory (%s): expected one .ovf file found: %d",
+				name, len(matches))
+		}
+		f, err := os.Open(matches[0])
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return ParseOVFMetadata(f)
+	}
+
+	f, err := openOVA(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("ova file (%s): missing .ovf file", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ova file (%s): %s", name, err)
+		}
+		if filepath.Ext(cleanTarName(h.Name)) == ".ovf" && h.Typeflag == tar.TypeReg {
+			m, err := ParseOVFMetadata(tr)
+			if err != nil {
+				return nil, fmt.Errorf("ova file (%s): %s", name, err)
+			}
+			return m, nil
+		}
+	}
+}
+
+// OS returns the name of the supported operating system described by the
+// OVF, see OSDescriptor.OVFNames.
+func (m *OVFMetadata) OS() (string, error) {
+	var found []string
+	for _, name := range OperatingSystemNames() {
+		for _, s := range OperatingSystems[name].OVFNames {
+			s = strings.ToLower(s)
+			if strings.Contains(strings.ToLower(m.OSType), s) ||
+				strings.Contains(strings.ToLower(m.OSDescription), s) {
+				found = append(found, name)
+				break
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", errors.New("ovf: operating system not recognized")
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("ovf: ambiguous operating system: %s", strings.Join(found, ", "))
+}
+
+// ovfFileOrder sorts the files fis of an OVF directory into the order they
+// are added to the image: the .ovf descriptor, the .mf manifest and .cert
+// certificate, then the files referenced by the descriptor in the order of
+// refs, its References section, then any other files in their order in fis.
+func ovfFileOrder(fis []os.FileInfo, refs []string) {
+	rank := make(map[string]int, len(refs))
+	for i, name := range refs {
+		if _, ok := rank[name]; !ok {
+			rank[name] = 3 + i
+		}
+	}
+	order := func(fi os.FileInfo) int {
+		switch filepath.Ext(fi.Name()) {
+		case ".ovf":
+			return 0
+		case ".mf":
+			return 1
+		case ".cert":
+			return 2
+		}
+		if n, ok := rank[fi.Name()]; ok {
+			return n
+		}
+		return 3 + len(refs)
+	}
+	sort.SliceStable(fis, func(i, j int) bool {
+		return order(fis[i]) < order(fis[j])
+	})
+}
+
+// readOVFReferences returns the References of the .ovf descriptor of files
+// fis of OVF directory dirname, nil if there is no descriptor.
+func readOVFReferences(dirname string, fis []os.FileInfo) ([]string, error) {
+	for _, fi := range fis {
+		if filepath.Ext(fi.Name()) != ".ovf" {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dirname, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		m, err := ParseOVFMetadata(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fi.Name(), err)
+		}
+		return m.Files, nil
+	}
+	return nil, nil
+}
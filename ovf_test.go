@@ -0,0 +1,273 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testOVF = `<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1"
+    xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1"
+    xmlns:vmw="http://www.vmware.com/schema/ovf">
+  <VirtualSystem ovf:id="vm">
+    <OperatingSystemSection ovf:id="112" vmw:osType="windows8Server64Guest">
+      <Info>The kind of installed guest operating system</Info>
+      <Description>Microsoft Windows Server 2012 (64-bit)</Description>
+    </OperatingSystemSection>
+    <ProductSection>
+      <Info>Information about the installed software</Info>
+      <Product>stemcell</Product>
+      <Version>1200.4</Version>
+    </ProductSection>
+  </VirtualSystem>
+</Envelope>
+`
+
+func TestParseOVFMetadata(t *testing.T) {
+	m, err := ParseOVFMetadata(strings.NewReader(testOVF))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := OVFMetadata{
+		Version:       "1200.4",
+		OSType:        "windows8Server64Guest",
+		OSDescription: "Microsoft Windows Server 2012 (64-bit)",
+	}
+	if !reflect.DeepEqual(*m, exp) {
+		t.Errorf("ParseOVFMetadata: got %+v want %+v", *m, exp)
+	}
+	if name, err := m.OS(); err != nil || name != "windows2012R2" {
+		t.Errorf("OVFMetadata.OS: got %q, %v want %q", name, err, "windows2012R2")
+	}
+
+	tests := []struct {
+		m    OVFMetadata
+		exp  string
+		fail bool
+	}{
+		{OVFMetadata{OSType: "ubuntu64Guest", OSDescription: "Ubuntu 18.04 LTS"}, "ubuntu-bionic", false},
+		{OVFMetadata{OSType: "ubuntu64Guest", OSDescription: "Ubuntu Linux (64-bit)"}, "", true},
+		{OVFMetadata{OSDescription: "ubuntu xenial and bionic"}, "", true},
+	}
+	for _, x := range tests {
+		name, err := x.m.OS()
+		if (err != nil) != x.fail || name != x.exp {
+			t.Errorf("OVFMetadata.OS(%+v): got %q, %v want %q", x.m, name, err, x.exp)
+		}
+	}
+}
+
+func TestReadOVFMetadata(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "./vm.ovf", Body: testOVF},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+	ovf := filepath.Join(dir, "ovf")
+	if err := os.Mkdir(ovf, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(ovf, "vm.ovf"), []byte(testOVF), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{ova, ovf} {
+		m, err := ReadOVFMetadata(name)
+		if err != nil {
+			t.Errorf("ReadOVFMetadata(%s): %s", name, err)
+			continue
+		}
+		if m.Version != "1200.4" {
+			t.Errorf("ReadOVFMetadata(%s): version: got %q", name, m.Version)
+		}
+	}
+
+	missing := createTar(t, dir, "missing.ova", []tarEntry{{Name: "vm-disk1.vmdk", Body: "disk"}})
+	if _, err := ReadOVFMetadata(missing); err == nil {
+		t.Error("ReadOVFMetadata: expected error for ova without an .ovf")
+	}
+}
+
+// testDevicesOVF has a USB controller and a sound card, that VMware exports
+// as an "other" device.
+const testDevicesOVF = `<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1"
+    xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1"
+    xmlns:rasd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData">
+  <VirtualSystem ovf:id="vm">
+    <VirtualHardwareSection>
+      <Info>Virtual hardware requirements</Info>
+      <Item>
+        <rasd:ElementName>2 virtual CPU(s)</rasd:ElementName>
+        <rasd:ResourceType>3</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:ElementName>4096MB of memory</rasd:ElementName>
+        <rasd:ResourceType>4</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:ElementName>SCSI Controller 0</rasd:ElementName>
+        <rasd:ResourceType>6</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:ElementName>Hard Disk 1</rasd:ElementName>
+        <rasd:ResourceType> 17 </rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:ElementName>Network adapter 1</rasd:ElementName>
+        <rasd:ResourceType>10</rasd:ResourceType>
+      </Item>
+      <Item ovf:required="false">
+        <rasd:ElementName>USB Controller (EHCI)</rasd:ElementName>
+        <rasd:ResourceType>23</rasd:ResourceType>
+      </Item>
+      <Item ovf:required="false">
+        <rasd:ElementName>Sound Card</rasd:ElementName>
+        <rasd:ResourceSubType>vmware.soundcard.hdaudio</rasd:ResourceSubType>
+        <rasd:ResourceType>1</rasd:ResourceType>
+      </Item>
+    </VirtualHardwareSection>
+  </VirtualSystem>
+</Envelope>
+`
+
+func TestCheckOVFDevices(t *testing.T) {
+	m, err := ParseOVFMetadata(strings.NewReader(testDevicesOVF))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Devices) != 7 || m.Devices[3] != (OVFDevice{"Hard Disk 1", 17}) {
+		t.Fatalf("ParseOVFMetadata: devices: got %+v", m.Devices)
+	}
+
+	tests := []struct {
+		allow string
+		bad   []string // names of the devices not allowed
+	}{
+		{"disk,controller,ethernet,usb,other", nil},
+		{"disk, controller, ethernet, 23, 1", nil},
+		{"disk,controller,ethernet", []string{`USB controller "USB Controller (EHCI)"`, `other device "Sound Card"`}},
+		{"disk,controller", []string{"ethernet adapter", "USB controller", "other device"}},
+	}
+	for _, x := range tests {
+		allow, err := ParseOVFDevices(x.allow)
+		if err != nil {
+			t.Errorf("ParseOVFDevices(%q): %s", x.allow, err)
+			continue
+		}
+		err = CheckOVFDevices(m, allow)
+		if x.bad == nil {
+			if err != nil {
+				t.Errorf("CheckOVFDevices(%q): %s", x.allow, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("CheckOVFDevices(%q): expected error", x.allow)
+			continue
+		}
+		for _, s := range x.bad {
+			if !strings.Contains(err.Error(), s) {
+				t.Errorf("CheckOVFDevices(%q): expected error to contain %q got: %s", x.allow, s, err)
+			}
+		}
+		if strings.Contains(err.Error(), "processor") || strings.Contains(err.Error(), "disk drive") {
+			t.Errorf("CheckOVFDevices(%q): error includes allowed devices: %s", x.allow, err)
+		}
+	}
+
+	for _, s := range []string{"", " , "} {
+		if allow, err := ParseOVFDevices(s); err != nil || (s == "" && allow != nil) {
+			t.Errorf("ParseOVFDevices(%q): got %q, %v", s, allow, err)
+		}
+	}
+	if _, err := ParseOVFDevices("disk,webcam"); err == nil {
+		t.Error("ParseOVFDevices: expected error for unknown device name")
+	}
+
+	// the devices are checked when the input is validated
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: testDevicesOVF},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+	c := &Config{OVAFile: ova, AllowDevices: []string{"disk", "controller", "ethernet"}}
+	if err := c.ValidateInput(); err == nil || !strings.Contains(err.Error(), "USB controller") {
+		t.Errorf("ValidateInput: expected USB controller error got: %v", err)
+	}
+	c.AllowDevices = nil
+	if err := c.ValidateInput(); err != nil {
+		t.Errorf("ValidateInput: without AllowDevices: %s", err)
+	}
+}
+
+const testReferencesOVF = `<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1"
+    xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1">
+  <References>
+    <File ovf:href="vm-disk2.vmdk" ovf:id="file1" ovf:size="5"/>
+    <File ovf:href="vm-disk10.vmdk" ovf:id="file2" ovf:size="5"/>
+    <File ovf:href="vm-disk1.vmdk" ovf:id="file3" ovf:size="5"/>
+  </References>
+</Envelope>
+`
+
+func TestCreateImageFromOVFOrder(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ovf := filepath.Join(dir, "ovf")
+	if err := os.Mkdir(ovf, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range map[string]string{
+		"vm.ovf":         testReferencesOVF,
+		"vm.mf":          "",
+		"vm-disk1.vmdk":  "disk1",
+		"vm-disk10.vmdk": "disk10",
+		"vm-disk2.vmdk":  "disk2",
+		"README":         "other",
+		"a.txt":          "other",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(ovf, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &Config{TmpRoot: dir, Logger: DiscardLogger, stop: make(chan struct{})}
+	defer c.Cleanup()
+	if err := c.CreateImageFromOVF(ovf); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(c.Image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	names, _ := readStemcell(t, f)
+	exp := []string{"vm.ovf", "vm.mf", "vm-disk2.vmdk", "vm-disk10.vmdk", "vm-disk1.vmdk", "README", "a.txt"}
+	if !reflect.DeepEqual(names, exp) {
+		t.Errorf("image entries: got %q want %q", names, exp)
+	}
+
+	m, err := ReadOVFMetadata(ovf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := exp[2:5]; !reflect.DeepEqual(m.Files, exp) {
+		t.Errorf("OVFMetadata.Files: got %q want %q", m.Files, exp)
+	}
+
+	// the descriptor must be valid
+	if err := ioutil.WriteFile(filepath.Join(ovf, "vm.ovf"), []byte("<Envelope>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateImageFromOVF(ovf); err == nil {
+		t.Error("expected error for invalid .ovf descriptor")
+	}
+}
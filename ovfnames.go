@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// An OVFNamePolicy is the files an OVF package must, and may, contain by
+// file extension, see Validate.
+type OVFNamePolicy struct {
+	Required []string       // extensions of which at least one file is required
+	Max      map[string]int // maximum number of files of an extension, others are unlimited
+}
+
+// DefaultOVFNamePolicy is the minimal check of the OVF specification: exactly
+// one .ovf descriptor and at most one .mf manifest and .cert certificate.
+// Source: http://www.dmtf.org/sites/default/files/standards/documents/DSP0243_2.1.1.pdf
+var DefaultOVFNamePolicy = &OVFNamePolicy{
+	Required: []string{".ovf"},
+	Max:      map[string]int{".ovf": 1, ".mf": 1, ".cert": 1},
+}
+
+// OVFNamePolicies are the presets of -ovf-name-policy.
+var OVFNamePolicies = map[string]*OVFNamePolicy{
+	"default": DefaultOVFNamePolicy,
+	// the package must have a manifest, so that its files can be verified
+	"strict": {
+		Required: []string{".ovf", ".mf"},
+		Max:      map[string]int{".ovf": 1, ".mf": 1, ".cert": 1},
+	},
+	// only the descriptor is checked
+	"lenient": {
+		Required: []string{".ovf"},
+		Max:      map[string]int{".ovf": 1},
+	},
+}
+
+// OVFNamePolicyNames returns the sorted names of OVFNamePolicies.
+func OVFNamePolicyNames() []string {
+	var names []string
+	for name := range OVFNamePolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupOVFNamePolicy returns the OVFNamePolicies preset name, if name is
+// empty DefaultOVFNamePolicy is returned.
+func LookupOVFNamePolicy(name string) (*OVFNamePolicy, error) {
+	if name == "" {
+		return DefaultOVFNamePolicy, nil
+	}
+	if p, ok := OVFNamePolicies[name]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("invalid ovf name policy (%s): must be one of: %s",
+		name, strings.Join(OVFNamePolicyNames(), ", "))
+}
+
+// ValidateOVFNamePolicy validates -ovf-name-policy name.
+func ValidateOVFNamePolicy(name string) error {
+	_, err := LookupOVFNamePolicy(name)
+	return err
+}
+
+// extensions returns the extensions checked by p, the Required extensions
+// first.
+func (p *OVFNamePolicy) extensions() []string {
+	seen := make(map[string]bool)
+	exts := append([]string(nil), p.Required...)
+	for _, ext := range exts {
+		seen[ext] = true
+	}
+	var rest []string
+	for ext := range p.Max {
+		if !seen[ext] {
+			rest = append(rest, ext)
+		}
+	}
+	sort.Strings(rest)
+	return append(exts, rest...)
+}
+
+// Validate validates that OVF package files names satisfy p.
+func (p *OVFNamePolicy) Validate(names []string) error {
+	// file extensions - for validation
+	exts := make(map[string]int)
+	for _, s := range names {
+		exts[filepath.Ext(s)]++
+	}
+
+	// list files by ext - for error messages
+	byExt := func(ext string) string {
+		var a []string
+		for _, s := range names {
+			if filepath.Ext(s) == ext {
+				a = append(a, s)
+			}
+		}
+		return strings.Join(a, ", ")
+	}
+
+	required := make(map[string]bool)
+	for _, ext := range p.Required {
+		required[ext] = true
+	}
+	for _, ext := range p.extensions() {
+		n := exts[ext]
+		if n == 0 && required[ext] {
+			return fmt.Errorf("missing %s file (one is required)", ext)
+		}
+		max, ok := p.Max[ext]
+		if !ok || n <= max {
+			continue
+		}
+		switch {
+		case max == 1 && required[ext]:
+			return fmt.Errorf("multiple %s files (expected one): %s", ext, byExt(ext))
+		case max == 1:
+			return fmt.Errorf("multiple %s files (expected one or zero): %s", ext, byExt(ext))
+		default:
+			return fmt.Errorf("too many %s files (expected at most %d): %s", ext, max, byExt(ext))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// ExpandPath expands a leading "~" or "~user" in path name to the home
+// directory and returns the absolute path of the result.  Relative paths are
+// resolved against the working directory.  An empty name is returned as is.
+func ExpandPath(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	if strings.HasPrefix(name, "~") {
+		i := strings.IndexAny(name, `/`+string(filepath.Separator))
+		if i == -1 {
+			i = len(name)
+		}
+		var home string
+		if username := name[1:i]; username == "" {
+			dir, err := os.UserHomeDir()
+			if err != nil {
+				return "", fmt.Errorf("expanding path (%s): %s", name, err)
+			}
+			home = dir
+		} else {
+			u, err := user.Lookup(username)
+			if err != nil {
+				return "", fmt.Errorf("expanding path (%s): %s", name, err)
+			}
+			home = u.HomeDir
+		}
+		name = home + name[i:]
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", fmt.Errorf("expanding path (%s): %s", name, err)
+	}
+	return abs, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpandPath(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs := filepath.Join(wd, "abs", "vm.ova")
+	tests := []struct {
+		in, exp string
+	}{
+		{"", ""},
+		{"~", home},
+		{"~/images/vm.ova", filepath.Join(home, "images", "vm.ova")},
+		{"./vm.ova", filepath.Join(wd, "vm.ova")},
+		{"vm.ova", filepath.Join(wd, "vm.ova")},
+		{"a/../vm.ova", filepath.Join(wd, "vm.ova")},
+		{abs, abs},
+		{"foo~/vm.ova", filepath.Join(wd, "foo~", "vm.ova")},
+	}
+	for _, x := range tests {
+		s, err := ExpandPath(x.in)
+		if err != nil {
+			t.Errorf("ExpandPath(%q): %s", x.in, err)
+			continue
+		}
+		if s != x.exp {
+			t.Errorf("ExpandPath(%q): got %q want %q", x.in, s, x.exp)
+		}
+	}
+	if _, err := ExpandPath("~no-such-user-ova2stemcell/vm.ova"); err == nil {
+		t.Error("ExpandPath: expected error for unknown user")
+	}
+}
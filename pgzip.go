@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+)
+
+// parallelGzipBlockSize is the size of the blocks compressed concurrently by
+// a parallelGzipWriter.
+const parallelGzipBlockSize = 1 << 20
+
+// A parallelGzipWriter gzip compresses blocks of its input concurrently.
+// Each block is written as a separate gzip member, the concatenation of
+// which is a valid gzip stream (RFC 1952) that compress/gzip, and gzip(1),
+// read as one.  The output depends only on the input, not on the number of
+// threads, but is slightly larger than that of a gzip.Writer.
+//
+// At most threads blocks are compressed, and held in memory, at once.
+// Blocks are compressed in their own goroutine, so no goroutines are leaked
+// if the writer is not closed.
+type parallelGzipWriter struct {
+	w       io.Writer
+	threads int
+	buf     []byte
+	pending []chan []byte // compressed blocks, in order
+	blocks  int           // number of blocks started
+	err     error
+	closed  bool
+}
+
+// newParallelGzipWriter returns a parallelGzipWriter that writes to w using
+// threads goroutines.
+func newParallelGzipWriter(w io.Writer, threads int) *parallelGzipWriter {
+	if threads < 1 {
+		threads = 1
+	}
+	return &parallelGzipWriter{
+		w:       w,
+		threads: threads,
+		buf:     make([]byte, 0, parallelGzipBlockSize),
+	}
+}
+
+func (z *parallelGzipWriter) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		k := copy(z.buf[len(z.buf):cap(z.buf)], p)
+		z.buf = z.buf[:len(z.buf)+k]
+		p = p[k:]
+		if len(z.buf) == cap(z.buf) {
+			if err := z.startBlock(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// startBlock starts compressing the buffered block, if threads blocks are
+// pending the oldest is written first.
+func (z *parallelGzipWriter) startBlock() error {
+	if len(z.pending) >= z.threads {
+		if err := z.writeBlock(); err != nil {
+			return err
+		}
+	}
+	block := z.buf
+	z.buf = make([]byte, 0, parallelGzipBlockSize)
+	ch := make(chan []byte, 1)
+	go func() { ch <- gzipBlock(block) }()
+	z.pending = append(z.pending, ch)
+	z.blocks++
+	return nil
+}
+
+// writeBlock waits for the oldest pending block and writes it.
+func (z *parallelGzipWriter) writeBlock() error {
+	b := <-z.pending[0]
+	z.pending = z.pending[1:]
+	if _, err := z.w.Write(b); err != nil {
+		z.err = err
+	}
+	return z.err
+}
+
+// Close compresses any buffered data and writes the pending blocks.  An
+// empty input is written as one empty gzip member.
+func (z *parallelGzipWriter) Close() error {
+	if z.closed {
+		return z.err
+	}
+	z.closed = true
+	if z.err == nil && (len(z.buf) != 0 || z.blocks == 0) {
+		z.startBlock()
+	}
+	for len(z.pending) != 0 && z.err == nil {
+		z.writeBlock()
+	}
+	return z.err
+}
+
+// gzipBlock returns block compressed as a gzip member, see newGzipWriter.
+func gzipBlock(block []byte) []byte {
+	var b bytes.Buffer
+	gw := newGzipWriter(&b)
+	gw.Write(block) // writes to a bytes.Buffer cannot fail
+	gw.Close()
+	return b.Bytes()
+}
+
+// gzipThreads returns the Config.GzipThreads of the -gzip-threads flag n,
+// zero is one thread per CPU.
+func gzipThreads(n int) int {
+	if n == 0 {
+		return runtime.NumCPU()
+	}
+	return n
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"runtime"
+	"testing"
+)
+
+// gzipTestData returns n bytes of compressible pseudo-random data.
+func gzipTestData(n int) []byte {
+	r := rand.New(rand.NewSource(1))
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = "abcdefgh"[r.Intn(8)]
+	}
+	return b
+}
+
+func TestParallelGzipWriter(t *testing.T) {
+	sizes := []int{0, 1, parallelGzipBlockSize, parallelGzipBlockSize*2 + parallelGzipBlockSize/2}
+	for _, size := range sizes {
+		data := gzipTestData(size)
+		var outputs [][]byte
+		for _, threads := range []int{1, 2, 8} {
+			var b bytes.Buffer
+			z := newParallelGzipWriter(&b, threads)
+			// odd sized writes so that blocks span writes
+			for p := data; len(p) != 0; {
+				n := 4093
+				if n > len(p) {
+					n = len(p)
+				}
+				if _, err := z.Write(p[:n]); err != nil {
+					t.Fatal(err)
+				}
+				p = p[n:]
+			}
+			if err := z.Close(); err != nil {
+				t.Fatal(err)
+			}
+			gr, err := gzip.NewReader(bytes.NewReader(b.Bytes()))
+			if err != nil {
+				t.Fatalf("%d bytes (%d threads): %s", size, threads, err)
+			}
+			got, err := ioutil.ReadAll(gr)
+			if err != nil {
+				t.Fatalf("%d bytes (%d threads): %s", size, threads, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("%d bytes (%d threads): decompressed data does not match", size, threads)
+			}
+			outputs = append(outputs, b.Bytes())
+		}
+		for i := 1; i < len(outputs); i++ {
+			if !bytes.Equal(outputs[0], outputs[i]) {
+				t.Errorf("%d bytes: output depends on the number of threads", size)
+			}
+		}
+	}
+}
+
+type errWriter struct{ err error }
+
+func (w errWriter) Write(p []byte) (int, error) { return 0, w.err }
+
+func TestParallelGzipWriterError(t *testing.T) {
+	exp := errors.New("write error")
+	z := newParallelGzipWriter(errWriter{exp}, 2)
+	data := gzipTestData(parallelGzipBlockSize * 4)
+	_, err := z.Write(data)
+	if cerr := z.Close(); err == nil {
+		err = cerr
+	}
+	if err != exp {
+		t.Errorf("parallelGzipWriter: got error %v want %v", err, exp)
+	}
+}
+
+func TestGzipThreadsStemcell(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c := newTestConfig(t, dir)
+	defer c.Cleanup()
+	c.GzipThreads = 4
+
+	var b bytes.Buffer
+	if err := c.CreateStemcellTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyStemcell(&b, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+const benchmarkGzipSize = 64 * 1024 * 1024
+
+func benchmarkGzip(b *testing.B, newWriter func(w io.Writer) io.WriteCloser) {
+	data := gzipTestData(benchmarkGzipSize)
+	b.SetBytes(benchmarkGzipSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := newWriter(ioutil.Discard)
+		if _, err := w.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGzip(b *testing.B) {
+	benchmarkGzip(b, func(w io.Writer) io.WriteCloser { return newGzipWriter(w) })
+}
+
+func BenchmarkParallelGzip(b *testing.B) {
+	benchmarkGzip(b, func(w io.Writer) io.WriteCloser {
+		return newParallelGzipWriter(w, runtime.NumCPU())
+	})
+}
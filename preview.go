@@ -0,0 +1,51 @@
+package main
+
+import "io"
+
+// PendingSha1 is the sha1 written by PrintManifests if the image has not been
+// created.
+const PendingSha1 = "PENDING"
+
+// PrintManifests writes the stemcell.MF that would be created for each of
+// versions to w, each is a YAML document.  The manifests are
+// created and validated as by WriteManifest.  If the image has not been
+// created, c.Sha1sum is empty, the sha1, and sha256 if requested, is
+// PendingSha1 and a comment notes that it is computed when the stemcell is
+// built.
+func (c *Config) PrintManifests(w io.Writer, versions []string) error {
+	defer func(version string) { c.Version = version }(c.Version)
+
+	for _, version := range versions {
+		c.Version = version
+		pending := c.Sha1sum == ""
+		if pending {
+			c.Sha1sum = PendingSha1
+			if c.wantSha256() {
+				c.Sha256sum = PendingSha1
+			}
+		}
+		m, err := c.NewManifest()
+		if pending {
+			c.Sha1sum = ""
+			c.Sha256sum = ""
+		}
+		if err != nil {
+			return err
+		}
+		if pending {
+			s := "sha1 is pending: it is the sha1 of the image, computed when the stemcell is built"
+			if c.wantSha256() {
+				s = "sha1 and sha256 are pending: they are the digests of the image, " +
+					"computed when the stemcell is built"
+			}
+			if m.Comment != "" {
+				s = m.Comment + "\n" + s
+			}
+			m.Comment = s
+		}
+		if err := c.writeManifest(w, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
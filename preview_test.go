@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPrintManifests(t *testing.T) {
+	c := &Config{
+		Agent:          "go_agent-hardened",
+		ManifestLayout: ManifestV2,
+		Logger:         DiscardLogger,
+	}
+	var b bytes.Buffer
+	if err := c.PrintManifests(&b, []string{"1.2", "1.3"}); err != nil {
+		t.Fatal(err)
+	}
+	if c.Sha1sum != "" || c.Version != "" || c.Manifest != "" {
+		t.Errorf("PrintManifests: modified config: %+v", c)
+	}
+	docs := strings.Split(b.String(), "---\n")[1:]
+	if len(docs) != 2 {
+		t.Fatalf("PrintManifests: expected 2 documents got %d:\n%s", len(docs), b.String())
+	}
+	for i, doc := range docs {
+		m, err := ParseManifest(strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Version != []string{"1.2", "1.3"}[i] || m.Sha1 != PendingSha1 {
+			t.Errorf("PrintManifests: document %d: version %q sha1 %q", i, m.Version, m.Sha1)
+		}
+		if !strings.HasSuffix(m.Name, "-go_agent-hardened") || m.BoshProtocol == "" {
+			t.Errorf("PrintManifests: document %d: flags were not applied:\n%s", i, doc)
+		}
+		if !strings.Contains(doc, "# sha1 is pending") {
+			t.Errorf("PrintManifests: document %d: missing pending comment:\n%s", i, doc)
+		}
+	}
+
+	c.Sha1sum = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	b.Reset()
+	if err := c.PrintManifests(&b, []string{"1.2"}); err != nil {
+		t.Fatal(err)
+	}
+	if s := b.String(); !strings.Contains(s, c.Sha1sum) || strings.Contains(s, "pending") {
+		t.Errorf("PrintManifests: expected the image sha1:\n%s", s)
+	}
+}
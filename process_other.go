@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly
+
+package main
+
+// processRunning returns if process pid is running.  It is unknown on this
+// platform, so the process is assumed to have exited and only the age of a
+// temp directory is checked.
+func processRunning(pid int) bool {
+	return false
+}
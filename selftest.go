@@ -0,0 +1,176 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// selfTestStatus is the result of a self-test check, a warning does not
+// cause the self-test to fail.
+type selfTestStatus string
+
+const (
+	selfTestPass selfTestStatus = "PASS"
+	selfTestWarn selfTestStatus = "WARN"
+	selfTestFail selfTestStatus = "FAIL"
+	selfTestSkip selfTestStatus = "SKIP" // see ValidateReport
+)
+
+// SelfTest checks that the environment can build stemcells and writes a
+// PASS, WARN or FAIL line for each check to w.  Temp files are created in
+// tmpRoot, or the default temp directory if empty.  An error is returned if
+// any check fails.
+func SelfTest(w io.Writer, tmpRoot string) error {
+	checks := []struct {
+		name string
+		fn   func() (selfTestStatus, string)
+	}{
+		{"ovftool", selfTestOvftool},
+		{"temp dir", func() (selfTestStatus, string) { return selfTestTempDir(tmpRoot) }},
+		{"disk space", func() (selfTestStatus, string) { return selfTestDiskSpace(tmpRoot) }},
+		{"build", selfTestBuild},
+	}
+	failed := 0
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, c := range checks {
+		Log.Debugf("self-test: running check: %s", c.name)
+		status, msg := c.fn()
+		if status == selfTestFail {
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", status, c.name, msg)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if failed != 0 {
+		return fmt.Errorf("self-test: %d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+func selfTestOvftool() (selfTestStatus, string) {
+	path, err := exec.LookPath("ovftool")
+	if err != nil {
+		return selfTestWarn, "not found in PATH (only reported by -inspect)"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "--version").Output()
+	if err != nil {
+		return selfTestWarn, fmt.Sprintf("%s: getting version: %s", path, err)
+	}
+	return selfTestPass, fmt.Sprintf("%s (%s)", path, strings.TrimSpace(string(out)))
+}
+
+func selfTestTempDir(tmpRoot string) (selfTestStatus, string) {
+	c := Config{TmpRoot: tmpRoot, Logger: DiscardLogger}
+	dir, err := c.TempDir()
+	if err != nil {
+		return selfTestFail, err.Error()
+	}
+	if err := checkWritable(dir); err != nil {
+		c.Cleanup()
+		return selfTestFail, err.Error()
+	}
+	c.Cleanup()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		return selfTestFail, fmt.Sprintf("temp dir (%s) was not removed", dir)
+	}
+	return selfTestPass, fmt.Sprintf("created and removed: %s", dir)
+}
+
+func selfTestDiskSpace(tmpRoot string) (selfTestStatus, string) {
+	if tmpRoot == "" {
+		tmpRoot = os.TempDir()
+	}
+	avail, err := availableBytes(tmpRoot)
+	if err == errStatfsUnsupported {
+		return selfTestWarn, err.Error()
+	}
+	if err != nil {
+		return selfTestFail, err.Error()
+	}
+	return selfTestPass, fmt.Sprintf("%s available in: %s", formatBytes(avail), tmpRoot)
+}
+
+// selfTestBuild builds a stemcell from a tiny in memory OVA and checks that
+// the image and manifest can be read back.
+func selfTestBuild() (selfTestStatus, string) {
+	var ova bytes.Buffer
+	tw := tar.NewWriter(&ova)
+	for _, name := range []string{"selftest.ovf", "selftest-disk1.vmdk"} {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(name))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return selfTestFail, err.Error()
+		}
+		if _, err := io.WriteString(tw, name); err != nil {
+			return selfTestFail, err.Error()
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return selfTestFail, err.Error()
+	}
+	want := ova.Bytes()
+
+	var stemcell bytes.Buffer
+	if err := BuildStemcellFromOVA(bytes.NewReader(want), "1.0", DefaultOS, &stemcell); err != nil {
+		return selfTestFail, err.Error()
+	}
+
+	gr, err := gzip.NewReader(&stemcell)
+	if err != nil {
+		return selfTestFail, err.Error()
+	}
+	var image []byte
+	var m *Manifest
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return selfTestFail, err.Error()
+		}
+		switch hdr.Name {
+		case "image":
+			if image, err = ioutil.ReadAll(tr); err != nil {
+				return selfTestFail, err.Error()
+			}
+		case "stemcell.MF":
+			if m, err = ParseManifest(tr); err != nil {
+				return selfTestFail, err.Error()
+			}
+		}
+	}
+	if image == nil || m == nil {
+		return selfTestFail, "stemcell is missing the image or manifest"
+	}
+	if sum := fmt.Sprintf("%x", sha1.Sum(image)); sum != m.Sha1 {
+		return selfTestFail, fmt.Sprintf("image sha1 (%s) does not match manifest (%s)", sum, m.Sha1)
+	}
+	ir, err := gzip.NewReader(bytes.NewReader(image))
+	if err != nil {
+		return selfTestFail, err.Error()
+	}
+	got, err := ioutil.ReadAll(ir)
+	if err != nil {
+		return selfTestFail, err.Error()
+	}
+	if !bytes.Equal(got, want) {
+		return selfTestFail, "image does not match the ova"
+	}
+	return selfTestPass, "gzip/tar round-trip of a test stemcell"
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var b bytes.Buffer
+	if err := SelfTest(&b, dir); err != nil {
+		t.Fatalf("SelfTest: %s\n%s", err, b.String())
+	}
+	for _, name := range []string{"ovftool", "temp dir", "disk space", "build"} {
+		if !strings.Contains(b.String(), name) {
+			t.Errorf("SelfTest: missing check %q in output:\n%s", name, b.String())
+		}
+	}
+
+	b.Reset()
+	if err := SelfTest(&b, filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("SelfTest: expected error for missing temp dir:\n%s", b.String())
+	}
+	if !strings.Contains(b.String(), "FAIL") {
+		t.Errorf("SelfTest: expected a FAIL line:\n%s", b.String())
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SignatureExt is appended to the filename of a stemcell to name its
+// detached signature, see WriteSignatureFile.
+const SignatureExt = ".sig"
+
+// signatureComment prefixes the first line of a signature file, which names
+// the file signed.  It is not signed.
+const signatureComment = "untrusted comment: ova2stemcell ed25519ph signature of "
+
+// signatureOptions sign and verify Ed25519ph signatures (RFC 8032): the
+// SHA-512 digest of the stemcell is signed, so the stemcell, which may be
+// many gigabytes, is never held in memory.
+var signatureOptions = &ed25519.Options{Hash: crypto.SHA512}
+
+// readPEM returns the DER bytes of the PEM block of type typ in file name.
+func readPEM(name, typ string) ([]byte, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM %q block found", typ)
+		}
+		if block.Type == typ {
+			return block.Bytes, nil
+		}
+	}
+}
+
+// LoadSigningKey loads the -sign-key Ed25519 private key from file name, a
+// PEM encoded PKCS #8 "PRIVATE KEY" as written by:
+//
+//	openssl genpkey -algorithm ed25519 -out key.pem
+func LoadSigningKey(name string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(name, "PRIVATE KEY")
+	if err != nil {
+		return nil, fmt.Errorf("signing key (%s): %s", name, err)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("signing key (%s): %s", name, err)
+	}
+	k, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key (%s): is a %T not an ed25519 key", name, key)
+	}
+	return k, nil
+}
+
+// LoadVerifyKey loads the -verify-sig Ed25519 public key from file name, a
+// PEM encoded PKIX "PUBLIC KEY" as written by:
+//
+//	openssl pkey -in key.pem -pubout -out key.pub
+func LoadVerifyKey(name string) (ed25519.PublicKey, error) {
+	der, err := readPEM(name, "PUBLIC KEY")
+	if err != nil {
+		return nil, fmt.Errorf("public key (%s): %s", name, err)
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("public key (%s): %s", name, err)
+	}
+	k, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key (%s): is a %T not an ed25519 key", name, key)
+	}
+	return k, nil
+}
+
+// WriteSignatureFile writes the signature, by key, of file filename whose
+// SHA-512 digest is digest to the file "filename.sig" and returns its name.
+// The signature file is two lines: an unsigned comment naming the file and
+// the base64 encoded Ed25519ph signature.
+func WriteSignatureFile(filename string, key ed25519.PrivateKey, digest []byte) (string, error) {
+	name := filename + SignatureExt
+	sig, err := key.Sign(nil, digest, signatureOptions)
+	if err != nil {
+		return "", fmt.Errorf("signing (%s): %s", filename, err)
+	}
+	data := signatureComment + filepath.Base(filename) + "\n" +
+		base64.StdEncoding.EncodeToString(sig) + "\n"
+	if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+		return "", fmt.Errorf("writing signature file (%s): %s", name, err)
+	}
+	return name, nil
+}
+
+// readSignatureFile returns the signature of signature file name.
+func readSignatureFile(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if s := strings.TrimSpace(sc.Text()); s != "" && !strings.HasPrefix(s, "untrusted comment:") {
+			lines = append(lines, s)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) != 1 {
+		return nil, errors.New("expected one signature line")
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[0])
+	if err != nil {
+		return nil, fmt.Errorf("decoding signature: %s", err)
+	}
+	if len(sig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid signature size: %d", len(sig))
+	}
+	return sig, nil
+}
+
+// VerifySignatureFile verifies the detached signature "filename.sig" of file
+// filename with public key pub, see WriteSignatureFile.
+func VerifySignatureFile(filename string, pub ed25519.PublicKey) error {
+	name := filename + SignatureExt
+	sig, err := readSignatureFile(name)
+	if err != nil {
+		return fmt.Errorf("signature file (%s): %s", name, err)
+	}
+	h := sha512.New()
+	if err := hashFile(h, filename); err != nil {
+		return fmt.Errorf("verifying signature (%s): %s", filename, err)
+	}
+	if err := ed25519.VerifyWithOptions(pub, h.Sum(nil), sig, signatureOptions); err != nil {
+		return fmt.Errorf("signature file (%s): signature is not valid for %s: %s", name, filename, err)
+	}
+	return nil
+}
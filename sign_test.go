@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestKey writes the PEM encoded PKCS #8 private key and PKIX public key
+// of key to dir as name.pem and name.pub, and returns their names.
+func writeTestKey(t *testing.T, dir, name string, key, pub interface{}) (string, string) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv := filepath.Join(dir, name+".pem")
+	if err := ioutil.WriteFile(priv, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if der, err = x509.MarshalPKIXPublicKey(pub); err != nil {
+		t.Fatal(err)
+	}
+	public := filepath.Join(dir, name+".pub")
+	if err := ioutil.WriteFile(public, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return priv, public
+}
+
+func TestSignStemcell(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, public := writeTestKey(t, dir, "key", key, pub)
+	otherPub, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPublic := writeTestKey(t, dir, "other", otherKey, otherPub)
+
+	c := &Config{
+		OVAFile:   ova,
+		OutputDir: dir,
+		SignKey:   priv,
+		Version:   "1.2",
+		Logger:    DiscardLogger,
+		stop:      make(chan struct{}),
+	}
+	if errs := c.Validate(); len(errs) != 0 {
+		t.Fatalf("Validate: %v", errs)
+	}
+	defer c.Cleanup()
+	results, err := realMain(c, []string{"1.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stemcell := results[0].StemcellPath
+	b, err := ioutil.ReadFile(stemcell + SignatureExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := signatureComment + filepath.Base(stemcell) + "\n"; !strings.HasPrefix(string(b), exp) {
+		t.Errorf("signature file does not start with %q:\n%s", exp, b)
+	}
+
+	var out bytes.Buffer
+	if err := VerifyMode(&out, stemcell, "", public, nil, nil); err != nil {
+		t.Fatalf("VerifyMode: %s\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "verified signature: "+stemcell+SignatureExt) {
+		t.Errorf("VerifyMode: unexpected output:\n%s", out.String())
+	}
+	if err := VerifyMode(ioutil.Discard, stemcell, "", otherPublic, nil, nil); err == nil {
+		t.Error("VerifyMode: expected error verifying with another key")
+	}
+
+	// the signature is of the exact bytes of the stemcell
+	data, err := ioutil.ReadFile(stemcell)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := filepath.Join(dir, "copy.tgz")
+	if err := ioutil.WriteFile(signed, append(data, 0), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(signed+SignatureExt, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := LoadVerifyKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySignatureFile(signed, pubKey); err == nil {
+		t.Error("VerifySignatureFile: expected error for modified stemcell")
+	}
+	if err := ioutil.WriteFile(signed, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySignatureFile(signed, pubKey); err != nil {
+		t.Errorf("VerifySignatureFile: %s", err)
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, public := writeTestKey(t, dir, "ecdsa", key, &key.PublicKey)
+
+	tests := []struct {
+		name string
+		err  string
+	}{
+		{priv, "not an ed25519 key"},
+		{public, `no PEM "PRIVATE KEY" block found`},
+		{filepath.Join(dir, "missing.pem"), "no such file"},
+	}
+	for _, x := range tests {
+		_, err := LoadSigningKey(x.name)
+		if err == nil || !strings.Contains(err.Error(), x.err) {
+			t.Errorf("LoadSigningKey(%s): got error %v want: %q", x.name, err, x.err)
+		}
+	}
+	if _, err := LoadVerifyKey(public); err == nil || !strings.Contains(err.Error(), "not an ed25519 key") {
+		t.Errorf("LoadVerifyKey(%s): expected error for ecdsa key got: %v", public, err)
+	}
+}
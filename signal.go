@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// InterruptSignals returns the signals that stop a build and cleanup any
+// temporary files.  Other signals, such as SIGWINCH when a terminal is
+// resized or SIGCHLD, are ignored.
+func InterruptSignals() []os.Signal {
+	return []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+}
+
+// IsInterruptSignal returns if sig is one of InterruptSignals.
+func IsInterruptSignal(sig os.Signal) bool {
+	for _, s := range InterruptSignals() {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
+
+// LogReopenSignal reopens the -log-file, if one is used, instead of stopping
+// the build.
+var LogReopenSignal os.Signal = syscall.SIGHUP
+
+// withoutSignal returns signals without sig.
+func withoutSignal(signals []os.Signal, sig os.Signal) []os.Signal {
+	var a []os.Signal
+	for _, s := range signals {
+		if s != sig {
+			a = append(a, s)
+		}
+	}
+	return a
+}
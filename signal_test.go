@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestIsInterruptSignal(t *testing.T) {
+	tests := map[os.Signal]bool{
+		os.Interrupt:     true,
+		syscall.SIGTERM:  true,
+		syscall.SIGHUP:   true,
+		syscall.SIGWINCH: false,
+		syscall.SIGCHLD:  false,
+		syscall.SIGURG:   false,
+	}
+	for sig, exp := range tests {
+		if IsInterruptSignal(sig) != exp {
+			t.Errorf("IsInterruptSignal(%s): got %t want %t", sig, !exp, exp)
+		}
+	}
+}
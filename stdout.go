@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// StdoutOutput is the -output that writes the stemcell tarball to stdout,
+// see Config.Output.
+const StdoutOutput = "-"
+
+// A countWriter counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// writeStemcellOutput writes the stemcell tarball to c.Output and records
+// the step.  No temp file is created, the stemcell is not verified and no
+// checksum files are written.
+func (c *Config) writeStemcellOutput(start time.Time) error {
+	w := &countWriter{w: c.Output}
+	if err := c.CreateStemcellTo(w); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.Steps = append(c.Steps, BuildStep{
+		Name:     "stemcell",
+		Version:  c.Version,
+		Path:     StdoutOutput,
+		Size:     w.n,
+		Sha1:     c.StemcellSha1sum,
+		Duration: time.Since(start),
+	})
+	c.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRealMainOutput(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+
+	var stdout bytes.Buffer
+	c := &Config{
+		OVAFile:      ova,
+		OutputDir:    dir,
+		Output:       &stdout,
+		VerifyOutput: true,
+		Logger:       DiscardLogger,
+		stop:         make(chan struct{}),
+	}
+	defer c.Cleanup()
+	results, err := realMain(c, []string{"1.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].StemcellPath != StdoutOutput {
+		t.Fatalf("realMain: unexpected results: %+v", results)
+	}
+	if sum := fmt.Sprintf("%x", sha1.Sum(stdout.Bytes())); sum != results[0].TarballSha1 {
+		t.Errorf("realMain: TarballSha1: got %s want %s", results[0].TarballSha1, sum)
+	}
+	m, err := VerifyStemcell(bytes.NewReader(stdout.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != "1.2" {
+		t.Errorf("realMain: manifest version: got %s want %s", m.Version, "1.2")
+	}
+
+	// nothing is written to the output directory
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 {
+		t.Errorf("realMain: files created in the output directory: %d", len(fis)-1)
+	}
+
+	restore := setFlags(t, dir)
+	OutputDir = StdoutOutput
+	errs := ValidateFlags()
+	restore()
+	if len(errs) != 0 {
+		t.Errorf("ValidateFlags: unexpected errors for -output -: %v", errs)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// measureImage is the first pass of a streamed image, see Config.StreamImage.
+// OVA r, read from file name, is compressed like compressImage but only the
+// size and digests of the image are kept, nothing is written to disk.
+func (c *Config) measureImage(r io.Reader, name string) error {
+	c.debugf("measuring streamed image of: %s", name)
+
+	h := c.newImageHash()
+	n := &countWriter{w: ioutil.Discard}
+	t := time.Now()
+	w := c.imageWriter(c.Writer(io.MultiWriter(h, c.limitImage(n))))
+	if _, err := copyBuffer(w, c.Reader(r)); err != nil {
+		return fmt.Errorf("measuring image (%s): %s", name, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("measuring image (%s): %s", name, err)
+	}
+	c.debugf("measured streamed image in: %s", time.Since(t))
+
+	c.imageStream = name
+	c.streamSize = n.n
+	c.setImageSums(h)
+	c.debugf("sha1 checksum of streamed image is: %s", c.Sha1sum)
+	return nil
+}
+
+// addStreamedImage is the second pass of a streamed image: the OVA is
+// compressed again, directly into tar archive tr as the image entry, whose
+// size is known from the first pass, see measureImage.  Compression is
+// deterministic, so the entry is exactly the image that was measured, an
+// error is returned if it is not, e.g. because the OVA was modified.
+func (c *Config) addStreamedImage(tr *tar.Writer) error {
+	ova, err := openOVA(c.imageStream)
+	if err != nil {
+		return fmt.Errorf("opening ova file (%s): %s", c.imageStream, err)
+	}
+	defer ova.Close()
+
+	if err := tr.WriteHeader(tarHeader("image", c.streamSize, time.Now())); err != nil {
+		return err
+	}
+	h := sha1.New()
+	n := &countWriter{w: tr}
+	w := c.imageWriter(io.MultiWriter(h, n))
+	if _, err := copyBuffer(w, c.Reader(ova)); err != nil {
+		return fmt.Errorf("streaming image (%s): %s", c.imageStream, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("streaming image (%s): %s", c.imageStream, err)
+	}
+	if sum := fmt.Sprintf("%x", h.Sum(nil)); n.n != c.streamSize || sum != c.Sha1sum {
+		return fmt.Errorf("streaming image (%s): image (%d bytes, sha1 %s) differs from the "+
+			"image measured (%d bytes, sha1 %s): was the ova modified?", c.imageStream, n.n, sum,
+			c.streamSize, c.Sha1sum)
+	}
+	return nil
+}
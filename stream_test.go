@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStreamImage(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	// larger than one parallel gzip block
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: string(gzipTestData(3 * parallelGzipBlockSize / 2))},
+	})
+	gz := gzipFile(t, ova, filepath.Join(dir, "vm.ova.gz"))
+
+	tests := []struct {
+		name    string
+		ova     string
+		threads int
+	}{
+		{"ova", ova, 0},
+		{"ova-gzip", gz, 0},
+		{"ova-threads", ova, 4},
+	}
+	for _, x := range tests {
+		// the image of each build must be identical, only how it is
+		// written differs
+		var images [2][]byte
+		for i, stream := range []bool{false, true} {
+			c := &Config{
+				OVAFile:     x.ova,
+				OutputDir:   dir,
+				OutputName:  x.name + "-{version}.tgz",
+				Force:       true,
+				GzipThreads: x.threads,
+				StreamImage: stream,
+				Logger:      DiscardLogger,
+				stop:        make(chan struct{}),
+			}
+			results, err := realMain(c, []string{"1.2"})
+			if err != nil {
+				c.Cleanup()
+				t.Fatalf("%s (stream %t): %s", x.name, stream, err)
+			}
+			if _, err := os.Stat(filepath.Join(c.tmpdir, "image")); os.IsNotExist(err) != stream {
+				t.Errorf("%s (stream %t): image temp file exists: %t", x.name, stream, err == nil)
+			}
+			c.Cleanup()
+			if stream && c.Steps[0].Path != "(streamed)" {
+				t.Errorf("%s: image step path: got %q want %q", x.name, c.Steps[0].Path, "(streamed)")
+			}
+
+			f, err := os.Open(results[0].StemcellPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, files := readStemcell(t, f)
+			f.Close()
+			m, err := ParseManifest(bytes.NewReader(files["stemcell.MF"]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Sha1 != results[0].ImageSha1 || int64(len(files["image"])) != results[0].ImageSize {
+				t.Errorf("%s (stream %t): manifest sha1 %s and image size %d do not match result: %+v",
+					x.name, stream, m.Sha1, len(files["image"]), results[0])
+			}
+			images[i] = files["image"]
+		}
+		if !bytes.Equal(images[0], images[1]) {
+			t.Errorf("%s: streamed image differs from the image written to a temp file", x.name)
+		}
+	}
+
+	// the ova is modified between the passes
+	c := &Config{OVAFile: ova, Version: "1.2", StreamImage: true, Logger: DiscardLogger,
+		stop: make(chan struct{})}
+	defer c.Cleanup()
+	if err := c.CreateImageFromOVA(ova); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteManifest(); err != nil {
+		t.Fatal(err)
+	}
+	createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: "modified"},
+	})
+	err := c.CreateStemcellTo(ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "was the ova modified") {
+		t.Errorf("expected error for modified ova got: %v", err)
+	}
+}
+
+// benchmarkCreateStemcell builds a stemcell from a 64MB OVA and reports the
+// bytes written to the temp directory, the image, if any, and stemcell.
+func benchmarkCreateStemcell(b *testing.B, stream bool) {
+	dir := tempDir(b)
+	defer os.RemoveAll(dir)
+	ova := createTar(b, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: string(gzipTestData(benchmarkGzipSize))},
+	})
+	b.SetBytes(benchmarkGzipSize)
+	b.ResetTimer()
+	var written int64
+	for i := 0; i < b.N; i++ {
+		c := &Config{Version: "1.2", TmpRoot: dir, StreamImage: stream, Logger: DiscardLogger,
+			stop: make(chan struct{})}
+		if err := c.CreateImageFromOVA(ova); err != nil {
+			b.Fatal(err)
+		}
+		if err := c.WriteManifest(); err != nil {
+			b.Fatal(err)
+		}
+		if err := c.CreateStemcell(); err != nil {
+			b.Fatal(err)
+		}
+		for _, name := range []string{c.Image, c.Stemcell} {
+			if fi, err := os.Stat(name); err == nil {
+				written += fi.Size()
+			}
+		}
+		c.Cleanup()
+	}
+	b.ReportMetric(float64(written)/float64(b.N), "disk-bytes/op")
+}
+
+func BenchmarkCreateStemcell(b *testing.B)         { benchmarkCreateStemcell(b, false) }
+func BenchmarkCreateStemcellStreamed(b *testing.B) { benchmarkCreateStemcell(b, true) }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// A BuildStep records an artifact created while building a stemcell.
+type BuildStep struct {
+	Name     string // e.g. "image", "manifest" or "stemcell"
+	Version  string // stemcell version, empty if shared by all versions
+	Path     string
+	Size     int64
+	Sha1     string
+	Duration time.Duration
+}
+
+// A StepTiming is the duration of a step of realMain, see BuildSteps.
+type StepTiming struct {
+	Name     string
+	Version  string // stemcell version, empty if shared by all versions
+	Duration time.Duration
+}
+
+// recordStep appends a BuildStep for the artifact at path to c.Steps, if
+// sum is empty the sha1 of path is computed.  Directories have no size or
+// checksum.  An empty path is the in memory, or streamed, image.
+func (c *Config) recordStep(name, path, sum string, start time.Time) error {
+	s := BuildStep{
+		Name:     name,
+		Version:  c.Version,
+		Path:     path,
+		Sha1:     sum,
+		Duration: time.Since(start),
+	}
+	if name == "image" {
+		s.Version = ""
+	}
+	if path == "" {
+		s.Path = "(memory)"
+		s.Size = int64(len(c.imageData))
+		if c.imageStream != "" {
+			s.Path = "(streamed)"
+			s.Size = c.streamSize
+		}
+		c.mu.Lock()
+		c.Steps = append(c.Steps, s)
+		c.mu.Unlock()
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("build summary: %s", err)
+	}
+	if fi.Mode().IsRegular() {
+		s.Size = fi.Size()
+		if s.Sha1 == "" {
+			h := sha1.New()
+			if err := hashFile(h, path); err != nil {
+				return fmt.Errorf("build summary: %s", err)
+			}
+			s.Sha1 = fmt.Sprintf("%x", h.Sum(nil))
+		}
+	}
+	c.mu.Lock()
+	c.Steps = append(c.Steps, s)
+	c.mu.Unlock()
+	return nil
+}
+
+// WriteSummary writes a table of the artifacts created by each step to w.
+func WriteSummary(w io.Writer, steps []BuildStep) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tVERSION\tSIZE\tSHA1\tDURATION\tPATH")
+	for _, s := range steps {
+		version := s.Version
+		if version == "" {
+			version = "-"
+		}
+		sum := s.Sha1
+		if sum == "" {
+			sum = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n", s.Name, version, s.Size, sum,
+			s.Duration.Round(time.Millisecond), s.Path)
+	}
+	return tw.Flush()
+}
+
+// WriteSummaryFile writes the build summary to file name, or logs it at the
+// info level if name is "-".
+func WriteSummaryFile(name string, steps []BuildStep) error {
+	var b bytes.Buffer
+	if err := WriteSummary(&b, steps); err != nil {
+		return err
+	}
+	if name == "-" {
+		Log.Infof("build summary:\n%s", b.String())
+		return nil
+	}
+	if err := ioutil.WriteFile(name, b.Bytes(), 0644); err != nil {
+		return fmt.Errorf("writing build summary (%s): %s", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteSummary(t *testing.T) {
+	steps := []BuildStep{
+		{Name: "image", Path: "/tmp/image", Size: 10, Sha1: "abc", Duration: 1500 * time.Microsecond},
+		{Name: "stemcell", Version: "1.2", Path: "/out/stemcell.tgz", Size: 20, Sha1: "def"},
+		{Name: "stemcell", Version: "1.3", Path: "/out/stemcell.d"},
+	}
+	var b bytes.Buffer
+	if err := WriteSummary(&b, steps); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("WriteSummary: expected 4 lines got:\n%s", b.String())
+	}
+	exp := [][]string{
+		{"STEP", "VERSION", "SIZE", "SHA1", "DURATION", "PATH"},
+		{"image", "-", "10", "abc", "2ms", "/tmp/image"},
+		{"stemcell", "1.2", "20", "def", "0s", "/out/stemcell.tgz"},
+		{"stemcell", "1.3", "0", "-", "0s", "/out/stemcell.d"},
+	}
+	for i, line := range lines {
+		if f := strings.Fields(line); strings.Join(f, " ") != strings.Join(exp[i], " ") {
+			t.Errorf("WriteSummary: line %d: got %q want %q", i, f, exp[i])
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The policies for symlinks in an OVF directory, see readOVFDirectory.
+const (
+	SymlinkError  = "error"  // fail, the default
+	SymlinkFollow = "follow" // add the file the symlink points to
+	SymlinkSkip   = "skip"   // leave the symlink out of the image
+)
+
+// SymlinkPolicies are the valid symlink policies.
+var SymlinkPolicies = []string{SymlinkError, SymlinkFollow, SymlinkSkip}
+
+// ValidateSymlinkPolicy validates symlink policy s.
+func ValidateSymlinkPolicy(s string) error {
+	for _, p := range SymlinkPolicies {
+		if s == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid symlink policy (%s): must be one of: %s",
+		s, strings.Join(SymlinkPolicies, ", "))
+}
+
+// readOVFDirectory returns the files of OVF directory dirname that are added
+// to the image, with symlinks handled according to policy, SymlinkError if
+// empty.  With SymlinkFollow a symlink is replaced by the os.FileInfo of the
+// file it points to, which keeps the name of the symlink.  Skipped and
+// followed symlinks are logged to log.
+func readOVFDirectory(log Logger, dirname, policy string) ([]os.FileInfo, error) {
+	fis, err := ioutil.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	list := fis[:0]
+	for _, fi := range fis {
+		if fi.Mode()&os.ModeSymlink == 0 {
+			list = append(list, fi)
+			continue
+		}
+		path := filepath.Join(dirname, fi.Name())
+		switch policy {
+		case SymlinkSkip:
+			log.Debugf("ovf directory (%s): skipping symlink: %s", dirname, fi.Name())
+		case SymlinkFollow:
+			target, err := os.Stat(path)
+			if err != nil {
+				return nil, fmt.Errorf("following symlink: %s", err)
+			}
+			log.Debugf("ovf directory (%s): following symlink: %s", dirname, fi.Name())
+			list = append(list, target)
+		default:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("contains a symlink (%s -> %s): use -ovf-symlinks follow or skip",
+				fi.Name(), link)
+		}
+	}
+	return list, nil
+}
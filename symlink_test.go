@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOVFDirectorySymlinks(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// the disk is a symlink to a shared base disk
+	ovf := filepath.Join(dir, "ovf")
+	if err := os.Mkdir(ovf, 0755); err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(dir, "base.vmdk")
+	if err := ioutil.WriteFile(base, []byte("base disk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(ovf, "vm.ovf"), []byte("<Envelope/>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(base, filepath.Join(ovf, "vm-disk1.vmdk")); err != nil {
+		t.Skipf("creating symlink: %s", err)
+	}
+
+	tests := []struct {
+		policy string
+		err    string   // validation error, if any
+		names  []string // image entries
+	}{
+		{"", "contains a symlink (vm-disk1.vmdk -> " + base + ")", nil},
+		{SymlinkError, "contains a symlink", nil},
+		{SymlinkFollow, "", []string{"vm.ovf", "vm-disk1.vmdk"}},
+		{SymlinkSkip, "", []string{"vm.ovf"}},
+	}
+	for _, x := range tests {
+		err := ValidateOVFDirectory(DiscardLogger, ovf, false, x.policy, nil)
+		if x.err != "" {
+			if err == nil || !strings.Contains(err.Error(), x.err) {
+				t.Errorf("%q: ValidateOVFDirectory: got error %v want: %q", x.policy, err, x.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: ValidateOVFDirectory: %s", x.policy, err)
+			continue
+		}
+
+		c := &Config{Symlinks: x.policy, TmpRoot: dir, Logger: DiscardLogger, stop: make(chan struct{})}
+		if err := c.CreateImageFromOVF(ovf); err != nil {
+			t.Errorf("%q: CreateImageFromOVF: %s", x.policy, err)
+			continue
+		}
+		f, err := os.Open(c.Image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, files := readStemcell(t, f)
+		f.Close()
+		c.Cleanup()
+		if strings.Join(names, ",") != strings.Join(x.names, ",") {
+			t.Errorf("%q: image entries: got %q want %q", x.policy, names, x.names)
+		}
+		if b, ok := files["vm-disk1.vmdk"]; ok && string(b) != "base disk" {
+			t.Errorf("%q: vm-disk1.vmdk: got %q want the contents of the base disk", x.policy, b)
+		}
+	}
+
+	// a broken symlink cannot be followed
+	if err := os.Remove(base); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateOVFDirectory(DiscardLogger, ovf, false, SymlinkFollow, nil); err == nil {
+		t.Error("ValidateOVFDirectory: expected error following a broken symlink")
+	}
+	if err := ValidateSymlinkPolicy("copy"); err == nil {
+		t.Error("ValidateSymlinkPolicy: expected error for invalid policy")
+	}
+}
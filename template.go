@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"text/template"
+)
+
+// manifestTemplateFuncs are the functions available to -manifest-template
+// templates, yaml quotes a string as required by YAML, see yamlString.
+var manifestTemplateFuncs = template.FuncMap{
+	"yaml": yamlString,
+}
+
+// LoadManifestTemplate parses manifest template file name, a text/template
+// that is executed with the *Manifest of each stemcell, e.g.:
+//
+//	name: my-stemcell
+//	version: {{ yaml .Version }}
+//	sha1: {{ .Sha1 }}
+func LoadManifestTemplate(name string) (*template.Template, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("manifest template (%s): %s", name, err)
+	}
+	t, err := template.New(name).Funcs(manifestTemplateFuncs).Option("missingkey=error").Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("manifest template (%s): %s", name, err)
+	}
+	return t, nil
+}
+
+// ExecuteManifestTemplate executes manifest template t with manifest m and
+// writes the result to w.  The result must be a valid manifest, see
+// Manifest.Validate, with the version, sha1 and, if set, sha256 of m.
+func ExecuteManifestTemplate(w io.Writer, t *template.Template, m *Manifest) error {
+	var b bytes.Buffer
+	if err := t.Execute(&b, m); err != nil {
+		return fmt.Errorf("executing manifest template: %s", err)
+	}
+	p, err := ParseManifest(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		return fmt.Errorf("manifest template (%s): %s", t.Name(), err)
+	}
+	if err := p.Validate(); err != nil {
+		return fmt.Errorf("manifest template (%s): %s", t.Name(), err)
+	}
+	for _, f := range []struct{ key, got, exp string }{
+		{"version", p.Version, m.Version},
+		{"sha1", p.Sha1, m.Sha1},
+		{"sha256", p.Sha256, m.Sha256},
+	} {
+		if f.got != f.exp {
+			return fmt.Errorf("manifest template (%s): %s (%s) does not match the stemcell %s (%s)",
+				t.Name(), f.key, f.got, f.key, f.exp)
+		}
+	}
+	_, err = b.WriteTo(w)
+	return err
+}
+
+// writeManifest writes manifest m to w with c.ManifestTemplate, if set,
+// otherwise with Manifest.WriteTo.
+func (c *Config) writeManifest(w io.Writer, m *Manifest) error {
+	if c.ManifestTemplate != nil {
+		return ExecuteManifestTemplate(w, c.ManifestTemplate, m)
+	}
+	_, err := m.WriteTo(w)
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testManifestTemplate = `---
+name: custom-{{ .OperatingSystem }}
+version: {{ yaml .Version }}
+sha1: {{ yaml .Sha1 }}
+operating_system: {{ .OperatingSystem }}
+director_hint: unusual
+cloud_properties:
+{{- range $k, $v := .CloudProperties }}
+  {{ $k }}: {{ yaml $v }}
+{{- end }}
+`
+
+func TestManifestTemplate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tmpl, err := LoadManifestTemplate(write("custom.tmpl", testManifestTemplate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+	c := &Config{
+		OVAFile:          ova,
+		OutputDir:        dir,
+		ManifestTemplate: tmpl,
+		VerifyOutput:     true,
+		Logger:           DiscardLogger,
+		stop:             make(chan struct{}),
+	}
+	defer c.Cleanup()
+	results, err := realMain(c, []string{"1.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(results[0].StemcellPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, files := readStemcell(t, f)
+	mf := string(files["stemcell.MF"])
+	for _, s := range []string{
+		"name: custom-windows2012R2\n",
+		"version: \"1.2\"\n",
+		"director_hint: unusual\n",
+		"  hypervisor: esxi\n",
+	} {
+		if !strings.Contains(mf, s) {
+			t.Errorf("ManifestTemplate: manifest does not contain %q:\n%s", s, mf)
+		}
+	}
+
+	m := NewManifest("1.2", "abc", DefaultOS)
+	invalid := map[string]string{
+		"version": "name: n\nversion: \"9.9\"\nsha1: {{ .Sha1 }}\noperating_system: o\n" +
+			"cloud_properties:\n  a: b\n",
+		"keys":    "name: n\nversion: {{ yaml .Version }}\nsha1: {{ .Sha1 }}\n",
+		"yaml":    "name: {{ .Name }}\nname: twice\n",
+		"missing": "name: {{ .NoSuchField }}\n",
+	}
+	for name, s := range invalid {
+		tmpl, err := LoadManifestTemplate(write(name+".tmpl", s))
+		if err != nil {
+			t.Errorf("%s: LoadManifestTemplate: %s", name, err)
+			continue
+		}
+		var b bytes.Buffer
+		if err := ExecuteManifestTemplate(&b, tmpl, m); err == nil {
+			t.Errorf("%s: ExecuteManifestTemplate: expected error got:\n%s", name, b.String())
+		}
+	}
+	if _, err := LoadManifestTemplate(write("syntax.tmpl", "name: {{ .Name")); err == nil {
+		t.Error("LoadManifestTemplate: expected error for invalid template")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// BuildSteps are the steps of realMain, in order, that may be given their own
+// timeout with -step-timeout.  The manifest and stemcell steps are run once
+// per version.
+var BuildSteps = []string{"validate", "image", "manifest", "stemcell"}
+
+// ParseStepTimeouts parses the comma separated list of STEP=DURATION pairs s,
+// e.g. "image=30m,stemcell=10m".  STEP must be one of BuildSteps.
+func ParseStepTimeouts(s string) (map[string]time.Duration, error) {
+	m := make(map[string]time.Duration)
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		i := strings.IndexByte(kv, '=')
+		if i == -1 {
+			return nil, fmt.Errorf("invalid step timeout (%s): must be STEP=DURATION", kv)
+		}
+		step := strings.TrimSpace(kv[:i])
+		if !isBuildStep(step) {
+			return nil, fmt.Errorf("invalid step timeout (%s): step must be one of: %s",
+				kv, strings.Join(BuildSteps, ", "))
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(kv[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid step timeout (%s): %s", kv, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid step timeout (%s): duration must be positive", kv)
+		}
+		m[step] = d
+	}
+	return m, nil
+}
+
+func isBuildStep(name string) bool {
+	for _, s := range BuildSteps {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// A TimeoutError is returned by realMain when the build, or one of its steps,
+// did not finish in time.
+type TimeoutError struct {
+	Step    string        // step that was running
+	Timeout time.Duration // the timeout that expired
+	Overall bool          // the -timeout of the build, not of Step
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Overall {
+		return fmt.Sprintf("build timed out after %s during step: %s", e.Timeout, e.Step)
+	}
+	return fmt.Sprintf("step (%s) timed out after %s", e.Step, e.Timeout)
+}
+
+// startTimers starts the -timeout of the build, after which c is stopped,
+// cancelling any copy in progress and removing the temp directory.  The
+// timers must be stopped with stopTimers when the build finishes.
+func (c *Config) startTimers() {
+	if c.Timeout <= 0 {
+		return
+	}
+	d := c.Timeout
+	t := time.AfterFunc(d, func() {
+		c.expire(&TimeoutError{Timeout: d, Overall: true})
+	})
+	c.mu.Lock()
+	c.deadline = t
+	c.deadlineAt = time.Now().Add(d)
+	c.mu.Unlock()
+}
+
+// startStep records that step is running, for the error of an expired
+// timeout, and starts its timeout, if any.  The previous step is finished:
+// its timeout is stopped and its duration is appended to c.Timings.
+//
+// If c has been stopped ErrInterupt, or the TimeoutError that stopped it, is
+// returned, so a build that is stopped while copying a small file, see
+// drainReader, ends at the next step.  Timers may fire late, so if the
+// previous step, or the build, has run past its timeout c is stopped now and
+// the TimeoutError is returned.  This way a step that overran its timeout
+// never succeeds.
+func (c *Config) startStep(step string) error {
+	c.debugf("starting step: %s", step)
+	if c.stopped() {
+		return c.timeoutError(ErrInterupt)
+	}
+	now := time.Now()
+
+	c.mu.Lock()
+	var e *TimeoutError
+	switch {
+	case c.timeout != nil:
+		e = c.timeout
+	case !c.deadlineAt.IsZero() && now.After(c.deadlineAt):
+		e = &TimeoutError{Step: c.step, Timeout: c.Timeout, Overall: true}
+	case !c.stepAt.IsZero() && now.After(c.stepAt):
+		e = &TimeoutError{Step: c.step, Timeout: c.StepTimeouts[c.step]}
+	}
+	var done []StepTiming
+	if e == nil {
+		n := len(c.Timings)
+		c.endStep(now)
+		done = c.Timings[n:]
+		c.step = step
+		c.stepVersion = c.Version
+		c.stepStart = now
+		c.stopStepTimer()
+		if d, ok := c.StepTimeouts[step]; ok && d > 0 {
+			c.stepTimer = time.AfterFunc(d, func() {
+				c.expire(&TimeoutError{Step: step, Timeout: d})
+			})
+			c.stepAt = now.Add(d)
+		}
+	}
+	c.mu.Unlock()
+
+	if e != nil {
+		c.expire(e)
+		return c.timeoutError(e)
+	}
+	for _, t := range done {
+		c.emitStep(EventStepCompleted, t)
+	}
+	c.emitStep(EventStepStarted, StepTiming{Name: step, Version: stepVersion(step, c.Version)})
+	return nil
+}
+
+// endStep appends the duration of the current step, if any, to c.Timings,
+// c.mu must be held.  The validate and image steps are shared by all
+// versions.
+func (c *Config) endStep(now time.Time) {
+	if c.step == "" {
+		return
+	}
+	t := StepTiming{
+		Name:     c.step,
+		Version:  stepVersion(c.step, c.stepVersion),
+		Duration: now.Sub(c.stepStart),
+	}
+	c.Timings = append(c.Timings, t)
+	c.step = ""
+}
+
+// stepVersion returns the stemcell version of step, which is empty for the
+// validate and image steps as they are shared by all versions.
+func stepVersion(step, version string) string {
+	if step == "validate" || step == "image" {
+		return ""
+	}
+	return version
+}
+
+// stopStepTimer stops the timeout of the current step, c.mu must be held.
+func (c *Config) stopStepTimer() {
+	if c.stepTimer != nil {
+		c.stepTimer.Stop()
+	}
+	c.stepTimer = nil
+	c.stepAt = time.Time{}
+}
+
+// stopTimers stops the timeouts started by startTimers and startStep and
+// records the duration of the last step.
+func (c *Config) stopTimers() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.endStep(time.Now())
+	if c.deadline != nil {
+		c.deadline.Stop()
+	}
+	c.deadline = nil
+	c.deadlineAt = time.Time{}
+	c.stopStepTimer()
+}
+
+// expire records timeout error e, if no other timeout has expired, and stops
+// c.
+func (c *Config) expire(e *TimeoutError) {
+	c.mu.Lock()
+	if e.Step == "" {
+		e.Step = c.step
+	}
+	if c.timeout == nil {
+		c.timeout = e
+	}
+	c.mu.Unlock()
+	c.logger().Warnf("%s - stopping", e)
+	c.Stop()
+}
+
+// timeoutError returns the TimeoutError of c, if a timeout expired, otherwise
+// err.  Errors caused by stopping c, such as ErrInterupt, are replaced by the
+// reason c was stopped.
+func (c *Config) timeoutError(err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil && c.timeout != nil {
+		return c.timeout
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseStepTimeouts(t *testing.T) {
+	tests := []struct {
+		in    string
+		exp   map[string]time.Duration
+		valid bool
+	}{
+		{"", map[string]time.Duration{}, true},
+		{"image=30m", map[string]time.Duration{"image": 30 * time.Minute}, true},
+		{" image=1h , stemcell=90s,", map[string]time.Duration{
+			"image":    time.Hour,
+			"stemcell": 90 * time.Second,
+		}, true},
+		{"image", nil, false},
+		{"rdiff=1m", nil, false},
+		{"image=soon", nil, false},
+		{"image=0s", nil, false},
+		{"image=-1m", nil, false},
+	}
+	for _, x := range tests {
+		m, err := ParseStepTimeouts(x.in)
+		if (err == nil) != x.valid {
+			t.Errorf("ParseStepTimeouts(%q): valid: got %t want %t: %v", x.in, err == nil, x.valid, err)
+			continue
+		}
+		if x.valid && !reflect.DeepEqual(m, x.exp) {
+			t.Errorf("ParseStepTimeouts(%q): got %v want %v", x.in, m, x.exp)
+		}
+	}
+}
+
+func TestRealMainTimeout(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// large enough that compressing it takes longer than the timeouts
+	disk := make([]byte, 8<<20)
+	rand.New(rand.NewSource(1)).Read(disk)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: string(disk)},
+	})
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		steps   map[string]time.Duration
+		exp     TimeoutError
+	}{
+		{
+			name:    "overall",
+			timeout: time.Nanosecond,
+			exp:     TimeoutError{Timeout: time.Nanosecond, Overall: true},
+		},
+		{
+			name:  "step",
+			steps: map[string]time.Duration{"image": time.Nanosecond},
+			exp:   TimeoutError{Step: "image", Timeout: time.Nanosecond},
+		},
+	}
+	for _, x := range tests {
+		tmp := filepath.Join(dir, x.name)
+		if err := os.Mkdir(tmp, 0755); err != nil {
+			t.Fatal(err)
+		}
+		c := &Config{
+			OVAFile:      ova,
+			OutputDir:    dir,
+			TmpRoot:      tmp,
+			Timeout:      x.timeout,
+			StepTimeouts: x.steps,
+			Logger:       DiscardLogger,
+			stop:         make(chan struct{}),
+		}
+		_, err := realMain(c, []string{"1.2"})
+		c.Cleanup()
+		e, ok := err.(*TimeoutError)
+		if !ok {
+			t.Errorf("%s: expected *TimeoutError got: %#v", x.name, err)
+			continue
+		}
+		// the overall timeout may expire during any step
+		if x.exp.Overall {
+			x.exp.Step = e.Step
+		}
+		if *e != x.exp {
+			t.Errorf("%s: got %+v want %+v", x.name, *e, x.exp)
+		}
+		if list, _ := ioutil.ReadDir(tmp); len(list) != 0 {
+			t.Errorf("%s: temp directory was not removed: %s", x.name, list[0].Name())
+		}
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.tgz")); len(matches) != 0 {
+		t.Errorf("expected no stemcells got: %q", matches)
+	}
+}
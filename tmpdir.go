@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TempDirPrefix is the prefix of the temp directories created by
+// Config.TempDir, see CleanOrphanTempDirs.
+const TempDirPrefix = "ova2stemcell-"
+
+// tempDirPIDFile is the file, in each temp directory, that contains the
+// process ID of the build that created it.
+const tempDirPIDFile = "ova2stemcell.pid"
+
+var buildIDRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// ValidateBuildID validates build ID id, see -build-id.  Only letters,
+// digits, '_', '.' and '-' are allowed so that it is safe in filenames.
+func ValidateBuildID(id string) error {
+	if id == "" {
+		return nil
+	}
+	if len(id) > 64 || !buildIDRe.MatchString(id) {
+		return fmt.Errorf("invalid build id (%s): must start with a letter or "+
+			"digit and contain only letters, digits, '_', '.' and '-'", id)
+	}
+	return nil
+}
+
+// tempDirPrefix returns the prefix of the temp directory of c, which names
+// the versions being built and c.BuildID so that orphaned temp directories
+// can be traced to their build, e.g. "ova2stemcell-1.2_1.3-ci42-".
+func (c *Config) tempDirPrefix() string {
+	prefix := TempDirPrefix
+	if c.tmpLabel != "" {
+		prefix += c.tmpLabel + "-"
+	}
+	if c.BuildID != "" {
+		prefix += c.BuildID + "-"
+	}
+	return prefix
+}
+
+// writePIDFile records the process ID of the build in temp directory dir.
+func writePIDFile(dir string) error {
+	name := filepath.Join(dir, tempDirPIDFile)
+	return ioutil.WriteFile(name, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// readPIDFile returns the process ID recorded in temp directory dir.
+func readPIDFile(dir string) (int, bool) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, tempDirPIDFile))
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	return pid, err == nil && pid > 0
+}
+
+// lastModified returns the most recent modification time of directory dir
+// and the files in it.
+func lastModified(dir string, fi os.FileInfo) time.Time {
+	t := fi.ModTime()
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return t
+	}
+	for _, fi := range fis {
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t
+}
+
+// CleanOrphanTempDirs removes the temp directories in root, or the default
+// temp directory if empty, left by builds that were killed.  Only
+// directories whose name starts with TempDirPrefix, that have not been
+// modified for age and whose build process is no longer running are
+// removed.  Each directory removed is written to w.
+func CleanOrphanTempDirs(w io.Writer, root string, age time.Duration) error {
+	if root == "" {
+		root = os.TempDir()
+	}
+	Log.Debugf("cleaning orphaned temp directories older than %s in: %s", age, root)
+	fis, err := ioutil.ReadDir(root)
+	if err != nil {
+		return fmt.Errorf("cleaning temp directories (%s): %s", root, err)
+	}
+	cutoff := time.Now().Add(-age)
+	for _, fi := range fis {
+		// ReadDir does not follow symlinks, so a link is never a dir
+		if !fi.IsDir() || !strings.HasPrefix(fi.Name(), TempDirPrefix) {
+			continue
+		}
+		dir := filepath.Join(root, fi.Name())
+		if t := lastModified(dir, fi); t.After(cutoff) {
+			Log.Debugf("skipping temp directory (%s): modified at %s", dir, t)
+			continue
+		}
+		if pid, ok := readPIDFile(dir); ok && pid != os.Getpid() && processRunning(pid) {
+			Log.Debugf("skipping temp directory (%s): build (pid %d) is running", dir, pid)
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("removing temp directory (%s): %s", dir, err)
+		}
+		fmt.Fprintf(w, "removed orphaned temp directory: %s\n", dir)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTempDirName(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+
+	c := &Config{TmpRoot: root, BuildID: "ci42", Logger: DiscardLogger, stop: make(chan struct{})}
+	c.tmpLabel = "1.2_1.3"
+	defer c.Cleanup()
+	dir, err := c.TempDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := filepath.Base(dir); !strings.HasPrefix(name, "ova2stemcell-1.2_1.3-ci42-") {
+		t.Errorf("TempDir: unexpected name: %s", name)
+	}
+	if pid, ok := readPIDFile(dir); !ok || pid != os.Getpid() {
+		t.Errorf("TempDir: pid file: got %d %t want %d", pid, ok, os.Getpid())
+	}
+
+	for _, id := range []string{"a b", "-x", "a/b", strings.Repeat("a", 65)} {
+		if err := ValidateBuildID(id); err == nil {
+			t.Errorf("ValidateBuildID(%q): expected error", id)
+		}
+	}
+}
+
+func TestCleanOrphanTempDirs(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+
+	old := time.Now().Add(-48 * time.Hour)
+	mkdir := func(name string, pid int, mtime time.Time) string {
+		dir := filepath.Join(root, name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if pid != 0 {
+			pidFile := filepath.Join(dir, tempDirPIDFile)
+			if err := ioutil.WriteFile(pidFile, []byte(strconv.Itoa(pid)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(pidFile, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Chtimes(dir, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+
+	// a pid that is not running, the pid of init is always running
+	const deadPID = 1 << 30
+	orphan := mkdir("ova2stemcell-1.2-123", deadPID, old)
+	noPID := mkdir("ova2stemcell-1.3-456", 0, old)
+	recent := mkdir("ova2stemcell-1.4-789", deadPID, time.Now())
+	running := mkdir("ova2stemcell-1.5-012", 1, old)
+	other := mkdir("other-123", 0, old)
+	if err := os.Symlink(other, filepath.Join(root, "ova2stemcell-link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := CleanOrphanTempDirs(&b, root, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for dir, removed := range map[string]bool{
+		orphan:  true,
+		noPID:   true,
+		recent:  false,
+		running: !processRunning(1),
+		other:   false,
+	} {
+		_, err := os.Stat(dir)
+		if removed != os.IsNotExist(err) {
+			t.Errorf("CleanOrphanTempDirs: %s: removed %t want %t", filepath.Base(dir),
+				os.IsNotExist(err), removed)
+		}
+		if removed != strings.Contains(b.String(), dir+"\n") {
+			t.Errorf("CleanOrphanTempDirs: %s: not reported in output:\n%s", dir, b.String())
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(root, "ova2stemcell-link")); err != nil {
+		t.Errorf("CleanOrphanTempDirs: symlink removed: %s", err)
+	}
+}
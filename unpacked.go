@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// UnpackedDirname returns the name of the directory an unpacked stemcell
+// is written to, which is filename without its ".tgz" extension.
+func UnpackedDirname(filename string) string {
+	if s := strings.TrimSuffix(filename, ".tgz"); s != filename && s != "" {
+		return s
+	}
+	return filename + ".d"
+}
+
+// WriteUnpacked writes the image, manifest and any extra files as loose files
+// to directory dirname, instead of creating a stemcell tarball.  The files are
+// copied so that the image may be reused.  If overwrite is true an existing
+// dirname is replaced, otherwise it is an error if dirname exists.
+func (c *Config) WriteUnpacked(dirname string, overwrite bool) error {
+	c.debugf("writing unpacked stemcell to: %s", dirname)
+
+	// programming errors - panic!
+	if c.Manifest == "" {
+		panic("WriteUnpacked: empty manifest")
+	}
+	if !c.hasImage() {
+		panic("WriteUnpacked: empty image")
+	}
+
+	if _, err := os.Stat(dirname); !os.IsNotExist(err) && !overwrite {
+		return fmt.Errorf("directory (%s) already exists - refusing to overwrite", dirname)
+	}
+
+	// write to a temp directory next to dirname then rename it into place
+	tmp, err := ioutil.TempDir(filepath.Dir(dirname), "."+filepath.Base(dirname)+"-")
+	if err != nil {
+		return fmt.Errorf("writing unpacked stemcell: %s", err)
+	}
+	errorf := func(format string, a ...interface{}) error {
+		os.RemoveAll(tmp)
+		return fmt.Errorf(format, a...)
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return errorf("writing unpacked stemcell: %s", err)
+	}
+
+	files := []ExtraFile{{Path: c.Manifest, Name: "stemcell.MF"}}
+	if c.imageData != nil {
+		c.debugf("writing in memory image to unpacked stemcell")
+		if err := ioutil.WriteFile(filepath.Join(tmp, "image"), c.imageData, 0644); err != nil {
+			return errorf("writing unpacked stemcell: %s", err)
+		}
+	} else {
+		files = append(files, ExtraFile{Path: c.Image, Name: "image"})
+	}
+	files = append(files, c.ExtraFiles...)
+	for _, e := range files {
+		c.debugf("copying (%s) to unpacked stemcell as: %s", e.Path, e.Name)
+		if err := c.copyFile(e.Path, filepath.Join(tmp, e.Name)); err != nil {
+			return errorf("writing unpacked stemcell: %s", err)
+		}
+	}
+
+	if overwrite {
+		if err := os.RemoveAll(dirname); err != nil {
+			return errorf("writing unpacked stemcell: %s", err)
+		}
+	}
+	if err := os.Rename(tmp, dirname); err != nil {
+		return errorf("writing unpacked stemcell: %s", err)
+	}
+	return nil
+}
+
+// copyFile copies file src to new file dst, the copy can be cancelled by
+// stopping Config c unless src is small, see drainReader.
+func (c *Config) copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := copyBuffer(out, c.drainReader(in, fi.Size())); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteUnpacked(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c := newTestConfig(t, dir)
+	defer c.Cleanup()
+
+	out := filepath.Join(dir, UnpackedDirname(StemcellFilename("1.2", DefaultOS)))
+	if err := c.WriteUnpacked(out, false); err != nil {
+		t.Fatal(err)
+	}
+	image, err := ioutil.ReadFile(filepath.Join(out, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := ioutil.ReadFile(filepath.Join(out, "stemcell.MF"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := fmt.Sprintf("%x", sha1.Sum(image)); !strings.Contains(string(manifest), sum) {
+		t.Errorf("WriteUnpacked: manifest does not contain image sha1 (%s):\n%s", sum, manifest)
+	}
+
+	if err := c.WriteUnpacked(out, false); err == nil {
+		t.Error("WriteUnpacked: expected error when directory exists")
+	}
+	if err := c.WriteUnpacked(out, true); err != nil {
+		t.Errorf("WriteUnpacked: overwrite: %s", err)
+	}
+}
+
+func TestCopyFileDrain(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		drain int64
+		err   error
+	}{
+		{0, ErrInterupt},
+		{9, ErrInterupt},
+		{10, nil},
+		{DefaultDrainSize, nil},
+	}
+	for i, x := range tests {
+		c := &Config{Logger: DiscardLogger, DrainSize: x.drain, stop: make(chan struct{})}
+		close(c.stop)
+		dst := filepath.Join(dir, fmt.Sprintf("dst-%d", i))
+		if err := c.copyFile(src, dst); err != x.err {
+			t.Errorf("%d: copyFile: expected error %v got: %v", x.drain, x.err, err)
+		}
+		_, err := os.Stat(dst)
+		if x.err == nil && err != nil {
+			t.Errorf("%d: %s", x.drain, err)
+		}
+		if x.err != nil && !os.IsNotExist(err) {
+			t.Errorf("%d: expected cancelled copy to be removed: %v", x.drain, err)
+		}
+		// the build ends at the next step
+		if err := c.startStep("next"); err != ErrInterupt {
+			t.Errorf("%d: startStep: expected error %v got: %v", x.drain, ErrInterupt, err)
+		}
+	}
+}
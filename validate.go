@@ -0,0 +1,364 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// Severity is the severity of a ValidationError.
+type Severity string
+
+const (
+	SeverityError   Severity = "error"   // the stemcell cannot be built
+	SeverityWarning Severity = "warning" // the stemcell can be built
+)
+
+// A ValidationError is a problem with the value of a flag.
+type ValidationError struct {
+	Field    string // name of the flag, without the leading '-', or "args"
+	Message  string
+	Severity Severity
+}
+
+func (e ValidationError) Error() string { return e.Message }
+
+// Fatal returns if e prevents the stemcell from being built.
+func (e ValidationError) Fatal() bool { return e.Severity != SeverityWarning }
+
+// HasFatal returns if any of errs are fatal.
+func HasFatal(errs []ValidationError) bool {
+	for _, e := range errs {
+		if e.Fatal() {
+			return true
+		}
+	}
+	return false
+}
+
+// A validator collects the ValidationErrors of ValidateFlags and
+// Config.Validate.
+type validator struct {
+	errs []ValidationError
+}
+
+// add adds an error for field if err is not nil and returns if it was.
+func (v *validator) add(field string, err error) bool {
+	if err == nil {
+		return false
+	}
+	v.errs = append(v.errs, ValidationError{
+		Field:    field,
+		Message:  err.Error(),
+		Severity: SeverityError,
+	})
+	return true
+}
+
+// warn adds a warning for field.
+func (v *validator) warn(field, format string, a ...interface{}) {
+	v.errs = append(v.errs, ValidationError{
+		Field:    field,
+		Message:  fmt.Sprintf(format, a...),
+		Severity: SeverityWarning,
+	})
+}
+
+// failed returns if there is an error for field.
+func (v *validator) failed(field string) bool {
+	for _, e := range v.errs {
+		if e.Field == field && e.Fatal() {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate validates the fields of c used to build c.Version, which like
+// -version may be a comma separated list of versions, see realMain, and
+// returns a ValidationError for each problem found.  The Field of each error
+// is the name of the Config field, e.g. "OutputDir".  Unlike ValidateFlags it
+// does not depend on the command line.  Checks that depend on a field that
+// is invalid are skipped.
+func (c *Config) Validate() []error {
+	return c.validate(SplitVersions(c.Version))
+}
+
+// validate is Validate for building versions, instead of c.Version, which is
+// set by realMain as each version is built.
+func (c *Config) validate(versions []string) []error {
+	v := &validator{}
+
+	n := 0
+	for _, s := range []string{c.OVAFile, c.OVFDir, c.ImageFile, c.FromStemcell} {
+		if strings.TrimSpace(s) != "" {
+			n++
+		}
+	}
+	switch {
+	case n == 0:
+		v.add("OVAFile", errors.New("missing input: one of the OVA file, OVF directory, image file or "+
+			"stemcell must be set"))
+	case n > 1:
+		v.add("OVAFile", errors.New("more than one input: only one of the OVA file, OVF directory, "+
+			"image file or stemcell may be set"))
+	}
+	badOS := v.add("OS", ValidateOS(c.osName()))
+	if c.Agent != "" {
+		v.add("Agent", ValidateAgent(c.Agent))
+	}
+	if c.ManifestLayout != "" {
+		v.add("ManifestLayout", ValidateManifestLayout(c.ManifestLayout))
+	}
+	if c.IaaS != "" {
+		v.add("IaaS", ValidateIaaS(c.IaaS))
+	}
+	if c.APIVersion < 0 {
+		v.add("APIVersion", fmt.Errorf("invalid api version (%d): must be a positive integer", c.APIVersion))
+	}
+	badVersion := v.add("Version", ValidateVersions(versions, c.OutputName, c.osName()))
+
+	stdout := c.Output != nil
+	if stdout {
+		if len(versions) > 1 {
+			v.add("Output", errors.New("only one version can be built when writing the stemcell to a stream"))
+		}
+		if c.Unpacked {
+			v.add("Unpacked", errors.New("an unpacked stemcell cannot be written to a stream"))
+		}
+		if c.OutputName != "" {
+			v.add("OutputName", errors.New("the stemcell filename cannot be set when writing it to a stream"))
+		}
+		if len(c.Checksums) != 0 {
+			v.add("Checksums", errors.New("checksum files cannot be written when writing the stemcell to a stream"))
+		}
+		if c.Lock {
+			v.add("Lock", errors.New("a lock file cannot be created when writing the stemcell to a stream"))
+		}
+		if c.SignKey != "" {
+			v.add("SignKey", errors.New("a signature file cannot be written when writing the stemcell to a stream"))
+		}
+	}
+
+	if !stdout {
+		c.debugf("validating output directory: %s", c.OutputDir)
+	}
+	badOutput := stdout || v.add("OutputDir", ValidateOutputDir(c.OutputDir))
+	badName := stdout || v.add("OutputName", ValidateOutputName(c.OutputName))
+	if !badName && !badVersion {
+		for _, ver := range versions {
+			if v.add("OutputName", ValidateFilenameVersion(OutputFilename(c.OutputName, ver, c.osName()), ver)) {
+				badName = true
+				break
+			}
+		}
+	}
+	if !badName && c.OutputName != "" && !strings.Contains(c.OutputName, "%s") &&
+		!strings.Contains(c.OutputName, "{version}") {
+		v.warn("OutputName", "stemcell filename (%s) does not contain the version ('%%s' or "+
+			"'{version}'): the stemcell filename will not show its version", c.OutputName)
+	}
+	if !badOutput && !badName && !badVersion && !badOS {
+		for _, ver := range versions {
+			name := StemcellPath(c.OutputDir, c.OutputName, ver, c.osName(), c.Unpacked)
+			if c.Force {
+				c.debugf("force enabled: not checking if stemcell filename (%s) exists", name)
+			} else {
+				c.debugf("validating that stemcell filename (%s) does not exist", name)
+			}
+			if v.add("OutputDir", ValidateStemcellFilename(name, c.Force)) {
+				break
+			}
+		}
+	}
+
+	if !v.add("ExtraFiles", ValidateExtraFiles(c.ExtraFiles)) && c.EmbedBuildInfo {
+		for _, e := range c.ExtraFiles {
+			if e.Name == BuildInfoName {
+				v.add("EmbedBuildInfo", fmt.Errorf("an extra file (%s) is named %s", e, BuildInfoName))
+				break
+			}
+		}
+	}
+	if c.TmpRoot != "" {
+		c.debugf("validating temp directory: %s", c.TmpRoot)
+	}
+	v.add("TmpRoot", ValidateTmpRoot(c.TmpRoot))
+	if c.WorkDir != "" {
+		switch {
+		case c.FromStemcell != "":
+			v.add("WorkDir", errors.New("the image of a stemcell is extracted, not created, so is not checkpointed"))
+		case c.StreamImage:
+			v.add("WorkDir", errors.New("a streamed image is not written to a file, so cannot be checkpointed"))
+		default:
+			c.debugf("validating work directory: %s", c.WorkDir)
+			v.add("WorkDir", ValidateWorkDir(c.WorkDir))
+		}
+	}
+	if c.MetricsFile != "" {
+		v.add("MetricsFile", ValidateMetricsFile(c.MetricsFile))
+	}
+	v.add("BuildID", ValidateBuildID(c.BuildID))
+
+	if len(c.Checksums) != 0 && c.Unpacked && !stdout {
+		v.add("Checksums", errors.New("checksum files cannot be written for an unpacked stemcell"))
+	}
+	if c.SignKey != "" && !stdout {
+		if c.Unpacked {
+			v.add("SignKey", errors.New("an unpacked stemcell cannot be signed"))
+		} else {
+			_, err := LoadSigningKey(c.SignKey)
+			v.add("SignKey", err)
+		}
+	}
+	if c.DiskSpaceFactor < 0 {
+		v.add("DiskSpaceFactor", fmt.Errorf("invalid disk space factor (%g): must not be negative",
+			c.DiskSpaceFactor))
+	}
+	if c.MemoryImageLimit < 0 {
+		v.add("MemoryImageLimit", fmt.Errorf("invalid memory image limit (%d): must not be negative",
+			c.MemoryImageLimit))
+	}
+	if c.MaxImageSize < 0 {
+		v.add("MaxImageSize", fmt.Errorf("invalid max image size (%d): must not be negative", c.MaxImageSize))
+	}
+	if c.GzipThreads < 0 {
+		v.add("GzipThreads", fmt.Errorf("invalid gzip threads (%d): must not be negative", c.GzipThreads))
+	}
+	if c.IORetries < 0 {
+		v.add("IORetries", fmt.Errorf("invalid i/o retries (%d): must not be negative", c.IORetries))
+	}
+	if c.Timeout < 0 {
+		v.add("Timeout", fmt.Errorf("invalid timeout (%s): must not be negative", c.Timeout))
+	}
+	if c.Symlinks != "" {
+		v.add("Symlinks", ValidateSymlinkPolicy(c.Symlinks))
+	}
+	v.add("NamePolicy", ValidateOVFNamePolicy(c.NamePolicy))
+	if c.StreamImage {
+		if c.OVAFile == "" {
+			v.add("StreamImage", errors.New("only an OVA file can be streamed"))
+		} else if c.Unpacked {
+			v.add("StreamImage", errors.New("the image of an unpacked stemcell cannot be streamed"))
+		}
+	}
+	if c.AllowDevices != nil && (c.ImageFile != "" || c.FromStemcell != "") {
+		v.add("AllowDevices", errors.New("devices can only be checked for an OVA file or OVF directory"))
+	}
+
+	if c.TrustInputs {
+		v.warn("TrustInputs", "inputs are trusted: skipping integrity checks: "+TrustedChecks)
+	}
+	if c.NoImageGzip {
+		v.warn("NoImageGzip", "not compressing the image is experimental: BOSH expects the stemcell "+
+			"image to be gzip compressed")
+	}
+
+	errs := make([]error, len(v.errs))
+	for i, e := range v.errs {
+		errs[i] = e
+	}
+	return errs
+}
+
+// configFlags maps the Config fields checked by Config.Validate to the flag
+// that sets them.
+var configFlags = map[string]string{
+	"OVAFile":          "ova",
+	"OS":               "os",
+	"Agent":            "agent",
+	"ManifestLayout":   "manifest-version",
+	"IaaS":             "iaas",
+	"APIVersion":       "api-version",
+	"Version":          "version",
+	"Output":           "output",
+	"OutputDir":        "output",
+	"OutputName":       "output-name",
+	"Unpacked":         "unpacked",
+	"Checksums":        "emit-checksum",
+	"SignKey":          "sign-key",
+	"ExtraFiles":       "include",
+	"TmpRoot":          "tmp-dir",
+	"WorkDir":          "work-dir",
+	"MetricsFile":      "metrics-file",
+	"BuildID":          "build-id",
+	"MaxImageSize":     "max-image-size",
+	"MemoryImageLimit": "memory-image-limit",
+	"DiskSpaceFactor":  "disk-space-factor",
+	"GzipThreads":      "gzip-threads",
+	"Timeout":          "timeout",
+	"IORetries":        "io-retries",
+	"Lock":             "lock",
+	"EmbedBuildInfo":   "embed-build-info",
+	"AllowDevices":     "ovf-allow-devices",
+	"Symlinks":         "ovf-symlinks",
+	"StreamImage":      "stream-image",
+	"NamePolicy":       "ovf-name-policy",
+	"TrustInputs":      "trust-inputs",
+	"NoImageGzip":      "no-image-gzip",
+}
+
+// ValidateFlags validates the flags used to build a stemcell and returns a
+// ValidationError for each problem found.  The values of the flags are
+// validated by Config.Validate, whose messages are prefixed with the name of
+// the flag, this checks what only applies to the command line.  Checks that
+// depend on a flag that is invalid are skipped.
+func ValidateFlags() []ValidationError {
+	v := &validator{}
+
+	if args := flag.Args(); len(args) != 0 {
+		v.add("args", fmt.Errorf("extra arguments: %s", strings.Join(args, ", ")))
+	}
+	for _, err := range flagConfig().validate(SplitVersions(StemcellVersion)) {
+		e := err.(ValidationError)
+		name, ok := configFlags[e.Field]
+		if !ok {
+			panic("ValidateFlags: no flag for Config field: " + e.Field)
+		}
+		e.Field = name
+		e.Message = "-" + name + ": " + e.Message
+		v.errs = append(v.errs, e)
+	}
+
+	if !v.failed("version") {
+		v.add("min-version", ValidateMinVersion(SplitVersions(StemcellVersion), MinVersion))
+	}
+	if ManifestTmpl != "" {
+		_, err := LoadManifestTemplate(ManifestTmpl)
+		v.add("manifest-template", err)
+	}
+	if OutputDir == StdoutOutput {
+		for _, f := range []struct {
+			name string
+			set  bool
+		}{
+			{"json", JSONOutput},
+			{"events", EventsOutput},
+		} {
+			if f.set {
+				v.add(f.name, fmt.Errorf("-%s cannot be used with -output -", f.name))
+			}
+		}
+	}
+	if EventsOutput && JSONOutput {
+		v.add("events", errors.New("-events cannot be used with -json"))
+	}
+
+	_, err := ParseChecksumAlgorithms(EmitChecksum)
+	v.add("emit-checksum", err)
+	_, err = ParseStepTimeouts(StepTimeouts)
+	v.add("step-timeout", err)
+	_, err = ParseImageChecksums(ImageChecksum)
+	v.add("checksum", err)
+	_, err = ParseOVFDevices(AllowDevices)
+	v.add("ovf-allow-devices", err)
+
+	if ExpectManifest != "" {
+		v.add("expect-manifest", errors.New("-expect-manifest can only be used with -verify"))
+	}
+	if VerifySigKey != "" {
+		v.add("verify-sig", errors.New("-verify-sig can only be used with -verify"))
+	}
+	return v.errs
+}
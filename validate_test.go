@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// setFlags sets the flag globals used by ValidateFlags to valid values and
+// returns a func that restores them.
+func setFlags(t *testing.T, dir string) func() {
+	ova, ovf, version, min := OvaFile, OvfDir, StemcellVersion, MinVersion
+	osName, agent, layout, iaas := OperatingSystem, Agent, ManifestLayout, IaaS
+	out, name, tmp, include := OutputDir, OutputName, TmpRoot, IncludeFiles
+	checksum, unpacked, nogzip, image := EmitChecksum, Unpacked, NoImageGzip, ImageFile
+	jsonOutput, fromStemcell, allowDevices := JSONOutput, FromStemcell, AllowDevices
+
+	OvaFile, OvfDir, StemcellVersion, MinVersion = filepath.Join(dir, "vm.ova"), "", "1.2", ""
+	OperatingSystem, Agent, ManifestLayout, IaaS = DefaultOS, DefaultAgent, ManifestV1, DefaultIaaS
+	OutputDir, OutputName, TmpRoot, IncludeFiles = dir, "", "", nil
+	EmitChecksum, Unpacked, NoImageGzip, ImageFile = "", false, false, ""
+	JSONOutput, FromStemcell, AllowDevices = false, "", ""
+
+	return func() {
+		OvaFile, OvfDir, StemcellVersion, MinVersion = ova, ovf, version, min
+		OperatingSystem, Agent, ManifestLayout, IaaS = osName, agent, layout, iaas
+		OutputDir, OutputName, TmpRoot, IncludeFiles = out, name, tmp, include
+		EmitChecksum, Unpacked, NoImageGzip, ImageFile = checksum, unpacked, nogzip, image
+		JSONOutput, FromStemcell, AllowDevices = jsonOutput, fromStemcell, allowDevices
+	}
+}
+
+func TestValidateFlags(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		set      func()
+		field    string
+		severity Severity
+	}{
+		{func() { OvaFile = "" }, "ova", SeverityError},
+		{func() { OvfDir = dir }, "ova", SeverityError},
+		{func() { ImageFile = filepath.Join(dir, "disk.img") }, "ova", SeverityError},
+		{func() { FromStemcell = filepath.Join(dir, "stemcell.tgz") }, "ova", SeverityError},
+		{func() { StemcellVersion = "" }, "version", SeverityError},
+		{func() { StemcellVersion = "a.b" }, "version", SeverityError},
+		{func() { MinVersion = "1.2" }, "min-version", SeverityError},
+		{func() { OperatingSystem = "plan9" }, "os", SeverityError},
+		{func() { Agent = "a b" }, "agent", SeverityError},
+		{func() { ManifestLayout = "v3" }, "manifest-version", SeverityError},
+		{func() { IaaS = "gcp" }, "iaas", SeverityError},
+		{func() { OutputDir = filepath.Join(dir, "missing") }, "output", SeverityError},
+		{func() { OutputName = "a/b.tgz" }, "output-name", SeverityError},
+		{func() { OutputName = StemcellFilename("1.0", DefaultOS) }, "output-name", SeverityError},
+		{func() { OutputName = "stemcell.tgz" }, "output-name", SeverityWarning},
+		{func() { TmpRoot = filepath.Join(dir, "missing") }, "tmp-dir", SeverityError},
+		{func() { IncludeFiles = extraFilesFlag{{Path: dir, Name: "image"}} }, "include", SeverityError},
+		{func() { EmitChecksum = "md5" }, "emit-checksum", SeverityError},
+		{func() { EmitChecksum, Unpacked = "sha1", true }, "emit-checksum", SeverityError},
+		{func() { NoImageGzip = true }, "no-image-gzip", SeverityWarning},
+		{func() { AllowDevices = "disk,webcam" }, "ovf-allow-devices", SeverityError},
+		{func() {
+			OvaFile, ImageFile, AllowDevices = "", filepath.Join(dir, "disk.img"), "disk"
+		}, "ovf-allow-devices", SeverityError},
+		{func() { OutputDir, StemcellVersion = StdoutOutput, "1.2,1.3" }, "output", SeverityError},
+		{func() { OutputDir, Unpacked = StdoutOutput, true }, "unpacked", SeverityError},
+		{func() { OutputDir, OutputName = StdoutOutput, "stemcell.tgz" }, "output-name", SeverityError},
+		{func() { OutputDir, JSONOutput = StdoutOutput, true }, "json", SeverityError},
+	}
+	for i, x := range tests {
+		restore := setFlags(t, dir)
+		if errs := ValidateFlags(); len(errs) != 0 {
+			restore()
+			t.Fatalf("ValidateFlags: unexpected errors for valid flags: %v", errs)
+		}
+		x.set()
+		errs := ValidateFlags()
+		restore()
+		if len(errs) != 1 {
+			t.Errorf("%d: ValidateFlags: expected 1 error got: %+v", i, errs)
+			continue
+		}
+		if e := errs[0]; e.Field != x.field || e.Severity != x.severity {
+			t.Errorf("%d: ValidateFlags: got field %q severity %q want %q %q: %s",
+				i, e.Field, e.Severity, x.field, x.severity, e.Message)
+		}
+		if HasFatal(errs) != (x.severity == SeverityError) {
+			t.Errorf("%d: HasFatal: got %t", i, HasFatal(errs))
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		set      func(c *Config, versions *[]string)
+		field    string
+		severity Severity
+	}{
+		{func(c *Config, _ *[]string) { c.OVAFile = "" }, "OVAFile", SeverityError},
+		{func(c *Config, _ *[]string) { c.OVFDir = dir }, "OVAFile", SeverityError},
+		{func(c *Config, _ *[]string) { c.OS = "plan9" }, "OS", SeverityError},
+		{func(c *Config, _ *[]string) { c.Agent = "a b" }, "Agent", SeverityError},
+		{func(c *Config, _ *[]string) { c.ManifestLayout = "v3" }, "ManifestLayout", SeverityError},
+		{func(c *Config, _ *[]string) { c.IaaS = "gcp" }, "IaaS", SeverityError},
+		{func(c *Config, _ *[]string) { c.APIVersion = -1 }, "APIVersion", SeverityError},
+		{func(_ *Config, v *[]string) { *v = nil }, "Version", SeverityError},
+		{func(_ *Config, v *[]string) { *v = []string{"1.2", "1.2"} }, "Version", SeverityError},
+		{func(c *Config, v *[]string) { c.Output, *v = ioutil.Discard, []string{"1.2", "1.3"} }, "Output", SeverityError},
+		{func(c *Config, _ *[]string) { c.Output, c.Unpacked = ioutil.Discard, true }, "Unpacked", SeverityError},
+		{func(c *Config, _ *[]string) { c.Output, c.Lock = ioutil.Discard, true }, "Lock", SeverityError},
+		{func(c *Config, _ *[]string) { c.Output, c.SignKey = ioutil.Discard, "key.pem" }, "SignKey", SeverityError},
+		{func(c *Config, _ *[]string) { c.OutputDir = filepath.Join(dir, "missing") }, "OutputDir", SeverityError},
+		{func(c *Config, _ *[]string) { c.OutputName = "a/b.tgz" }, "OutputName", SeverityError},
+		{func(c *Config, _ *[]string) { c.OutputName = "stemcell.tgz" }, "OutputName", SeverityWarning},
+		{func(c *Config, _ *[]string) { c.Checksums, c.Unpacked = []string{"sha1"}, true }, "Checksums", SeverityError},
+		{func(c *Config, _ *[]string) { c.SignKey = filepath.Join(dir, "missing.pem") }, "SignKey", SeverityError},
+		{func(c *Config, _ *[]string) { c.SignKey, c.Unpacked = "key.pem", true }, "SignKey", SeverityError},
+		{func(c *Config, _ *[]string) { c.ExtraFiles = []ExtraFile{{Path: dir, Name: "image"}} }, "ExtraFiles", SeverityError},
+		{func(c *Config, _ *[]string) { c.TmpRoot = filepath.Join(dir, "missing") }, "TmpRoot", SeverityError},
+		{func(c *Config, _ *[]string) { c.WorkDir = filepath.Join(dir, "missing") }, "WorkDir", SeverityError},
+		{func(c *Config, _ *[]string) { c.WorkDir, c.StreamImage = dir, true }, "WorkDir", SeverityError},
+		{func(c *Config, _ *[]string) { c.MaxImageSize = -1 }, "MaxImageSize", SeverityError},
+		{func(c *Config, _ *[]string) { c.MemoryImageLimit = -1 }, "MemoryImageLimit", SeverityError},
+		{func(c *Config, _ *[]string) { c.DiskSpaceFactor = -1 }, "DiskSpaceFactor", SeverityError},
+		{func(c *Config, _ *[]string) { c.GzipThreads = -1 }, "GzipThreads", SeverityError},
+		{func(c *Config, _ *[]string) { c.Timeout = -1 }, "Timeout", SeverityError},
+		{func(c *Config, _ *[]string) { c.IORetries = -1 }, "IORetries", SeverityError},
+		{func(c *Config, _ *[]string) {
+			c.OVAFile, c.ImageFile, c.AllowDevices = "", "disk.img", []string{"disk"}
+		}, "AllowDevices", SeverityError},
+		{func(c *Config, _ *[]string) { c.Symlinks = "copy" }, "Symlinks", SeverityError},
+		{func(c *Config, _ *[]string) { c.StreamImage, c.Unpacked = true, true }, "StreamImage", SeverityError},
+		{func(c *Config, _ *[]string) {
+			c.OVAFile, c.OVFDir, c.StreamImage = "", dir, true
+		}, "StreamImage", SeverityError},
+		{func(c *Config, _ *[]string) { c.NamePolicy = "loose" }, "NamePolicy", SeverityError},
+		{func(c *Config, _ *[]string) { c.NoImageGzip = true }, "NoImageGzip", SeverityWarning},
+	}
+	for i, x := range tests {
+		c := &Config{OVAFile: filepath.Join(dir, "vm.ova"), OutputDir: dir}
+		versions := []string{"1.2"}
+		c.Version = "1.2"
+		if errs := c.Validate(); len(errs) != 0 {
+			t.Fatalf("Validate: unexpected errors for a valid config: %v", errs)
+		}
+		x.set(c, &versions)
+		c.Version = strings.Join(versions, ",")
+		errs := c.Validate()
+		if len(errs) != 1 {
+			t.Errorf("%d: Validate: expected 1 error got: %+v", i, errs)
+			continue
+		}
+		e, ok := errs[0].(ValidationError)
+		if !ok {
+			t.Errorf("%d: Validate: error is a %T not a ValidationError", i, errs[0])
+			continue
+		}
+		if e.Field != x.field || e.Severity != x.severity {
+			t.Errorf("%d: Validate: got field %q severity %q want %q %q: %s",
+				i, e.Field, e.Severity, x.field, x.severity, e.Message)
+		}
+		if _, ok := configFlags[e.Field]; !ok {
+			t.Errorf("%d: configFlags: missing flag of field: %s", i, e.Field)
+		}
+	}
+}
+
+func TestValidateReport(t *testing.T) {
+	columns := regexp.MustCompile(`  +`)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: "disk"},
+	})
+
+	tests := []struct {
+		errs []ValidationError
+		ok   bool
+		exp  []string // lines of the report
+	}{
+		{
+			nil,
+			true,
+			[]string{"PASS  input", "PASS  disk space", "PASS\n"},
+		},
+		{
+			[]ValidationError{{Field: "output-name", Message: "no version", Severity: SeverityWarning}},
+			true,
+			[]string{"WARN  output-name        no version", "PASS  input", "PASS\n"},
+		},
+		{
+			[]ValidationError{{Field: "version", Message: "bad version", Severity: SeverityError}},
+			false,
+			[]string{"FAIL  version            bad version", "PASS  input", "FAIL\n"},
+		},
+		{
+			[]ValidationError{{Field: "ova", Message: "missing ova", Severity: SeverityError}},
+			false,
+			[]string{"FAIL  ova                missing ova", "SKIP  input", "SKIP  disk space", "FAIL\n"},
+		},
+	}
+	for i, x := range tests {
+		c := &Config{OVAFile: ova, TmpRoot: dir, Logger: DiscardLogger}
+		var b bytes.Buffer
+		err := ValidateReport(&b, c, x.errs)
+		if (err == nil) != x.ok {
+			t.Errorf("%d: got error %v want ok %t", i, err, x.ok)
+		}
+		// the width of the columns depends on the longest flag name
+		report := columns.ReplaceAllString(b.String(), "  ")
+		for _, s := range x.exp {
+			if !strings.Contains(report, columns.ReplaceAllString(s, "  ")) {
+				t.Errorf("%d: report does not contain %q:\n%s", i, s, b.String())
+			}
+		}
+	}
+
+	// the input is checked
+	c := &Config{OVAFile: filepath.Join(dir, "missing.ova"), Logger: DiscardLogger}
+	var b bytes.Buffer
+	if err := ValidateReport(&b, c, nil); err == nil || !strings.Contains(b.String(), "FAIL  input") {
+		t.Errorf("expected input check to fail got: %v\n%s", err, b.String())
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// cliChecks are the flags checked by ValidateFlags itself, rather than by
+// Config.Validate, see configFlags.
+var cliChecks = []string{"min-version", "manifest-template", "json", "events", "emit-checksum",
+	"step-timeout", "checksum", "ovf-allow-devices", "expect-manifest", "verify-sig"}
+
+// validateCheckNames returns the names of the checks of ValidateFlags, in the
+// order they are reported by ValidateReport.
+func validateCheckNames() []string {
+	seen := map[string]bool{"args": true}
+	var names []string
+	for _, name := range configFlags {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, name := range cliChecks {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{"args"}, names...)
+}
+
+// flagValue returns the value of flag name, as reported by ValidateReport.
+func flagValue(name string) string {
+	var v string
+	if name == "args" {
+		v = strings.Join(flag.Args(), " ")
+	} else if f := flag.Lookup(name); f != nil {
+		v = f.Value.String()
+	}
+	if v == "" {
+		return "(not set)"
+	}
+	return v
+}
+
+// ValidateReport writes a PASS, WARN or FAIL line to w for each check of
+// ValidateFlags, whose errors are errs, then checks the input of c, the free
+// disk space and ovftool, like the validate step of realMain, and writes the
+// overall result.  Checks that depend on an invalid flag are skipped.  An
+// error is returned if any check fails.
+func ValidateReport(w io.Writer, c *Config, errs []ValidationError) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	failed, total := 0, 0
+	report := func(status selfTestStatus, name, msg string) {
+		total++
+		if status == selfTestFail {
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", status, name, msg)
+	}
+	bad := make(map[string]bool)
+	for _, name := range validateCheckNames() {
+		ok := true
+		for _, e := range errs {
+			if e.Field != name {
+				continue
+			}
+			if e.Fatal() {
+				ok = false
+				bad[name] = true
+				report(selfTestFail, name, e.Message)
+			} else {
+				report(selfTestWarn, name, e.Message)
+			}
+		}
+		if ok {
+			report(selfTestPass, name, flagValue(name))
+		}
+	}
+
+	switch {
+	case bad["ova"] || bad["ovf-symlinks"] || bad["ovf-name-policy"] || bad["ovf-allow-devices"]:
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", selfTestSkip, "input", "skipped: invalid flags")
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", selfTestSkip, "disk space", "skipped: invalid flags")
+	default:
+		c.debugf("validate: checking input: %s", c.input())
+		if err := c.ValidateInput(); err != nil {
+			report(selfTestFail, "input", err.Error())
+		} else {
+			report(selfTestPass, "input", c.input())
+		}
+		size, err := InputSize(c.input(), c.ExtraFiles)
+		if err == nil {
+			err = CheckDiskSpace(c.logger(), c.TmpRoot, size, c.DiskSpaceFactor)
+		}
+		if err != nil {
+			report(selfTestFail, "disk space", err.Error())
+		} else {
+			report(selfTestPass, "disk space", fmt.Sprintf("input and extra files are %s", formatBytes(uint64(size))))
+		}
+	}
+	status, msg := selfTestOvftool()
+	report(status, "ovftool", msg)
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if failed != 0 {
+		fmt.Fprintln(w, "FAIL")
+		return fmt.Errorf("validate: %d of %d checks failed", failed, total)
+	}
+	fmt.Fprintln(w, "PASS")
+	return nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// VerifyStemcell reads stemcell tarball r and verifies that it contains
+// exactly one image and stemcell.MF entry, plus the entries named by extra,
+// that the manifest is valid and that the sha1, and sha256 if present, of the
+// image matches the manifest.  The manifest is returned.
+func VerifyStemcell(r io.Reader, extra []string) (*Manifest, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("verifying stemcell: %s", err)
+	}
+	defer gr.Close()
+
+	expected := map[string]bool{"image": true, "stemcell.MF": true}
+	for _, name := range extra {
+		expected[name] = true
+	}
+	seen := make(map[string]bool)
+
+	var m *Manifest
+	var imageSum, imageSum256 string
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("verifying stemcell: %s", err)
+		}
+		if !expected[hdr.Name] {
+			return nil, fmt.Errorf("verifying stemcell: unexpected entry: %s", hdr.Name)
+		}
+		if seen[hdr.Name] {
+			return nil, fmt.Errorf("verifying stemcell: duplicate entry: %s", hdr.Name)
+		}
+		seen[hdr.Name] = true
+
+		switch hdr.Name {
+		case "image":
+			h := sha1.New()
+			h256 := sha256.New()
+			if _, err := copyBuffer(io.MultiWriter(h, h256), tr); err != nil {
+				return nil, fmt.Errorf("verifying stemcell: reading image: %s", err)
+			}
+			imageSum = fmt.Sprintf("%x", h.Sum(nil))
+			imageSum256 = fmt.Sprintf("%x", h256.Sum(nil))
+		case "stemcell.MF":
+			if m, err = ParseManifest(tr); err != nil {
+				return nil, fmt.Errorf("verifying stemcell: %s", err)
+			}
+			if err := m.Validate(); err != nil {
+				return nil, fmt.Errorf("verifying stemcell: %s", err)
+			}
+		}
+	}
+	// the gzip trailer checksum is only verified once EOF is read
+	if _, err := copyBuffer(ioutil.Discard, gr); err != nil {
+		return nil, fmt.Errorf("verifying stemcell: %s", err)
+	}
+	for name := range expected {
+		if !seen[name] {
+			return nil, fmt.Errorf("verifying stemcell: missing entry: %s", name)
+		}
+	}
+	if m == nil {
+		return nil, errors.New("verifying stemcell: missing manifest")
+	}
+	if imageSum != m.Sha1 {
+		return nil, fmt.Errorf("verifying stemcell: image sha1 (%s) does not match manifest sha1 (%s)",
+			imageSum, m.Sha1)
+	}
+	if m.Sha256 != "" && imageSum256 != m.Sha256 {
+		return nil, fmt.Errorf("verifying stemcell: image sha256 (%s) does not match manifest sha256 (%s)",
+			imageSum256, m.Sha256)
+	}
+	return m, nil
+}
+
+// VerifyStemcellFile is like VerifyStemcell, but verifies stemcell file name
+// and that the manifest version is version.
+func VerifyStemcellFile(name, version string, extra []string) (*Manifest, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("verifying stemcell (%s): %s", name, err)
+	}
+	defer f.Close()
+	m, err := VerifyStemcell(f, extra)
+	if err != nil {
+		return nil, fmt.Errorf("%s (%s)", err, name)
+	}
+	if version != "" && m.Version != version {
+		return nil, fmt.Errorf("verifying stemcell (%s): manifest version (%s) does not match: %s",
+			name, m.Version, version)
+	}
+	return m, nil
+}
+
+// ManifestFields are the manifest keys compared by DiffManifests.
+var ManifestFields = []string{"name", "version", "bosh_protocol", "api_version", "sha1",
+	"sha256", "operating_system", "stemcell_formats", "cloud_properties"}
+
+// DefaultExpectIgnore are the manifest fields whose differences are ignored
+// by -expect-manifest by default, they differ between builds.
+const DefaultExpectIgnore = "version,sha1,sha256"
+
+// ParseManifestFields parses the comma separated list of ManifestFields s.
+func ParseManifestFields(s string) ([]string, error) {
+	var fields []string
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		ok := false
+		for _, x := range ManifestFields {
+			ok = ok || f == x
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid manifest field (%s): must be one of: %s",
+				f, strings.Join(ManifestFields, ", "))
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// A ManifestDiff is a field that differs between two manifests.
+type ManifestDiff struct {
+	Field    string // e.g. "name" or "cloud_properties.hypervisor"
+	Expected string
+	Actual   string
+	Ignored  bool // the field is one of the ignored fields
+}
+
+func (d ManifestDiff) String() string {
+	s := fmt.Sprintf("%s: expected %q got %q", d.Field, d.Expected, d.Actual)
+	if d.Ignored {
+		s += " (ignored)"
+	}
+	return s
+}
+
+// DiffManifests compares manifest actual to expected field by field, in the
+// order of ManifestFields, and returns the differences.  Differences in the
+// fields named by ignore are returned with Ignored set.  A cloud_properties
+// difference is reported for each key that differs.
+func DiffManifests(expected, actual *Manifest, ignore []string) []ManifestDiff {
+	ignored := make(map[string]bool)
+	for _, f := range ignore {
+		ignored[f] = true
+	}
+	var diffs []ManifestDiff
+	add := func(field, key, exp, got string) {
+		if exp == got {
+			return
+		}
+		name := field
+		if key != "" {
+			name += "." + key
+		}
+		diffs = append(diffs, ManifestDiff{
+			Field:    name,
+			Expected: exp,
+			Actual:   got,
+			Ignored:  ignored[field],
+		})
+	}
+	for _, f := range ManifestFields {
+		switch f {
+		case "name":
+			add(f, "", expected.Name, actual.Name)
+		case "version":
+			add(f, "", expected.Version, actual.Version)
+		case "bosh_protocol":
+			add(f, "", expected.BoshProtocol, actual.BoshProtocol)
+		case "api_version":
+			add(f, "", apiVersionString(expected.APIVersion), apiVersionString(actual.APIVersion))
+		case "sha1":
+			add(f, "", expected.Sha1, actual.Sha1)
+		case "sha256":
+			add(f, "", expected.Sha256, actual.Sha256)
+		case "operating_system":
+			add(f, "", expected.OperatingSystem, actual.OperatingSystem)
+		case "stemcell_formats":
+			add(f, "", strings.Join(expected.StemcellFormats, ","),
+				strings.Join(actual.StemcellFormats, ","))
+		case "cloud_properties":
+			keys := make(map[string]bool)
+			for k := range expected.CloudProperties {
+				keys[k] = true
+			}
+			for k := range actual.CloudProperties {
+				keys[k] = true
+			}
+			var sorted []string
+			for k := range keys {
+				sorted = append(sorted, k)
+			}
+			sort.Strings(sorted)
+			for _, k := range sorted {
+				add(f, k, expected.CloudProperties[k], actual.CloudProperties[k])
+			}
+		}
+	}
+	return diffs
+}
+
+// VerifyMode verifies stemcell file name, see VerifyStemcellFile, and writes
+// the result to w.  If pubKey is not empty the detached signature of the
+// stemcell is verified with it, see VerifySignatureFile.  If expectManifest is
+// not empty the stemcell's manifest is compared to it, each difference is
+// written to w and an error is returned if any of the differences are not in
+// ignore.
+func VerifyMode(w io.Writer, name, expectManifest, pubKey string, ignore, extra []string) error {
+	m, err := VerifyStemcellFile(name, "", extra)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "verified stemcell: %s (version %s, image sha1 %s)\n", name, m.Version, m.Sha1)
+	if pubKey != "" {
+		pub, err := LoadVerifyKey(pubKey)
+		if err != nil {
+			return err
+		}
+		if err := VerifySignatureFile(name, pub); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "verified signature: %s (key %s)\n", name+SignatureExt, pubKey)
+	}
+	if expectManifest == "" {
+		return nil
+	}
+
+	f, err := os.Open(expectManifest)
+	if err != nil {
+		return fmt.Errorf("expected manifest (%s): %s", expectManifest, err)
+	}
+	defer f.Close()
+	exp, err := ParseManifest(f)
+	if err != nil {
+		return fmt.Errorf("expected manifest (%s): %s", expectManifest, err)
+	}
+
+	n := 0
+	for _, d := range DiffManifests(exp, m, ignore) {
+		fmt.Fprintf(w, "manifest differs: %s\n", d)
+		if !d.Ignored {
+			n++
+		}
+	}
+	if n != 0 {
+		return fmt.Errorf("stemcell (%s): manifest does not match expected manifest (%s): %d differences",
+			name, expectManifest, n)
+	}
+	fmt.Fprintf(w, "manifest matches: %s\n", expectManifest)
+	return nil
+}
+
+// apiVersionString returns api_version v as a string, empty if omitted.
+func apiVersionString(v int) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.Itoa(v)
+}
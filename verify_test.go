@@ -0,0 +1,179 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeStemcell returns a gzipped tarball of entries.
+func writeStemcell(t *testing.T, entries []tarEntry) []byte {
+	var b bytes.Buffer
+	gw := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.Name, Mode: 0644, Size: int64(len(e.Body))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.Body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestVerifyStemcell(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c := newTestConfig(t, dir)
+	defer c.Cleanup()
+
+	var b bytes.Buffer
+	if err := c.CreateStemcellTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	good := b.Bytes()
+	m, err := VerifyStemcell(bytes.NewReader(good), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != c.Version || m.Sha1 != c.Sha1sum {
+		t.Errorf("VerifyStemcell: unexpected manifest: %+v", m)
+	}
+
+	_, files := readStemcell(t, bytes.NewReader(good))
+	manifest := string(files["stemcell.MF"])
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		errstr  string
+	}{
+		{"missing image", []tarEntry{{Name: "stemcell.MF", Body: manifest}}, "missing entry"},
+		{"missing manifest", []tarEntry{{Name: "image", Body: "abc"}}, "missing entry"},
+		{"extra", []tarEntry{{Name: "image", Body: "abc"}, {Name: "stemcell.MF", Body: manifest}, {Name: "x", Body: ""}}, "unexpected entry"},
+		{"duplicate", []tarEntry{{Name: "image", Body: "abc"}, {Name: "image", Body: "abc"}}, "duplicate entry"},
+		{"sha1", []tarEntry{{Name: "image", Body: "abc"}, {Name: "stemcell.MF", Body: manifest}}, "does not match"},
+	}
+	for _, x := range tests {
+		_, err := VerifyStemcell(bytes.NewReader(writeStemcell(t, x.entries)), nil)
+		if err == nil || !strings.Contains(err.Error(), x.errstr) {
+			t.Errorf("VerifyStemcell (%s): got error %v want %q", x.name, err, x.errstr)
+		}
+	}
+
+	// truncated tarball
+	if _, err := VerifyStemcell(bytes.NewReader(good[:len(good)-8]), nil); err == nil {
+		t.Error("VerifyStemcell: expected error for truncated stemcell")
+	}
+}
+
+func TestVerifyStemcellOVF(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for name, body := range map[string]string{"vm.ovf": "<Envelope/>", "vm-disk1.vmdk": "disk"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &Config{Version: "1.2", Logger: DiscardLogger, stop: make(chan struct{})}
+	defer c.Cleanup()
+	if err := c.CreateImageFromOVF(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteManifest(); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := c.CreateStemcellTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyStemcell(&b, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDiffManifests(t *testing.T) {
+	exp := NewManifest("1.2", "aaaa", DefaultOS)
+	got := NewManifest("1.3", "bbbb", DefaultOS)
+	got.Name = "other"
+	got.CloudProperties["hypervisor"] = "kvm"
+	got.CloudProperties["extra"] = "x"
+
+	var diffs []string
+	for _, d := range DiffManifests(exp, got, []string{"version", "sha1"}) {
+		diffs = append(diffs, d.String())
+	}
+	want := []string{
+		`name: expected "bosh-vsphere-esxi-windows-2012R2-go_agent" got "other"`,
+		`version: expected "1.2" got "1.3" (ignored)`,
+		`sha1: expected "aaaa" got "bbbb" (ignored)`,
+		`cloud_properties.extra: expected "" got "x"`,
+		`cloud_properties.hypervisor: expected "esxi" got "kvm"`,
+	}
+	if strings.Join(diffs, "\n") != strings.Join(want, "\n") {
+		t.Errorf("DiffManifests:\ngot:\n%s\nwant:\n%s", strings.Join(diffs, "\n"),
+			strings.Join(want, "\n"))
+	}
+	if d := DiffManifests(exp, exp, nil); len(d) != 0 {
+		t.Errorf("DiffManifests: expected no differences got: %v", d)
+	}
+
+	if f, err := ParseManifestFields(DefaultExpectIgnore); err != nil || len(f) != 3 {
+		t.Errorf("ParseManifestFields(%q): got %q, %v", DefaultExpectIgnore, f, err)
+	}
+	if _, err := ParseManifestFields("version,sha512"); err == nil {
+		t.Error("ParseManifestFields: expected error for unknown field")
+	}
+}
+
+func TestVerifyModeExpectManifest(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c := newTestConfig(t, dir)
+	defer c.Cleanup()
+
+	var b bytes.Buffer
+	if err := c.CreateStemcellTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	stemcell := filepath.Join(dir, "stemcell.tgz")
+	if err := ioutil.WriteFile(stemcell, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// same shape, different version and sha1
+	expected := NewManifest("999.1", "0000", c.osName())
+	var mb bytes.Buffer
+	if _, err := expected.WriteTo(&mb); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "expected.MF")
+	if err := ioutil.WriteFile(name, mb.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := VerifyMode(&out, stemcell, name, "", []string{"version", "sha1"}, nil); err != nil {
+		t.Fatalf("VerifyMode: %s\n%s", err, out.String())
+	}
+	if s := out.String(); !strings.Contains(s, "(ignored)") || !strings.Contains(s, "manifest matches") {
+		t.Errorf("VerifyMode: unexpected output:\n%s", s)
+	}
+
+	out.Reset()
+	if err := VerifyMode(&out, stemcell, name, "", nil, nil); err == nil {
+		t.Errorf("VerifyMode: expected error when version and sha1 are not ignored:\n%s", out.String())
+	}
+}
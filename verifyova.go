@@ -0,0 +1,150 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path/filepath"
+)
+
+// An MFResult is the result of checking one entry of the .mf manifest of an
+// OVA, see VerifyOVAManifest.
+type MFResult struct {
+	Entry MFEntry
+	Err   error // nil if the digest matches
+}
+
+func (r MFResult) String() string {
+	status := "PASS"
+	if r.Err != nil {
+		status = "FAIL"
+	}
+	s := fmt.Sprintf("%s  %s(%s)", status, r.Entry.Algorithm, r.Entry.Filename)
+	if r.Err != nil {
+		s += ": " + r.Err.Error()
+	}
+	return s
+}
+
+// mfAlgorithms are the digest algorithms of an MFEntry.
+var mfAlgorithms = []string{"SHA1", "SHA256", "SHA512"}
+
+// VerifyOVAManifest reads OVA file name, which may be gzip compressed, once
+// and checks the digest of each file listed in its .mf manifest.  Files
+// before the manifest, usually only the .ovf, are hashed with every
+// algorithm of mfAlgorithms, files after it only with the algorithms it
+// lists for them.  An error is returned if the OVA cannot be read or has no
+// manifest, a digest that does not match is reported by its MFResult.  The
+// files, other than .mf and .cert files, that are not listed in the manifest
+// are returned as unlisted.
+func VerifyOVAManifest(name string) (results []MFResult, unlisted []string, err error) {
+	var entries []MFEntry
+	var mfName string
+	var files []string                              // regular files other than the .mf, in order
+	hashes := make(map[string]map[string]hash.Hash) // file => algorithm => hash
+
+	// the algorithms of a file are only known once the manifest is read
+	selectHashes := func(hdr *tar.Header) []hash.Hash {
+		if filepath.Ext(hdr.Name) == ".mf" {
+			return nil
+		}
+		algs := mfAlgorithms
+		if mfName != "" {
+			algs = nil
+			for _, e := range entries {
+				if e.Filename == hdr.Name {
+					algs = append(algs, e.Algorithm)
+				}
+			}
+		}
+		m := make(map[string]hash.Hash)
+		var hs []hash.Hash
+		for _, alg := range algs {
+			if _, ok := m[alg]; ok {
+				continue
+			}
+			if h, err := newMFHash(alg); err == nil {
+				m[alg] = h
+				hs = append(hs, h)
+			}
+		}
+		Log.Debugf("verifying ova (%s): hashing (%s) with: %v", name, hdr.Name, algs)
+		hashes[hdr.Name] = m
+		return hs
+	}
+	err = walkOVA(name, selectHashes, func(hdr *tar.Header, r io.Reader) error {
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		if filepath.Ext(hdr.Name) != ".mf" {
+			files = append(files, hdr.Name)
+			return nil
+		}
+		if mfName != "" {
+			return fmt.Errorf("multiple .mf files: %s and %s", mfName, hdr.Name)
+		}
+		mfName = hdr.Name
+		var err error
+		if entries, err = ParseMF(r); err != nil {
+			return fmt.Errorf("%s: %s", mfName, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("verifying ova (%s): %s", name, err)
+	}
+	if mfName == "" {
+		return nil, nil, fmt.Errorf("verifying ova (%s): missing .mf manifest", name)
+	}
+
+	listed := make(map[string]bool)
+	for _, e := range entries {
+		listed[e.Filename] = true
+		r := MFResult{Entry: e}
+		fileHashes, ok := hashes[e.Filename]
+		var got string
+		if h := fileHashes[e.Algorithm]; h != nil {
+			got = fmt.Sprintf("%x", h.Sum(nil))
+		}
+		switch {
+		case !ok:
+			r.Err = errors.New("missing file")
+		case got != e.Digest:
+			r.Err = fmt.Errorf("digest (%s) does not match the manifest (%s)", got, e.Digest)
+		}
+		results = append(results, r)
+	}
+	for _, s := range files {
+		if !listed[s] && filepath.Ext(s) != ".cert" {
+			unlisted = append(unlisted, s)
+		}
+	}
+	return results, unlisted, nil
+}
+
+// VerifyOVAMode checks OVA file name against its .mf manifest, see
+// VerifyOVAManifest, and writes the result of each entry to w.  Files that
+// are not listed in the manifest are reported, but are not an error.  An
+// error is returned if any digest did not match.
+func VerifyOVAMode(w io.Writer, name string) error {
+	results, unlisted, err := VerifyOVAManifest(name)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, r := range results {
+		fmt.Fprintln(w, r)
+		if r.Err != nil {
+			failed++
+		}
+	}
+	for _, s := range unlisted {
+		fmt.Fprintf(w, "NOTE  %s is not listed in the manifest\n", s)
+	}
+	if failed != 0 {
+		return fmt.Errorf("verifying ova (%s): %d of %d digests do not match", name, failed, len(results))
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestVerifyOVAManifest(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ovf, disk := "<Envelope/>", "disk"
+	mf := fmt.Sprintf("SHA256(vm.ovf)= %x\nSHA1(vm-disk1.vmdk)= %x\n", sha256.Sum256([]byte(ovf)), sha1.Sum([]byte(disk)))
+
+	tests := []struct {
+		name     string
+		entries  []tarEntry
+		failed   []string // files whose digest does not match
+		unlisted []string
+	}{
+		{
+			"intact",
+			[]tarEntry{
+				{Name: "vm.ovf", Body: ovf},
+				{Name: "vm.mf", Body: mf},
+				{Name: "vm-disk1.vmdk", Body: disk},
+			},
+			nil,
+			nil,
+		},
+		{
+			"tampered",
+			[]tarEntry{
+				{Name: "vm.ovf", Body: ovf},
+				{Name: "vm.mf", Body: mf},
+				{Name: "vm-disk1.vmdk", Body: "tampered disk"},
+				{Name: "extra.iso", Body: "iso"},
+				{Name: "vm.cert", Body: "cert"},
+			},
+			[]string{"vm-disk1.vmdk"},
+			[]string{"extra.iso"},
+		},
+		{
+			"tampered-ovf",
+			[]tarEntry{
+				{Name: "./vm.ovf", Body: "<Envelope></Envelope>"},
+				{Name: "./vm.mf", Body: mf},
+				{Name: "./vm-disk1.vmdk", Body: disk},
+			},
+			[]string{"vm.ovf"},
+			nil,
+		},
+		{
+			"missing-disk",
+			[]tarEntry{
+				{Name: "vm.ovf", Body: ovf},
+				{Name: "vm.mf", Body: mf},
+			},
+			[]string{"vm-disk1.vmdk"},
+			nil,
+		},
+	}
+	for _, x := range tests {
+		ova := createTar(t, dir, x.name+".ova", x.entries)
+		results, unlisted, err := VerifyOVAManifest(ova)
+		if err != nil {
+			t.Errorf("%s: VerifyOVAManifest: %s", x.name, err)
+			continue
+		}
+		if len(results) != 2 {
+			t.Errorf("%s: VerifyOVAManifest: expected 2 results got: %v", x.name, results)
+		}
+		var failed []string
+		for _, r := range results {
+			if r.Err != nil {
+				failed = append(failed, r.Entry.Filename)
+			}
+		}
+		if strings.Join(failed, ",") != strings.Join(x.failed, ",") {
+			t.Errorf("%s: VerifyOVAManifest: failed: got %q want %q", x.name, failed, x.failed)
+		}
+		if strings.Join(unlisted, ",") != strings.Join(x.unlisted, ",") {
+			t.Errorf("%s: VerifyOVAManifest: unlisted: got %q want %q", x.name, unlisted, x.unlisted)
+		}
+
+		var w bytes.Buffer
+		err = VerifyOVAMode(&w, ova)
+		if (err != nil) != (len(x.failed) != 0) {
+			t.Errorf("%s: VerifyOVAMode: got error %v want error %t\n%s", x.name, err, len(x.failed) != 0, w.String())
+		}
+		if n := strings.Count(w.String(), "FAIL"); n != len(x.failed) {
+			t.Errorf("%s: VerifyOVAMode: expected %d FAIL lines got:\n%s", x.name, len(x.failed), w.String())
+		}
+	}
+
+	// a gzip compressed OVA is read as is
+	ova := createTar(t, dir, "gz.ova", tests[0].entries)
+	gz := gzipFile(t, ova, ova+".gz")
+	if err := VerifyOVAMode(&bytes.Buffer{}, gz); err != nil {
+		t.Errorf("VerifyOVAMode: gzip compressed ova: %s", err)
+	}
+
+	noMF := createTar(t, dir, "no-mf.ova", []tarEntry{{Name: "vm.ovf", Body: ovf}})
+	if _, _, err := VerifyOVAManifest(noMF); err == nil {
+		t.Error("VerifyOVAManifest: expected error for ova without a .mf")
+	}
+}
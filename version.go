@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CompareVersions compares the dot separated numeric versions a and b and
+// returns -1, 0 or +1 if a is less than, equal to or greater than b.
+// Components are compared numerically, so "001.002" equals "1.2", and
+// missing components are treated as zero, so "1.2" equals "1.2.0".
+func CompareVersions(a, b string) (int, error) {
+	as, err := splitVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	bs, err := splitVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for len(as) < len(bs) {
+		as = append(as, "0")
+	}
+	for len(bs) < len(as) {
+		bs = append(bs, "0")
+	}
+	for i := range as {
+		if c := compareNumbers(as[i], bs[i]); c != 0 {
+			return c, nil
+		}
+	}
+	return 0, nil
+}
+
+func splitVersion(s string) ([]string, error) {
+	parts := strings.Split(s, ".")
+	for i, p := range parts {
+		if p == "" || strings.Trim(p, "0123456789") != "" {
+			return nil, fmt.Errorf("invalid version (%s): components must be numbers", s)
+		}
+		if p = strings.TrimLeft(p, "0"); p == "" {
+			p = "0"
+		}
+		parts[i] = p
+	}
+	return parts, nil
+}
+
+// compareNumbers compares decimal strings without leading zeros.
+func compareNumbers(a, b string) int {
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// ValidateMinVersion validates that each of versions is strictly greater
+// than version min, if min is empty no validation is performed.
+func ValidateMinVersion(versions []string, min string) error {
+	if min == "" {
+		return nil
+	}
+	Log.Debugf("validating versions (%s) are greater than: %s",
+		strings.Join(versions, ", "), min)
+	for _, v := range versions {
+		c, err := CompareVersions(v, min)
+		if err != nil {
+			return err
+		}
+		if c <= 0 {
+			return fmt.Errorf("version (%s) must be greater than the minimum version (%s)",
+				v, min)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+var compareVersionsTests = []struct {
+	a, b string
+	exp  int
+}{
+	{"1.2", "1.2", 0},
+	{"001.002", "1.2", 0},
+	{"1.2", "1.2.0", 0},
+	{"1.2", "1.10", -1},
+	{"1.10", "1.9", 1},
+	{"2.0", "1.99", 1},
+	{"1.2.1", "1.2", 1},
+	{"0.0", "0", 0},
+	{"99999999999999999999.1", "99999999999999999998.1", 1},
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, x := range compareVersionsTests {
+		c, err := CompareVersions(x.a, x.b)
+		if err != nil {
+			t.Errorf("CompareVersions(%q, %q): %s", x.a, x.b, err)
+			continue
+		}
+		if c != x.exp {
+			t.Errorf("CompareVersions(%q, %q): got %d want %d", x.a, x.b, c, x.exp)
+		}
+	}
+	for _, s := range []string{"", "1.", "1.a", "-1.2"} {
+		if _, err := CompareVersions(s, "1.2"); err == nil {
+			t.Errorf("CompareVersions(%q): expected error", s)
+		}
+	}
+}
+
+func TestValidateMinVersion(t *testing.T) {
+	if err := ValidateMinVersion([]string{"1.3", "2.0"}, "1.2"); err != nil {
+		t.Error(err)
+	}
+	if err := ValidateMinVersion([]string{"1.3", "001.002"}, "1.2"); err == nil {
+		t.Error("ValidateMinVersion: expected error for equal version")
+	}
+	if err := ValidateMinVersion([]string{"1.1"}, ""); err != nil {
+		t.Error(err)
+	}
+}
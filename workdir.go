@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// StateSchema is the schema_version of the -work-dir state file, a state
+// file of another schema is ignored.
+const StateSchema = 1
+
+// The files of the -work-dir.  The work directory is used by one build at a
+// time.
+const (
+	stateFileName = "ova2stemcell-state.json"
+	workImageName = "image"
+)
+
+// BuildState is the checkpoint of a build written to the state file of the
+// -work-dir after each phase completes, see Config.createImage.  Each
+// phase's output is validated against its recorded size and digests before
+// it is reused.
+//
+//	{
+//	  "schema_version": 1,
+//	  "input_key": "...",
+//	  "phases": [
+//	    {"name": "image", "path": "image", "size": 1024, "input_size": 4096, "sha1": "..."}
+//	  ]
+//	}
+type BuildState struct {
+	SchemaVersion int          `json:"schema_version"`
+	InputKey      string       `json:"input_key"` // see Config.inputKey
+	Phases        []StatePhase `json:"phases"`
+}
+
+// A StatePhase is a completed phase of a build and its output.
+type StatePhase struct {
+	Name      string `json:"name"`
+	Path      string `json:"path"` // relative to the work directory
+	Size      int64  `json:"size"`
+	InputSize int64  `json:"input_size,omitempty"` // see CheckImageSize
+	Sha1      string `json:"sha1"`
+	Sha256    string `json:"sha256,omitempty"`
+}
+
+// phase returns the phase of s named name, nil if it did not complete.
+func (s *BuildState) phase(name string) *StatePhase {
+	for i := range s.Phases {
+		if s.Phases[i].Name == name {
+			return &s.Phases[i]
+		}
+	}
+	return nil
+}
+
+// ValidateWorkDir validates the -work-dir dirname, it must be an existing
+// writable directory.
+func ValidateWorkDir(dirname string) error {
+	fi, err := os.Stat(dirname)
+	if err != nil {
+		return fmt.Errorf("work directory (%s): %s", dirname, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("work directory (%s): is not a directory", dirname)
+	}
+	if err := checkWritable(dirname); err != nil {
+		return fmt.Errorf("work directory (%s): is not writable: %s", dirname, err)
+	}
+	return nil
+}
+
+// readStateFile reads the state file of work directory dirname.  A missing
+// state file is not an error, nil is returned.
+func readStateFile(dirname string) (*BuildState, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dirname, stateFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s BuildState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("parsing state file: %s", err)
+	}
+	if s.SchemaVersion != StateSchema {
+		return nil, fmt.Errorf("state file schema_version (%d) is not %d", s.SchemaVersion, StateSchema)
+	}
+	return &s, nil
+}
+
+// inputKey returns a digest of the input of c, and the options that change
+// the image created from it, that identifies the build in the state file.
+// The input is identified by the name, size and modification time of its
+// files, like make, since digesting a large input takes about as long as
+// compressing it.
+func (c *Config) inputKey() (string, error) {
+	input, err := filepath.Abs(c.input())
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(input)
+	if err != nil {
+		return "", err
+	}
+	fis := []os.FileInfo{fi}
+	if fi.IsDir() {
+		if fis, err = ioutil.ReadDir(input); err != nil {
+			return "", err
+		}
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "schema_version: %d\ninput: %s\ninput_type: %s\n", StateSchema, input, c.inputType())
+	// the parallel gzip output does not depend on the number of threads,
+	// only on whether it is parallel, see parallelGzipWriter
+	fmt.Fprintf(h, "no_image_gzip: %t\nparallel_gzip: %t\nsymlinks: %s\n", c.NoImageGzip, c.GzipThreads > 1,
+		c.Symlinks)
+	for _, fi := range fis {
+		fmt.Fprintf(h, "file: %s %d %d\n", fi.Name(), fi.Size(), fi.ModTime().UnixNano())
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// imagePath returns the name of the image file: in the WorkDir, if set,
+// otherwise in the temp directory.
+func (c *Config) imagePath() (string, error) {
+	if c.WorkDir != "" {
+		return filepath.Join(c.WorkDir, workImageName), nil
+	}
+	tmpdir, err := c.TempDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(tmpdir, "image"), nil
+}
+
+// createImage creates image file name, see imagePath, with write.  Without
+// a WorkDir this is Config.createFile.  With a WorkDir the image checkpointed
+// by an earlier build of the same input is reused, if it is still valid, and
+// otherwise the image is written and checkpointed to the state file.
+//
+// The state file is removed before the image is replaced, and the image is
+// written to a temp file that is renamed, so a build stopped at any point
+// leaves either no checkpoint or a complete one.
+func (c *Config) createImage(name string, write func(w io.Writer) error) error {
+	if c.WorkDir == "" {
+		return c.createFile("image file", name, c.reuseImage(name), write)
+	}
+	key, err := c.inputKey()
+	if err != nil {
+		return fmt.Errorf("work directory (%s): %s", c.WorkDir, err)
+	}
+	err = c.resumeImage(name, key)
+	if err == nil {
+		c.Image = name
+		c.logger().Infof("resuming from checkpointed image: %s", name)
+		return nil
+	}
+	c.debugf("not resuming from work directory (%s): %s", c.WorkDir, err)
+
+	state := filepath.Join(c.WorkDir, stateFileName)
+	if err := os.Remove(state); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing state file (%s): %s", state, err)
+	}
+	c.removePartialImages()
+	if err := c.replaceFile("image file", name, write); err != nil {
+		return err
+	}
+	c.Image = name
+	return c.writeStateFile(key, name)
+}
+
+// resumeImage validates the image file name checkpointed in the state file
+// of the WorkDir and, if it is the image of the input identified by key,
+// sets c.Sha1sum, c.Sha256sum and c.imageInputSize.  An error is returned if
+// the image cannot be reused.
+func (c *Config) resumeImage(name, key string) error {
+	s, err := readStateFile(c.WorkDir)
+	if err != nil {
+		c.logger().Warnf("ignoring invalid state file (%s): %s", filepath.Join(c.WorkDir, stateFileName), err)
+		return err
+	}
+	if s == nil {
+		return errors.New("no state file")
+	}
+	if s.InputKey != key {
+		return errors.New("the input or image options changed")
+	}
+	p := s.phase("image")
+	if p == nil || filepath.Join(c.WorkDir, p.Path) != name {
+		return errors.New("no image was checkpointed")
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if fi.Size() != p.Size {
+		c.logger().Warnf("not resuming from checkpointed image (%s): size (%d) does not match state "+
+			"file (%d)", name, fi.Size(), p.Size)
+		return errors.New("image size changed")
+	}
+	if c.MaxImageSize > 0 && fi.Size() > c.MaxImageSize {
+		return c.imageTooLarge()
+	}
+	if err := c.reuseImage(name)(); err != nil {
+		c.logger().Warnf("not resuming from invalid checkpointed image (%s): %s", name, err)
+		return err
+	}
+	if c.Sha1sum != p.Sha1 || (c.Sha256sum != "" && p.Sha256 != "" && c.Sha256sum != p.Sha256) {
+		c.logger().Warnf("not resuming from checkpointed image (%s): digest does not match state file", name)
+		return errors.New("image digest changed")
+	}
+	c.imageInputSize = p.InputSize
+	return nil
+}
+
+// writeStateFile atomically writes the state file of the WorkDir recording
+// image file name, whose digests are c.Sha1sum and c.Sha256sum, as the image
+// of the input identified by key.
+func (c *Config) writeStateFile(key, name string) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fmt.Errorf("checkpointing image (%s): %s", name, err)
+	}
+	s := BuildState{
+		SchemaVersion: StateSchema,
+		InputKey:      key,
+		Phases: []StatePhase{{
+			Name:      "image",
+			Path:      filepath.Base(name),
+			Size:      fi.Size(),
+			InputSize: c.imageInputSize,
+			Sha1:      c.Sha1sum,
+			Sha256:    c.Sha256sum,
+		}},
+	}
+	state := filepath.Join(c.WorkDir, stateFileName)
+	err = c.replaceFile("state file", state, func(w io.Writer) error {
+		b, err := json.MarshalIndent(&s, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.debugf("checkpointed image (%s) to state file: %s", name, state)
+	return nil
+}
+
+// removeCheckpoint removes the state file and image of the WorkDir once the
+// build succeeds, they are only needed to resume a build.
+func (c *Config) removeCheckpoint() {
+	if c.WorkDir == "" || c.Image != filepath.Join(c.WorkDir, workImageName) {
+		return
+	}
+	for _, name := range []string{filepath.Join(c.WorkDir, stateFileName), c.Image} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			c.logger().Warnf("removing checkpoint (%s): %s", name, err)
+		}
+	}
+	c.Image = ""
+}
+
+// removePartialImages removes the temp files of images that a stopped build
+// did not finish writing to the WorkDir, see replaceFile.
+func (c *Config) removePartialImages() {
+	names, _ := filepath.Glob(filepath.Join(c.WorkDir, "."+workImageName+".tmp-*"))
+	for _, name := range names {
+		c.debugf("removing partial image: %s", name)
+		os.Remove(name)
+	}
+}
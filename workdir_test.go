@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWorkDirResume(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: strings.Repeat("disk", 4096)},
+	})
+	work := filepath.Join(dir, "work")
+	if err := os.Mkdir(work, 0755); err != nil {
+		t.Fatal(err)
+	}
+	image := filepath.Join(work, workImageName)
+	state := filepath.Join(work, stateFileName)
+
+	build := func(onImage BuildHook) ([]*BuildResult, error) {
+		out := filepath.Join(dir, "out")
+		os.RemoveAll(out)
+		if err := os.Mkdir(out, 0755); err != nil {
+			t.Fatal(err)
+		}
+		c := &Config{
+			OVAFile:        ova,
+			OutputDir:      out,
+			WorkDir:        work,
+			ImageChecksums: []string{"sha1", "sha256"},
+			// the OVA is small enough to be compressed in memory
+			MemoryImageLimit: DefaultMemoryImageLimit,
+			VerifyOutput:     true,
+			OnImageCreated:   onImage,
+			Version:          "1.2",
+			Logger:           DiscardLogger,
+			stop:             make(chan struct{}),
+		}
+		if errs := c.Validate(); len(errs) != 0 {
+			t.Fatalf("Validate: %v", errs)
+		}
+		defer c.Cleanup()
+		return realMain(c, []string{"1.2"})
+	}
+
+	// the build is stopped after the image phase
+	errStopped := errors.New("stopped after image")
+	_, err := build(func(path string) error {
+		if path != image {
+			t.Errorf("image: got %q want %q", path, image)
+		}
+		return errStopped
+	})
+	if err == nil || !strings.Contains(err.Error(), errStopped.Error()) {
+		t.Fatalf("expected error %q got: %v", errStopped, err)
+	}
+	checkpoint, err := os.Stat(image)
+	if err != nil {
+		t.Fatalf("image was not checkpointed: %s", err)
+	}
+	s, err := readStateFile(work)
+	if err != nil || s == nil {
+		t.Fatalf("readStateFile: %v %v", s, err)
+	}
+	p := s.phase("image")
+	if p == nil || p.Path != workImageName || p.Size != checkpoint.Size() || p.Sha1 == "" || p.Sha256 == "" {
+		t.Fatalf("state file: unexpected image phase: %+v", p)
+	}
+	state0, err := ioutil.ReadFile(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image0, err := ioutil.ReadFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// restore writes the checkpoint of the first build to the work directory
+	// and then breaks it with corrupt
+	restore := func(corrupt func()) {
+		if err := ioutil.WriteFile(image, image0, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(state, state0, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if corrupt != nil {
+			corrupt()
+		}
+	}
+	tests := []struct {
+		name    string
+		corrupt func()
+		resumed bool
+	}{
+		{"resume", nil, true},
+		{"corrupt state", func() { ioutil.WriteFile(state, state0[:len(state0)/2], 0644) }, false},
+		{"schema", func() {
+			ioutil.WriteFile(state, []byte(strings.Replace(string(state0), `"schema_version": 1`,
+				`"schema_version": 2`, 1)), 0644)
+		}, false},
+		{"missing state", func() { os.Remove(state) }, false},
+		{"missing image", func() { os.Remove(image) }, false},
+		{"truncated image", func() { ioutil.WriteFile(image, image0[:len(image0)/2], 0644) }, false},
+		{"modified image", func() {
+			b := append([]byte(nil), image0...)
+			b[len(b)/2] ^= 0xff
+			ioutil.WriteFile(image, b, 0644)
+		}, false},
+		{"modified input", func() {
+			mtime := time.Now().Add(time.Hour)
+			if err := os.Chtimes(ova, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+	}
+	for _, x := range tests {
+		restore(x.corrupt)
+		before, _ := os.Stat(image)
+		partial := filepath.Join(work, "."+workImageName+".tmp-123")
+		if err := ioutil.WriteFile(partial, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		resumed := false
+		results, err := build(func(path string) error {
+			fi, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			resumed = before != nil && os.SameFile(before, fi)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: %s", x.name, err)
+			continue
+		}
+		if resumed != x.resumed {
+			t.Errorf("%s: resumed: got %t want %t", x.name, resumed, x.resumed)
+		}
+		if results[0].ImageSha1 != p.Sha1 {
+			t.Errorf("%s: image sha1: got %s want %s", x.name, results[0].ImageSha1, p.Sha1)
+		}
+		// the checkpoint is removed once the build succeeds
+		for _, name := range []string{image, state} {
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Errorf("%s: checkpoint (%s) not removed: %v", x.name, name, err)
+			}
+		}
+		if _, err := os.Stat(partial); x.resumed == os.IsNotExist(err) {
+			t.Errorf("%s: partial image: %v", x.name, err)
+		}
+		os.Remove(partial)
+	}
+}
+
+func TestWorkDirGzipThreads(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	// more than one parallel gzip block
+	ova := createTar(t, dir, "vm.ova", []tarEntry{
+		{Name: "vm.ovf", Body: "<Envelope/>"},
+		{Name: "vm-disk1.vmdk", Body: strings.Repeat("disk", parallelGzipBlockSize/2)},
+	})
+	work := filepath.Join(dir, "work")
+	if err := os.Mkdir(work, 0755); err != nil {
+		t.Fatal(err)
+	}
+	image := filepath.Join(work, workImageName)
+
+	errStopped := errors.New("stopped after image")
+	tests := []struct {
+		threads int
+		resumed bool
+	}{
+		{4, false}, // checkpoint
+		{8, true},  // the parallel output does not depend on the threads
+		{1, false}, // a single gzip member
+	}
+	var checkpoint os.FileInfo
+	for i, x := range tests {
+		c := &Config{
+			OVAFile:     ova,
+			OutputDir:   dir,
+			WorkDir:     work,
+			GzipThreads: x.threads,
+			Logger:      DiscardLogger,
+			stop:        make(chan struct{}),
+		}
+		resumed := false
+		c.OnImageCreated = func(path string) error {
+			fi, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			resumed = checkpoint != nil && os.SameFile(checkpoint, fi)
+			checkpoint = fi
+			return errStopped
+		}
+		_, err := realMain(c, []string{"1.2"})
+		c.Cleanup()
+		if err == nil || !strings.Contains(err.Error(), errStopped.Error()) {
+			t.Fatalf("%d: expected error %q got: %v", i, errStopped, err)
+		}
+		if resumed != x.resumed {
+			t.Errorf("%d: gzip threads %d: resumed: got %t want %t", i, x.threads, resumed, x.resumed)
+		}
+		if _, err := os.Stat(image); err != nil {
+			t.Errorf("%d: image was not checkpointed: %s", i, err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// yamlString returns s formatted as a YAML scalar that is always parsed as a
+// string, s is quoted if a plain scalar would be a number, boolean or null or
+// contains characters with special meaning in YAML.
+func yamlString(s string) string {
+	if yamlNeedsQuote(s) {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func yamlNeedsQuote(s string) bool {
+	if s == "" || s != strings.TrimSpace(s) {
+		return true
+	}
+	switch strings.ToLower(s) {
+	case "~", "null", "true", "false", "yes", "no", "on", "off", "y", "n":
+		return true
+	}
+	if strings.IndexByte("-?:,[]{}#&*!|>'\"%@`.+0123456789", s[0]) != -1 {
+		return true
+	}
+	if strings.Contains(s, ": ") || strings.Contains(s, " #") || strings.HasSuffix(s, ":") {
+		return true
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// yamlKeyValue splits a "key: value" mapping entry into its key and value.
+// The key may be quoted and value, which may be empty, is returned with any
+// trailing comment and surrounding whitespace intact.
+func yamlKeyValue(line string) (key, value string, err error) {
+	var rest string
+	switch {
+	case strings.HasPrefix(line, `"`), strings.HasPrefix(line, `'`):
+		q, err := yamlQuotedPrefix(line)
+		if err != nil {
+			return "", "", err
+		}
+		if key, err = unquote(q); err != nil {
+			return "", "", err
+		}
+		rest = strings.TrimLeft(line[len(q):], " ")
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", fmt.Errorf("expected ':' after key: %s", line)
+		}
+		rest = rest[1:]
+	default:
+		i := 0
+		for {
+			j := strings.IndexByte(line[i:], ':')
+			if j == -1 {
+				return "", "", fmt.Errorf("expected 'key: value': %s", line)
+			}
+			i += j
+			if i == len(line)-1 || line[i+1] == ' ' {
+				break
+			}
+			i++
+		}
+		key = strings.TrimSpace(line[:i])
+		rest = line[i+1:]
+	}
+	if rest != "" && rest[0] != ' ' {
+		return "", "", fmt.Errorf("expected 'key: value': %s", line)
+	}
+	return key, rest, nil
+}
+
+// yamlScalar parses a plain, single or double quoted YAML scalar, trailing
+// comments are ignored.
+func yamlScalar(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", nil
+	}
+	if s[0] == '"' || s[0] == '\'' {
+		q, err := yamlQuotedPrefix(s)
+		if err != nil {
+			return "", err
+		}
+		if rest := strings.TrimSpace(s[len(q):]); rest != "" && rest[0] != '#' {
+			return "", fmt.Errorf("unexpected text after quoted string: %s", s)
+		}
+		return unquote(q)
+	}
+	if s[0] == '#' {
+		return "", nil
+	}
+	if i := strings.Index(s, " #"); i != -1 {
+		s = strings.TrimSpace(s[:i])
+	}
+	return s, nil
+}
+
+// yamlQuotedPrefix returns the single or double quoted string at the start
+// of s.
+func yamlQuotedPrefix(s string) (string, error) {
+	if s[0] == '"' {
+		q, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid quoted string: %s", s)
+		}
+		return q, nil
+	}
+	for i := 1; i < len(s); i++ {
+		if s[i] == '\'' {
+			if i+1 < len(s) && s[i+1] == '\'' {
+				i++ // escaped quote
+				continue
+			}
+			return s[:i+1], nil
+		}
+	}
+	return "", fmt.Errorf("unterminated quoted string: %s", s)
+}